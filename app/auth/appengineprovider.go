@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+	"net/http"
+)
+
+// AppEngineProvider is the Provider implementation backed by the App Engine Users API.
+type AppEngineProvider struct {
+}
+
+// NewAppEngineProvider creates a new Provider that authenticates users with their google account
+func NewAppEngineProvider() *AppEngineProvider {
+	return new(AppEngineProvider)
+}
+
+func (p *AppEngineProvider) CurrentUser(request *http.Request) (currentUser *User) {
+	context := appengine.NewContext(request)
+	if u := user.Current(context); u != nil {
+		return &User{u.Email}
+	}
+
+	return nil
+}
+
+// IsAdmin returns true for the administrators of the App Engine application
+func (p *AppEngineProvider) IsAdmin(request *http.Request) bool {
+	return user.IsAdmin(appengine.NewContext(request))
+}
+
+func (p *AppEngineProvider) LoginURL(request *http.Request, destination string) (url string, err error) {
+	context := appengine.NewContext(request)
+	return user.LoginURL(context, destination)
+}
+
+// RequireLogin redirects unauthenticated requests to the login page. Note that most routes are also
+// restricted by the app.yaml configuration.
+func (p *AppEngineProvider) RequireLogin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if p.CurrentUser(request) == nil {
+			loginUrl, err := p.LoginURL(request, request.URL.String())
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			http.Redirect(writer, request, loginUrl, http.StatusFound)
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
@@ -0,0 +1,28 @@
+// auth package abstracts how users of the web application are authenticated. On App Engine, this is
+// delegated to the Users API while a standalone server relies on http basic authentication or on a
+// trusted header set by an authenticating reverse proxy.
+package auth
+
+import (
+	"net/http"
+)
+
+// User is an authenticated user
+type User struct {
+	Email string
+}
+
+// Provider is the abstraction of an authentication mechanism.
+type Provider interface {
+	// CurrentUser returns the authenticated user for the request or nil if the request isn't authenticated.
+	CurrentUser(request *http.Request) (user *User)
+
+	// LoginURL returns the url that has a user authenticate and then redirects to the destination url.
+	LoginURL(request *http.Request, destination string) (url string, err error)
+
+	// RequireLogin wraps a handler so that only authenticated requests get to it.
+	RequireLogin(handler http.Handler) http.Handler
+
+	// IsAdmin returns true if the request is authenticated as an administrator of the application.
+	IsAdmin(request *http.Request) bool
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	BASIC_AUTH_REALM = "glukit"
+)
+
+// BasicAuthProvider is the Provider implementation that authenticates users with http basic authentication
+// against a fixed set of email addresses and passwords.
+type BasicAuthProvider struct {
+	passwords map[string]string
+	admins    map[string]bool
+}
+
+// NewBasicAuthProvider creates a new Provider that accepts the given email addresses and passwords. The admins are the
+// email addresses of the users allowed to administer the server.
+func NewBasicAuthProvider(passwords map[string]string, admins []string) *BasicAuthProvider {
+	p := new(BasicAuthProvider)
+	p.passwords = make(map[string]string)
+	for email, password := range passwords {
+		p.passwords[strings.ToLower(email)] = password
+	}
+	p.admins = newAdminSet(admins)
+
+	return p
+}
+
+// newAdminSet creates the set of administrator email addresses, normalized to lower case
+func newAdminSet(admins []string) map[string]bool {
+	adminSet := make(map[string]bool)
+	for _, email := range admins {
+		adminSet[strings.ToLower(email)] = true
+	}
+
+	return adminSet
+}
+
+func (p *BasicAuthProvider) CurrentUser(request *http.Request) (user *User) {
+	email, password, ok := request.BasicAuth()
+	if !ok {
+		return nil
+	}
+
+	email = strings.ToLower(email)
+	if expected, ok := p.passwords[email]; ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+		return &User{email}
+	}
+
+	return nil
+}
+
+func (p *BasicAuthProvider) IsAdmin(request *http.Request) bool {
+	user := p.CurrentUser(request)
+	return user != nil && p.admins[user.Email]
+}
+
+// LoginURL returns the destination as is since browsers prompt for credentials as soon as the destination
+// requires authentication.
+func (p *BasicAuthProvider) LoginURL(request *http.Request, destination string) (url string, err error) {
+	return destination, nil
+}
+
+func (p *BasicAuthProvider) RequireLogin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if p.CurrentUser(request) == nil {
+			writer.Header().Set("WWW-Authenticate", "Basic realm=\""+BASIC_AUTH_REALM+"\"")
+			http.Error(writer, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// HeaderProvider is the Provider implementation that trusts a header holding the email address of the user. It
+// should only be used behind a reverse proxy that authenticates users and always sets (or strips) the header.
+type HeaderProvider struct {
+	header string
+	admins map[string]bool
+}
+
+// NewHeaderProvider creates a new Provider that trusts the given header to hold the user's email address. The admins
+// are the email addresses of the users allowed to administer the server.
+func NewHeaderProvider(header string, admins []string) *HeaderProvider {
+	p := new(HeaderProvider)
+	p.header = header
+	p.admins = newAdminSet(admins)
+
+	return p
+}
+
+func (p *HeaderProvider) CurrentUser(request *http.Request) (user *User) {
+	if email := strings.TrimSpace(request.Header.Get(p.header)); email != "" {
+		return &User{strings.ToLower(email)}
+	}
+
+	return nil
+}
+
+func (p *HeaderProvider) IsAdmin(request *http.Request) bool {
+	user := p.CurrentUser(request)
+	return user != nil && p.admins[user.Email]
+}
+
+// LoginURL returns the destination as is since authentication is handled by the reverse proxy.
+func (p *HeaderProvider) LoginURL(request *http.Request, destination string) (url string, err error) {
+	return destination, nil
+}
+
+func (p *HeaderProvider) RequireLogin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if p.CurrentUser(request) == nil {
+			http.Error(writer, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
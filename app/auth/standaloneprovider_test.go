@@ -0,0 +1,75 @@
+package auth_test
+
+import (
+	. "github.com/alexandre-normand/glukit/app/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthProvider(t *testing.T) {
+	p := NewBasicAuthProvider(map[string]string{"Test@glukit.com": "secret"}, nil)
+
+	request := httptest.NewRequest("GET", "/data", nil)
+	if user := p.CurrentUser(request); user != nil {
+		t.Errorf("TestBasicAuthProvider failed: expected no user without credentials but got [%v]", user)
+	}
+
+	request.SetBasicAuth("test@glukit.com", "wrong")
+	if user := p.CurrentUser(request); user != nil {
+		t.Errorf("TestBasicAuthProvider failed: expected no user with the wrong password but got [%v]", user)
+	}
+
+	request.SetBasicAuth("test@glukit.com", "secret")
+	if user := p.CurrentUser(request); user == nil || user.Email != "test@glukit.com" {
+		t.Errorf("TestBasicAuthProvider failed: expected user [%s] but got [%v]", "test@glukit.com", user)
+	}
+}
+
+func TestBasicAuthProviderRequireLogin(t *testing.T) {
+	p := NewBasicAuthProvider(map[string]string{"test@glukit.com": "secret"}, nil)
+	handler := p.RequireLogin(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusOK)
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/data", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("TestBasicAuthProviderRequireLogin failed: got status [%d] but expected [%d]", recorder.Code, http.StatusUnauthorized)
+	}
+
+	if recorder.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("TestBasicAuthProviderRequireLogin failed: expected a basic auth challenge")
+	}
+
+	request := httptest.NewRequest("GET", "/data", nil)
+	request.SetBasicAuth("test@glukit.com", "secret")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("TestBasicAuthProviderRequireLogin failed: got status [%d] but expected [%d]", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestHeaderProvider(t *testing.T) {
+	p := NewHeaderProvider("X-Forwarded-Email", []string{"Admin@glukit.com"})
+
+	request := httptest.NewRequest("GET", "/data", nil)
+	if user := p.CurrentUser(request); user != nil {
+		t.Errorf("TestHeaderProvider failed: expected no user without the header but got [%v]", user)
+	}
+
+	request.Header.Set("X-Forwarded-Email", "test@glukit.com")
+	if user := p.CurrentUser(request); user == nil || user.Email != "test@glukit.com" {
+		t.Errorf("TestHeaderProvider failed: expected user [%s] but got [%v]", "test@glukit.com", user)
+	}
+
+	if p.IsAdmin(request) {
+		t.Errorf("TestHeaderProvider failed: expected [%s] not to be an admin", "test@glukit.com")
+	}
+
+	request.Header.Set("X-Forwarded-Email", "admin@glukit.com")
+	if !p.IsAdmin(request) {
+		t.Errorf("TestHeaderProvider failed: expected [%s] to be an admin", "admin@glukit.com")
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/model"
+	"os"
+)
+
+const (
+	AUTH_MODE_BASIC  = "basic"
+	AUTH_MODE_HEADER = "header"
+
+	DEFAULT_LISTEN_ADDRESS  = ":8080"
+	DEFAULT_DATABASE_DRIVER = "sqlite3"
+	DEFAULT_DATABASE_SOURCE = "glukit.db"
+	DEFAULT_AUTH_HEADER     = "X-Forwarded-Email"
+	DEFAULT_WORKERS         = 4
+)
+
+// ServerConfig is the configuration of a standalone glukit server. It is read from a json file.
+type ServerConfig struct {
+	// The address to listen on (i.e. ":8080")
+	Listen string `json:"listen"`
+	// The host name users reach the server with (i.e. "glukit.example.com")
+	Host string `json:"host"`
+	// The base url, including the scheme, users reach the server with (i.e. "https://glukit.example.com")
+	SSLHost string `json:"sslHost"`
+	// The directory holding the view resources (templates, javascript, css, etc.)
+	ViewDir string `json:"viewDir"`
+	// The number of background job workers
+	Workers  int            `json:"workers"`
+	Database DatabaseConfig `json:"database"`
+	Auth     AuthConfig     `json:"auth"`
+	Google   GoogleConfig   `json:"google"`
+	Stripe   StripeConfig   `json:"stripe"`
+	// The oauth clients allowed to use the API (i.e. glukloader)
+	OauthClients []OauthClientConfig `json:"oauthClients"`
+	// The optional insulin action curves and carb absorption model of the insulin and carbs on board series
+	OnBoard *model.OnBoardSettings `json:"onBoard"`
+}
+
+// DatabaseConfig is the database/sql driver name and data source. Supported drivers are sqlite3 and postgres.
+type DatabaseConfig struct {
+	Driver     string `json:"driver"`
+	DataSource string `json:"dataSource"`
+}
+
+// AuthConfig configures how users are authenticated. With the basic mode, Users maps email addresses to passwords.
+// With the header mode, the email address of the user is read from the Header set by an authenticating
+// reverse proxy. Admins are the email addresses of the users allowed to use the administration endpoints.
+type AuthConfig struct {
+	Mode   string            `json:"mode"`
+	Users  map[string]string `json:"users"`
+	Header string            `json:"header"`
+	Admins []string          `json:"admins"`
+}
+
+// GoogleConfig holds the optional google oauth client used to fetch a user's name and picture.
+type GoogleConfig struct {
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+}
+
+// StripeConfig holds the optional stripe keys used for donations.
+type StripeConfig struct {
+	Key            string `json:"key"`
+	PublishableKey string `json:"publishableKey"`
+}
+
+// OauthClientConfig is an oauth client of the glukit API.
+type OauthClientConfig struct {
+	Id          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectUri string `json:"redirectUri"`
+}
+
+// LoadServerConfig reads the ServerConfig from a json file and applies defaults to unset values.
+func LoadServerConfig(path string) (serverConfig *ServerConfig, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	serverConfig = new(ServerConfig)
+	if err = json.NewDecoder(file).Decode(serverConfig); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error reading configuration [%s]: %v", path, err))
+	}
+
+	serverConfig.applyDefaults()
+	if err = serverConfig.validate(); err != nil {
+		return nil, err
+	}
+
+	return serverConfig, nil
+}
+
+// applyDefaults sets the default values of anything left unset
+func (serverConfig *ServerConfig) applyDefaults() {
+	if serverConfig.Listen == "" {
+		serverConfig.Listen = DEFAULT_LISTEN_ADDRESS
+	}
+
+	if serverConfig.Host == "" {
+		serverConfig.Host = "localhost" + serverConfig.Listen
+	}
+
+	if serverConfig.SSLHost == "" {
+		serverConfig.SSLHost = "http://" + serverConfig.Host
+	}
+
+	if serverConfig.ViewDir == "" {
+		serverConfig.ViewDir = "view"
+	}
+
+	if serverConfig.Workers <= 0 {
+		serverConfig.Workers = DEFAULT_WORKERS
+	}
+
+	if serverConfig.Database.Driver == "" {
+		serverConfig.Database.Driver = DEFAULT_DATABASE_DRIVER
+	}
+
+	if serverConfig.Database.DataSource == "" {
+		serverConfig.Database.DataSource = DEFAULT_DATABASE_SOURCE
+	}
+
+	if serverConfig.Auth.Mode == "" {
+		serverConfig.Auth.Mode = AUTH_MODE_BASIC
+	}
+
+	if serverConfig.Auth.Header == "" {
+		serverConfig.Auth.Header = DEFAULT_AUTH_HEADER
+	}
+}
+
+// validate returns an error if the configuration can't be used to run a server
+func (serverConfig *ServerConfig) validate() (err error) {
+	switch serverConfig.Auth.Mode {
+	case AUTH_MODE_BASIC:
+		if len(serverConfig.Auth.Users) == 0 {
+			return errors.New("Basic authentication requires at least one user")
+		}
+	case AUTH_MODE_HEADER:
+	default:
+		return errors.New(fmt.Sprintf("Invalid authentication mode [%s], expected one of [%s, %s]", serverConfig.Auth.Mode,
+			AUTH_MODE_BASIC, AUTH_MODE_HEADER))
+	}
+
+	if serverConfig.OnBoard != nil {
+		if err = serverConfig.OnBoard.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AppConfig returns the AppConfig matching the ServerConfig
+func (serverConfig *ServerConfig) AppConfig() *AppConfig {
+	appConfig := new(AppConfig)
+	appConfig.GoogleClientId = serverConfig.Google.ClientId
+	appConfig.GoogleClientSecret = serverConfig.Google.ClientSecret
+	appConfig.Host = serverConfig.Host
+	appConfig.SSLHost = serverConfig.SSLHost
+	appConfig.StripeKey = serverConfig.Stripe.Key
+	appConfig.StripePublishableKey = serverConfig.Stripe.PublishableKey
+	appConfig.OnBoard = serverConfig.OnBoard
+
+	return appConfig
+}
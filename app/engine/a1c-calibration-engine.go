@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/grd/stat"
+	"sort"
+	"time"
+)
+
+const (
+	// The number of lab results with an estimate at the time of the test needed to calibrate the estimates of a user
+	MIN_A1C_CALIBRATION_PAIRS = 2
+	// How long before a lab test the estimate it's compared to can end. Estimates go back A1C_ESTIMATION_SCORE_PERIOD days so
+	// a few days of difference hardly change them.
+	A1C_PAIRING_MAX_ESTIMATE_AGE = time.Duration(7*24) * time.Hour
+)
+
+// ErrNotEnoughLabA1Cs is returned when there aren't enough pairs of lab results and estimates to calibrate the estimates
+var ErrNotEnoughLabA1Cs = errors.New("Not enough lab a1c results with an estimate to calibrate the a1c estimates")
+
+// PairLabA1Cs pairs each lab result with the most recent estimate ending before the test, if it ends at most A1C_PAIRING_MAX_ESTIMATE_AGE
+// before it. The lab results and estimates don't need to be sorted and the pairs are returned in chronological order.
+func PairLabA1Cs(labA1Cs []model.LabA1C, estimates []model.A1CEstimate) (pairs []model.A1CPair) {
+	sortedEstimates := make([]model.A1CEstimate, len(estimates))
+	copy(sortedEstimates, estimates)
+	sort.Slice(sortedEstimates, func(i, j int) bool {
+		return sortedEstimates[i].UpperBound.Before(sortedEstimates[j].UpperBound)
+	})
+
+	sortedLabA1Cs := make([]model.LabA1C, len(labA1Cs))
+	copy(sortedLabA1Cs, labA1Cs)
+	sort.Slice(sortedLabA1Cs, func(i, j int) bool {
+		return sortedLabA1Cs[i].Time.Before(sortedLabA1Cs[j].Time)
+	})
+
+	pairs = make([]model.A1CPair, 0)
+	for _, labA1C := range sortedLabA1Cs {
+		// The index of the first estimate ending after the test
+		i := sort.Search(len(sortedEstimates), func(i int) bool {
+			return sortedEstimates[i].UpperBound.After(labA1C.Time)
+		})
+
+		if i > 0 && labA1C.Time.Sub(sortedEstimates[i-1].UpperBound) <= A1C_PAIRING_MAX_ESTIMATE_AGE {
+			pairs = append(pairs, model.A1CPair{Lab: labA1C, Estimate: sortedEstimates[i-1]})
+		}
+	}
+
+	return pairs
+}
+
+// CalibrateA1C fits the calibration of a user's estimates from pairs of lab results and estimates. It returns ErrNotEnoughLabA1Cs if there
+// are fewer than MIN_A1C_CALIBRATION_PAIRS pairs.
+func CalibrateA1C(pairs []model.A1CPair) (calibration *model.A1CCalibration, err error) {
+	if len(pairs) < MIN_A1C_CALIBRATION_PAIRS {
+		return nil, ErrNotEnoughLabA1Cs
+	}
+
+	differences := make(stat.Float64Slice, len(pairs))
+	for i, pair := range pairs {
+		differences[i] = pair.Lab.Value - pair.Estimate.Value
+	}
+
+	return &model.A1CCalibration{Offset: stat.Mean(differences), PairCount: len(pairs)}, nil
+}
+
+// CalculateA1CReport reports an estimate with its calibrated value and the GMI of the reads it was estimated from. The estimates
+// and lab results of the user are paired to calibrate the estimate, it's left uncalibrated if there aren't enough pairs.
+func CalculateA1CReport(context context.Context, estimate model.A1CEstimate, reads []apimodel.GlucoseRead, estimates []model.A1CEstimate,
+	labA1Cs []model.LabA1C) (report *model.A1CReport, err error) {
+	values, err := glucoseValues(reads)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, ErrNoReadsForMetrics
+	}
+
+	glucose := make(stat.Float64Slice, len(values))
+	for i, v := range values {
+		glucose[i] = v.value
+	}
+
+	report = &model.A1CReport{Estimate: estimate, GMI: CalculateGMI(stat.Mean(glucose)), Pairs: PairLabA1Cs(labA1Cs, estimates)}
+	if calibration, err := CalibrateA1C(report.Pairs); err == nil {
+		calibrated := calibration.Apply(estimate.Value)
+		report.Calibration = calibration
+		report.Calibrated = &calibrated
+	} else {
+		log.Debugf(context, "Not calibrating a1c estimate with [%d] pairs: %v", len(report.Pairs), err)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,72 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPairLabA1Cs(t *testing.T) {
+	day := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	estimates := []model.A1CEstimate{
+		model.A1CEstimate{Value: 6.2, UpperBound: day.AddDate(0, 0, 35)},
+		model.A1CEstimate{Value: 6.0, UpperBound: day},
+		model.A1CEstimate{Value: 6.1, UpperBound: day.AddDate(0, 0, 1)},
+	}
+	labA1Cs := []model.LabA1C{
+		model.LabA1C{Value: 6.9, Time: day.AddDate(0, 0, 40)},
+		model.LabA1C{Value: 6.5, Time: day.AddDate(0, 0, 2)},
+		// Too long after the most recent estimate to be paired
+		model.LabA1C{Value: 7.5, Time: day.AddDate(0, 0, 60)},
+	}
+
+	pairs := engine.PairLabA1Cs(labA1Cs, estimates)
+	if len(pairs) != 2 {
+		t.Fatalf("TestPairLabA1Cs failed: got [%d] pairs but expected [%d]", len(pairs), 2)
+	}
+
+	if pairs[0].Lab.Value != 6.5 || pairs[0].Estimate.Value != 6.1 || pairs[1].Lab.Value != 6.9 || pairs[1].Estimate.Value != 6.2 {
+		t.Errorf("TestPairLabA1Cs failed: got [%v] but expected 6.5 paired with 6.1 and 6.9 with 6.2", pairs)
+	}
+}
+
+func TestCalibrateA1CWithoutEnoughPairs(t *testing.T) {
+	pairs := []model.A1CPair{model.A1CPair{Lab: model.LabA1C{Value: 7}, Estimate: model.A1CEstimate{Value: 6.5}}}
+
+	if _, err := engine.CalibrateA1C(pairs); err != engine.ErrNotEnoughLabA1Cs {
+		t.Errorf("TestCalibrateA1CWithoutEnoughPairs failed: got error [%v] but expected [%v]", err, engine.ErrNotEnoughLabA1Cs)
+	}
+}
+
+func TestCalculateA1CReport(t *testing.T) {
+	day := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	estimate := model.A1CEstimate{Value: 6.0, UpperBound: day.AddDate(0, 0, 90)}
+	estimates := []model.A1CEstimate{estimate, model.A1CEstimate{Value: 6.4, UpperBound: day}}
+	labA1Cs := []model.LabA1C{
+		model.LabA1C{Value: 6.6, Time: day.AddDate(0, 0, 1)},
+		model.LabA1C{Value: 6.4, Time: day.AddDate(0, 0, 91)},
+	}
+	// An average of 154 mg/dL
+	reads := makeEpisodeReads(day, 100, 154, 208)
+
+	report, err := engine.CalculateA1CReport(context.Background(), estimate, reads, estimates, labA1Cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Calibration == nil || report.Calibration.PairCount != 2 || math.Abs(report.Calibration.Offset-0.3) > 0.0001 {
+		t.Fatalf("TestCalculateA1CReport failed: got calibration [%v] but expected an offset of [0.3] from [2] pairs", report.Calibration)
+	}
+
+	if report.Estimate.Value != 6.0 || math.Abs(*report.Calibrated-6.3) > 0.0001 {
+		t.Errorf("TestCalculateA1CReport failed: got a raw estimate of [%f] calibrated to [%f] but expected [6.0] and [6.3]", report.Estimate.Value,
+			*report.Calibrated)
+	}
+
+	if expected := engine.CalculateGMI(154); math.Abs(report.GMI-expected) > 0.0001 {
+		t.Errorf("TestCalculateA1CReport failed: got a gmi of [%f] but expected [%f]", report.GMI, expected)
+	}
+}
@@ -4,12 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
 	"github.com/grd/stat"
 	"context"
-	"google.golang.org/appengine/log"
 	"sort"
 	"time"
 )
@@ -44,8 +44,7 @@ func CalculateA1CEstimate(context context.Context, reads []apimodel.GlucoseRead)
 		sortedReads := model.ReadStatsSlice(reads)
 		sort.Sort(sortedReads)
 		median := stat.MedianFromSortedData(sortedReads)
-		//a1c := (average + 77.3) / 35.6
-		a1c := (median + 77.3) / 35.6
+		a1c := estimateA1CFromMedian(median)
 		log.Debugf(context, "Estimated a1c is [%f]", a1c)
 		return &model.A1CEstimate{
 			Value:          a1c,
@@ -56,15 +55,77 @@ func CalculateA1CEstimate(context context.Context, reads []apimodel.GlucoseRead)
 	}
 }
 
-func EstimateA1C(context context.Context, glukitUser *model.GlukitUser, endOfPeriod time.Time) (a1c *model.A1CEstimate, err error) {
-	// Get the last period's worth of reads
-	upperBound := util.GetMidnightUTCBefore(endOfPeriod)
-	lowerBound := upperBound.AddDate(0, 0, -1*A1C_ESTIMATION_SCORE_PERIOD)
+// EstimateA1Cs estimates the a1cs of a user for the periods ending before each of the endsOfPeriods, which must be sorted. The reads of
+// all periods are loaded at once and the window of reads slides from one period to the next while order statistics keep its median.
+// The estimate of a period is nil if it doesn't have enough read coverage.
+func EstimateA1Cs(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (a1cs []*model.A1CEstimate, err error) {
+	a1cs = make([]*model.A1CEstimate, len(endsOfPeriods))
+	if len(endsOfPeriods) == 0 {
+		return a1cs, nil
+	}
 
-	log.Debugf(context, "Getting reads for a1c estimate calculation from [%s] to [%s]", lowerBound, upperBound)
-	if reads, err := store.GetGlucoseReads(context, glukitUser.Email, lowerBound, upperBound); err != nil {
-		return &model.UNDEFINED_A1C_ESTIMATE, err
-	} else {
-		return CalculateA1CEstimate(context, reads)
+	lowerBound := util.GetMidnightUTCBefore(endsOfPeriods[0]).AddDate(0, 0, -1*A1C_ESTIMATION_SCORE_PERIOD)
+	upperBound := util.GetMidnightUTCBefore(endsOfPeriods[len(endsOfPeriods)-1])
+
+	log.Debugf(context, "Getting reads for a1c estimate calculation of [%d] periods from [%s] to [%s]", len(endsOfPeriods), lowerBound, upperBound)
+	reads, err := repository.GetGlucoseReads(context, glukitUser.Email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := glucoseValues(reads)
+	if err != nil {
+		return nil, err
+	}
+
+	window := make([]float64, len(values))
+	for i := range values {
+		window[i] = values[i].value
+	}
+	statistics := newOrderStatistics(window)
+
+	// The window of the period is reads[start:end]
+	start, end := 0, 0
+	for i, endOfPeriod := range endsOfPeriods {
+		periodUpperBound := util.GetMidnightUTCBefore(endOfPeriod)
+		periodLowerBound := periodUpperBound.AddDate(0, 0, -1*A1C_ESTIMATION_SCORE_PERIOD)
+
+		for end < len(reads) && !reads[end].GetTime().After(periodUpperBound) {
+			statistics.Add(values[end].value)
+			end = end + 1
+		}
+
+		for start < end && reads[start].GetTime().Before(periodLowerBound) {
+			statistics.Remove(values[start].value)
+			start = start + 1
+		}
+
+		if start == end {
+			log.Debugf(context, "Insufficient read coverage to estimate a1c for period ending at [%s], got no reads", periodUpperBound)
+			continue
+		}
+
+		firstReadTime := reads[start].GetTime()
+		lastReadTime := reads[end-1].GetTime()
+		if days := lastReadTime.Sub(firstReadTime) / (time.Hour * 24); days < A1C_READ_COVERAGE_REQUIREMENT_IN_DAYS {
+			log.Debugf(context, "Insufficient read coverage to estimate a1c for period ending at [%s], got [%d] days but requires [%d]",
+				periodUpperBound, days, A1C_READ_COVERAGE_REQUIREMENT_IN_DAYS)
+			continue
+		}
+
+		a1cs[i] = &model.A1CEstimate{
+			Value:          estimateA1CFromMedian(stat.MedianFromSortedData(statistics)),
+			LowerBound:     firstReadTime,
+			UpperBound:     lastReadTime,
+			CalculatedOn:   time.Now(),
+			ScoringVersion: A1C_SCORING_VERSION}
 	}
+
+	log.Infof(context, "Estimated a1cs of [%d] periods from [%d] reads", len(a1cs), len(reads))
+	return a1cs, nil
+}
+
+// estimateA1CFromMedian naively assumes that the a1c relates to the median glucose like it does to the average glucose
+func estimateA1CFromMedian(median float64) float64 {
+	return (median + 77.3) / 35.6
 }
@@ -1,3 +1,6 @@
+//go:build appengine_legacy
+// +build appengine_legacy
+
 package engine_test
 
 import (
@@ -88,7 +91,7 @@ func setupTestData(t *testing.T, average float32, upperDate time.Time) (c aetest
 
 	user := model.GlukitUser{TEST_USER, "", "", upperDate,
 		"", "", util.GLUKIT_EPOCH_TIME, apimodel.UNDEFINED_GLUCOSE_READ,
-		model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, false, "", upperDate, model.UNDEFINED_A1C_ESTIMATE}
+		model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, false, "", upperDate, model.UNDEFINED_A1C_ESTIMATE, model.DEFAULT_GLUCOSE_TARGETS}
 
 	key, err = store.StoreUserProfile(c, upperDate, user)
 	if err != nil {
@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/grd/stat"
+	"sort"
+)
+
+const (
+	// The number of days of reads an ambulatory glucose profile is normally generated from
+	AGP_PERIOD_IN_DAYS = 14
+	// The size of the time of day buckets of the percentile curves
+	AGP_BUCKET_MINUTES = 15
+
+	AGP_DATE_FORMAT = "2006-01-02"
+)
+
+// ErrNoReadsForAGP is returned when an ambulatory glucose profile is requested for a window without any read
+var ErrNoReadsForAGP = errors.New("No reads to generate an ambulatory glucose profile from")
+
+// CalculateAGP generates the ambulatory glucose profile of the reads. Reads are positioned by their time of day in their
+// own timezone so that days spent in different timezones line up. Values are converted to the requested glucose unit.
+func CalculateAGP(context context.Context, reads []apimodel.GlucoseRead, bucketMinutes int, glucoseUnit apimodel.GlucoseUnit) (agp *model.AmbulatoryGlucoseProfile, err error) {
+	if len(reads) == 0 {
+		return nil, ErrNoReadsForAGP
+	}
+
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	log.Debugf(context, "Generating ambulatory glucose profile from [%d] reads", len(sortedReads))
+
+	bucketValues := make([]stat.Float64Slice, 24*60/bucketMinutes)
+	agp = new(model.AmbulatoryGlucoseProfile)
+	agp.DailyOverlay = make([]model.AGPDay, 0)
+	dayIndexes := make(map[string]int)
+
+	for _, read := range sortedReads {
+		value, err := read.GetNormalizedValue(glucoseUnit)
+		if err != nil {
+			return nil, err
+		}
+
+		localTime := read.GetTime()
+		timeOfDay := localTime.Hour()*60 + localTime.Minute()
+		bucket := timeOfDay / bucketMinutes
+		bucketValues[bucket] = append(bucketValues[bucket], float64(value))
+
+		date := localTime.Format(AGP_DATE_FORMAT)
+		if _, ok := dayIndexes[date]; !ok {
+			dayIndexes[date] = len(agp.DailyOverlay)
+			agp.DailyOverlay = append(agp.DailyOverlay, model.AGPDay{Date: date, Points: make([]model.AGPPoint, 0)})
+		}
+
+		day := &agp.DailyOverlay[dayIndexes[date]]
+		day.Points = append(day.Points, model.AGPPoint{TimeOfDay: timeOfDay, Value: float64(value)})
+	}
+
+	agp.Buckets = make([]model.AGPBucket, 0)
+	for i, values := range bucketValues {
+		if len(values) == 0 {
+			continue
+		}
+
+		sort.Float64s(values)
+		agp.Buckets = append(agp.Buckets, model.AGPBucket{
+			TimeOfDay:    i * bucketMinutes,
+			Count:        len(values),
+			Percentile5:  stat.QuantileFromSortedData(values, 0.05),
+			Percentile25: stat.QuantileFromSortedData(values, 0.25),
+			Percentile50: stat.QuantileFromSortedData(values, 0.50),
+			Percentile75: stat.QuantileFromSortedData(values, 0.75),
+			Percentile95: stat.QuantileFromSortedData(values, 0.95)})
+	}
+
+	agp.LowerBound = sortedReads[0].GetTime()
+	agp.UpperBound = sortedReads[len(sortedReads)-1].GetTime()
+	agp.Days = len(agp.DailyOverlay)
+	agp.Unit = glucoseUnit
+	agp.BucketMinutes = bucketMinutes
+
+	return agp, nil
+}
@@ -0,0 +1,64 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"testing"
+	"time"
+)
+
+func TestAGPPercentiles(t *testing.T) {
+	location, _ := time.LoadLocation("America/Los_Angeles")
+	start := time.Date(2014, time.April, 18, 0, 0, 0, 0, location)
+
+	// 21 days of reads where each day's value is constant, from 100 to 300 mg/dL
+	reads := make([]apimodel.GlucoseRead, 0)
+	for day := 0; day < 21; day++ {
+		for i := 0; i < 288; i++ {
+			readTime := start.AddDate(0, 0, day).Add(time.Duration(i*5) * time.Minute)
+			reads = append(reads, apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(readTime), TimeZoneId: "America/Los_Angeles"},
+				Unit: apimodel.MG_PER_DL, Value: float32(100 + 10*day)})
+		}
+	}
+
+	agp, err := engine.CalculateAGP(context.Background(), reads, engine.AGP_BUCKET_MINUTES, apimodel.MG_PER_DL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if agp.Days != 21 || len(agp.DailyOverlay) != 21 || len(agp.DailyOverlay[0].Points) != 288 {
+		t.Errorf("TestAGPPercentiles failed: got [%d] days in the overlay but expected [%d] days of [%d] points", len(agp.DailyOverlay), 21, 288)
+	}
+
+	if agp.DailyOverlay[0].Date != "2014-04-18" {
+		t.Errorf("TestAGPPercentiles failed: got first day [%s] but expected [%s]", agp.DailyOverlay[0].Date, "2014-04-18")
+	}
+
+	if len(agp.Buckets) != 24*60/engine.AGP_BUCKET_MINUTES {
+		t.Fatalf("TestAGPPercentiles failed: got [%d] buckets but expected [%d]", len(agp.Buckets), 24*60/engine.AGP_BUCKET_MINUTES)
+	}
+
+	for _, bucket := range agp.Buckets {
+		if bucket.Percentile50 != 200 || bucket.Percentile5 != 110 || bucket.Percentile95 != 290 {
+			t.Errorf("TestAGPPercentiles failed: got percentiles [%v] for bucket at [%d] but expected a median of 200 from 110 to 290", bucket, bucket.TimeOfDay)
+		}
+	}
+}
+
+func TestAGPUsesLocalTimeOfDay(t *testing.T) {
+	// Midnight in Los Angeles is 7 or 8 in the morning in UTC but should land in the first bucket
+	location, _ := time.LoadLocation("America/Los_Angeles")
+	readTime := time.Date(2014, time.April, 18, 0, 5, 0, 0, location)
+	reads := []apimodel.GlucoseRead{apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(readTime), TimeZoneId: "America/Los_Angeles"},
+		Unit: apimodel.MG_PER_DL, Value: 90}}
+
+	agp, err := engine.CalculateAGP(context.Background(), reads, engine.AGP_BUCKET_MINUTES, apimodel.MG_PER_DL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agp.Buckets) != 1 || agp.Buckets[0].TimeOfDay != 0 || agp.DailyOverlay[0].Points[0].TimeOfDay != 5 {
+		t.Errorf("TestAGPUsesLocalTimeOfDay failed: got buckets [%v] and overlay [%v] but expected the read in the first bucket", agp.Buckets, agp.DailyOverlay)
+	}
+}
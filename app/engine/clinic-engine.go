@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// The number of random bytes of clinic ids
+	CLINIC_ID_SIZE = 8
+	// The number of random bytes of invite codes, encoded as 8 characters for patients to type in
+	CLINIC_INVITE_CODE_SIZE = 5
+	// How long an invite can be redeemed for
+	CLINIC_INVITE_VALIDITY = time.Duration(7*24) * time.Hour
+	// The days of reads, leading to the most recent read, the time in range of patients is calculated over
+	CLINIC_TIME_IN_RANGE_PERIOD_IN_DAYS = 14
+
+	// The values patients can be sorted on
+	PATIENT_SORT_NAME          = "name"
+	PATIENT_SORT_GLUKIT_SCORE  = "glukitScore"
+	PATIENT_SORT_A1C           = "a1c"
+	PATIENT_SORT_TIME_IN_RANGE = "timeInRange"
+	PATIENT_SORT_LAST_SYNC     = "lastSync"
+)
+
+// ErrClinicInviteNotRedeemable is returned when a patient redeems an invite that expired or was already redeemed
+var ErrClinicInviteNotRedeemable = store.ErrClinicInviteNotRedeemable
+
+// PatientFilter narrows down the patients of a clinic. Empty criteria match all patients.
+type PatientFilter struct {
+	DiabetesType string
+	// Matched, case-insensitively, against the name and email of patients
+	Search string
+	// Only patients who didn't sync since then, including those who never did
+	NotSyncedSince *time.Time
+}
+
+// NewClinic returns a clinic with a new random id and the normalized emails of its practitioners
+func NewClinic(name string, practitionerEmails []string, now time.Time) (clinic *model.Clinic, err error) {
+	id := make([]byte, CLINIC_ID_SIZE)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	clinic = &model.Clinic{Id: hex.EncodeToString(id), Name: name, PractitionerEmails: practitionerEmails, CreatedOn: now}
+	*clinic = clinic.NormalizePractitionerEmails()
+
+	return clinic, nil
+}
+
+// NewClinicInvite returns a new invite to the clinic with a random code, redeemable for CLINIC_INVITE_VALIDITY
+func NewClinicInvite(clinic model.Clinic, practitionerEmail string, now time.Time) (invite *model.ClinicInvite, err error) {
+	code := make([]byte, CLINIC_INVITE_CODE_SIZE)
+	if _, err = rand.Read(code); err != nil {
+		return nil, err
+	}
+
+	return &model.ClinicInvite{Code: base32.StdEncoding.EncodeToString(code), ClinicId: clinic.Id, CreatedBy: practitionerEmail,
+		CreatedOn: now, ExpiresOn: now.Add(CLINIC_INVITE_VALIDITY)}, nil
+}
+
+// EnrollInClinic redeems an invite for the patient to be enrolled in its clinic. Invites can only be redeemed once, before they expire,
+// and the redemption is atomic so that concurrent requests can't both redeem the same code.
+func EnrollInClinic(context context.Context, repository store.ClinicRepository, patientEmail string, code string, now time.Time) (enrollment *model.ClinicEnrollment, err error) {
+	invite, err := repository.RedeemClinicInvite(context, strings.ToUpper(strings.TrimSpace(code)), patientEmail, now)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment = &model.ClinicEnrollment{ClinicId: invite.ClinicId, PatientEmail: patientEmail, EnrolledOn: now}
+	if err = repository.StoreClinicEnrollment(context, *enrollment); err != nil {
+		return nil, err
+	}
+
+	log.Infof(context, "Enrolled user [%s] in clinic [%s] with invite from [%s]", patientEmail, invite.ClinicId, invite.CreatedBy)
+	return enrollment, nil
+}
+
+// FindClinicPatient returns the email a patient was enrolled with if they're enrolled in a clinic the user is a practitioner of, or an
+// empty string if they aren't. Patients are matched on their normalized email since their data is stored under the email they enrolled
+// with.
+func FindClinicPatient(context context.Context, repository store.ClinicRepository, practitionerEmail string, patientEmail string) (enrolledEmail string, err error) {
+	clinics, err := repository.GetClinicsByPractitioner(context, model.NormalizeEmail(practitionerEmail))
+	if err != nil {
+		return "", err
+	}
+
+	patientEmail = model.NormalizeEmail(patientEmail)
+	for _, clinic := range clinics {
+		enrollments, err := repository.GetClinicEnrollmentsByClinic(context, clinic.Id)
+		if err != nil {
+			return "", err
+		}
+
+		for _, enrollment := range enrollments {
+			if model.NormalizeEmail(enrollment.PatientEmail) == patientEmail {
+				return enrollment.PatientEmail, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// SummarizeClinicPatients returns the summaries of all patients enrolled in the clinic
+func SummarizeClinicPatients(context context.Context, repository store.Repository, clinicId string) (summaries []model.PatientSummary, err error) {
+	enrollments, err := repository.GetClinicEnrollmentsByClinic(context, clinicId)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries = make([]model.PatientSummary, 0, len(enrollments))
+	for _, enrollment := range enrollments {
+		patient, err := repository.GetUserProfile(context, enrollment.PatientEmail)
+		if err == store.ErrNoSuchUser {
+			log.Warningf(context, "Skipping patient [%s] of clinic [%s] without a profile", enrollment.PatientEmail, clinicId)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		summary, err := SummarizePatient(context, repository, *patient, enrollment)
+		if err != nil {
+			return nil, err
+		}
+
+		summaries = append(summaries, *summary)
+	}
+
+	return summaries, nil
+}
+
+// SummarizePatient returns the overview of a patient with their most recent glukit score and a1c estimate, their time in range with
+// their own glucose targets over the CLINIC_TIME_IN_RANGE_PERIOD_IN_DAYS leading to their most recent read and the time of that
+// read as the time of their last sync
+func SummarizePatient(context context.Context, repository store.GlucoseReadRepository, patient model.GlukitUser, enrollment model.ClinicEnrollment) (summary *model.PatientSummary, err error) {
+	summary = &model.PatientSummary{Email: patient.Email, FirstName: patient.FirstName, LastName: patient.LastName,
+		DiabetesType: patient.DiabetesType, EnrolledOn: enrollment.EnrolledOn}
+
+	if score := patient.MostRecentScore.Value; score != model.UNDEFINED_SCORE_VALUE {
+		summary.GlukitScore = &score
+	}
+
+	if a1c := patient.MostRecentA1C.Value; a1c != model.UNDEFINED_A1C_VALUE {
+		summary.A1C = &a1c
+	}
+
+	lastSync := patient.MostRecentRead.GetTime()
+	if util.GLUKIT_EPOCH_TIME.Equal(lastSync) {
+		return summary, nil
+	}
+	summary.LastSync = &lastSync
+
+	reads, err := repository.GetGlucoseReads(context, patient.Email, lastSync.AddDate(0, 0, -1*CLINIC_TIME_IN_RANGE_PERIOD_IN_DAYS), lastSync)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, err := CalculateGlycemicMetrics(context, reads, patient.GetTargets().Thresholds)
+	if err == nil {
+		summary.TimeInRange = &metrics.TimeInRange
+	} else if err != ErrNoReadsForMetrics {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// FilterPatientSummaries returns the summaries of the patients matching all the criteria of the filter
+func FilterPatientSummaries(summaries []model.PatientSummary, filter PatientFilter) (filtered []model.PatientSummary) {
+	search := strings.ToLower(filter.Search)
+	filtered = make([]model.PatientSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		if len(filter.DiabetesType) > 0 && summary.DiabetesType != filter.DiabetesType {
+			continue
+		}
+
+		if len(search) > 0 && !strings.Contains(strings.ToLower(summary.FirstName+" "+summary.LastName+" "+summary.Email), search) {
+			continue
+		}
+
+		if filter.NotSyncedSince != nil && summary.LastSync != nil && !summary.LastSync.Before(*filter.NotSyncedSince) {
+			continue
+		}
+
+		filtered = append(filtered, summary)
+	}
+
+	return filtered
+}
+
+// SortPatientSummaries sorts the summaries, in place, on one of the PATIENT_SORT values. Patients without a value are always last,
+// in either order, and ties are sorted by name.
+func SortPatientSummaries(summaries []model.PatientSummary, sortBy string, descending bool) (err error) {
+	var value func(summary model.PatientSummary) (float64, bool)
+	switch sortBy {
+	case PATIENT_SORT_NAME:
+		value = func(summary model.PatientSummary) (float64, bool) { return 0, true }
+	case PATIENT_SORT_GLUKIT_SCORE:
+		value = func(summary model.PatientSummary) (float64, bool) {
+			if summary.GlukitScore == nil {
+				return 0, false
+			}
+			return float64(*summary.GlukitScore), true
+		}
+	case PATIENT_SORT_A1C:
+		value = func(summary model.PatientSummary) (float64, bool) {
+			if summary.A1C == nil {
+				return 0, false
+			}
+			return *summary.A1C, true
+		}
+	case PATIENT_SORT_TIME_IN_RANGE:
+		value = func(summary model.PatientSummary) (float64, bool) {
+			if summary.TimeInRange == nil {
+				return 0, false
+			}
+			return *summary.TimeInRange, true
+		}
+	case PATIENT_SORT_LAST_SYNC:
+		value = func(summary model.PatientSummary) (float64, bool) {
+			if summary.LastSync == nil {
+				return 0, false
+			}
+			return float64(summary.LastSync.Unix()), true
+		}
+	default:
+		return errors.New(fmt.Sprintf("Invalid sort [%s], expected one of [%s, %s, %s, %s, %s]", sortBy, PATIENT_SORT_NAME,
+			PATIENT_SORT_GLUKIT_SCORE, PATIENT_SORT_A1C, PATIENT_SORT_TIME_IN_RANGE, PATIENT_SORT_LAST_SYNC))
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		first, firstDefined := value(summaries[i])
+		second, secondDefined := value(summaries[j])
+		if firstDefined != secondDefined {
+			return firstDefined
+		}
+
+		if first != second {
+			return (first < second) != descending
+		}
+
+		firstName, secondName := patientSortName(summaries[i]), patientSortName(summaries[j])
+		if sortBy == PATIENT_SORT_NAME && descending {
+			return firstName > secondName
+		}
+
+		return firstName < secondName
+	})
+
+	return nil
+}
+
+func patientSortName(summary model.PatientSummary) string {
+	return strings.ToLower(summary.LastName + " " + summary.FirstName + " " + summary.Email)
+}
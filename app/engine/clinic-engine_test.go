@@ -0,0 +1,233 @@
+package engine_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+var clinicNow = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestEnrollInClinicGivesPractitionersAccess(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	clinic, err := engine.NewClinic("Endocrinology", []string{"doctor@glukit.com"}, clinicNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreClinic(c, *clinic); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := engine.NewClinicInvite(*clinic, "doctor@glukit.com", clinicNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreClinicInvite(c, *invite); err != nil {
+		t.Fatal(err)
+	}
+
+	if enrolledEmail, err := engine.FindClinicPatient(c, r, "doctor@glukit.com", "patient@glukit.com"); err != nil {
+		t.Fatal(err)
+	} else if enrolledEmail != "" {
+		t.Errorf("TestEnrollInClinicGivesPractitionersAccess failed: got access before enrollment but expected none")
+	}
+
+	if _, err := engine.EnrollInClinic(c, r, "patient@glukit.com", invite.Code, clinicNow.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if enrolledEmail, err := engine.FindClinicPatient(c, r, "doctor@glukit.com", "patient@glukit.com"); err != nil {
+		t.Fatal(err)
+	} else if enrolledEmail == "" {
+		t.Errorf("TestEnrollInClinicGivesPractitionersAccess failed: got no access after enrollment but expected access")
+	}
+
+	if enrolledEmail, err := engine.FindClinicPatient(c, r, "other@glukit.com", "patient@glukit.com"); err != nil {
+		t.Fatal(err)
+	} else if enrolledEmail != "" {
+		t.Errorf("TestEnrollInClinicGivesPractitionersAccess failed: got access for a practitioner of another clinic but expected none")
+	}
+
+	if _, err := engine.EnrollInClinic(c, r, "sibling@glukit.com", invite.Code, clinicNow.Add(time.Hour)); err != engine.ErrClinicInviteNotRedeemable {
+		t.Errorf("TestEnrollInClinicGivesPractitionersAccess failed: got [%v] redeeming twice but expected [%v]", err,
+			engine.ErrClinicInviteNotRedeemable)
+	}
+
+	if err := r.DeleteClinicEnrollment(c, "patient@glukit.com", clinic.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if enrolledEmail, err := engine.FindClinicPatient(c, r, "doctor@glukit.com", "patient@glukit.com"); err != nil {
+		t.Fatal(err)
+	} else if enrolledEmail != "" {
+		t.Errorf("TestEnrollInClinicGivesPractitionersAccess failed: got access after withdrawal but expected none")
+	}
+}
+
+func TestClinicPractitionerEmailsIgnoreCase(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	clinic, err := engine.NewClinic("Endocrinology", []string{" Doctor@Glukit.com "}, clinicNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreClinic(c, *clinic); err != nil {
+		t.Fatal(err)
+	}
+
+	clinics, err := r.GetClinicsByPractitioner(c, "doctor@glukit.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clinics) != 1 || clinics[0].Id != clinic.Id {
+		t.Errorf("TestClinicPractitionerEmailsIgnoreCase failed: got [%v] but expected [%s]", clinics, clinic.Id)
+	}
+
+	if !clinic.HasPractitioner("DOCTOR@glukit.com") {
+		t.Errorf("TestClinicPractitionerEmailsIgnoreCase failed: got no practitioner match for [DOCTOR@glukit.com] but expected a match")
+	}
+}
+
+func TestEnrollInClinicWithExpiredInvite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	invite, err := engine.NewClinicInvite(model.Clinic{Id: "clinic"}, "doctor@glukit.com", clinicNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreClinicInvite(c, *invite); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = engine.EnrollInClinic(c, r, "patient@glukit.com", invite.Code, clinicNow.Add(engine.CLINIC_INVITE_VALIDITY))
+	if err != engine.ErrClinicInviteNotRedeemable {
+		t.Errorf("TestEnrollInClinicWithExpiredInvite failed: got [%v] but expected [%v]", err, engine.ErrClinicInviteNotRedeemable)
+	}
+}
+
+func TestFilterAndSortPatientSummaries(t *testing.T) {
+	score, lowScore := int64(120), int64(80)
+	longAgo, recently := clinicNow.AddDate(0, 0, -10), clinicNow.Add(-1*time.Hour)
+	summaries := []model.PatientSummary{
+		model.PatientSummary{Email: "never@glukit.com", FirstName: "Never", LastName: "Synced", DiabetesType: model.DIABETES_TYPE_1},
+		model.PatientSummary{Email: "high@glukit.com", FirstName: "High", LastName: "Score", DiabetesType: model.DIABETES_TYPE_1,
+			GlukitScore: &score, LastSync: &longAgo},
+		model.PatientSummary{Email: "low@glukit.com", FirstName: "Low", LastName: "Score", DiabetesType: model.DIABETES_TYPE_1,
+			GlukitScore: &lowScore, LastSync: &recently},
+		model.PatientSummary{Email: "t2@glukit.com", FirstName: "Type", LastName: "Two", DiabetesType: model.DIABETES_TYPE_2,
+			GlukitScore: &lowScore, LastSync: &recently},
+	}
+
+	filtered := engine.FilterPatientSummaries(summaries, engine.PatientFilter{DiabetesType: model.DIABETES_TYPE_1})
+	if err := engine.SortPatientSummaries(filtered, engine.PATIENT_SORT_GLUKIT_SCORE, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(filtered) != 3 || filtered[0].Email != "high@glukit.com" || filtered[1].Email != "low@glukit.com" ||
+		filtered[2].Email != "never@glukit.com" {
+		t.Errorf("TestFilterAndSortPatientSummaries failed: got [%v] but expected [high, low, never]", filtered)
+	}
+
+	notSyncedSince := clinicNow.AddDate(0, 0, -1)
+	stale := engine.FilterPatientSummaries(summaries, engine.PatientFilter{Search: "score", NotSyncedSince: &notSyncedSince})
+	if len(stale) != 1 || stale[0].Email != "high@glukit.com" {
+		t.Errorf("TestFilterAndSortPatientSummaries failed: got [%v] but expected [high]", stale)
+	}
+
+	if err := engine.SortPatientSummaries(summaries, "age", false); err == nil {
+		t.Errorf("TestFilterAndSortPatientSummaries failed: got no error for an unknown sort but expected one")
+	}
+}
+
+func TestSummarizePatientUsesPatientTargets(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	reads := make([]apimodel.GlucoseRead, 24)
+	for i := range reads {
+		reads[i] = apimodel.GlucoseRead{Time: apimodel.Time{apimodel.GetTimeMillis(clinicNow.Add(time.Duration(i) * time.Hour)), "UTC"},
+			Unit: apimodel.MG_PER_DL, Value: 150}
+	}
+
+	patient := model.GlukitUser{Email: "patient@glukit.com", MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, MostRecentScore: model.UNDEFINED_SCORE,
+		MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE}
+	if err := r.StoreUserProfile(c, clinicNow, patient); err != nil {
+		t.Fatal(err)
+	}
+
+	w := store.NewRepositoryGlucoseReadBatchWriter(c, r, patient.Email)
+	if _, err := w.WriteGlucoseReadBatch(reads); err != nil {
+		t.Fatal(err)
+	}
+	patient.MostRecentRead = reads[len(reads)-1]
+	enrollment := model.ClinicEnrollment{ClinicId: "clinic", PatientEmail: patient.Email, EnrolledOn: clinicNow}
+
+	summary, err := engine.SummarizePatient(c, r, patient, enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.TimeInRange == nil || *summary.TimeInRange != 100 {
+		t.Errorf("TestSummarizePatientUsesPatientTargets failed: got time in range [%v] with the default targets but expected 100", summary.TimeInRange)
+	}
+
+	patient.Targets = model.GLUCOSE_TARGETS_PRESETS[model.TARGETS_PROFILE_PREGNANCY]
+	if summary, err = engine.SummarizePatient(c, r, patient, enrollment); err != nil {
+		t.Fatal(err)
+	}
+
+	if summary.TimeInRange == nil || *summary.TimeInRange != 0 {
+		t.Errorf("TestSummarizePatientUsesPatientTargets failed: got time in range [%v] with the pregnancy targets but expected 0", summary.TimeInRange)
+	}
+}
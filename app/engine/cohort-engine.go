@@ -0,0 +1,187 @@
+package engine
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"github.com/grd/stat"
+	"sort"
+	"time"
+)
+
+const (
+	COHORT_AGGREGATION_FUNCTION_NAME = "runCohortAggregation"
+	// The smallest number of users a cohort needs for its distributions to be revealed
+	MIN_COHORT_SIZE = 20
+	// How long an aggregation is used before the next one is started
+	COHORT_AGGREGATION_PERIOD = time.Duration(24) * time.Hour
+	// The days of reads, leading to the most recent read, the time in range of users is calculated over
+	COHORT_TIME_IN_RANGE_PERIOD_IN_DAYS = 14
+	// The age band of the cohorts of users of all ages, which includes users whose age isn't known
+	ALL_AGE_BANDS = -2
+)
+
+// cohortKey identifies the distribution of a metric within a cohort
+type cohortKey struct {
+	diabetesType string
+	ageBand      int
+	metric       string
+}
+
+// StartCohortAggregation queues the aggregation of the cohorts
+func StartCohortAggregation(context context.Context, jobQueue queue.Queue) (err error) {
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: COHORT_AGGREGATION_FUNCTION_NAME})
+	if err != nil {
+		log.Criticalf(context, "Couldn't schedule the execution of [%s]: %v", COHORT_AGGREGATION_FUNCTION_NAME, err)
+		return err
+	}
+
+	log.Infof(context, "Queued up cohort aggregation")
+	return nil
+}
+
+// IsCohortAggregationStale returns true if the aggregation is older than the COHORT_AGGREGATION_PERIOD
+func IsCohortAggregationStale(aggregation model.CohortAggregation, now time.Time) bool {
+	return now.Sub(aggregation.CalculatedOn) > COHORT_AGGREGATION_PERIOD
+}
+
+// RunCohortAggregation aggregates the metrics of all users who opted in to be part of the cohorts and stores the distributions of
+// the cohorts large enough to keep their members anonymous, replacing the previous ones. Users are part of the cohort of their type of
+// diabetes, for all ages, and of the one of their age band if it's known.
+func RunCohortAggregation(context context.Context, repository store.Repository, now time.Time) (aggregation *model.CohortAggregation, err error) {
+	members, err := repository.FindCohortMembers(context)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[cohortKey][]float64)
+	for _, member := range members {
+		metrics, err := CalculateCohortMetrics(context, repository, member)
+		if err != nil {
+			return nil, err
+		}
+
+		ageBands := []int{ALL_AGE_BANDS}
+		if ageBand := GetAgeBand(member, now); ageBand != UNKNOWN_BAND {
+			ageBands = append(ageBands, ageBand)
+		}
+
+		for metric, value := range metrics {
+			for _, ageBand := range ageBands {
+				key := cohortKey{member.DiabetesType, ageBand, metric}
+				values[key] = append(values[key], value)
+			}
+		}
+	}
+
+	aggregation = &model.CohortAggregation{CalculatedOn: now, MemberCount: len(members), Distributions: make([]model.CohortDistribution, 0)}
+	for key, cohortValues := range values {
+		if len(cohortValues) < MIN_COHORT_SIZE {
+			log.Debugf(context, "Not revealing the [%s] distribution of cohort [%s, %d] of [%d] users", key.metric, key.diabetesType, key.ageBand,
+				len(cohortValues))
+			continue
+		}
+
+		aggregation.Distributions = append(aggregation.Distributions, newCohortDistribution(key, cohortValues))
+	}
+
+	sort.Slice(aggregation.Distributions, func(i, j int) bool {
+		first, second := aggregation.Distributions[i], aggregation.Distributions[j]
+		if first.DiabetesType != second.DiabetesType {
+			return first.DiabetesType < second.DiabetesType
+		}
+		if first.AgeBand != second.AgeBand {
+			return first.AgeBand < second.AgeBand
+		}
+
+		return first.Metric < second.Metric
+	})
+
+	if err = repository.StoreCohortAggregation(context, *aggregation); err != nil {
+		return nil, err
+	}
+
+	log.Infof(context, "Aggregated [%d] cohort distributions from [%d] users", len(aggregation.Distributions), len(members))
+	return aggregation, nil
+}
+
+// newCohortDistribution returns the distribution of the values with the quantiles of each percentile
+func newCohortDistribution(key cohortKey, values []float64) model.CohortDistribution {
+	sorted := make(stat.Float64Slice, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	quantiles := make([]float64, 101)
+	for i := range quantiles {
+		quantiles[i] = stat.QuantileFromSortedData(sorted, float64(i)/100)
+	}
+
+	return model.CohortDistribution{DiabetesType: key.diabetesType, AgeBand: key.ageBand, Metric: key.metric, Size: len(values),
+		Quantiles: quantiles}
+}
+
+// CalculateCohortMetrics returns the values of the metrics users are ranked on, keyed by metric. Metrics are only compared when they're
+// calculated the same way for everyone: scores of the current version against the DEFAULT_SCORING_TARGET, estimates of the current
+// version and the time in range of the COHORT_TIME_IN_RANGE_PERIOD_IN_DAYS leading to the user's most recent read, with the
+// DEFAULT_GLUCOSE_THRESHOLDS. Metrics the user doesn't have such a value for are left out.
+func CalculateCohortMetrics(context context.Context, repository store.GlucoseReadRepository, user model.GlukitUser) (metrics map[string]float64, err error) {
+	metrics = make(map[string]float64)
+
+	score := user.MostRecentScore
+	if score.Value != model.UNDEFINED_SCORE_VALUE && score.ScoringVersion == SCORING_VERSION && score.GetTarget() == model.DEFAULT_SCORING_TARGET {
+		metrics[model.COHORT_METRIC_GLUKIT_SCORE] = float64(score.Value)
+	}
+
+	a1c := user.MostRecentA1C
+	if a1c.Value != model.UNDEFINED_A1C_VALUE && a1c.ScoringVersion == A1C_SCORING_VERSION {
+		metrics[model.COHORT_METRIC_A1C] = a1c.Value
+	}
+
+	upperBound := user.MostRecentRead.GetTime()
+	if util.GLUKIT_EPOCH_TIME.Equal(upperBound) {
+		return metrics, nil
+	}
+
+	reads, err := repository.GetGlucoseReads(context, user.Email, upperBound.AddDate(0, 0, -1*COHORT_TIME_IN_RANGE_PERIOD_IN_DAYS), upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	glycemicMetrics, err := CalculateGlycemicMetrics(context, reads, model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err == nil {
+		metrics[model.COHORT_METRIC_TIME_IN_RANGE] = glycemicMetrics.TimeInRange
+	} else if err != ErrNoReadsForMetrics {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// RankInCohorts ranks the metrics of a user within the cohorts they're part of, in the order of the distributions of the aggregation.
+// Users are ranked whether they opted in to be part of the cohorts or not. Cohorts without a distribution, because they're too small,
+// and metrics the user doesn't have a comparable value for aren't ranked.
+func RankInCohorts(context context.Context, repository store.GlucoseReadRepository, user model.GlukitUser, aggregation model.CohortAggregation, now time.Time) (rankings []model.CohortRanking, err error) {
+	metrics, err := CalculateCohortMetrics(context, repository, user)
+	if err != nil {
+		return nil, err
+	}
+
+	ageBand := GetAgeBand(user, now)
+	rankings = make([]model.CohortRanking, 0)
+	for _, distribution := range aggregation.Distributions {
+		if distribution.DiabetesType != user.DiabetesType || (distribution.AgeBand != ALL_AGE_BANDS && distribution.AgeBand != ageBand) {
+			continue
+		}
+
+		if value, ok := metrics[distribution.Metric]; ok {
+			rankings = append(rankings, model.CohortRanking{DiabetesType: distribution.DiabetesType, AgeBand: distribution.AgeBand,
+				Metric: distribution.Metric, CohortSize: distribution.Size, Value: value, BetterThan: distribution.BetterThan(value),
+				CalculatedOn: aggregation.CalculatedOn})
+		}
+	}
+
+	return rankings, nil
+}
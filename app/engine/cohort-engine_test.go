@@ -0,0 +1,91 @@
+package engine_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	_ "github.com/mattn/go-sqlite3"
+	"math"
+	"testing"
+	"time"
+)
+
+var cohortNow = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// makeCohortMember returns a user without reads with the given score and age
+func makeCohortMember(i int, score int64, age int, optIn bool) model.GlukitUser {
+	return model.GlukitUser{Email: fmt.Sprintf("member%d@glukit.com", i), DiabetesType: model.DIABETES_TYPE_1,
+		DateOfBirth: cohortNow.AddDate(-1*age, 0, -1), AccountCreated: cohortNow.AddDate(0, -1, 0), MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ,
+		MostRecentScore: model.GlukitScore{Value: score, ScoringVersion: engine.SCORING_VERSION}, MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE,
+		CohortOptIn: optIn}
+}
+
+func TestRunCohortAggregation(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := context.Background()
+	// Members with scores of 100 to 124, the first MIN_COHORT_SIZE of them in their thirties
+	for i := 0; i < engine.MIN_COHORT_SIZE+5; i++ {
+		age := 35
+		if i >= engine.MIN_COHORT_SIZE {
+			age = 70
+		}
+
+		if err := r.StoreUserProfile(c, time.Now(), makeCohortMember(i, int64(100+i), age, true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Users who didn't opt in aren't part of the distributions
+	if err := r.StoreUserProfile(c, time.Now(), makeCohortMember(100, 1, 35, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregation, err := engine.RunCohortAggregation(c, r, cohortNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := r.GetCohortAggregation(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cohort of members over 60 is too small to be revealed
+	if len(stored.Distributions) != 2 || stored.MemberCount != engine.MIN_COHORT_SIZE+5 {
+		t.Fatalf("TestRunCohortAggregation failed: got [%d] distributions of [%d] members but expected [%d] of [%d]", len(stored.Distributions),
+			stored.MemberCount, 2, engine.MIN_COHORT_SIZE+5)
+	}
+
+	all := aggregation.Distributions[0]
+	if all.AgeBand != engine.ALL_AGE_BANDS || all.Size != engine.MIN_COHORT_SIZE+5 || all.Quantiles[0] != 100 || all.Quantiles[100] != 124 {
+		t.Errorf("TestRunCohortAggregation failed: got [%v] but expected the distribution of scores 100 to 124 for all ages", all)
+	}
+
+	rankings, err := engine.RankInCohorts(c, r, makeCohortMember(200, 106, 35, false), *stored, cohortNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rankings) != 2 {
+		t.Fatalf("TestRunCohortAggregation failed: got [%d] rankings but expected [%d]", len(rankings), 2)
+	}
+
+	// A score of 106 is better than the 18 higher scores of all members and the 13 higher scores of the members in their thirties
+	if math.Abs(rankings[0].BetterThan-72) > 0.0001 || math.Abs(rankings[1].BetterThan-65) > 0.0001 {
+		t.Errorf("TestRunCohortAggregation failed: got better than [%.1f%%] and [%.1f%%] but expected [72%%] and [65%%]",
+			rankings[0].BetterThan, rankings[1].BetterThan)
+	}
+}
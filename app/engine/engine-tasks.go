@@ -1,43 +1,56 @@
 package engine
 
 import (
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
-	"google.golang.org/appengine/delay"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
 	"time"
 )
 
-var RunGlukitScoreCalculationChunk = delay.Func(GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, func(context context.Context, userEmail string,
-	lowerBound time.Time) {
-	log.Criticalf(context, "This function purely exists as a workaround to the \"initialization loop\" error that "+
-		"shows up because the function calls itself. This implementation defines the same signature as the "+
-		"real one which we define in init() to override this implementation!")
-})
-
-var RunA1CCalculationChunk = delay.Func(A1C_BATCH_CALCULATION_FUNCTION_NAME, func(context context.Context, userEmail string,
-	lowerBound time.Time) {
-	log.Criticalf(context, "This function purely exists as a workaround to the \"initialization loop\" error that "+
-		"shows up because the function calls itself. This implementation defines the same signature as the "+
-		"real one which we define in init() to override this implementation!")
-})
-
 const (
-	PERIODS_PER_BATCH                            = 6
-	BATCH_CALCULATION_QUEUE_NAME                 = "batch-calculation"
-	GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME = "runGlukitScoreCalculationChunk"
-	A1C_BATCH_CALCULATION_FUNCTION_NAME          = "runA1CCalculationChunk"
+	PERIODS_PER_BATCH                             = 6
+	BATCH_CALCULATION_QUEUE_NAME                  = "batch-calculation"
+	GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME  = "runGlukitScoreCalculationChunk"
+	A1C_BATCH_CALCULATION_FUNCTION_NAME           = "runA1CCalculationChunk"
+	EPISODE_DETECTION_FUNCTION_NAME               = "runEpisodeDetectionChunk"
+	INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME = "runInsulinRatioCalculationChunk"
+	// The period of reads covered by each chunk of episode detection
+	EPISODE_DETECTION_PERIOD = time.Duration(7*24) * time.Hour
+	// How far before the lower bound of a chunk to look at reads so that episodes starting right before it are detected
+	EPISODE_DETECTION_LOOKBACK = time.Hour
 )
 
-func RunGlukitScoreBatchCalculation(context context.Context, userEmail string, lowerBound time.Time) {
-	glukitUser, _, _, err := store.GetUserData(context, userEmail)
+// RunGlukitScoreBatchCalculation calculates a chunk of glukit scores starting at the lowerBound and enqueues the next chunk. An error
+// means the chunk should be retried. Since scores are stored by upper bound, running a chunk again is harmless.
+func RunGlukitScoreBatchCalculation(context context.Context, repository store.Repository, jobQueue queue.Queue, userEmail string, lowerBound time.Time) (err error) {
+	scorer, _ := GetGlukitScorer(SCORING_VERSION)
+	return runGlukitScoreChunk(context, repository, jobQueue, scorer, GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, userEmail, lowerBound)
+}
+
+// RunGlukitScoreRecalculation calculates a chunk of glukit scores of the given version starting at the lowerBound and enqueues the
+// next chunk, like RunGlukitScoreBatchCalculation. Scores of other versions are kept.
+func RunGlukitScoreRecalculation(context context.Context, repository store.Repository, jobQueue queue.Queue, version int, userEmail string, lowerBound time.Time) (err error) {
+	scorer, ok := GetGlukitScorer(version)
+	if !ok {
+		return errors.New(fmt.Sprintf("No glukit scorer registered for version [%d]", version))
+	}
+
+	return runGlukitScoreChunk(context, repository, jobQueue, scorer, GlukitScoreRecalculationJobName(version), userEmail, lowerBound)
+}
+
+// runGlukitScoreChunk calculates a chunk of glukit scores with the scorer and enqueues the next chunk under the job name. The best
+// and most recent scores of the user are only updated with scores of the current SCORING_VERSION.
+func runGlukitScoreChunk(context context.Context, repository store.Repository, jobQueue queue.Queue, scorer GlukitScorer, jobName string, userEmail string, lowerBound time.Time) (err error) {
+	glukitUser, _, err := repository.GetUserData(context, userEmail)
 	if _, ok := err.(store.StoreError); err != nil && !ok {
 		log.Errorf(context, "We're trying to run a batch glukit score calculation for user [%s] that doesn't exist. "+
 			"Got error: %v", userEmail, err)
-		return
+		return err
 	}
 
 	bestScore := glukitUser.BestScore
@@ -52,34 +65,47 @@ func RunGlukitScoreBatchCalculation(context context.Context, userEmail string, l
 	// Calculate the GlukitScore for every period until now by increment of 1 day. This is a moving score over the last GLUKIT_SCORE_PERIOD that gets a new value every day.
 	// This will likely go through a few calculations for which we don't have data yet but this seems like the fair
 	// price to pay for making sure we don't stop processing glukit scores because someone might have stopped using their CGM for a week or so.
+	// All periods of the chunk are scored in a single pass over their reads.
+	endsOfPeriods := make([]time.Time, 0)
 	for periodUpperBound = lowerBound.AddDate(0, 0, 1); periodUpperBound.Before(time.Now()) && periodUpperBound.Before(upperBound); periodUpperBound = periodUpperBound.AddDate(0, 0, 1) {
-		glukitScore, err := CalculateGlukitScore(context, glukitUser, periodUpperBound)
-		if err != nil {
-			util.Propagate(err)
-		}
+		endsOfPeriods = append(endsOfPeriods, periodUpperBound)
+	}
 
-		if glukitScore.IsBetterThan(glukitUser.BestScore) {
-			bestScore = *glukitScore
+	glukitScores, err := scorer.Score(context, repository, glukitUser, endsOfPeriods)
+	if err != nil {
+		return err
+	}
+
+	for i, glukitScore := range glukitScores {
+		if glukitScore.Value == model.UNDEFINED_SCORE_VALUE {
+			continue
 		}
 
-		if glukitScore.Value != model.UNDEFINED_SCORE_VALUE {
-			if periodUpperBound.After(mostRecentScore.UpperBound) {
-				mostRecentScore = *glukitScore
+		if scorer.Version() == SCORING_VERSION {
+			// Scores calculated against another target or version can't be compared so the first score against the new target becomes the best
+			if !glukitScore.IsComparableTo(bestScore) || glukitScore.IsBetterThan(bestScore) {
+				bestScore = glukitScore
 			}
 
-			glukitScoreBatch = append(glukitScoreBatch, *glukitScore)
+			if endsOfPeriods[i].After(mostRecentScore.UpperBound) {
+				mostRecentScore = glukitScore
+			}
 		}
+
+		glukitScoreBatch = append(glukitScoreBatch, glukitScore)
 	}
 
 	// Store the batch
-	store.StoreGlukitScoreBatch(context, userEmail, glukitScoreBatch)
+	if err = repository.StoreGlukitScoreBatch(context, userEmail, glukitScoreBatch); err != nil {
+		return err
+	}
 
 	// Update the bestScore/LastScoredRead if one of them is different than what was already there
 	if bestScore != glukitUser.BestScore || mostRecentScore != glukitUser.MostRecentScore {
 		glukitUser.BestScore = bestScore
 		glukitUser.MostRecentScore = mostRecentScore
-		if _, err := store.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
-			util.Propagate(err)
+		if err := repository.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
+			return err
 		} else {
 			log.Debugf(context, "Updated glukit user [%s] with an improved GlukitScore of [%v] and most recent score of [%v]",
 				glukitUser.Email, bestScore, mostRecentScore)
@@ -88,25 +114,48 @@ func RunGlukitScoreBatchCalculation(context context.Context, userEmail string, l
 
 	// Kick off the next chunk of glukit score calculation
 	if !periodUpperBound.Before(upperBound) {
-		task, err := RunGlukitScoreCalculationChunk.Task(userEmail, periodUpperBound)
+		err := jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: jobName, UserEmail: userEmail, LowerBound: periodUpperBound})
 		if err != nil {
-			log.Criticalf(context, "Couldn't schedule the next execution of [%s] for user [%s]. "+
-				"This breaks batch calculation of glukit scores for that user!: %v", GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, userEmail, err)
+			log.Errorf(context, "Couldn't schedule the next execution of [%s] for user [%s], the chunk will be retried: %v",
+				jobName, userEmail, err)
+			return err
 		}
-		taskqueue.Add(context, task, BATCH_CALCULATION_QUEUE_NAME)
 
-		log.Infof(context, "Queued up next chunk of glukit score calculation for user [%s] and lowerBound [%s]", userEmail, periodUpperBound.Format(util.TIMEFORMAT))
+		log.Infof(context, "Queued up next chunk of glukit score calculation of version [%d] for user [%s] and lowerBound [%s]", scorer.Version(),
+			userEmail, periodUpperBound.Format(util.TIMEFORMAT))
 	} else {
-		log.Infof(context, "Done with glukit score calculation for user [%s]", userEmail)
+		log.Infof(context, "Done with glukit score calculation of version [%d] for user [%s]", scorer.Version(), userEmail)
 	}
+
+	return nil
+}
+
+// RunA1CBatchCalculation estimates a chunk of a1cs starting at the lowerBound and enqueues the next chunk. An error
+// means the chunk should be retried.
+func RunA1CBatchCalculation(context context.Context, repository store.Repository, jobQueue queue.Queue, userEmail string, lowerBound time.Time) (err error) {
+	estimator, _ := GetA1CEstimator(A1C_SCORING_VERSION)
+	return runA1CChunk(context, repository, jobQueue, estimator, A1C_BATCH_CALCULATION_FUNCTION_NAME, userEmail, lowerBound)
 }
 
-func RunA1CBatchCalculation(context context.Context, userEmail string, lowerBound time.Time) {
-	glukitUser, _, _, err := store.GetUserData(context, userEmail)
+// RunA1CRecalculation estimates a chunk of a1cs of the given version starting at the lowerBound and enqueues the next chunk, like
+// RunA1CBatchCalculation. Estimates of other versions are kept.
+func RunA1CRecalculation(context context.Context, repository store.Repository, jobQueue queue.Queue, version int, userEmail string, lowerBound time.Time) (err error) {
+	estimator, ok := GetA1CEstimator(version)
+	if !ok {
+		return errors.New(fmt.Sprintf("No a1c estimator registered for version [%d]", version))
+	}
+
+	return runA1CChunk(context, repository, jobQueue, estimator, A1CRecalculationJobName(version), userEmail, lowerBound)
+}
+
+// runA1CChunk estimates a chunk of a1cs with the estimator and enqueues the next chunk under the job name. The most recent a1c
+// of the user is only updated with estimates of the current A1C_SCORING_VERSION.
+func runA1CChunk(context context.Context, repository store.Repository, jobQueue queue.Queue, estimator A1CEstimator, jobName string, userEmail string, lowerBound time.Time) (err error) {
+	glukitUser, _, err := repository.GetUserData(context, userEmail)
 	if _, ok := err.(store.StoreError); err != nil && !ok {
 		log.Errorf(context, "We're trying to run a batch of a1c estimates for user [%s] that doesn't exist. "+
 			"Got error: %v", userEmail, err)
-		return
+		return err
 	}
 
 	mostRecentA1C := glukitUser.MostRecentA1C
@@ -119,26 +168,39 @@ func RunA1CBatchCalculation(context context.Context, userEmail string, lowerBoun
 	// Calculate the GlukitScore for every period until now by increment of 1 day. This is a moving estimate over the last A1C_ESTIMATION_SCORE_PERIOD that gets a new value every day.
 	// This will likely go through a few calculations for which we don't have data yet but this seems like the fair
 	// price to pay for making sure we don't stop processing estimates because someone might have stopped using their CGM for a week or so.
+	// All periods of the chunk are estimated in a single pass over their reads.
+	endsOfPeriods := make([]time.Time, 0)
 	for periodUpperBound = lowerBound.AddDate(0, 0, 1); periodUpperBound.Before(time.Now()) && periodUpperBound.Before(upperBound); periodUpperBound = periodUpperBound.AddDate(0, 0, 1) {
-		a1cEstimate, err := EstimateA1C(context, glukitUser, periodUpperBound)
-		if err != nil {
-			log.Warningf(context, "Error trying to calculate a1c for user [%s] with upper bound [%s]: %v", userEmail, periodUpperBound, err)
-		} else {
-			a1cBatch = append(a1cBatch, *a1cEstimate)
-			if periodUpperBound.After(mostRecentA1C.UpperBound) {
-				mostRecentA1C = *a1cEstimate
-			}
+		endsOfPeriods = append(endsOfPeriods, periodUpperBound)
+	}
+
+	a1cEstimates, err := estimator.Estimate(context, repository, glukitUser, endsOfPeriods)
+	if err != nil {
+		log.Warningf(context, "Error trying to calculate a1cs for user [%s] from [%s]: %v", userEmail, lowerBound, err)
+		return err
+	}
+
+	for i, a1cEstimate := range a1cEstimates {
+		if a1cEstimate == nil {
+			continue
+		}
+
+		a1cBatch = append(a1cBatch, *a1cEstimate)
+		if estimator.Version() == A1C_SCORING_VERSION && endsOfPeriods[i].After(mostRecentA1C.UpperBound) {
+			mostRecentA1C = *a1cEstimate
 		}
 	}
 
 	// Store the batch
-	store.StoreA1CBatch(context, userEmail, a1cBatch)
+	if err = repository.StoreA1CBatch(context, userEmail, a1cBatch); err != nil {
+		return err
+	}
 
 	if mostRecentA1C != glukitUser.MostRecentA1C {
 		glukitUser.MostRecentA1C = mostRecentA1C
 
-		if _, err := store.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
-			util.Propagate(err)
+		if err := repository.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
+			return err
 		} else {
 			log.Debugf(context, "Updated glukit user [%s] with a most recent a1c [%v]",
 				glukitUser.Email, mostRecentA1C)
@@ -147,15 +209,132 @@ func RunA1CBatchCalculation(context context.Context, userEmail string, lowerBoun
 
 	// Kick off the next chunk of glukit score calculation
 	if !periodUpperBound.Before(upperBound) {
-		task, err := RunA1CCalculationChunk.Task(userEmail, periodUpperBound)
+		err := jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: jobName, UserEmail: userEmail, LowerBound: periodUpperBound})
 		if err != nil {
-			log.Criticalf(context, "Couldn't schedule the next execution of [%s] for user [%s]. "+
-				"This breaks batch calculation of glukit scores for that user!: %v", A1C_BATCH_CALCULATION_FUNCTION_NAME, userEmail, err)
+			log.Errorf(context, "Couldn't schedule the next execution of [%s] for user [%s], the chunk will be retried: %v",
+				jobName, userEmail, err)
+			return err
 		}
-		taskqueue.Add(context, task, BATCH_CALCULATION_QUEUE_NAME)
 
-		log.Infof(context, "Queued up next chunk of a1c calculation for user [%s] and lowerBound [%s]", userEmail, periodUpperBound.Format(util.TIMEFORMAT))
+		log.Infof(context, "Queued up next chunk of a1c calculation of version [%d] for user [%s] and lowerBound [%s]", estimator.Version(),
+			userEmail, periodUpperBound.Format(util.TIMEFORMAT))
 	} else {
-		log.Infof(context, "Done with a1c estimation for user [%s]", userEmail)
+		log.Infof(context, "Done with a1c estimation of version [%d] for user [%s]", estimator.Version(), userEmail)
+	}
+
+	return nil
+}
+
+// RunGlycemicEpisodeDetection detects the episodes of a chunk of EPISODE_DETECTION_PERIOD of reads starting at the lowerBound, using the
+// thresholds of the user's targets, replaces the previously detected ones and enqueues the next chunk until it reaches the present. If an
+// episode was still going on at the start of the chunk, it's detected again from its start. An error means the chunk should be retried.
+func RunGlycemicEpisodeDetection(context context.Context, repository store.Repository, jobQueue queue.Queue, userEmail string, lowerBound time.Time) (err error) {
+	upperBound := lowerBound.Add(EPISODE_DETECTION_PERIOD)
+	from := lowerBound.Add(-1 * EPISODE_DETECTION_LOOKBACK)
+
+	limit := 1
+	previous, err := repository.GetGlycemicEpisodes(context, userEmail, store.ScoreScanQuery{Limit: &limit, To: &from})
+	if err != nil {
+		return err
 	}
+
+	if len(previous) > 0 && previous[0].End.Add(EPISODE_MAX_READ_GAP).After(from) {
+		from = previous[0].Start
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, userEmail)
+	if err != nil {
+		return err
+	}
+
+	reads, err := repository.GetGlucoseReads(context, userEmail, from, upperBound)
+	if err != nil {
+		return err
+	}
+
+	episodes, err := DetectGlycemicEpisodes(reads, glukitUser.GetTargets().Thresholds)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf(context, "Detected [%d] episodes from [%d] reads for user [%s] between [%s] and [%s]", len(episodes), len(reads), userEmail,
+		from.Format(util.TIMEFORMAT), upperBound.Format(util.TIMEFORMAT))
+	if err = repository.ReplaceGlycemicEpisodes(context, userEmail, from, upperBound, episodes); err != nil {
+		return err
+	}
+
+	if upperBound.Before(time.Now()) {
+		err := jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: EPISODE_DETECTION_FUNCTION_NAME, UserEmail: userEmail, LowerBound: upperBound})
+		if err != nil {
+			log.Errorf(context, "Couldn't schedule the next execution of [%s] for user [%s], the chunk will be retried: %v",
+				EPISODE_DETECTION_FUNCTION_NAME, userEmail, err)
+			return err
+		}
+
+		log.Infof(context, "Queued up next chunk of episode detection for user [%s] and lowerBound [%s]", userEmail, upperBound.Format(util.TIMEFORMAT))
+	} else {
+		log.Infof(context, "Done with episode detection for user [%s]", userEmail)
+	}
+
+	return nil
+}
+
+// RunInsulinRatioBatchCalculation estimates the insulin ratios every INSULIN_RATIO_INTERVAL days after the lowerBound, for up to PERIODS_PER_BATCH
+// estimates, and enqueues the next chunk until it reaches the present. Each estimate is calculated from the INSULIN_RATIO_PERIOD days leading to its
+// upper bound. An error means the chunk should be retried. Since ratios are stored by upper bound, running a chunk again is harmless.
+func RunInsulinRatioBatchCalculation(context context.Context, repository store.Repository, jobQueue queue.Queue, userEmail string, lowerBound time.Time) (err error) {
+	ratiosBatch := make([]model.InsulinRatios, 0)
+	periodUpperBound := lowerBound.AddDate(0, 0, INSULIN_RATIO_INTERVAL)
+
+	log.Debugf(context, "Calculating batch of insulin ratios for user [%s]", userEmail)
+	for ; periodUpperBound.Before(time.Now()) && len(ratiosBatch) < PERIODS_PER_BATCH; periodUpperBound = periodUpperBound.AddDate(0, 0, INSULIN_RATIO_INTERVAL) {
+		periodLowerBound := periodUpperBound.AddDate(0, 0, -1*INSULIN_RATIO_PERIOD)
+
+		// Samples need to be isolated from what happened before them and their effect is observed after them
+		dataLowerBound := periodLowerBound.Add(-1 * INSULIN_RATIO_OBSERVATION_PERIOD)
+		dataUpperBound := periodUpperBound.Add(INSULIN_RATIO_OBSERVATION_PERIOD)
+		reads, err := repository.GetGlucoseReads(context, userEmail, dataLowerBound, dataUpperBound)
+		if err != nil {
+			return err
+		}
+
+		injections, err := repository.GetInjections(context, userEmail, dataLowerBound, dataUpperBound)
+		if err != nil {
+			return err
+		}
+
+		meals, err := repository.GetMeals(context, userEmail, dataLowerBound, dataUpperBound)
+		if err != nil {
+			return err
+		}
+
+		ratios, err := EstimateInsulinRatios(reads, injections, meals, periodLowerBound, periodUpperBound)
+		if err != nil {
+			return err
+		}
+
+		ratiosBatch = append(ratiosBatch, *ratios)
+	}
+
+	if err = repository.StoreInsulinRatios(context, userEmail, ratiosBatch); err != nil {
+		return err
+	}
+
+	// Kick off the next chunk of insulin ratio estimation
+	if periodUpperBound.Before(time.Now()) {
+		nextLowerBound := periodUpperBound.AddDate(0, 0, -1*INSULIN_RATIO_INTERVAL)
+		err := jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME, UserEmail: userEmail,
+			LowerBound: nextLowerBound})
+		if err != nil {
+			log.Errorf(context, "Couldn't schedule the next execution of [%s] for user [%s], the chunk will be retried: %v",
+				INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME, userEmail, err)
+			return err
+		}
+
+		log.Infof(context, "Queued up next chunk of insulin ratio estimation for user [%s] and lowerBound [%s]", userEmail, nextLowerBound.Format(util.TIMEFORMAT))
+	} else {
+		log.Infof(context, "Done with insulin ratio estimation for user [%s]", userEmail)
+	}
+
+	return nil
 }
@@ -4,21 +4,17 @@ package engine
 
 import (
 	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
 	"math"
 	"time"
 )
 
 const (
-	// The multiplier applied to any deviation from the target, on the low spectrum (i.e. anything less than 83)
-	LOW_MULTIPLIER = 1
-	// The multiplier applied to any deviation from the target, on the high spectrum (i.e. anything above 83)
-	HIGH_MULTIPLIER = 2
 	// Glukit score calculation period
 	GLUKIT_SCORE_PERIOD = 7
 	// One period of reads minus on day for potential data gaps
@@ -32,58 +28,85 @@ const (
 // January 1st, 2014
 var A1C_CALCULATION_START = time.Unix(1388534400, 0)
 
-// CalculateGlukitScore computes the GlukitScore for a given user. This is done in a few steps:
-//   1. Get the latest GLUKIT_SCORE_PERIOD days of reads
-//   2. For the most recent reads up to READS_REQUIREMENT, calculate the individual score
-//      contribution and add it to the GlukitScore.
-//   3. If we had enough reads to satisfy the requirements, we return the sum of
-//      all individual score contributions.
-func CalculateGlukitScore(context context.Context, glukitUser *model.GlukitUser, endOfPeriod time.Time) (glukitScore *model.GlukitScore, err error) {
-	// Get the last period's worth of reads
-	upperBound := util.GetMidnightUTCBefore(endOfPeriod)
-	lowerBound := upperBound.AddDate(0, 0, -1*GLUKIT_SCORE_PERIOD)
-	score := model.UNDEFINED_SCORE_VALUE
-
-	log.Debugf(context, "Getting reads for glukit score calculation from [%s] to [%s]", lowerBound, upperBound)
-	if reads, err := store.GetGlucoseReads(context, glukitUser.Email, lowerBound, upperBound); err != nil {
-		return &model.UNDEFINED_SCORE, err
-	} else {
-		// We might want to do some interpolation of missing reads at some point but for now, we'll only use
-		// actual values. Since we know we'll have gaps in a 2 weeks window because of sensor warm-ups, let's
-		// just normalize by stopping after the equivalent of full 14 days of reads (assuming most people won't have
-		// more than 2 days worth of missing data)
-		readCount := 0
-		score = 0
-
-		for i := 0; i < len(reads) && i < READS_REQUIREMENT; i++ {
-			score = score + int64(CalculateIndividualReadScoreWeight(context, reads[i]))
-			readCount = readCount + 1
+// CalculateGlukitScores computes the GlukitScores of a user for the periods ending before each of the endsOfPeriods, which must
+// be sorted. The reads of all periods are loaded at once and the window of reads slides from one period to the next:
+//   1. Reads before the period leave the window and reads up to the end of the period enter it.
+//   2. A running sum keeps the individual score contributions of the first reads of the window, up to READS_REQUIREMENT,
+//      calculated against the user's scoring target.
+//   3. If we had enough reads to satisfy the requirements, the GlukitScore of the period is the running sum. It's the
+//      UNDEFINED_SCORE otherwise.
+func CalculateGlukitScores(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (glukitScores []model.GlukitScore, err error) {
+	glukitScores = make([]model.GlukitScore, len(endsOfPeriods))
+	if len(endsOfPeriods) == 0 {
+		return glukitScores, nil
+	}
+
+	target := glukitUser.GetTargets().Scoring
+	lowerBound := util.GetMidnightUTCBefore(endsOfPeriods[0]).AddDate(0, 0, -1*GLUKIT_SCORE_PERIOD)
+	upperBound := util.GetMidnightUTCBefore(endsOfPeriods[len(endsOfPeriods)-1])
+
+	log.Debugf(context, "Getting reads for glukit score calculation of [%d] periods from [%s] to [%s]", len(endsOfPeriods), lowerBound, upperBound)
+	reads, err := repository.GetGlucoseReads(context, glukitUser.Email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	// We might want to do some interpolation of missing reads at some point but for now, we'll only use
+	// actual values. Since we know we'll have gaps in a 2 weeks window because of sensor warm-ups, let's
+	// just normalize by stopping after the equivalent of full 14 days of reads (assuming most people won't have
+	// more than 2 days worth of missing data)
+	contributions := make([]int64, len(reads))
+	for i := range reads {
+		contributions[i] = int64(CalculateIndividualReadScoreWeight(context, reads[i], target))
+	}
+
+	// The window of the period is reads[start:end] and the running sum is the one of the contributions of reads[start:scored]
+	start, scored, end := 0, 0, 0
+	score := int64(0)
+	for i, endOfPeriod := range endsOfPeriods {
+		periodUpperBound := util.GetMidnightUTCBefore(endOfPeriod)
+		periodLowerBound := periodUpperBound.AddDate(0, 0, -1*GLUKIT_SCORE_PERIOD)
+
+		for end < len(reads) && !reads[end].GetTime().After(periodUpperBound) {
+			end = end + 1
 		}
 
-		log.Infof(context, "Readcount of [%d] used for glukit score calculation of [%d]", readCount, score)
-		if readCount < READS_REQUIREMENT {
-			log.Infof(context, "Received only [%d] but required [%d] to calculate valid GlukitScore", readCount, READS_REQUIREMENT)
-			return &model.UNDEFINED_SCORE, nil
+		for start < end && reads[start].GetTime().Before(periodLowerBound) {
+			if start < scored {
+				score = score - contributions[start]
+			} else {
+				scored = start + 1
+			}
+			start = start + 1
 		}
-	}
 
-	if score == model.UNDEFINED_SCORE_VALUE {
-		glukitScore = &model.UNDEFINED_SCORE
-	} else {
-		glukitScore = &model.GlukitScore{
-			Value:          score,
-			LowerBound:     lowerBound,
-			UpperBound:     upperBound,
-			CalculatedOn:   time.Now(),
-			ScoringVersion: SCORING_VERSION}
+		for scored < end && scored-start < READS_REQUIREMENT {
+			score = score + contributions[scored]
+			scored = scored + 1
+		}
+
+		if readCount := scored - start; readCount < READS_REQUIREMENT {
+			log.Debugf(context, "Received only [%d] but required [%d] to calculate valid GlukitScore for period ending at [%s]", readCount,
+				READS_REQUIREMENT, periodUpperBound)
+			glukitScores[i] = model.UNDEFINED_SCORE
+		} else {
+			glukitScores[i] = model.GlukitScore{
+				Value:          score,
+				LowerBound:     periodLowerBound,
+				UpperBound:     periodUpperBound,
+				CalculatedOn:   time.Now(),
+				ScoringVersion: SCORING_VERSION,
+				Target:         target}
+		}
 	}
 
-	return glukitScore, nil
+	log.Infof(context, "Calculated [%d] glukit scores from [%d] reads", len(glukitScores), len(reads))
+	return glukitScores, nil
 }
 
-// An individual score is either 0 if it's straight on perfection (83) or it's the deviation from 83 weighted
-// by whether it's high (multiplier of 2) or lower (multiplier of 1)
-func CalculateIndividualReadScoreWeight(context context.Context, read apimodel.GlucoseRead) (weightedScoreContribution float64) {
+// An individual score is either 0 if it's straight on the target or it's the deviation from the target weighted
+// by whether it's high or low (by default, a multiplier of 2 for highs and 1 for lows)
+func CalculateIndividualReadScoreWeight(context context.Context, read apimodel.GlucoseRead, target model.ScoringTarget) (weightedScoreContribution float64) {
 	weightedScoreContribution = 0.
 	convertedValue, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
 	if err != nil {
@@ -91,10 +114,10 @@ func CalculateIndividualReadScoreWeight(context context.Context, read apimodel.G
 	}
 	value := float64(convertedValue)
 
-	if value > model.TARGET_GLUCOSE_VALUE {
-		weightedScoreContribution = (value - model.TARGET_GLUCOSE_VALUE) * HIGH_MULTIPLIER
-	} else if value < model.TARGET_GLUCOSE_VALUE {
-		weightedScoreContribution = -(value - model.TARGET_GLUCOSE_VALUE) * LOW_MULTIPLIER
+	if value > target.Value {
+		weightedScoreContribution = (value - target.Value) * target.HighMultiplier
+	} else if value < target.Value {
+		weightedScoreContribution = -(value - target.Value) * target.LowMultiplier
 	}
 
 	return weightedScoreContribution
@@ -113,7 +136,7 @@ func CalculateUserFacingScore(internal model.GlukitScore) (external *int64) {
 }
 
 // StartGlukitScoreBatch tries to calculate glukit scores for any week following the most recent calculated score
-func StartGlukitScoreBatch(context context.Context, glukitUser *model.GlukitUser) (err error) {
+func StartGlukitScoreBatch(context context.Context, jobQueue queue.Queue, glukitUser *model.GlukitUser) (err error) {
 	lowerBoundOfLastScore := glukitUser.MostRecentScore.LowerBound
 
 	// Calculate our minimum allowed lower bound since we don't want to incur the cost of too many reads when
@@ -128,12 +151,14 @@ func StartGlukitScoreBatch(context context.Context, glukitUser *model.GlukitUser
 	}
 
 	// Kick off the first chunk of glukit score calculation
-	task, err := RunGlukitScoreCalculationChunk.Task(glukitUser.Email, lowerBound)
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, UserEmail: glukitUser.Email, LowerBound: lowerBound})
 	if err != nil {
 		log.Criticalf(context, "Couldn't schedule the next execution of [%s] for user [%s]. "+
 			"This breaks batch calculation of glukit scores for that user!: %v", GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, glukitUser.Email, err)
+
+		return err
 	}
-	taskqueue.Add(context, task, BATCH_CALCULATION_QUEUE_NAME)
+
 	log.Infof(context, "Queued up first chunk of glukit score calculation for user [%s] and lowerBound [%s]", glukitUser.Email, lowerBound.Format(util.TIMEFORMAT))
 
 	return nil
@@ -141,7 +166,7 @@ func StartGlukitScoreBatch(context context.Context, glukitUser *model.GlukitUser
 
 // StartA1CCalculationBatch tries to calculate a1c estimates for any week following the most recent calculated glukit score (a hack, we should have the most recent
 // a1c calculation date)
-func StartA1CCalculationBatch(context context.Context, glukitUser *model.GlukitUser) (err error) {
+func StartA1CCalculationBatch(context context.Context, jobQueue queue.Queue, glukitUser *model.GlukitUser) (err error) {
 	lowerBoundOfLastA1C := glukitUser.MostRecentA1C.LowerBound
 
 	// Uninitialized, default to January 1st, 2014
@@ -161,13 +186,61 @@ func StartA1CCalculationBatch(context context.Context, glukitUser *model.GlukitU
 	}
 
 	// Kick off the first chunk of glukit score calculation
-	task, err := RunA1CCalculationChunk.Task(glukitUser.Email, lowerBound)
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: A1C_BATCH_CALCULATION_FUNCTION_NAME, UserEmail: glukitUser.Email, LowerBound: lowerBound})
 	if err != nil {
 		log.Criticalf(context, "Couldn't schedule the next execution of [%s] for user [%s]. "+
 			"This breaks batch calculation of a1c estimates scores for that user!: %v", A1C_BATCH_CALCULATION_FUNCTION_NAME, glukitUser.Email, err)
+
+		return err
 	}
-	taskqueue.Add(context, task, BATCH_CALCULATION_QUEUE_NAME)
+
 	log.Infof(context, "Queued up first chunk of a1c calculation for user [%s] and lowerBound [%s]", glukitUser.Email, lowerBound.Format(util.TIMEFORMAT))
 
 	return nil
 }
+
+// StartGlycemicEpisodeDetection queues the detection of episodes for reads from the given lower bound onwards, typically the time
+// of the earliest new read
+func StartGlycemicEpisodeDetection(context context.Context, jobQueue queue.Queue, email string, lowerBound time.Time) (err error) {
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: EPISODE_DETECTION_FUNCTION_NAME, UserEmail: email, LowerBound: lowerBound})
+	if err != nil {
+		log.Criticalf(context, "Couldn't schedule the execution of [%s] for user [%s]: %v", EPISODE_DETECTION_FUNCTION_NAME, email, err)
+		return err
+	}
+
+	log.Infof(context, "Queued up first chunk of episode detection for user [%s] and lowerBound [%s]", email, lowerBound.Format(util.TIMEFORMAT))
+
+	return nil
+}
+
+// StartInsulinRatioBatch queues the estimation of insulin ratios following the most recent estimate. Estimates of older calculation
+// versions are recalculated, up to MAX_CALCULATION_DAYS_TO_LOOK_BACK days back.
+func StartInsulinRatioBatch(context context.Context, repository store.InsulinRatioRepository, jobQueue queue.Queue, email string) (err error) {
+	minLowerBound := util.GetMidnightUTCBefore(time.Now()).AddDate(0, 0, -1*MAX_CALCULATION_DAYS_TO_LOOK_BACK)
+	lowerBound := minLowerBound
+
+	limit := 1
+	mostRecent, err := repository.GetInsulinRatios(context, email, store.ScoreScanQuery{Limit: &limit})
+	if err != nil {
+		return err
+	}
+
+	if len(mostRecent) > 0 && mostRecent[0].CalculationVersion == INSULIN_RATIO_CALCULATION_VERSION && mostRecent[0].UpperBound.After(minLowerBound) {
+		lowerBound = mostRecent[0].UpperBound
+	}
+
+	if !lowerBound.AddDate(0, 0, INSULIN_RATIO_INTERVAL).Before(time.Now()) {
+		log.Debugf(context, "Insulin ratios of user [%s] are up to date", email)
+		return nil
+	}
+
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME, UserEmail: email, LowerBound: lowerBound})
+	if err != nil {
+		log.Criticalf(context, "Couldn't schedule the execution of [%s] for user [%s]: %v", INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME, email, err)
+		return err
+	}
+
+	log.Infof(context, "Queued up first chunk of insulin ratio estimation for user [%s] and lowerBound [%s]", email, lowerBound.Format(util.TIMEFORMAT))
+
+	return nil
+}
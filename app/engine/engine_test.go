@@ -0,0 +1,32 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"testing"
+	"time"
+)
+
+func TestCalculateIndividualReadScoreWeight(t *testing.T) {
+	readTime := apimodel.Time{Timestamp: apimodel.GetTimeMillis(time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)), TimeZoneId: "UTC"}
+	olderAdults := model.GLUCOSE_TARGETS_PRESETS[model.TARGETS_PROFILE_OLDER_ADULTS].Scoring
+	for _, c := range []struct {
+		value    float32
+		target   model.ScoringTarget
+		expected float64
+	}{
+		{83, model.DEFAULT_SCORING_TARGET, 0},
+		{93, model.DEFAULT_SCORING_TARGET, 20},
+		{73, model.DEFAULT_SCORING_TARGET, 10},
+		{130, olderAdults, 10},
+		{110, olderAdults, 20},
+	} {
+		read := apimodel.GlucoseRead{Time: readTime, Unit: apimodel.MG_PER_DL, Value: c.value}
+		if weight := engine.CalculateIndividualReadScoreWeight(context.Background(), read, c.target); weight != c.expected {
+			t.Errorf("TestCalculateIndividualReadScoreWeight failed: got [%f] for [%f] against [%v] but expected [%f]", weight, c.value,
+				c.target, c.expected)
+		}
+	}
+}
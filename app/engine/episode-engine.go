@@ -0,0 +1,244 @@
+package engine
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"sort"
+	"time"
+)
+
+const (
+	// How long glucose has to stay out of range for an episode to start and how long it has to stay below VeryLow or
+	// above VeryHigh for the episode to be level 2
+	EPISODE_MIN_DURATION = time.Duration(15) * time.Minute
+	// How long glucose has to stay back in range for an episode to end
+	EPISODE_RECOVERY_DURATION = time.Duration(15) * time.Minute
+	// Highs lasting at least this long are prolonged
+	PROLONGED_HIGH_DURATION = time.Duration(2) * time.Hour
+	// Reads further apart than this end any episode in progress since we can't know what happened in between
+	EPISODE_MAX_READ_GAP = time.Duration(30) * time.Minute
+	// Lows starting between midnight and this hour, in the local time of the read, are nocturnal
+	NOCTURNAL_END_HOUR = 6
+)
+
+// episodeRead is a glucose read in mg/dL with its local time
+type episodeRead struct {
+	time  time.Time
+	value float64
+}
+
+// episodeDetector defines a type of episode by the values that are out of range (level 1) and severely out of range (level 2)
+type episodeDetector struct {
+	episodeType string
+	isOut       func(value float64) bool
+	isSevere    func(value float64) bool
+}
+
+// episodeCandidate is an episode in progress
+type episodeCandidate struct {
+	episode model.GlycemicEpisode
+	// The start of the current run of reads back in range or the zero time if glucose is still out of range
+	recoveryStart time.Time
+	// The start of the current run of severe reads or the zero time if the last read wasn't severe
+	severeStart time.Time
+	lastRead    time.Time
+}
+
+// DetectGlycemicEpisodes returns the low and high episodes found in the reads, sorted by start time. The reads don't need to be
+// sorted. An episode starts when glucose goes below the Low threshold (or above the High threshold) for at least EPISODE_MIN_DURATION
+// and ends when it's back in range for at least EPISODE_RECOVERY_DURATION. An episode still going on at the last read or at a gap
+// in the reads is returned as not recovered.
+func DetectGlycemicEpisodes(reads []apimodel.GlucoseRead, thresholds model.GlucoseThresholds) (episodes []model.GlycemicEpisode, err error) {
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values := make([]episodeRead, len(sortedReads))
+	for i, read := range sortedReads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = episodeRead{read.GetTime(), float64(value)}
+	}
+
+	lows := episodeDetector{model.EPISODE_TYPE_LOW, func(value float64) bool {
+		return value < thresholds.Low
+	}, func(value float64) bool {
+		return value < thresholds.VeryLow
+	}}
+	highs := episodeDetector{model.EPISODE_TYPE_HIGH, func(value float64) bool {
+		return value > thresholds.High
+	}, func(value float64) bool {
+		return value > thresholds.VeryHigh
+	}}
+
+	episodes = append(lows.detect(values), highs.detect(values)...)
+	sort.Sort(glycemicEpisodesByStart(episodes))
+
+	return episodes, nil
+}
+
+// detect runs the detection of a type of episodes over sorted reads
+func (detector episodeDetector) detect(values []episodeRead) (episodes []model.GlycemicEpisode) {
+	episodes = make([]model.GlycemicEpisode, 0)
+
+	var candidate *episodeCandidate
+	for _, read := range values {
+		if candidate != nil && read.time.Sub(candidate.lastRead) > EPISODE_MAX_READ_GAP {
+			// If glucose was already back in range before the gap, we consider the episode over
+			if !candidate.recoveryStart.IsZero() {
+				episodes = detector.finish(episodes, candidate, candidate.recoveryStart, true)
+			} else {
+				episodes = detector.finish(episodes, candidate, candidate.lastRead, false)
+			}
+			candidate = nil
+		}
+
+		if detector.isOut(read.value) {
+			if candidate == nil {
+				candidate = &episodeCandidate{episode: model.GlycemicEpisode{Type: detector.episodeType, Level: model.EPISODE_LEVEL_1,
+					Start: read.time, ExtremeValue: read.value, ExtremeTime: read.time}}
+			}
+
+			candidate.recoveryStart = time.Time{}
+			if detector.isMoreExtreme(read.value, candidate.episode.ExtremeValue) {
+				candidate.episode.ExtremeValue = read.value
+				candidate.episode.ExtremeTime = read.time
+			}
+		} else if candidate != nil && candidate.recoveryStart.IsZero() {
+			candidate.recoveryStart = read.time
+		}
+
+		if candidate == nil {
+			continue
+		}
+
+		if detector.isSevere(read.value) {
+			if candidate.severeStart.IsZero() {
+				candidate.severeStart = read.time
+			}
+		} else {
+			candidate.endSevereRun(read.time)
+		}
+		candidate.lastRead = read.time
+
+		if !candidate.recoveryStart.IsZero() && read.time.Sub(candidate.recoveryStart) >= EPISODE_RECOVERY_DURATION {
+			episodes = detector.finish(episodes, candidate, candidate.recoveryStart, true)
+			candidate = nil
+		}
+	}
+
+	if candidate != nil {
+		episodes = detector.finish(episodes, candidate, candidate.lastRead, false)
+	}
+
+	return episodes
+}
+
+// isMoreExtreme returns true if the value is further out of range than the current nadir or peak
+func (detector episodeDetector) isMoreExtreme(value float64, extreme float64) bool {
+	if detector.episodeType == model.EPISODE_TYPE_LOW {
+		return value < extreme
+	}
+
+	return value > extreme
+}
+
+// finish ends a candidate episode and appends it to the episodes if it lasted long enough
+func (detector episodeDetector) finish(episodes []model.GlycemicEpisode, candidate *episodeCandidate, end time.Time, recovered bool) []model.GlycemicEpisode {
+	candidate.endSevereRun(end)
+
+	episode := candidate.episode
+	duration := end.Sub(episode.Start)
+	if duration < EPISODE_MIN_DURATION {
+		return episodes
+	}
+
+	episode.End = end
+	episode.DurationMinutes = duration.Minutes()
+	episode.Recovered = recovered
+	if recovered {
+		episode.RecoveryMinutes = end.Sub(episode.ExtremeTime).Minutes()
+	}
+
+	if episode.Type == model.EPISODE_TYPE_LOW {
+		episode.Nocturnal = episode.Start.Hour() < NOCTURNAL_END_HOUR
+	} else {
+		episode.Prolonged = duration >= PROLONGED_HIGH_DURATION
+	}
+
+	return append(episodes, episode)
+}
+
+// endSevereRun ends the current run of severe reads, if any, and makes the episode level 2 if the run lasted long enough
+func (candidate *episodeCandidate) endSevereRun(end time.Time) {
+	if !candidate.severeStart.IsZero() && end.Sub(candidate.severeStart) >= EPISODE_MIN_DURATION {
+		candidate.episode.Level = model.EPISODE_LEVEL_2
+	}
+
+	candidate.severeStart = time.Time{}
+}
+
+// CountEpisodesPerWeek counts the episodes of each kind for every week between the lower and upper bounds. Weeks start on Monday
+// at midnight UTC and are sorted chronologically, including the ones without any episodes.
+func CountEpisodesPerWeek(episodes []model.GlycemicEpisode, lowerBound time.Time, upperBound time.Time) (counts []model.WeeklyEpisodeCounts) {
+	counts = make([]model.WeeklyEpisodeCounts, 0)
+	indexes := make(map[time.Time]int)
+	for weekStart := startOfWeek(lowerBound); !weekStart.After(upperBound); weekStart = weekStart.AddDate(0, 0, 7) {
+		indexes[weekStart] = len(counts)
+		counts = append(counts, model.WeeklyEpisodeCounts{WeekStart: weekStart})
+	}
+
+	for _, episode := range episodes {
+		i, ok := indexes[startOfWeek(episode.Start)]
+		if !ok {
+			continue
+		}
+
+		weekCounts := &counts[i]
+		if episode.Type == model.EPISODE_TYPE_LOW {
+			weekCounts.Lows = weekCounts.Lows + 1
+			if episode.Level == model.EPISODE_LEVEL_2 {
+				weekCounts.Level2Lows = weekCounts.Level2Lows + 1
+			}
+			if episode.Nocturnal {
+				weekCounts.NocturnalLows = weekCounts.NocturnalLows + 1
+			}
+		} else {
+			weekCounts.Highs = weekCounts.Highs + 1
+			if episode.Level == model.EPISODE_LEVEL_2 {
+				weekCounts.Level2Highs = weekCounts.Level2Highs + 1
+			}
+			if episode.Prolonged {
+				weekCounts.ProlongedHighs = weekCounts.ProlongedHighs + 1
+			}
+		}
+	}
+
+	return counts
+}
+
+// startOfWeek returns the Monday at midnight UTC of the week of the given time
+func startOfWeek(value time.Time) time.Time {
+	utc := value.UTC()
+	midnight := time.Date(utc.Year(), utc.Month(), utc.Day(), 0, 0, 0, 0, time.UTC)
+
+	return midnight.AddDate(0, 0, -1*((int(midnight.Weekday())+6)%7))
+}
+
+// glycemicEpisodesByStart sorts episodes chronologically
+type glycemicEpisodesByStart []model.GlycemicEpisode
+
+func (slice glycemicEpisodesByStart) Len() int {
+	return len(slice)
+}
+
+func (slice glycemicEpisodesByStart) Less(i, j int) bool {
+	return slice[i].Start.Before(slice[j].Start)
+}
+
+func (slice glycemicEpisodesByStart) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
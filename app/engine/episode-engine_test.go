@@ -0,0 +1,120 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"testing"
+	"time"
+)
+
+// makeEpisodeReads creates 5 minute reads starting at the given time with the given values
+func makeEpisodeReads(start time.Time, values ...float32) []apimodel.GlucoseRead {
+	reads := make([]apimodel.GlucoseRead, len(values))
+	for i, value := range values {
+		readTime := start.Add(time.Duration(i*5) * time.Minute)
+		reads[i] = apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(readTime), TimeZoneId: "UTC"},
+			Unit: apimodel.MG_PER_DL, Value: value}
+	}
+
+	return reads
+}
+
+func TestDetectNocturnalLevel2Low(t *testing.T) {
+	start := time.Date(2014, time.April, 18, 2, 0, 0, 0, time.UTC)
+	reads := makeEpisodeReads(start, 100, 100, 65, 60, 50, 50, 50, 52, 60, 80, 90, 100, 100, 100)
+
+	episodes, err := engine.DetectGlycemicEpisodes(reads, model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 1 {
+		t.Fatalf("TestDetectNocturnalLevel2Low failed: got [%d] episodes but expected [%d]", len(episodes), 1)
+	}
+
+	episode := episodes[0]
+	expected := model.GlycemicEpisode{Type: model.EPISODE_TYPE_LOW, Level: model.EPISODE_LEVEL_2, Nocturnal: true,
+		Start: start.Add(10 * time.Minute), End: start.Add(45 * time.Minute), ExtremeValue: 50, ExtremeTime: start.Add(20 * time.Minute),
+		DurationMinutes: 35, RecoveryMinutes: 25, Recovered: true}
+	if episode.Type != expected.Type || episode.Level != expected.Level || episode.Nocturnal != expected.Nocturnal || episode.Prolonged ||
+		!episode.Start.Equal(expected.Start) || !episode.End.Equal(expected.End) || episode.ExtremeValue != expected.ExtremeValue ||
+		!episode.ExtremeTime.Equal(expected.ExtremeTime) || episode.DurationMinutes != expected.DurationMinutes ||
+		episode.RecoveryMinutes != expected.RecoveryMinutes || episode.Recovered != expected.Recovered {
+		t.Errorf("TestDetectNocturnalLevel2Low failed: got [%v] but expected [%v]", episode, expected)
+	}
+}
+
+func TestDetectIgnoresShortExcursions(t *testing.T) {
+	start := time.Date(2014, time.April, 18, 12, 0, 0, 0, time.UTC)
+	// A dip of 10 minutes isn't a low and a 10 minute return in range doesn't end the high
+	reads := makeEpisodeReads(start, 100, 65, 65, 100, 100, 200, 200, 200, 200, 150, 150, 200, 200, 100, 100, 100, 100)
+
+	episodes, err := engine.DetectGlycemicEpisodes(reads, model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 1 {
+		t.Fatalf("TestDetectIgnoresShortExcursions failed: got [%d] episodes but expected [%d]", len(episodes), 1)
+	}
+
+	if episodes[0].Type != model.EPISODE_TYPE_HIGH || episodes[0].Level != model.EPISODE_LEVEL_1 || episodes[0].DurationMinutes != 40 {
+		t.Errorf("TestDetectIgnoresShortExcursions failed: got [%v] but expected a level 1 high of [%d] minutes", episodes[0], 40)
+	}
+}
+
+func TestDetectProlongedHighAndGaps(t *testing.T) {
+	start := time.Date(2014, time.April, 18, 14, 0, 0, 0, time.UTC)
+	values := make([]float32, 30)
+	for i := range values {
+		values[i] = 270
+	}
+
+	// A high of over 2 hours followed by a gap of an hour and another high still going on at the last read
+	reads := append(makeEpisodeReads(start, values...), makeEpisodeReads(start.Add(210*time.Minute), 200, 200, 200, 200, 200)...)
+
+	episodes, err := engine.DetectGlycemicEpisodes(reads, model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(episodes) != 2 {
+		t.Fatalf("TestDetectProlongedHighAndGaps failed: got [%d] episodes but expected [%d]", len(episodes), 2)
+	}
+
+	if !episodes[0].Prolonged || episodes[0].Recovered || episodes[0].Level != model.EPISODE_LEVEL_2 || episodes[0].DurationMinutes != 145 {
+		t.Errorf("TestDetectProlongedHighAndGaps failed: got [%v] but expected a prolonged level 2 high of [%d] minutes", episodes[0], 145)
+	}
+
+	if episodes[1].Prolonged || episodes[1].Recovered || !episodes[1].Start.Equal(start.Add(210*time.Minute)) {
+		t.Errorf("TestDetectProlongedHighAndGaps failed: got [%v] but expected an ongoing high starting at [%s]", episodes[1], start.Add(210*time.Minute))
+	}
+}
+
+func TestCountEpisodesPerWeek(t *testing.T) {
+	// April 14th, 2014 is a Monday
+	monday := time.Date(2014, time.April, 14, 0, 0, 0, 0, time.UTC)
+	episodes := []model.GlycemicEpisode{
+		model.GlycemicEpisode{Type: model.EPISODE_TYPE_LOW, Level: model.EPISODE_LEVEL_2, Nocturnal: true, Start: monday.Add(2 * time.Hour)},
+		model.GlycemicEpisode{Type: model.EPISODE_TYPE_HIGH, Level: model.EPISODE_LEVEL_1, Start: monday.AddDate(0, 0, 6).Add(23 * time.Hour)},
+		model.GlycemicEpisode{Type: model.EPISODE_TYPE_HIGH, Level: model.EPISODE_LEVEL_2, Prolonged: true, Start: monday.AddDate(0, 0, 14)},
+	}
+
+	counts := engine.CountEpisodesPerWeek(episodes, monday.AddDate(0, 0, 3), monday.AddDate(0, 0, 15))
+	expected := []model.WeeklyEpisodeCounts{
+		model.WeeklyEpisodeCounts{WeekStart: monday, Lows: 1, Level2Lows: 1, NocturnalLows: 1, Highs: 1},
+		model.WeeklyEpisodeCounts{WeekStart: monday.AddDate(0, 0, 7)},
+		model.WeeklyEpisodeCounts{WeekStart: monday.AddDate(0, 0, 14), Highs: 1, Level2Highs: 1, ProlongedHighs: 1},
+	}
+
+	if len(counts) != len(expected) {
+		t.Fatalf("TestCountEpisodesPerWeek failed: got [%d] weeks but expected [%d]", len(counts), len(expected))
+	}
+
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Errorf("TestCountEpisodesPerWeek failed: got [%v] for week [%d] but expected [%v]", counts[i], i, expected[i])
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package engine
+
+import (
+	"errors"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	FORECAST_TAG      = "Forecast"
+	FORECAST_LOW_TAG  = "ForecastLow"
+	FORECAST_HIGH_TAG = "ForecastHigh"
+	// The name of the autoregressive forecast model, which is also the model of the forecast shown with the data
+	AUTOREGRESSIVE_MODEL_NAME = "autoregressive"
+	// How far back reads are used to make a forecast
+	FORECAST_HISTORY = time.Duration(3) * time.Hour
+	// The interval reads are resampled at to make a forecast
+	FORECAST_STEP = time.Duration(5) * time.Minute
+	// The minimum number of steps of reads, without any gap, needed to make a forecast
+	FORECAST_MIN_STEPS = 12
+	// The number of previous changes of glucose each change depends on in the autoregressive model
+	AUTOREGRESSIVE_ORDER = 3
+	// The ridge penalty of the autoregressive fit. It's only there to keep the fit solvable when no insulin or carbs were
+	// absorbed during the history.
+	AUTOREGRESSIVE_RIDGE = 0.001
+	// The interval between two forecasts when backtesting a model
+	FORECAST_BACKTEST_INTERVAL = time.Duration(30) * time.Minute
+	// The days of history forecast models are backtested against when the request doesn't have a lower bound
+	FORECAST_BACKTEST_PERIOD_IN_DAYS = 14
+)
+
+// The horizons glucose is forecast at
+var FORECAST_HORIZONS = []time.Duration{time.Duration(30) * time.Minute, time.Duration(60) * time.Minute, time.Duration(90) * time.Minute}
+
+// ErrNotEnoughReadsToForecast is returned when there aren't enough recent reads, without gaps, to make a forecast
+var ErrNotEnoughReadsToForecast = errors.New("Not enough recent reads to make a forecast")
+
+// ForecastInput is the data a forecast is made from. The reads, injections and meals are sorted by time and none of them is
+// after the time of the forecast.
+type ForecastInput struct {
+	Time       time.Time
+	Reads      []apimodel.GlucoseRead
+	Injections []apimodel.Injection
+	Meals      []apimodel.Meal
+}
+
+// ForecastModel predicts glucose after the time of its input. Models other than the autoregressive one can be plugged in with
+// RegisterForecastModel.
+type ForecastModel interface {
+	// Name returns the name that identifies the model
+	Name() string
+	// Forecast returns a point for each of the horizons, in the same order. It returns ErrNotEnoughReadsToForecast when the
+	// input doesn't have enough recent reads.
+	Forecast(input ForecastInput, horizons []time.Duration) (forecast *model.Forecast, err error)
+}
+
+var forecastModels = make(map[string]ForecastModel)
+
+// RegisterForecastModel makes a forecast model available by its name, replacing any model registered with the same name
+func RegisterForecastModel(forecastModel ForecastModel) {
+	forecastModels[forecastModel.Name()] = forecastModel
+}
+
+// GetForecastModel returns the registered forecast model with the given name
+func GetForecastModel(name string) (forecastModel ForecastModel, ok bool) {
+	forecastModel, ok = forecastModels[name]
+	return forecastModel, ok
+}
+
+// GetForecastModels returns all registered forecast models sorted by name
+func GetForecastModels() (models []ForecastModel) {
+	names := make([]string, 0, len(forecastModels))
+	for name := range forecastModels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	models = make([]ForecastModel, len(names))
+	for i, name := range names {
+		models[i] = forecastModels[name]
+	}
+
+	return models
+}
+
+// NewForecastInput returns the input of a forecast made at the given time. The reads, injections and meals don't need to be sorted
+// and the ones after the time of the forecast are left out.
+func NewForecastInput(forecastTime time.Time, reads []apimodel.GlucoseRead, injections []apimodel.Injection, meals []apimodel.Meal) ForecastInput {
+	timestamp := apimodel.GetTimeMillis(forecastTime)
+
+	sortedReads := make(apimodel.GlucoseReadSlice, 0, len(reads))
+	for _, read := range reads {
+		if read.Time.Timestamp <= timestamp {
+			sortedReads = append(sortedReads, read)
+		}
+	}
+	sort.Sort(sortedReads)
+
+	sortedInjections := make(apimodel.InjectionSlice, 0, len(injections))
+	for _, injection := range injections {
+		if injection.Time.Timestamp <= timestamp {
+			sortedInjections = append(sortedInjections, injection)
+		}
+	}
+	sort.Sort(sortedInjections)
+
+	sortedMeals := make(apimodel.MealSlice, 0, len(meals))
+	for _, meal := range meals {
+		if meal.Time.Timestamp <= timestamp {
+			sortedMeals = append(sortedMeals, meal)
+		}
+	}
+	sort.Sort(sortedMeals)
+
+	return ForecastInput{Time: forecastTime, Reads: sortedReads, Injections: sortedInjections, Meals: sortedMeals}
+}
+
+// autoregressiveModel is the ForecastModel returned by NewAutoregressiveModel
+type autoregressiveModel struct {
+	settings model.OnBoardSettings
+}
+
+// NewAutoregressiveModel returns a forecast model that fits an autoregressive model of the changes of glucose over the FORECAST_HISTORY
+// before each forecast. Each change depends on the AUTOREGRESSIVE_ORDER previous changes and on the insulin and carbs absorbed during
+// its step, according to the on board settings. Its prediction intervals come from the errors of the fit and widen with the horizon.
+func NewAutoregressiveModel(settings model.OnBoardSettings) ForecastModel {
+	return &autoregressiveModel{settings: settings}
+}
+
+func (forecaster *autoregressiveModel) Name() string {
+	return AUTOREGRESSIVE_MODEL_NAME
+}
+
+func (forecaster *autoregressiveModel) Forecast(input ForecastInput, horizons []time.Duration) (forecast *model.Forecast, err error) {
+	glucose, err := resampleReads(input.Reads, FORECAST_HISTORY)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(glucose) <= FORECAST_MIN_STEPS {
+		return nil, ErrNotEnoughReadsToForecast
+	}
+
+	// Steps are counted from the last read but horizons are from the time of the forecast
+	stepMillis := int64(FORECAST_STEP / time.Millisecond)
+	lastTimestamp := glucose[len(glucose)-1].timestamp
+	forecastTimestamp := apimodel.GetTimeMillis(input.Time)
+	if forecastTimestamp-lastTimestamp > int64(MEAL_MAX_READ_GAP/time.Millisecond) {
+		return nil, ErrNotEnoughReadsToForecast
+	}
+
+	horizonSteps := make([]int, len(horizons))
+	maxSteps := 1
+	for i, horizon := range horizons {
+		horizonSteps[i] = int((forecastTimestamp + int64(horizon/time.Millisecond) - lastTimestamp + stepMillis/2) / stepMillis)
+		if horizonSteps[i] > maxSteps {
+			maxSteps = horizonSteps[i]
+		}
+	}
+
+	changes := make([]float64, len(glucose)-1)
+	for i := 1; i < len(glucose); i++ {
+		changes[i-1] = glucose[i].value - glucose[i-1].value
+	}
+	insulin, carbs := forecaster.absorbed(input, glucose[0].timestamp, len(changes)+maxSteps)
+
+	x := make([][]float64, 0)
+	y := make([]float64, 0)
+	for k := AUTOREGRESSIVE_ORDER; k < len(changes); k++ {
+		x = append(x, forecaster.regressors(changes, insulin, carbs, k))
+		y = append(y, changes[k])
+	}
+
+	coefficients, ok := fitRidgeRegression(x, y, AUTOREGRESSIVE_RIDGE)
+	if !ok {
+		return nil, errors.New("Can't fit the autoregressive model to the reads")
+	}
+
+	sumOfSquares := 0.
+	for i := range x {
+		residual := y[i] - predict(coefficients, x[i])
+		sumOfSquares = sumOfSquares + residual*residual
+	}
+	variance := sumOfSquares / float64(len(x)-len(coefficients))
+
+	// The weights of past errors on each future change and the variance of the cumulated errors at each step
+	weights := make([]float64, maxSteps)
+	cumulatedWeight := 0.
+	stepVariances := make([]float64, maxSteps+1)
+	levels := make([]float64, maxSteps+1)
+	levels[0] = glucose[len(glucose)-1].value
+	for step := 1; step <= maxSteps; step++ {
+		k := len(changes)
+		change := predict(coefficients, forecaster.regressors(changes, insulin, carbs, k))
+		changes = append(changes, change)
+		levels[step] = levels[step-1] + change
+
+		j := step - 1
+		if j == 0 {
+			weights[j] = 1
+		} else {
+			for i := 1; i <= AUTOREGRESSIVE_ORDER && i <= j; i++ {
+				weights[j] = weights[j] + coefficients[i-1]*weights[j-i]
+			}
+		}
+		cumulatedWeight = cumulatedWeight + weights[j]
+		stepVariances[step] = stepVariances[step-1] + variance*cumulatedWeight*cumulatedWeight
+	}
+
+	forecast = &model.Forecast{Model: forecaster.Name(), MadeAt: input.Time, Points: make([]model.ForecastPoint, len(horizons))}
+	for i, horizon := range horizons {
+		step := horizonSteps[i]
+		if step < 1 {
+			step = 1
+		}
+
+		value := math.Max(0, levels[step])
+		margin := CONFIDENCE_INTERVAL_Z_SCORE * math.Sqrt(stepVariances[step])
+		forecast.Points[i] = model.ForecastPoint{HorizonMinutes: int(horizon / time.Minute), Time: input.Time.Add(horizon), Value: value,
+			Low: math.Max(0, value-margin), High: value + margin}
+	}
+
+	return forecast, nil
+}
+
+// regressors returns the previous changes and the insulin and carbs absorbed that the change at index k depends on
+func (forecaster *autoregressiveModel) regressors(changes []float64, insulin []float64, carbs []float64, k int) []float64 {
+	regressors := make([]float64, AUTOREGRESSIVE_ORDER+2)
+	for i := 1; i <= AUTOREGRESSIVE_ORDER; i++ {
+		regressors[i-1] = changes[k-i]
+	}
+	regressors[AUTOREGRESSIVE_ORDER] = insulin[k]
+	regressors[AUTOREGRESSIVE_ORDER+1] = carbs[k]
+
+	return regressors
+}
+
+// absorbed returns the units of insulin and grams of carbs absorbed during each of the given number of steps following the start
+// timestamp, in milliseconds
+func (forecaster *autoregressiveModel) absorbed(input ForecastInput, start int64, steps int) (insulin []float64, carbs []float64) {
+	earliest := start - int64(forecaster.settings.MaxActionDuration()/time.Millisecond)
+
+	insulin = make([]float64, steps)
+	for _, injection := range input.Injections {
+		if injection.Time.Timestamp < earliest {
+			continue
+		}
+
+		curve := forecaster.settings.InsulinCurves[ClassifyInsulin(injection)]
+		addAbsorption(insulin, float64(injection.Units), injection.Time.Timestamp, start, func(minutes float64) float64 {
+			return InsulinOnBoardFraction(curve, minutes)
+		})
+	}
+
+	carbs = make([]float64, steps)
+	for _, meal := range input.Meals {
+		if meal.Time.Timestamp < earliest {
+			continue
+		}
+
+		addAbsorption(carbs, float64(meal.Carbohydrates), meal.Time.Timestamp, start, func(minutes float64) float64 {
+			return CarbsOnBoardFraction(forecaster.settings.CarbAbsorption, minutes)
+		})
+	}
+
+	return insulin, carbs
+}
+
+// addAbsorption adds the part of an amount taken at the given timestamp that's absorbed during each step following the start timestamp.
+// The onBoard function returns the fraction of the amount left the given number of minutes after it was taken.
+func addAbsorption(absorbed []float64, amount float64, timestamp int64, start int64, onBoard func(minutes float64) float64) {
+	left := func(at int64) float64 {
+		minutes := float64(at-timestamp) / float64(time.Minute/time.Millisecond)
+		if minutes < 0 {
+			return 1
+		}
+
+		return onBoard(minutes)
+	}
+
+	stepMillis := int64(FORECAST_STEP / time.Millisecond)
+	for k := range absorbed {
+		stepStart := start + int64(k)*stepMillis
+		absorbed[k] = absorbed[k] + amount*(left(stepStart)-left(stepStart+stepMillis))
+	}
+}
+
+// resampleReads returns the glucose, in mg/dL, at every FORECAST_STEP from up to the given history before the last read to the last read.
+// It stops going back at the first gap of more than MEAL_MAX_READ_GAP between reads. The reads must be sorted by time.
+func resampleReads(reads []apimodel.GlucoseRead, history time.Duration) (values []timedValue, err error) {
+	if len(reads) == 0 {
+		return []timedValue{}, nil
+	}
+
+	lastTimestamp := reads[len(reads)-1].Time.Timestamp
+	firstTimestamp := lastTimestamp - int64((history+MEAL_MAX_READ_GAP)/time.Millisecond)
+	first := sort.Search(len(reads), func(i int) bool {
+		return reads[i].Time.Timestamp >= firstTimestamp
+	})
+
+	readValues := make([]timedValue, 0, len(reads)-first)
+	for _, read := range reads[first:] {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		readValues = append(readValues, timedValue{read.Time.Timestamp, float64(value)})
+	}
+
+	steps := int(history / FORECAST_STEP)
+	stepMillis := int64(FORECAST_STEP / time.Millisecond)
+	reversed := make([]timedValue, 0, steps+1)
+	for step := 0; step <= steps; step++ {
+		timestamp := lastTimestamp - int64(step)*stepMillis
+		value, ok := interpolateValue(readValues, timestamp)
+		if !ok {
+			break
+		}
+
+		reversed = append(reversed, timedValue{timestamp, value})
+	}
+
+	values = make([]timedValue, len(reversed))
+	for i, value := range reversed {
+		values[len(reversed)-1-i] = value
+	}
+
+	return values, nil
+}
+
+// fitRidgeRegression returns the coefficients that minimize the squared errors of predicting y from the rows of x plus the ridge penalty
+// of the squared coefficients. It returns false if the coefficients can't be solved.
+func fitRidgeRegression(x [][]float64, y []float64, ridge float64) (coefficients []float64, ok bool) {
+	if len(x) == 0 {
+		return nil, false
+	}
+
+	n := len(x[0])
+	a := make([][]float64, n)
+	for i := range a {
+		a[i] = make([]float64, n)
+		a[i][i] = ridge
+	}
+
+	b := make([]float64, n)
+	for row := range x {
+		for i := 0; i < n; i++ {
+			b[i] = b[i] + x[row][i]*y[row]
+			for j := 0; j < n; j++ {
+				a[i][j] = a[i][j] + x[row][i]*x[row][j]
+			}
+		}
+	}
+
+	return solveLinearSystem(a, b)
+}
+
+// solveLinearSystem solves a·x = b by gaussian elimination with partial pivoting. The matrix and vector are modified. It returns false if
+// the matrix is singular.
+func solveLinearSystem(a [][]float64, b []float64) (x []float64, ok bool) {
+	n := len(b)
+	for column := 0; column < n; column++ {
+		pivot := column
+		for row := column + 1; row < n; row++ {
+			if math.Abs(a[row][column]) > math.Abs(a[pivot][column]) {
+				pivot = row
+			}
+		}
+
+		if math.Abs(a[pivot][column]) < 1e-12 {
+			return nil, false
+		}
+
+		a[column], a[pivot] = a[pivot], a[column]
+		b[column], b[pivot] = b[pivot], b[column]
+		for row := column + 1; row < n; row++ {
+			factor := a[row][column] / a[column][column]
+			for k := column; k < n; k++ {
+				a[row][k] = a[row][k] - factor*a[column][k]
+			}
+			b[row] = b[row] - factor*b[column]
+		}
+	}
+
+	x = make([]float64, n)
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum = sum - a[row][k]*x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+
+	return x, true
+}
+
+func predict(coefficients []float64, regressors []float64) (prediction float64) {
+	for i, coefficient := range coefficients {
+		prediction = prediction + coefficient*regressors[i]
+	}
+
+	return prediction
+}
+
+// BacktestForecastModel measures the errors of the forecasts a model would have made every FORECAST_BACKTEST_INTERVAL between the lower
+// and upper bounds against the reads that followed them. Each forecast is only given the data up to the time it's made. The reads,
+// injections and meals don't need to be sorted but should go back far enough before the lower bound for the model: the FORECAST_HISTORY
+// of reads and the injections and meals still on board at that time for the autoregressive model.
+func BacktestForecastModel(forecastModel ForecastModel, reads []apimodel.GlucoseRead, injections []apimodel.Injection, meals []apimodel.Meal,
+	lowerBound time.Time, upperBound time.Time, horizons []time.Duration) (backtest *model.ForecastBacktest, err error) {
+	// All the data up to the end of the last horizon, the forecasts are given the beginning of it
+	lastHorizon := time.Duration(0)
+	for _, horizon := range horizons {
+		if horizon > lastHorizon {
+			lastHorizon = horizon
+		}
+	}
+	all := NewForecastInput(upperBound.Add(lastHorizon), reads, injections, meals)
+
+	values := make([]timedValue, len(all.Reads))
+	for i, read := range all.Reads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = timedValue{read.Time.Timestamp, float64(value)}
+	}
+
+	backtest = &model.ForecastBacktest{Model: forecastModel.Name(), LowerBound: lowerBound, UpperBound: upperBound,
+		Errors: make([]model.ForecastError, len(horizons))}
+	for i, horizon := range horizons {
+		backtest.Errors[i].HorizonMinutes = int(horizon / time.Minute)
+	}
+
+	covered := make([]int, len(horizons))
+	next := lowerBound
+	for i, read := range all.Reads {
+		readTime := read.GetTime()
+		if readTime.Before(next) {
+			continue
+		} else if readTime.After(upperBound) {
+			break
+		}
+		next = readTime.Add(FORECAST_BACKTEST_INTERVAL)
+
+		timestamp := read.Time.Timestamp
+		injectionCount := sort.Search(len(all.Injections), func(j int) bool {
+			return all.Injections[j].Time.Timestamp > timestamp
+		})
+		mealCount := sort.Search(len(all.Meals), func(j int) bool {
+			return all.Meals[j].Time.Timestamp > timestamp
+		})
+
+		input := ForecastInput{Time: readTime, Reads: all.Reads[:i+1], Injections: all.Injections[:injectionCount], Meals: all.Meals[:mealCount]}
+		forecast, err := forecastModel.Forecast(input, horizons)
+		if err == ErrNotEnoughReadsToForecast {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for j, point := range forecast.Points {
+			actual, ok := interpolateValue(values, apimodel.GetTimeMillis(point.Time))
+			if !ok {
+				continue
+			}
+
+			forecastError := &backtest.Errors[j]
+			difference := math.Abs(point.Value - actual)
+			forecastError.SampleCount = forecastError.SampleCount + 1
+			forecastError.MeanAbsoluteError = forecastError.MeanAbsoluteError + difference
+			forecastError.RootMeanSquareError = forecastError.RootMeanSquareError + difference*difference
+			forecastError.MeanAbsolutePercentageError = forecastError.MeanAbsolutePercentageError + difference*100/actual
+			if actual >= point.Low && actual <= point.High {
+				covered[j] = covered[j] + 1
+			}
+		}
+	}
+
+	for j := range backtest.Errors {
+		forecastError := &backtest.Errors[j]
+		if forecastError.SampleCount == 0 {
+			continue
+		}
+
+		count := float64(forecastError.SampleCount)
+		forecastError.MeanAbsoluteError = forecastError.MeanAbsoluteError / count
+		forecastError.RootMeanSquareError = math.Sqrt(forecastError.RootMeanSquareError / count)
+		forecastError.MeanAbsolutePercentageError = forecastError.MeanAbsolutePercentageError / count
+		forecastError.Coverage = float64(covered[j]) * 100 / count
+	}
+
+	return backtest, nil
+}
+
+// ForecastToDataPoints converts the points of a forecast to data points of the predicted values and of the low and high bounds of their
+// prediction intervals. Values are converted to the requested glucose unit and local times are in the given timezone.
+func ForecastToDataPoints(forecast *model.Forecast, timeZoneId string, glucoseUnit apimodel.GlucoseUnit) (values []apimodel.DataPoint,
+	lows []apimodel.DataPoint, highs []apimodel.DataPoint, err error) {
+	values = make([]apimodel.DataPoint, len(forecast.Points))
+	lows = make([]apimodel.DataPoint, len(forecast.Points))
+	highs = make([]apimodel.DataPoint, len(forecast.Points))
+	for i, point := range forecast.Points {
+		pointTime := apimodel.Time{Timestamp: apimodel.GetTimeMillis(point.Time), TimeZoneId: timeZoneId}
+		localTime, err := pointTime.Format()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, series := range []struct {
+			dataPoints []apimodel.DataPoint
+			value      float64
+			tag        string
+		}{{values, point.Value, FORECAST_TAG}, {lows, point.Low, FORECAST_LOW_TAG}, {highs, point.High, FORECAST_HIGH_TAG}} {
+			read := apimodel.GlucoseRead{Time: pointTime, Unit: apimodel.MG_PER_DL, Value: float32(series.value)}
+			convertedValue, err := read.GetNormalizedValue(glucoseUnit)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+
+			series.dataPoints[i] = apimodel.DataPoint{LocalTime: localTime, EpochTime: point.Time.Unix(), Y: convertedValue, Value: convertedValue,
+				Tag: series.tag, Unit: glucoseUnit}
+		}
+	}
+
+	return values, lows, highs, nil
+}
@@ -0,0 +1,114 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+// persistenceModel forecasts that glucose stays at its last value
+type persistenceModel struct{}
+
+func (persistence persistenceModel) Name() string {
+	return "persistence"
+}
+
+func (persistence persistenceModel) Forecast(input engine.ForecastInput, horizons []time.Duration) (forecast *model.Forecast, err error) {
+	if len(input.Reads) == 0 {
+		return nil, engine.ErrNotEnoughReadsToForecast
+	}
+
+	last := float64(input.Reads[len(input.Reads)-1].Value)
+	forecast = &model.Forecast{Model: persistence.Name(), MadeAt: input.Time}
+	for _, horizon := range horizons {
+		forecast.Points = append(forecast.Points, model.ForecastPoint{HorizonMinutes: int(horizon / time.Minute), Time: input.Time.Add(horizon),
+			Value: last, Low: last, High: last})
+	}
+
+	return forecast, nil
+}
+
+// makeRisingReads creates 5 minute reads rising by 1 mg/dL at each read from 100
+func makeRisingReads(start time.Time, count int) []apimodel.GlucoseRead {
+	values := make([]float32, count)
+	for i := range values {
+		values[i] = float32(100 + i)
+	}
+
+	return makeEpisodeReads(start, values...)
+}
+
+func TestAutoregressiveForecastOfSteadyRise(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+	reads := makeRisingReads(start, 37)
+	forecastTime := start.Add(3 * time.Hour)
+
+	forecaster := engine.NewAutoregressiveModel(model.DEFAULT_ONBOARD_SETTINGS)
+	forecast, err := forecaster.Forecast(engine.NewForecastInput(forecastTime, reads, nil, nil), engine.FORECAST_HORIZONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(forecast.Points) != len(engine.FORECAST_HORIZONS) {
+		t.Fatalf("TestAutoregressiveForecastOfSteadyRise failed: got [%d] points but expected [%d]", len(forecast.Points),
+			len(engine.FORECAST_HORIZONS))
+	}
+
+	for i, expected := range []float64{142, 148, 154} {
+		point := forecast.Points[i]
+		if math.Abs(point.Value-expected) > 0.5 || point.Low > point.Value || point.High < point.Value ||
+			!point.Time.Equal(forecastTime.Add(engine.FORECAST_HORIZONS[i])) {
+			t.Errorf("TestAutoregressiveForecastOfSteadyRise failed: got [%v] but expected a value of [%f] at [%s]", point, expected,
+				forecastTime.Add(engine.FORECAST_HORIZONS[i]))
+		}
+	}
+}
+
+func TestAutoregressiveForecastWithoutEnoughReads(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+
+	// An hour of reads but with a gap in the middle
+	reads := makeRisingReads(start, 13)
+	reads = append(reads[:4], reads[11:]...)
+
+	forecaster := engine.NewAutoregressiveModel(model.DEFAULT_ONBOARD_SETTINGS)
+	_, err := forecaster.Forecast(engine.NewForecastInput(start.Add(time.Hour), reads, nil, nil), engine.FORECAST_HORIZONS)
+	if err != engine.ErrNotEnoughReadsToForecast {
+		t.Errorf("TestAutoregressiveForecastWithoutEnoughReads failed: got [%v] but expected [%v]", err, engine.ErrNotEnoughReadsToForecast)
+	}
+}
+
+func TestBacktestForecastModel(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+	reads := makeRisingReads(start, 97)
+
+	// Forecasts every 30 minutes from 3 to 6 hours after the start, all with reads 90 minutes later
+	backtest, err := engine.BacktestForecastModel(persistenceModel{}, reads, nil, nil, start.Add(3*time.Hour), start.Add(6*time.Hour),
+		engine.FORECAST_HORIZONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expectedError := range []float64{6, 12, 18} {
+		forecastError := backtest.Errors[i]
+		if forecastError.SampleCount != 7 || math.Abs(forecastError.MeanAbsoluteError-expectedError) > 0.0001 ||
+			math.Abs(forecastError.RootMeanSquareError-expectedError) > 0.0001 || forecastError.Coverage != 0 {
+			t.Errorf("TestBacktestForecastModel failed: got [%v] but expected [7] samples with an error of [%f]", forecastError, expectedError)
+		}
+	}
+
+	backtest, err = engine.BacktestForecastModel(engine.NewAutoregressiveModel(model.DEFAULT_ONBOARD_SETTINGS), reads, nil, nil,
+		start.Add(3*time.Hour), start.Add(6*time.Hour), engine.FORECAST_HORIZONS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, forecastError := range backtest.Errors {
+		if forecastError.SampleCount != 7 || forecastError.MeanAbsoluteError > 0.5 {
+			t.Errorf("TestBacktestForecastModel failed: got [%v] but expected [7] samples with an error under [0.5]", forecastError)
+		}
+	}
+}
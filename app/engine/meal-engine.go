@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"sort"
+	"time"
+)
+
+const (
+	// The period following a meal that its response is analyzed over
+	MEAL_RESPONSE_DURATION = time.Duration(2) * time.Hour
+	// Meals with reads further apart than this during their response aren't analyzed
+	MEAL_MAX_READ_GAP = time.Duration(30) * time.Minute
+	// A rise of at least this much after a meal, in mg/dL, is a spike
+	MEAL_SPIKE_DELTA = 50.
+	// The minimum number of meals and percentage of spikes for a group of meals to consistently spike
+	CONSISTENT_SPIKE_MIN_MEALS = 3
+	CONSISTENT_SPIKE_RATE      = 75.
+	// The boundaries, in grams of carbs, of medium and large meals
+	MEDIUM_MEAL_CARBS = 20
+	LARGE_MEAL_CARBS  = 60
+)
+
+// The times of day and carb sizes in the order groups are sorted by
+var timesOfDay = []string{model.TIME_OF_DAY_MORNING, model.TIME_OF_DAY_AFTERNOON, model.TIME_OF_DAY_EVENING, model.TIME_OF_DAY_NIGHT}
+var carbSizes = []string{model.CARB_SIZE_SMALL, model.CARB_SIZE_MEDIUM, model.CARB_SIZE_LARGE}
+
+// AnalyzeMeals calculates the glucose response to each meal with carbs between the lower and upper bounds and groups them by time of day
+// and carb size. The reads should cover the MEAL_RESPONSE_DURATION following the last meal and the meals should include the ones eaten
+// during that time so that overlapping meals are detected. Neither needs to be sorted. Meals without enough reads to analyze their
+// response are left out.
+func AnalyzeMeals(meals []apimodel.Meal, reads []apimodel.GlucoseRead, lowerBound time.Time, upperBound time.Time) (analysis *model.MealAnalysis, err error) {
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values := make([]timedValue, len(sortedReads))
+	for i, read := range sortedReads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = timedValue{read.Time.Timestamp, float64(value)}
+	}
+
+	sortedMeals := make(apimodel.MealSlice, 0, len(meals))
+	for _, meal := range meals {
+		if meal.Carbohydrates > 0 {
+			sortedMeals = append(sortedMeals, meal)
+		}
+	}
+	sort.Sort(sortedMeals)
+
+	analysis = &model.MealAnalysis{LowerBound: lowerBound, UpperBound: upperBound, Meals: make([]model.MealResponse, 0)}
+	for i, meal := range sortedMeals {
+		mealTime := meal.GetTime()
+		if mealTime.Before(lowerBound) || mealTime.After(upperBound) {
+			continue
+		}
+
+		response, ok := analyzeMealResponse(values, meal.Time.Timestamp)
+		if !ok {
+			continue
+		}
+
+		response.Meal = meal
+		response.TimeOfDay = timeOfDay(mealTime)
+		response.CarbSize = carbSize(meal.Carbohydrates)
+		response.Overlapping = i+1 < len(sortedMeals) && sortedMeals[i+1].GetTime().Before(mealTime.Add(MEAL_RESPONSE_DURATION))
+		analysis.Meals = append(analysis.Meals, *response)
+	}
+
+	analysis.Groups = groupMealResponses(analysis.Meals)
+
+	return analysis, nil
+}
+
+// analyzeMealResponse calculates the response to a meal eaten at the given timestamp, in milliseconds. The values must be sorted by time.
+// It returns false if there aren't enough reads to cover the response.
+func analyzeMealResponse(values []timedValue, timestamp int64) (response *model.MealResponse, ok bool) {
+	endTimestamp := timestamp + int64(MEAL_RESPONSE_DURATION/time.Millisecond)
+	baseline, ok := interpolateValue(values, timestamp)
+	if !ok {
+		return nil, false
+	}
+
+	twoHourValue, ok := interpolateValue(values, endTimestamp)
+	if !ok {
+		return nil, false
+	}
+
+	points := []timedValue{timedValue{timestamp, baseline}}
+	for _, value := range values {
+		if value.timestamp > timestamp && value.timestamp < endTimestamp {
+			points = append(points, value)
+		}
+	}
+	points = append(points, timedValue{endTimestamp, twoHourValue})
+
+	response = &model.MealResponse{Baseline: baseline, TwoHourValue: twoHourValue}
+	peak := points[0]
+	for i := 1; i < len(points); i++ {
+		if points[i].timestamp-points[i-1].timestamp > int64(MEAL_MAX_READ_GAP/time.Millisecond) {
+			return nil, false
+		}
+
+		if points[i].value > peak.value {
+			peak = points[i]
+		}
+
+		// Trapezoids of the increments above the baseline, the parts below it don't count
+		minutes := float64(points[i].timestamp-points[i-1].timestamp) / float64(time.Minute/time.Millisecond)
+		response.AreaUnderCurve = response.AreaUnderCurve + minutes*(aboveBaseline(points[i-1].value, baseline)+aboveBaseline(points[i].value, baseline))/2
+	}
+
+	response.PeakDelta = peak.value - baseline
+	response.MinutesToPeak = float64(peak.timestamp-timestamp) / float64(time.Minute/time.Millisecond)
+
+	return response, true
+}
+
+// interpolateValue returns the glucose at the given timestamp, interpolated from the reads around it. The values must be sorted by time.
+// It returns false if there are no reads within MEAL_MAX_READ_GAP on each side of the timestamp.
+func interpolateValue(values []timedValue, timestamp int64) (value float64, ok bool) {
+	i := sort.Search(len(values), func(i int) bool {
+		return values[i].timestamp >= timestamp
+	})
+
+	if i < len(values) && values[i].timestamp == timestamp {
+		return values[i].value, true
+	}
+
+	if i == 0 || i == len(values) || values[i].timestamp-values[i-1].timestamp > int64(MEAL_MAX_READ_GAP/time.Millisecond) {
+		return 0, false
+	}
+
+	lower, upper := values[i-1], values[i]
+	position := float64(timestamp-lower.timestamp) / float64(upper.timestamp-lower.timestamp)
+
+	return lower.value + position*(upper.value-lower.value), true
+}
+
+func aboveBaseline(value float64, baseline float64) float64 {
+	if value < baseline {
+		return 0
+	}
+
+	return value - baseline
+}
+
+// timeOfDay returns the TIME_OF_DAY_* of a meal from its local time
+func timeOfDay(mealTime time.Time) string {
+	hour := mealTime.Hour()
+	switch {
+	case hour >= 5 && hour < 11:
+		return model.TIME_OF_DAY_MORNING
+	case hour >= 11 && hour < 17:
+		return model.TIME_OF_DAY_AFTERNOON
+	case hour >= 17 && hour < 22:
+		return model.TIME_OF_DAY_EVENING
+	default:
+		return model.TIME_OF_DAY_NIGHT
+	}
+}
+
+// carbSize returns the CARB_SIZE_* of a meal
+func carbSize(carbohydrates float32) string {
+	if carbohydrates < MEDIUM_MEAL_CARBS {
+		return model.CARB_SIZE_SMALL
+	} else if carbohydrates < LARGE_MEAL_CARBS {
+		return model.CARB_SIZE_MEDIUM
+	}
+
+	return model.CARB_SIZE_LARGE
+}
+
+// groupMealResponses averages the responses of the meals that don't overlap by time of day and carb size. Only groups with meals are
+// returned.
+func groupMealResponses(responses []model.MealResponse) (groups []model.MealGroupAnalysis) {
+	groups = make([]model.MealGroupAnalysis, 0)
+	for _, timeOfDay := range timesOfDay {
+		for _, carbSize := range carbSizes {
+			group := model.MealGroupAnalysis{TimeOfDay: timeOfDay, CarbSize: carbSize}
+			spikes := 0
+			for _, response := range responses {
+				if response.Overlapping || response.TimeOfDay != timeOfDay || response.CarbSize != carbSize {
+					continue
+				}
+
+				group.MealCount = group.MealCount + 1
+				group.AveragePeakDelta = group.AveragePeakDelta + response.PeakDelta
+				group.AverageMinutesToPeak = group.AverageMinutesToPeak + response.MinutesToPeak
+				group.AverageTwoHourValue = group.AverageTwoHourValue + response.TwoHourValue
+				group.AverageAreaUnderCurve = group.AverageAreaUnderCurve + response.AreaUnderCurve
+				if response.PeakDelta >= MEAL_SPIKE_DELTA {
+					spikes = spikes + 1
+				}
+			}
+
+			if group.MealCount == 0 {
+				continue
+			}
+
+			count := float64(group.MealCount)
+			group.AveragePeakDelta = group.AveragePeakDelta / count
+			group.AverageMinutesToPeak = group.AverageMinutesToPeak / count
+			group.AverageTwoHourValue = group.AverageTwoHourValue / count
+			group.AverageAreaUnderCurve = group.AverageAreaUnderCurve / count
+			group.SpikeRate = float64(spikes) * 100 / count
+			group.ConsistentlySpikes = group.MealCount >= CONSISTENT_SPIKE_MIN_MEALS && group.SpikeRate >= CONSISTENT_SPIKE_RATE
+			groups = append(groups, group)
+		}
+	}
+
+	return groups
+}
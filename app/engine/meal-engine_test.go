@@ -0,0 +1,96 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+// makeMealResponseReads creates 5 minute reads from 30 minutes before the meal to 2.5 hours after it. Glucose is at 100 until
+// the meal, rises to 160 an hour after it and goes down to 130 an hour later.
+func makeMealResponseReads(mealTime time.Time) []apimodel.GlucoseRead {
+	values := make([]float32, 0)
+	for minutes := -30; minutes <= 150; minutes = minutes + 5 {
+		switch {
+		case minutes <= 0:
+			values = append(values, 100)
+		case minutes <= 60:
+			values = append(values, float32(100+minutes))
+		case minutes <= 120:
+			values = append(values, 160-float32(minutes-60)/2)
+		default:
+			values = append(values, 130)
+		}
+	}
+
+	return makeEpisodeReads(mealTime.Add(-30*time.Minute), values...)
+}
+
+func makeMeal(mealTime time.Time, carbs float32) apimodel.Meal {
+	return apimodel.Meal{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(mealTime), TimeZoneId: "UTC"}, Carbohydrates: carbs}
+}
+
+func TestAnalyzeMeals(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+	meals := make([]apimodel.Meal, 0)
+	reads := make([]apimodel.GlucoseRead, 0)
+	for day := 0; day < 4; day++ {
+		mealTime := start.AddDate(0, 0, day)
+		meals = append(meals, makeMeal(mealTime, 45))
+		reads = append(reads, makeMealResponseReads(mealTime)...)
+	}
+
+	// A snack an hour after the last breakfast makes it overlap and a meal without reads can't be analyzed
+	meals = append(meals, makeMeal(start.AddDate(0, 0, 3).Add(time.Hour), 10), makeMeal(start.AddDate(0, 0, 5), 30))
+
+	analysis, err := engine.AnalyzeMeals(meals, reads, start, start.AddDate(0, 0, 6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(analysis.Meals) != 4 {
+		t.Fatalf("TestAnalyzeMeals failed: got [%d] meal responses but expected [%d]", len(analysis.Meals), 4)
+	}
+
+	response := analysis.Meals[0]
+	if response.Baseline != 100 || response.PeakDelta != 60 || response.MinutesToPeak != 60 || response.TwoHourValue != 130 ||
+		math.Abs(response.AreaUnderCurve-4500) > 0.01 || response.TimeOfDay != model.TIME_OF_DAY_MORNING ||
+		response.CarbSize != model.CARB_SIZE_MEDIUM || response.Overlapping {
+		t.Errorf("TestAnalyzeMeals failed: got [%v] but expected a baseline of [100], a peak delta of [60] after [60] minutes, "+
+			"a 2-hour value of [130] and an area under the curve of [4500]", response)
+	}
+
+	if !analysis.Meals[3].Overlapping {
+		t.Errorf("TestAnalyzeMeals failed: got [%v] but expected the last breakfast to overlap with the snack", analysis.Meals[3])
+	}
+
+	if len(analysis.Groups) != 1 {
+		t.Fatalf("TestAnalyzeMeals failed: got [%d] groups but expected [%d]", len(analysis.Groups), 1)
+	}
+
+	group := analysis.Groups[0]
+	if group.TimeOfDay != model.TIME_OF_DAY_MORNING || group.CarbSize != model.CARB_SIZE_MEDIUM || group.MealCount != 3 ||
+		group.AveragePeakDelta != 60 || group.SpikeRate != 100 || !group.ConsistentlySpikes {
+		t.Errorf("TestAnalyzeMeals failed: got [%v] but expected [3] medium morning meals that consistently spike", group)
+	}
+}
+
+func TestAnalyzeMealsWithGapInReads(t *testing.T) {
+	mealTime := time.Date(2014, time.April, 14, 19, 0, 0, 0, time.UTC)
+	reads := makeMealResponseReads(mealTime)
+
+	// Remove 40 minutes of reads in the middle of the response
+	withGap := append(append([]apimodel.GlucoseRead{}, reads[:12]...), reads[20:]...)
+
+	analysis, err := engine.AnalyzeMeals([]apimodel.Meal{makeMeal(mealTime, 80)}, withGap, mealTime, mealTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(analysis.Meals) != 0 || len(analysis.Groups) != 0 {
+		t.Errorf("TestAnalyzeMealsWithGapInReads failed: got [%v] but expected no meal responses", analysis)
+	}
+}
@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/grd/stat"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// The lag used to calculate CONGA
+	CONGA_PERIOD = time.Hour
+	// How far apart two reads can be from the exact lag to be compared for MODD and CONGA. Reads are
+	// normally 5 minutes apart.
+	READ_MATCHING_TOLERANCE = time.Duration(150) * time.Second
+)
+
+// ErrNoReadsForMetrics is returned when metrics are requested for a window without any read
+var ErrNoReadsForMetrics = errors.New("No reads to calculate metrics from")
+
+// timedValue is a glucose value in mg/dL with its timestamp in milliseconds
+type timedValue struct {
+	timestamp int64
+	value     float64
+}
+
+// CalculateGlycemicMetrics calculates the time in range and glycemic variability metrics of a window of reads. The reads
+// don't need to be sorted. The time in ranges are based on the given thresholds.
+func CalculateGlycemicMetrics(context context.Context, reads []apimodel.GlucoseRead, thresholds model.GlucoseThresholds) (metrics *model.GlycemicMetrics, err error) {
+	if len(reads) == 0 {
+		return nil, ErrNoReadsForMetrics
+	}
+
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values := make([]timedValue, len(sortedReads))
+	for i, read := range sortedReads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = timedValue{read.Time.Timestamp, float64(value)}
+	}
+
+	glucose := make(stat.Float64Slice, len(values))
+	for i, v := range values {
+		glucose[i] = v.value
+	}
+
+	log.Debugf(context, "Calculating glycemic metrics from [%d] reads", len(values))
+
+	metrics = new(model.GlycemicMetrics)
+	metrics.LowerBound = sortedReads[0].GetTime()
+	metrics.UpperBound = sortedReads[len(sortedReads)-1].GetTime()
+	metrics.ReadCount = len(values)
+	metrics.Thresholds = thresholds
+
+	calculateTimeInRanges(glucose, thresholds, metrics)
+
+	metrics.Average = stat.Mean(glucose)
+	metrics.StandardDeviation = standardDeviation(glucose, metrics.Average)
+	if metrics.Average > 0 {
+		metrics.CoefficientOfVariation = metrics.StandardDeviation / metrics.Average * 100.
+	}
+	metrics.GMI = CalculateGMI(metrics.Average)
+	metrics.MAGE = calculateMAGE(glucose, metrics.StandardDeviation)
+	metrics.MODD = calculateMODD(values)
+	metrics.CONGA = calculateCONGA(values, CONGA_PERIOD)
+	metrics.LBGI, metrics.HBGI = calculateBloodGlucoseIndices(glucose)
+
+	return metrics, nil
+}
+
+// CalculateGMI calculates the glucose management indicator from an average glucose in mg/dL
+func CalculateGMI(average float64) float64 {
+	return 3.31 + 0.02392*average
+}
+
+// calculateTimeInRanges sets the percentage of reads in each of the threshold ranges
+func calculateTimeInRanges(glucose stat.Float64Slice, thresholds model.GlucoseThresholds, metrics *model.GlycemicMetrics) {
+	var veryLow, low, inRange, high, veryHigh int
+	for _, value := range glucose {
+		switch {
+		case value < thresholds.VeryLow:
+			veryLow = veryLow + 1
+			low = low + 1
+		case value < thresholds.Low:
+			low = low + 1
+		case value <= thresholds.High:
+			inRange = inRange + 1
+		case value <= thresholds.VeryHigh:
+			high = high + 1
+		default:
+			high = high + 1
+			veryHigh = veryHigh + 1
+		}
+	}
+
+	percentage := func(count int) float64 {
+		return float64(count) / float64(len(glucose)) * 100.
+	}
+
+	metrics.TimeVeryLow = percentage(veryLow)
+	metrics.TimeBelowRange = percentage(low)
+	metrics.TimeInRange = percentage(inRange)
+	metrics.TimeAboveRange = percentage(high)
+	metrics.TimeVeryHigh = percentage(veryHigh)
+}
+
+// standardDeviation returns the sample standard deviation or 0 if there aren't enough values to calculate it
+func standardDeviation(values stat.Float64Slice, mean float64) float64 {
+	if len(values) < 2 {
+		return 0.
+	}
+
+	return stat.SdMean(values, mean)
+}
+
+// calculateMAGE calculates the mean amplitude of glycemic excursions. Only excursions, from a nadir to a peak or from a peak to
+// a nadir, larger than one standard deviation are counted. Smaller fluctuations along the way are ignored.
+func calculateMAGE(glucose stat.Float64Slice, sd float64) float64 {
+	if sd == 0. {
+		return 0.
+	}
+
+	amplitudes := make(stat.Float64Slice, 0)
+	// The direction of the current excursion: 1 when rising, -1 when falling and 0 until the first excursion is found
+	direction := 0
+	// The last turning point and the most extreme value of the current excursion
+	turningPoint := glucose[0]
+	extreme := glucose[0]
+	min, max := glucose[0], glucose[0]
+
+	for _, value := range glucose[1:] {
+		switch direction {
+		case 0:
+			min = math.Min(min, value)
+			max = math.Max(max, value)
+			if value-min > sd {
+				direction, turningPoint, extreme = 1, min, value
+			} else if max-value > sd {
+				direction, turningPoint, extreme = -1, max, value
+			}
+		case 1:
+			if value > extreme {
+				extreme = value
+			} else if extreme-value > sd {
+				amplitudes = append(amplitudes, extreme-turningPoint)
+				direction, turningPoint, extreme = -1, extreme, value
+			}
+		case -1:
+			if value < extreme {
+				extreme = value
+			} else if value-extreme > sd {
+				amplitudes = append(amplitudes, turningPoint-extreme)
+				direction, turningPoint, extreme = 1, extreme, value
+			}
+		}
+	}
+
+	// The last excursion counts if it's large enough even if it never turned
+	if direction != 0 && math.Abs(extreme-turningPoint) > sd {
+		amplitudes = append(amplitudes, math.Abs(extreme-turningPoint))
+	}
+
+	if len(amplitudes) == 0 {
+		return 0.
+	}
+
+	return stat.Mean(amplitudes)
+}
+
+// calculateMODD calculates the mean of the absolute differences between reads taken at the same time on consecutive days
+func calculateMODD(values []timedValue) float64 {
+	differences := laggedDifferences(values, 24*time.Hour)
+	if len(differences) == 0 {
+		return 0.
+	}
+
+	for i, difference := range differences {
+		differences[i] = math.Abs(difference)
+	}
+
+	return stat.Mean(differences)
+}
+
+// calculateCONGA calculates the standard deviation of the differences between reads and the reads taken one period before
+func calculateCONGA(values []timedValue, period time.Duration) float64 {
+	differences := laggedDifferences(values, period)
+
+	return standardDeviation(differences, stat.Mean(differences))
+}
+
+// laggedDifferences returns the differences between each read and the read taken the lag before it, for every read
+// that has a match within the READ_MATCHING_TOLERANCE. The values must be sorted by time.
+func laggedDifferences(values []timedValue, lag time.Duration) (differences stat.Float64Slice) {
+	lagInMillis := int64(lag / time.Millisecond)
+	toleranceInMillis := int64(READ_MATCHING_TOLERANCE / time.Millisecond)
+
+	differences = make(stat.Float64Slice, 0)
+	for _, v := range values {
+		target := v.timestamp - lagInMillis
+		i := sort.Search(len(values), func(i int) bool {
+			return values[i].timestamp >= target-toleranceInMillis
+		})
+
+		if i < len(values) && values[i].timestamp <= target+toleranceInMillis {
+			differences = append(differences, v.value-values[i].value)
+		}
+	}
+
+	return differences
+}
+
+// calculateBloodGlucoseIndices calculates the low and high blood glucose indices (Kovatchev et al.) which are the average
+// risks of hypoglycemia and hyperglycemia of the reads
+func calculateBloodGlucoseIndices(glucose stat.Float64Slice) (lbgi float64, hbgi float64) {
+	for _, value := range glucose {
+		// Values of 0 or less are sensor errors that don't have a risk
+		if value <= 0 {
+			continue
+		}
+
+		f := 1.509 * (math.Pow(math.Log(value), 1.084) - 5.381)
+		risk := 10. * f * f
+		if f < 0 {
+			lbgi = lbgi + risk
+		} else {
+			hbgi = hbgi + risk
+		}
+	}
+
+	return lbgi / float64(len(glucose)), hbgi / float64(len(glucose))
+}
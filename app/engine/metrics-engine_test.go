@@ -0,0 +1,100 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+// makeMetricsReads creates 5 minute reads starting at a fixed time with the given values
+func makeMetricsReads(values ...float32) []apimodel.GlucoseRead {
+	start, _ := time.Parse("02/01/2006 15:04", "18/04/2014 00:00")
+	reads := make([]apimodel.GlucoseRead, len(values))
+	for i, value := range values {
+		readTime := start.Add(time.Duration(i*5) * time.Minute)
+		reads[i] = apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(readTime), TimeZoneId: "America/Los_Angeles"},
+			Unit: apimodel.MG_PER_DL, Value: value}
+	}
+
+	return reads
+}
+
+func assertMetric(t *testing.T, name string, value float64, expected float64) {
+	if math.Abs(value-expected) > 0.01 {
+		t.Errorf("TestGlycemicMetrics failed: got %s of [%f] but expected [%f]", name, value, expected)
+	}
+}
+
+func TestGlycemicMetrics(t *testing.T) {
+	reads := makeMetricsReads(50, 60, 100, 150, 200, 300, 100, 100, 100, 100)
+
+	metrics, err := engine.CalculateGlycemicMetrics(context.Background(), reads, model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metrics.ReadCount != len(reads) {
+		t.Errorf("TestGlycemicMetrics failed: got read count of [%d] but expected [%d]", metrics.ReadCount, len(reads))
+	}
+
+	assertMetric(t, "time very low", metrics.TimeVeryLow, 10.)
+	assertMetric(t, "time below range", metrics.TimeBelowRange, 20.)
+	assertMetric(t, "time in range", metrics.TimeInRange, 60.)
+	assertMetric(t, "time above range", metrics.TimeAboveRange, 20.)
+	assertMetric(t, "time very high", metrics.TimeVeryHigh, 10.)
+	assertMetric(t, "average", metrics.Average, 126.)
+	assertMetric(t, "standard deviation", metrics.StandardDeviation, 74.42)
+	assertMetric(t, "coefficient of variation", metrics.CoefficientOfVariation, 59.06)
+	assertMetric(t, "gmi", metrics.GMI, 6.32)
+	// The rise from the nadir at 50 to the peak at 300 and the fall back down to 100
+	assertMetric(t, "mage", metrics.MAGE, 225.)
+}
+
+func TestGlycemicMetricsOfFlatReads(t *testing.T) {
+	values := make([]float32, 288*2)
+	for i := range values {
+		values[i] = 112
+	}
+
+	metrics, err := engine.CalculateGlycemicMetrics(context.Background(), makeMetricsReads(values...), model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMetric(t, "time in range", metrics.TimeInRange, 100.)
+	assertMetric(t, "standard deviation", metrics.StandardDeviation, 0.)
+	assertMetric(t, "mage", metrics.MAGE, 0.)
+	assertMetric(t, "modd", metrics.MODD, 0.)
+	assertMetric(t, "conga", metrics.CONGA, 0.)
+	// 112 mg/dL is the point of symmetry of the risk function so both indices are close to 0
+	assertMetric(t, "lbgi", metrics.LBGI, 0.)
+	assertMetric(t, "hbgi", metrics.HBGI, 0.)
+}
+
+func TestGlycemicMetricsOfDailyPattern(t *testing.T) {
+	// The second day is 20 mg/dL higher than the first at the same time
+	values := make([]float32, 288*2)
+	for i := range values {
+		values[i] = float32(100 + 20*(i/288))
+	}
+
+	metrics, err := engine.CalculateGlycemicMetrics(context.Background(), makeMetricsReads(values...), model.DEFAULT_GLUCOSE_THRESHOLDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertMetric(t, "modd", metrics.MODD, 20.)
+	if metrics.HBGI <= 0 || metrics.LBGI <= 0 {
+		t.Errorf("TestGlycemicMetricsOfDailyPattern failed: expected non zero risk indices but got lbgi [%f] and hbgi [%f]", metrics.LBGI, metrics.HBGI)
+	}
+}
+
+func TestGlycemicMetricsWithoutReads(t *testing.T) {
+	if _, err := engine.CalculateGlycemicMetrics(context.Background(), []apimodel.GlucoseRead{}, model.DEFAULT_GLUCOSE_THRESHOLDS); err != engine.ErrNoReadsForMetrics {
+		t.Errorf("TestGlycemicMetricsWithoutReads failed: got error [%v] but expected [%v]", err, engine.ErrNoReadsForMetrics)
+	}
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	INSULIN_ON_BOARD_TAG = "InsulinOnBoard"
+	CARBS_ON_BOARD_TAG   = "CarbsOnBoard"
+)
+
+// Keywords of the names and types of insulins that aren't rapid-acting, as found in the exports of pumps and apps
+var longActingInsulinKeywords = []string{"long", "basal", "lantus", "levemir", "tresiba", "toujeo", "basaglar", "glargine", "detemir", "degludec"}
+var regularInsulinKeywords = []string{"regular", "humulin r", "novolin r", "nph", "intermediate"}
+
+// ClassifyInsulin returns the INSULIN_CLASS_* of an injection from its insulin name and type. Injections that can't be
+// classified are considered rapid-acting since that's what boluses are.
+func ClassifyInsulin(injection apimodel.Injection) string {
+	description := strings.ToLower(injection.InsulinName + " " + injection.InsulinType)
+	for _, keyword := range longActingInsulinKeywords {
+		if strings.Contains(description, keyword) {
+			return model.INSULIN_CLASS_LONG
+		}
+	}
+
+	for _, keyword := range regularInsulinKeywords {
+		if strings.Contains(description, keyword) {
+			return model.INSULIN_CLASS_REGULAR
+		}
+	}
+
+	return model.INSULIN_CLASS_RAPID
+}
+
+// InsulinOnBoardFraction returns the fraction of an injection still active the given number of minutes after it. It's
+// the exponential model of insulin activity also used by OpenAPS and Loop.
+func InsulinOnBoardFraction(curve model.InsulinActionCurve, minutes float64) float64 {
+	duration := float64(curve.DurationMinutes)
+	peak := float64(curve.PeakMinutes)
+	if minutes < 0 || minutes >= duration {
+		return 0
+	}
+
+	tau := peak * (1 - peak/duration) / (1 - 2*peak/duration)
+	a := 2 * tau / duration
+	s := 1 / (1 - a + (1+a)*math.Exp(-duration/tau))
+
+	return 1 - s*(1-a)*((math.Pow(minutes, 2)/(tau*duration*(1-a))-minutes/tau-1)*math.Exp(-minutes/tau)+1)
+}
+
+// CarbsOnBoardFraction returns the fraction of the carbs of a meal not yet absorbed the given number of minutes after it
+func CarbsOnBoardFraction(absorption model.CarbAbsorptionModel, minutes float64) float64 {
+	if minutes < 0 {
+		return 0
+	}
+
+	progress := (minutes - float64(absorption.DelayMinutes)) / float64(absorption.AbsorptionMinutes)
+	if progress <= 0 {
+		return 1
+	} else if progress >= 1 {
+		return 0
+	}
+
+	if absorption.Model == model.CARB_ABSORPTION_PARABOLIC {
+		if progress < 0.5 {
+			return 1 - 2*progress*progress
+		}
+
+		return 2 - 2*progress*(2-progress)
+	}
+
+	return 1 - progress
+}
+
+// CalculateInsulinOnBoard returns the units of insulin on board at every interval of the settings between the lower and upper bounds.
+// The injections should include the ones before the lower bound that are still active (see OnBoardSettings.MaxActionDuration).
+// The local times of the points are in the given timezone.
+func CalculateInsulinOnBoard(injections []apimodel.Injection, settings model.OnBoardSettings, lowerBound time.Time, upperBound time.Time,
+	timeZoneId string) (dataPoints []apimodel.DataPoint, err error) {
+	return calculateOnBoard(len(injections), func(i int, minutes float64) float64 {
+		return float64(injections[i].Units) * InsulinOnBoardFraction(settings.InsulinCurves[ClassifyInsulin(injections[i])], minutes)
+	}, func(i int) int64 {
+		return injections[i].Time.Timestamp
+	}, settings, lowerBound, upperBound, timeZoneId, INSULIN_ON_BOARD_TAG, "units")
+}
+
+// CalculateCarbsOnBoard returns the grams of carbs on board at every interval of the settings between the lower and upper bounds.
+// The meals should include the ones before the lower bound that are still being absorbed (see OnBoardSettings.MaxActionDuration).
+// The local times of the points are in the given timezone.
+func CalculateCarbsOnBoard(meals []apimodel.Meal, settings model.OnBoardSettings, lowerBound time.Time, upperBound time.Time,
+	timeZoneId string) (dataPoints []apimodel.DataPoint, err error) {
+	return calculateOnBoard(len(meals), func(i int, minutes float64) float64 {
+		return float64(meals[i].Carbohydrates) * CarbsOnBoardFraction(settings.CarbAbsorption, minutes)
+	}, func(i int) int64 {
+		return meals[i].Time.Timestamp
+	}, settings, lowerBound, upperBound, timeZoneId, CARBS_ON_BOARD_TAG, "grams")
+}
+
+// calculateOnBoard sums what's on board of count events at each interval. The onBoard function returns what's left of an event the
+// given number of minutes after it and timestamp returns the time of an event in milliseconds.
+func calculateOnBoard(count int, onBoard func(i int, minutes float64) float64, timestamp func(i int) int64, settings model.OnBoardSettings,
+	lowerBound time.Time, upperBound time.Time, timeZoneId string, tag string, unit apimodel.GlucoseUnit) (dataPoints []apimodel.DataPoint, err error) {
+	interval := time.Duration(settings.IntervalMinutes) * time.Minute
+	maxMinutes := settings.MaxActionDuration().Minutes()
+
+	dataPoints = make([]apimodel.DataPoint, 0)
+	for pointTime := lowerBound.Truncate(interval); !pointTime.After(upperBound); pointTime = pointTime.Add(interval) {
+		if pointTime.Before(lowerBound) {
+			continue
+		}
+
+		pointTimestamp := apimodel.GetTimeMillis(pointTime)
+		total := 0.
+		for i := 0; i < count; i++ {
+			minutes := float64(pointTimestamp-timestamp(i)) / float64(time.Minute/time.Millisecond)
+			if minutes >= 0 && minutes < maxMinutes {
+				total = total + onBoard(i, minutes)
+			}
+		}
+
+		localTime, err := apimodel.Time{Timestamp: pointTimestamp, TimeZoneId: timeZoneId}.Format()
+		if err != nil {
+			return nil, err
+		}
+
+		value := float32(total)
+		dataPoints = append(dataPoints, apimodel.DataPoint{LocalTime: localTime, EpochTime: pointTime.Unix(), Y: value, Value: value, Tag: tag, Unit: unit})
+	}
+
+	return dataPoints, nil
+}
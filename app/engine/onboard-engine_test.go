@@ -0,0 +1,111 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInsulinOnBoardFraction(t *testing.T) {
+	curve := model.DEFAULT_ONBOARD_SETTINGS.InsulinCurves[model.INSULIN_CLASS_RAPID]
+
+	if fraction := engine.InsulinOnBoardFraction(curve, 0); math.Abs(fraction-1) > 0.0001 {
+		t.Errorf("TestInsulinOnBoardFraction failed: got [%f] at injection time but expected [%f]", fraction, 1.)
+	}
+
+	previous := 1.
+	for minutes := 5.; minutes < float64(curve.DurationMinutes); minutes = minutes + 5 {
+		fraction := engine.InsulinOnBoardFraction(curve, minutes)
+		if fraction > previous || fraction < 0 {
+			t.Fatalf("TestInsulinOnBoardFraction failed: got [%f] at [%f] minutes after [%f] but expected it to decrease", fraction, minutes, previous)
+		}
+		previous = fraction
+	}
+
+	if previous > 0.01 {
+		t.Errorf("TestInsulinOnBoardFraction failed: got [%f] at the end of the action but expected close to [%f]", previous, 0.)
+	}
+
+	if fraction := engine.InsulinOnBoardFraction(curve, float64(curve.DurationMinutes)); fraction != 0 {
+		t.Errorf("TestInsulinOnBoardFraction failed: got [%f] after the duration of action but expected [%f]", fraction, 0.)
+	}
+}
+
+func TestCarbsOnBoardFraction(t *testing.T) {
+	linear := model.CarbAbsorptionModel{Model: model.CARB_ABSORPTION_LINEAR, DelayMinutes: 10, AbsorptionMinutes: 100}
+	parabolic := model.CarbAbsorptionModel{Model: model.CARB_ABSORPTION_PARABOLIC, DelayMinutes: 10, AbsorptionMinutes: 100}
+
+	for _, c := range []struct {
+		absorption model.CarbAbsorptionModel
+		minutes    float64
+		expected   float64
+	}{
+		{linear, 5, 1},
+		{linear, 35, 0.75},
+		{linear, 110, 0},
+		{parabolic, 35, 0.875},
+		{parabolic, 60, 0.5},
+		{parabolic, 85, 0.125},
+	} {
+		if fraction := engine.CarbsOnBoardFraction(c.absorption, c.minutes); math.Abs(fraction-c.expected) > 0.0001 {
+			t.Errorf("TestCarbsOnBoardFraction failed: got [%f] at [%f] minutes with model [%s] but expected [%f]", fraction, c.minutes,
+				c.absorption.Model, c.expected)
+		}
+	}
+}
+
+func TestClassifyInsulin(t *testing.T) {
+	for _, c := range []struct {
+		injection apimodel.Injection
+		expected  string
+	}{
+		{apimodel.Injection{InsulinType: "Fast-Acting"}, model.INSULIN_CLASS_RAPID},
+		{apimodel.Injection{InsulinType: "Long-Acting"}, model.INSULIN_CLASS_LONG},
+		{apimodel.Injection{InsulinName: "Lantus"}, model.INSULIN_CLASS_LONG},
+		{apimodel.Injection{InsulinName: "Humulin R"}, model.INSULIN_CLASS_REGULAR},
+		{apimodel.Injection{InsulinType: "Correction Bolus"}, model.INSULIN_CLASS_RAPID},
+	} {
+		if insulinClass := engine.ClassifyInsulin(c.injection); insulinClass != c.expected {
+			t.Errorf("TestClassifyInsulin failed: got [%s] for [%v] but expected [%s]", insulinClass, c.injection, c.expected)
+		}
+	}
+}
+
+func TestCalculateOnBoard(t *testing.T) {
+	start := time.Date(2014, time.April, 18, 8, 0, 0, 0, time.UTC)
+	settings := model.DEFAULT_ONBOARD_SETTINGS
+
+	// A bolus an hour before the lower bound still counts while a long-acting injection after the upper bound doesn't
+	injections := []apimodel.Injection{
+		apimodel.Injection{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(start.Add(-1 * time.Hour)), TimeZoneId: "UTC"}, Units: 4, InsulinType: "Fast-Acting"},
+		apimodel.Injection{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(start.Add(3 * time.Hour)), TimeZoneId: "UTC"}, Units: 20, InsulinType: "Long-Acting"},
+	}
+
+	insulinOnBoard, err := engine.CalculateInsulinOnBoard(injections, settings, start, start.Add(2*time.Hour), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(insulinOnBoard) != 25 {
+		t.Fatalf("TestCalculateOnBoard failed: got [%d] points but expected [%d]", len(insulinOnBoard), 25)
+	}
+
+	expected := float32(4 * engine.InsulinOnBoardFraction(settings.InsulinCurves[model.INSULIN_CLASS_RAPID], 60))
+	if insulinOnBoard[0].Value != expected || insulinOnBoard[0].EpochTime != start.Unix() || insulinOnBoard[0].Tag != engine.INSULIN_ON_BOARD_TAG {
+		t.Errorf("TestCalculateOnBoard failed: got first point [%v] but expected a value of [%f] at [%d]", insulinOnBoard[0], expected, start.Unix())
+	}
+
+	meals := []apimodel.Meal{apimodel.Meal{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(start.Add(30 * time.Minute)), TimeZoneId: "UTC"}, Carbohydrates: 60}}
+	carbsOnBoard, err := engine.CalculateCarbsOnBoard(meals, settings, start, start.Add(2*time.Hour), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if carbsOnBoard[0].Value != 0 || carbsOnBoard[6].Value != 60 || carbsOnBoard[24].Value >= 60 {
+		t.Errorf("TestCalculateOnBoard failed: got carbs on board [%f, %f, %f] but expected [0, 60, < 60]", carbsOnBoard[0].Value,
+			carbsOnBoard[6].Value, carbsOnBoard[24].Value)
+	}
+}
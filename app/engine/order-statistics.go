@@ -0,0 +1,75 @@
+package engine
+
+import (
+	"sort"
+)
+
+// orderStatistics is a multiset of values that finds the value of any rank in logarithmic time, to keep the median of a sliding
+// window. All values that can be added must be known upfront: it's a binary indexed tree of the counts of each distinct value.
+// It implements the stat.Interface as a sorted data set.
+type orderStatistics struct {
+	// The distinct values, sorted
+	values []float64
+	// The binary indexed tree of the counts of the values, indexed from 1
+	counts []int
+	size   int
+}
+
+// newOrderStatistics returns empty order statistics for the given values, in any order
+func newOrderStatistics(values []float64) *orderStatistics {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	distinct := make([]float64, 0, len(sorted))
+	for i, value := range sorted {
+		if i == 0 || value != sorted[i-1] {
+			distinct = append(distinct, value)
+		}
+	}
+
+	return &orderStatistics{values: distinct, counts: make([]int, len(distinct)+1)}
+}
+
+// Add adds one occurrence of the value, which must be one of the values the statistics were created for
+func (statistics *orderStatistics) Add(value float64) {
+	statistics.update(value, 1)
+}
+
+// Remove removes one occurrence of the value, which must have been added before
+func (statistics *orderStatistics) Remove(value float64) {
+	statistics.update(value, -1)
+}
+
+func (statistics *orderStatistics) update(value float64, delta int) {
+	for i := sort.SearchFloat64s(statistics.values, value) + 1; i < len(statistics.counts); i += i & -i {
+		statistics.counts[i] = statistics.counts[i] + delta
+	}
+
+	statistics.size = statistics.size + delta
+}
+
+// Len returns the number of values
+func (statistics *orderStatistics) Len() int {
+	return statistics.size
+}
+
+// Get returns the value of the given rank, from 0 for the smallest value
+func (statistics *orderStatistics) Get(rank int) float64 {
+	step := 1
+	for step*2 < len(statistics.counts) {
+		step = step * 2
+	}
+
+	// Find the last position whose count of values up to it is still at most the rank, the value of the rank comes right after
+	position := 0
+	remaining := rank + 1
+	for ; step > 0; step = step / 2 {
+		if position+step < len(statistics.counts) && statistics.counts[position+step] < remaining {
+			position = position + step
+			remaining = remaining - statistics.counts[position]
+		}
+	}
+
+	return statistics.values[position]
+}
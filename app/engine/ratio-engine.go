@@ -0,0 +1,242 @@
+package engine
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/grd/stat"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// The current version of the insulin ratio estimation
+	INSULIN_RATIO_CALCULATION_VERSION = 1
+	// The days of history each estimate of insulin ratios is calculated from
+	INSULIN_RATIO_PERIOD = 30
+	// The days between two estimates of insulin ratios
+	INSULIN_RATIO_INTERVAL = 7
+	// How close to a meal a bolus has to be to count as covering it
+	MEAL_BOLUS_MATCHING_WINDOW = time.Duration(30) * time.Minute
+	// How long after a meal or correction its effect is measured. It's also how long before and after it there can't be any
+	// other meal or bolus for it to be isolated.
+	INSULIN_RATIO_OBSERVATION_PERIOD = time.Duration(4) * time.Hour
+	// Boluses starting lower than this, in mg/dL, aren't considered corrections
+	CORRECTION_MIN_START_GLUCOSE = 150.
+	// Without a sensitivity factor to account for where glucose ended, only meals ending within this of where they started,
+	// in mg/dL, are used to estimate carb ratios
+	MATCHED_MEAL_TOLERANCE = 30.
+	// The minimum number of samples for an estimate
+	INSULIN_RATIO_MIN_SAMPLES = 3
+	// The z-score of the 95% confidence intervals
+	CONFIDENCE_INTERVAL_Z_SCORE = 1.96
+)
+
+// The times of day of the estimates, the first one being for all samples
+var insulinRatioTimesOfDay = []string{model.TIME_OF_DAY_ALL, model.TIME_OF_DAY_MORNING, model.TIME_OF_DAY_AFTERNOON, model.TIME_OF_DAY_EVENING,
+	model.TIME_OF_DAY_NIGHT}
+
+// mealSample is a meal with the boluses that covered it and the glucose at its start and at the end of the observation period
+type mealSample struct {
+	meal  apimodel.Meal
+	units float64
+	start float64
+	end   float64
+}
+
+// EstimateInsulinRatios estimates carb ratios from meals with their boluses and insulin sensitivity factors from isolated correction
+// boluses, for each time of day. Only meals and boluses between the lower and upper bounds are sampled but the reads, injections and meals
+// should cover the INSULIN_RATIO_OBSERVATION_PERIOD before and after the bounds to check that samples are isolated and measure their
+// effect. Only rapid-acting insulin is considered.
+//
+// The sensitivity factor of a correction is the drop of glucose per unit. The carb ratio of a meal is its carbs divided by the insulin
+// it actually needed: the bolus plus the insulin that would have brought glucose back to where it started according to the estimated
+// sensitivity factor. When there aren't enough corrections to estimate the sensitivity factor, only meals after which glucose came back
+// close to where it started are used.
+func EstimateInsulinRatios(reads []apimodel.GlucoseRead, injections []apimodel.Injection, meals []apimodel.Meal, lowerBound time.Time,
+	upperBound time.Time) (ratios *model.InsulinRatios, err error) {
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values := make([]timedValue, len(sortedReads))
+	for i, read := range sortedReads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = timedValue{read.Time.Timestamp, float64(value)}
+	}
+
+	boluses := make(apimodel.InjectionSlice, 0, len(injections))
+	for _, injection := range injections {
+		if injection.Units > 0 && ClassifyInsulin(injection) == model.INSULIN_CLASS_RAPID {
+			boluses = append(boluses, injection)
+		}
+	}
+	sort.Sort(boluses)
+
+	sortedMeals := make(apimodel.MealSlice, 0, len(meals))
+	for _, meal := range meals {
+		if meal.Carbohydrates > 0 {
+			sortedMeals = append(sortedMeals, meal)
+		}
+	}
+	sort.Sort(sortedMeals)
+
+	ratios = &model.InsulinRatios{LowerBound: lowerBound, UpperBound: upperBound, CalculatedOn: time.Now(),
+		CalculationVersion: INSULIN_RATIO_CALCULATION_VERSION, Samples: make([]model.InsulinRatioSample, 0)}
+
+	corrections := findCorrections(values, boluses, sortedMeals, lowerBound, upperBound)
+	ratios.Samples = append(ratios.Samples, corrections...)
+	sensitivityFactors := make(map[string]model.RatioEstimate)
+	for _, timeOfDay := range insulinRatioTimesOfDay {
+		sensitivityFactors[timeOfDay] = estimateRatio(corrections, timeOfDay)
+	}
+
+	carbRatios := make([]model.InsulinRatioSample, 0)
+	for _, sample := range findMealSamples(values, boluses, sortedMeals, lowerBound, upperBound) {
+		mealTime := sample.meal.GetTime()
+		ratioSample := model.InsulinRatioSample{Kind: model.INSULIN_RATIO_SAMPLE_MEAL, Time: mealTime, TimeOfDay: timeOfDay(mealTime),
+			Carbohydrates: float64(sample.meal.Carbohydrates), Units: sample.units, StartGlucose: sample.start, EndGlucose: sample.end}
+
+		sensitivityFactor := sensitivityFactors[ratioSample.TimeOfDay]
+		if sensitivityFactor.SampleCount < INSULIN_RATIO_MIN_SAMPLES {
+			sensitivityFactor = sensitivityFactors[model.TIME_OF_DAY_ALL]
+		}
+
+		if sensitivityFactor.SampleCount >= INSULIN_RATIO_MIN_SAMPLES {
+			neededUnits := sample.units + (sample.end-sample.start)/sensitivityFactor.Value
+			if neededUnits <= 0 {
+				continue
+			}
+			ratioSample.Ratio = ratioSample.Carbohydrates / neededUnits
+		} else if math.Abs(sample.end-sample.start) <= MATCHED_MEAL_TOLERANCE {
+			ratioSample.Ratio = ratioSample.Carbohydrates / sample.units
+		} else {
+			continue
+		}
+
+		carbRatios = append(carbRatios, ratioSample)
+	}
+	ratios.Samples = append(ratios.Samples, carbRatios...)
+
+	ratios.Estimates = make([]model.InsulinRatioEstimate, len(insulinRatioTimesOfDay))
+	for i, timeOfDay := range insulinRatioTimesOfDay {
+		ratios.Estimates[i] = model.InsulinRatioEstimate{TimeOfDay: timeOfDay, CarbRatio: estimateRatio(carbRatios, timeOfDay),
+			SensitivityFactor: sensitivityFactors[timeOfDay]}
+	}
+
+	return ratios, nil
+}
+
+// findCorrections returns the samples of the boluses between the bounds without any meal or other bolus during the observation period
+// before and after them and that brought glucose down from at least CORRECTION_MIN_START_GLUCOSE
+func findCorrections(values []timedValue, boluses []apimodel.Injection, meals []apimodel.Meal, lowerBound time.Time,
+	upperBound time.Time) (corrections []model.InsulinRatioSample) {
+	corrections = make([]model.InsulinRatioSample, 0)
+	for i, bolus := range boluses {
+		bolusTime := bolus.GetTime()
+		if bolusTime.Before(lowerBound) || bolusTime.After(upperBound) {
+			continue
+		}
+
+		isolated := (i == 0 || bolusTime.Sub(boluses[i-1].GetTime()) > INSULIN_RATIO_OBSERVATION_PERIOD) &&
+			(i == len(boluses)-1 || boluses[i+1].GetTime().Sub(bolusTime) > INSULIN_RATIO_OBSERVATION_PERIOD)
+		for _, meal := range meals {
+			if math.Abs(float64(meal.GetTime().Sub(bolusTime))) <= float64(INSULIN_RATIO_OBSERVATION_PERIOD) {
+				isolated = false
+				break
+			}
+		}
+
+		if !isolated {
+			continue
+		}
+
+		start, end, ok := observeGlucose(values, bolus.Time.Timestamp)
+		if !ok || start < CORRECTION_MIN_START_GLUCOSE || end >= start {
+			continue
+		}
+
+		units := float64(bolus.Units)
+		corrections = append(corrections, model.InsulinRatioSample{Kind: model.INSULIN_RATIO_SAMPLE_CORRECTION, Time: bolusTime,
+			TimeOfDay: timeOfDay(bolusTime), Units: units, StartGlucose: start, EndGlucose: end, Ratio: (start - end) / units})
+	}
+
+	return corrections
+}
+
+// findMealSamples returns the meals between the bounds that were covered by boluses within the MEAL_BOLUS_MATCHING_WINDOW and without any
+// other meal or bolus during the observation period before and after them
+func findMealSamples(values []timedValue, boluses []apimodel.Injection, meals []apimodel.Meal, lowerBound time.Time,
+	upperBound time.Time) (samples []mealSample) {
+	samples = make([]mealSample, 0)
+	for i, meal := range meals {
+		mealTime := meal.GetTime()
+		if mealTime.Before(lowerBound) || mealTime.After(upperBound) {
+			continue
+		}
+
+		isolated := (i == 0 || mealTime.Sub(meals[i-1].GetTime()) > INSULIN_RATIO_OBSERVATION_PERIOD) &&
+			(i == len(meals)-1 || meals[i+1].GetTime().Sub(mealTime) > INSULIN_RATIO_OBSERVATION_PERIOD)
+
+		units := 0.
+		for _, bolus := range boluses {
+			distance := math.Abs(float64(bolus.GetTime().Sub(mealTime)))
+			if distance <= float64(MEAL_BOLUS_MATCHING_WINDOW) {
+				units = units + float64(bolus.Units)
+			} else if distance <= float64(INSULIN_RATIO_OBSERVATION_PERIOD) {
+				isolated = false
+			}
+		}
+
+		if !isolated || units == 0 {
+			continue
+		}
+
+		start, end, ok := observeGlucose(values, meal.Time.Timestamp)
+		if !ok {
+			continue
+		}
+
+		samples = append(samples, mealSample{meal, units, start, end})
+	}
+
+	return samples
+}
+
+// observeGlucose returns the glucose at the given timestamp, in milliseconds, and at the end of the observation period following it
+func observeGlucose(values []timedValue, timestamp int64) (start float64, end float64, ok bool) {
+	if start, ok = interpolateValue(values, timestamp); !ok {
+		return 0, 0, false
+	}
+
+	end, ok = interpolateValue(values, timestamp+int64(INSULIN_RATIO_OBSERVATION_PERIOD/time.Millisecond))
+
+	return start, end, ok
+}
+
+// estimateRatio returns the mean ratio of the samples of a time of day (or of all samples for TIME_OF_DAY_ALL) with its confidence interval.
+// Only the sample count is set when there aren't at least INSULIN_RATIO_MIN_SAMPLES.
+func estimateRatio(samples []model.InsulinRatioSample, timeOfDay string) (estimate model.RatioEstimate) {
+	ratios := make(stat.Float64Slice, 0)
+	for _, sample := range samples {
+		if timeOfDay == model.TIME_OF_DAY_ALL || sample.TimeOfDay == timeOfDay {
+			ratios = append(ratios, sample.Ratio)
+		}
+	}
+
+	estimate.SampleCount = len(ratios)
+	if estimate.SampleCount < INSULIN_RATIO_MIN_SAMPLES {
+		return estimate
+	}
+
+	estimate.Value = stat.Mean(ratios)
+	margin := CONFIDENCE_INTERVAL_Z_SCORE * standardDeviation(ratios, estimate.Value) / math.Sqrt(float64(estimate.SampleCount))
+	estimate.ConfidenceLow = estimate.Value - margin
+	estimate.ConfidenceHigh = estimate.Value + margin
+
+	return estimate
+}
@@ -0,0 +1,123 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"testing"
+	"time"
+)
+
+// makeObservationReads creates 5 minute reads from 30 minutes before the event to 30 minutes after the observation period. Glucose
+// goes linearly from the start value at the time of the event to the end value at the end of the observation period.
+func makeObservationReads(eventTime time.Time, start float64, end float64) []apimodel.GlucoseRead {
+	observationMinutes := int(engine.INSULIN_RATIO_OBSERVATION_PERIOD / time.Minute)
+	values := make([]float32, 0)
+	for minutes := -30; minutes <= observationMinutes+30; minutes = minutes + 5 {
+		switch {
+		case minutes <= 0:
+			values = append(values, float32(start))
+		case minutes <= observationMinutes:
+			values = append(values, float32(start+(end-start)*float64(minutes)/float64(observationMinutes)))
+		default:
+			values = append(values, float32(end))
+		}
+	}
+
+	return makeEpisodeReads(eventTime.Add(-30*time.Minute), values...)
+}
+
+func makeInjection(injectionTime time.Time, units float32, insulinType string) apimodel.Injection {
+	return apimodel.Injection{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(injectionTime), TimeZoneId: "UTC"}, Units: units,
+		InsulinType: insulinType}
+}
+
+func TestEstimateInsulinRatios(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 0, 0, 0, 0, time.UTC)
+	reads := make([]apimodel.GlucoseRead, 0)
+	injections := make([]apimodel.Injection, 0)
+	meals := make([]apimodel.Meal, 0)
+	for day := 0; day < 4; day++ {
+		breakfast := start.AddDate(0, 0, day).Add(8 * time.Hour)
+		meals = append(meals, makeMeal(breakfast, 60))
+		injections = append(injections, makeInjection(breakfast.Add(-10*time.Minute), 5, "Fast-Acting"))
+		reads = append(reads, makeObservationReads(breakfast, 100, 140)...)
+
+		// Corrections of 2 units bringing glucose down from 200 to 120
+		correction := start.AddDate(0, 0, day).Add(14 * time.Hour)
+		injections = append(injections, makeInjection(correction, 2, "Correction Bolus"))
+		reads = append(reads, makeObservationReads(correction, 200, 120)...)
+	}
+
+	// Basal insulin doesn't get in the way but a snack right after the last breakfast and a bolus right before the last
+	// correction do
+	injections = append(injections, makeInjection(start.Add(10*time.Hour), 20, "Long-Acting"),
+		makeInjection(start.AddDate(0, 0, 3).Add(13*time.Hour), 1, "Fast-Acting"))
+	meals = append(meals, makeMeal(start.AddDate(0, 0, 3).Add(9*time.Hour), 15))
+
+	ratios, err := engine.EstimateInsulinRatios(reads, injections, meals, start, start.AddDate(0, 0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ratios.CalculationVersion != engine.INSULIN_RATIO_CALCULATION_VERSION || len(ratios.Samples) != 6 {
+		t.Fatalf("TestEstimateInsulinRatios failed: got version [%d] and [%d] samples but expected version [%d] and [%d] samples",
+			ratios.CalculationVersion, len(ratios.Samples), engine.INSULIN_RATIO_CALCULATION_VERSION, 6)
+	}
+
+	estimates := make(map[string]model.InsulinRatioEstimate)
+	for _, estimate := range ratios.Estimates {
+		estimates[estimate.TimeOfDay] = estimate
+	}
+
+	// The breakfasts needed a unit more than their bolus to bring glucose back to where it started, given the sensitivity factor of 40
+	expectedSensitivity := model.RatioEstimate{Value: 40, ConfidenceLow: 40, ConfidenceHigh: 40, SampleCount: 3}
+	expectedCarbRatio := model.RatioEstimate{Value: 10, ConfidenceLow: 10, ConfidenceHigh: 10, SampleCount: 3}
+	for _, c := range []struct {
+		actual   model.RatioEstimate
+		expected model.RatioEstimate
+	}{
+		{estimates[model.TIME_OF_DAY_ALL].SensitivityFactor, expectedSensitivity},
+		{estimates[model.TIME_OF_DAY_AFTERNOON].SensitivityFactor, expectedSensitivity},
+		{estimates[model.TIME_OF_DAY_MORNING].SensitivityFactor, model.RatioEstimate{}},
+		{estimates[model.TIME_OF_DAY_ALL].CarbRatio, expectedCarbRatio},
+		{estimates[model.TIME_OF_DAY_MORNING].CarbRatio, expectedCarbRatio},
+		{estimates[model.TIME_OF_DAY_EVENING].CarbRatio, model.RatioEstimate{}},
+	} {
+		if !ratioEstimatesMatch(c.actual, c.expected) {
+			t.Errorf("TestEstimateInsulinRatios failed: got [%v] but expected [%v]", c.actual, c.expected)
+		}
+	}
+}
+
+func TestEstimateCarbRatiosWithoutCorrections(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 0, 0, 0, 0, time.UTC)
+	reads := make([]apimodel.GlucoseRead, 0)
+	injections := make([]apimodel.Injection, 0)
+	meals := make([]apimodel.Meal, 0)
+
+	// Only the dinners ending close to where they started can be used without a sensitivity factor
+	for day, end := range []float64{120, 90, 200, 105} {
+		dinner := start.AddDate(0, 0, day).Add(18 * time.Hour)
+		meals = append(meals, makeMeal(dinner, 48))
+		injections = append(injections, makeInjection(dinner, 4, "Fast-Acting"))
+		reads = append(reads, makeObservationReads(dinner, 100, end)...)
+	}
+
+	ratios, err := engine.EstimateInsulinRatios(reads, injections, meals, start, start.AddDate(0, 0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := model.RatioEstimate{Value: 12, ConfidenceLow: 12, ConfidenceHigh: 12, SampleCount: 3}
+	if carbRatio := ratios.Estimates[0].CarbRatio; !ratioEstimatesMatch(carbRatio, expected) {
+		t.Errorf("TestEstimateCarbRatiosWithoutCorrections failed: got [%v] but expected [%v]", carbRatio, expected)
+	}
+}
+
+func ratioEstimatesMatch(actual model.RatioEstimate, expected model.RatioEstimate) bool {
+	tolerance := 0.0001
+	return actual.SampleCount == expected.SampleCount && actual.Value-expected.Value < tolerance && expected.Value-actual.Value < tolerance &&
+		actual.ConfidenceLow-expected.ConfidenceLow < tolerance && expected.ConfidenceLow-actual.ConfidenceLow < tolerance &&
+		actual.ConfidenceHigh-expected.ConfidenceHigh < tolerance && expected.ConfidenceHigh-actual.ConfidenceHigh < tolerance
+}
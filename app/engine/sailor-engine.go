@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// The number of candidates with the best scores a steady sailor is matched from
+	STEADY_SAILOR_CANDIDATES = 50
+	// The number of best matches the steady sailor is randomly chosen from so that it's not always the same user
+	STEADY_SAILOR_TOP_MATCHES = 5
+	// The picture shown for every steady sailor instead of their own
+	STEADY_SAILOR_PICTURE_URL = "/images/glukit-buddy/happy.svg"
+	// The band of users whose age or diabetes duration isn't known
+	UNKNOWN_BAND = -1
+)
+
+// The upper bounds, in years, of the age bands users are matched on
+var AGE_BANDS = []int{13, 18, 26, 40, 60}
+
+// The upper bounds, in years, of the diabetes duration bands users are matched on
+var DIABETES_DURATION_BANDS = []int{1, 5, 10, 20}
+
+// The words the display names of steady sailors that didn't choose one are made of
+var sailorAdjectives = []string{"Steady", "Calm", "Patient", "Brave", "Gentle", "Bold", "Quiet", "Swift"}
+var sailorNames = []string{"Albatross", "Dolphin", "Gull", "Narwhal", "Otter", "Pelican", "Puffin", "Seal", "Tern", "Whale"}
+
+// FindSteadySailor finds the steady sailor of a user and returns their anonymized profile along with the upper boundary for their
+// most recent day of reads. The sailor is randomly chosen among the best matches of the users who opted in to be steady sailors,
+// falling back to internal users if none of them has reads. If no match can be found, store.ErrNoSteadySailorMatchFound is returned.
+func FindSteadySailor(context context.Context, repository store.UserRepository, recipientEmail string, random *rand.Rand) (sailor *model.SteadySailor, upperBound time.Time, err error) {
+	recipient, err := repository.GetUserProfile(context, recipientEmail)
+	if err != nil {
+		return nil, util.GLUKIT_EPOCH_TIME, err
+	}
+
+	candidates, err := repository.FindSteadySailorCandidates(context, recipient.DiabetesType, STEADY_SAILOR_CANDIDATES)
+	if err != nil {
+		return nil, util.GLUKIT_EPOCH_TIME, err
+	}
+
+	match := MatchSteadySailor(*recipient, candidates, time.Now(), random)
+	if match == nil {
+		log.Warningf(context, "No steady sailor match found for user [%s] with type of diabetes [%s] among [%d] candidates", recipientEmail,
+			recipient.DiabetesType, len(candidates))
+		return nil, util.GLUKIT_EPOCH_TIME, store.ErrNoSteadySailorMatchFound
+	}
+
+	log.Infof(context, "Found a steady sailor match for user [%s]: [%s]", recipientEmail, match.Email)
+	anonymized := AnonymizeSteadySailor(*match)
+
+	return &anonymized, util.GetEndOfDayBoundaryBefore(match.MostRecentRead.GetTime()), nil
+}
+
+// MatchSteadySailor returns the candidate to show as the steady sailor of the recipient or nil if there's none. Only candidates
+// with reads that opted in, or internal ones, are considered and internal candidates only if there's no other. Candidates are ranked
+// by how many of the age band, diabetes duration band and therapy they have in common with the recipient, then by ascending score
+// value, and the match is randomly chosen among the first STEADY_SAILOR_TOP_MATCHES.
+func MatchSteadySailor(recipient model.GlukitUser, candidates []model.GlukitUser, now time.Time, random *rand.Rand) (sailor *model.GlukitUser) {
+	seen := make(map[string]bool)
+	optedIn := make([]model.GlukitUser, 0)
+	internal := make([]model.GlukitUser, 0)
+	for _, candidate := range candidates {
+		if seen[candidate.Email] || candidate.Email == recipient.Email || util.GLUKIT_EPOCH_TIME.Equal(candidate.MostRecentRead.GetTime()) {
+			continue
+		}
+		seen[candidate.Email] = true
+
+		if candidate.Sailing.OptIn {
+			optedIn = append(optedIn, candidate)
+		} else if candidate.Internal {
+			internal = append(internal, candidate)
+		}
+	}
+
+	matches := optedIn
+	if len(matches) == 0 {
+		matches = internal
+	}
+
+	if len(matches) == 0 {
+		return nil
+	}
+
+	similarities := make(map[string]int)
+	for _, candidate := range matches {
+		similarities[candidate.Email] = similarity(recipient, candidate, now)
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if similarities[matches[i].Email] != similarities[matches[j].Email] {
+			return similarities[matches[i].Email] > similarities[matches[j].Email]
+		}
+
+		return matches[i].MostRecentScore.IsBetterThan(matches[j].MostRecentScore)
+	})
+
+	topMatches := len(matches)
+	if topMatches > STEADY_SAILOR_TOP_MATCHES {
+		topMatches = STEADY_SAILOR_TOP_MATCHES
+	}
+
+	return &matches[random.Intn(topMatches)]
+}
+
+// AnonymizeSteadySailor returns the profile of a steady sailor as shown to others, under the display name they chose or a name
+// derived from their email if they didn't, and with the same picture for everyone
+func AnonymizeSteadySailor(user model.GlukitUser) model.SteadySailor {
+	displayName := user.Sailing.DisplayName
+	if displayName == "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(user.Email))
+		sum := int(hash.Sum32() % uint32(len(sailorAdjectives)*len(sailorNames)))
+		displayName = sailorAdjectives[sum/len(sailorNames)] + " " + sailorNames[sum%len(sailorNames)]
+	}
+
+	return model.SteadySailor{Email: user.Email, DisplayName: displayName, PictureUrl: STEADY_SAILOR_PICTURE_URL,
+		MostRecentRead: user.MostRecentRead.GetTime(), MostRecentScore: user.MostRecentScore}
+}
+
+// similarity returns the number of matching criteria two users have in common. Criteria that aren't known for either user
+// never match.
+func similarity(recipient model.GlukitUser, candidate model.GlukitUser, now time.Time) (matching int) {
+	if band := GetAgeBand(recipient, now); band != UNKNOWN_BAND && band == GetAgeBand(candidate, now) {
+		matching = matching + 1
+	}
+
+	if band := GetDiabetesDurationBand(recipient, now); band != UNKNOWN_BAND && band == GetDiabetesDurationBand(candidate, now) {
+		matching = matching + 1
+	}
+
+	if recipient.Sailing.Therapy != "" && recipient.Sailing.Therapy == candidate.Sailing.Therapy {
+		matching = matching + 1
+	}
+
+	return matching
+}
+
+// GetAgeBand returns the index of the AGE_BANDS the user is in, len(AGE_BANDS) for the oldest users or UNKNOWN_BAND if the
+// user's age isn't known. Accounts are created with the date of birth set to the time of creation so a date of birth that
+// isn't at least a year before the creation of the account isn't known.
+func GetAgeBand(user model.GlukitUser, now time.Time) (band int) {
+	if !user.DateOfBirth.Before(user.AccountCreated.AddDate(-1, 0, 0)) {
+		return UNKNOWN_BAND
+	}
+
+	return getBand(AGE_BANDS, user.DateOfBirth, now)
+}
+
+// GetDiabetesDurationBand returns the index of the DIABETES_DURATION_BANDS the user is in, len(DIABETES_DURATION_BANDS) for the
+// longest durations or UNKNOWN_BAND if the user's diagnosis date isn't known
+func GetDiabetesDurationBand(user model.GlukitUser, now time.Time) (band int) {
+	if user.Sailing.DiagnosedOn.IsZero() {
+		return UNKNOWN_BAND
+	}
+
+	return getBand(DIABETES_DURATION_BANDS, user.Sailing.DiagnosedOn, now)
+}
+
+// getBand returns the index of the first band whose upper bound, in years, is greater than the years since the given time
+func getBand(upperBounds []int, since time.Time, now time.Time) (band int) {
+	for band, upperBound := range upperBounds {
+		if since.AddDate(upperBound, 0, 0).After(now) {
+			return band
+		}
+	}
+
+	return len(upperBounds)
+}
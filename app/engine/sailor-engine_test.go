@@ -0,0 +1,105 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var sailingNow = time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// makeSailor returns a user with reads and the given score, opt-in and age
+func makeSailor(email string, score int64, optIn bool, internal bool, age int) model.GlukitUser {
+	return model.GlukitUser{Email: email, DiabetesType: model.DIABETES_TYPE_1, Internal: internal, DateOfBirth: sailingNow.AddDate(-1*age, 0, -1),
+		AccountCreated: sailingNow.AddDate(0, -1, 0), MostRecentScore: model.GlukitScore{Value: score},
+		MostRecentRead: apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(sailingNow), TimeZoneId: "UTC"}, Unit: apimodel.MG_PER_DL, Value: 100},
+		Sailing:        model.SailingProfile{OptIn: optIn}}
+}
+
+func TestMatchSteadySailorOnlyConsidersOptedInUsers(t *testing.T) {
+	recipient := makeSailor("recipient@glukit.com", 500, false, false, 30)
+	candidates := []model.GlukitUser{
+		makeSailor("recipient@glukit.com", 500, false, false, 30),
+		makeSailor("private@glukit.com", 10, false, false, 30),
+		makeSailor("internal@glukit.com", 20, false, true, 30),
+		makeSailor("sailor@glukit.com", 300, true, false, 30),
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		if sailor := engine.MatchSteadySailor(recipient, candidates, sailingNow, rand.New(rand.NewSource(seed))); sailor == nil || sailor.Email != "sailor@glukit.com" {
+			t.Fatalf("TestMatchSteadySailorOnlyConsidersOptedInUsers failed: got [%v] but expected [%s]", sailor, "sailor@glukit.com")
+		}
+	}
+
+	if sailor := engine.MatchSteadySailor(recipient, candidates[:3], sailingNow, rand.New(rand.NewSource(1))); sailor == nil || sailor.Email != "internal@glukit.com" {
+		t.Errorf("TestMatchSteadySailorOnlyConsidersOptedInUsers failed: got [%v] but expected the internal user as a fallback", sailor)
+	}
+
+	if sailor := engine.MatchSteadySailor(recipient, candidates[:2], sailingNow, rand.New(rand.NewSource(1))); sailor != nil {
+		t.Errorf("TestMatchSteadySailorOnlyConsidersOptedInUsers failed: got [%v] but expected no match", sailor)
+	}
+}
+
+func TestMatchSteadySailorPrefersSimilarUsers(t *testing.T) {
+	recipient := makeSailor("recipient@glukit.com", 500, false, false, 15)
+	recipient.Sailing.Therapy = model.THERAPY_PUMP
+
+	candidates := make([]model.GlukitUser, 0)
+	for i := 0; i < 10; i++ {
+		candidates = append(candidates, makeSailor(string(rune('a'+i))+"@glukit.com", int64(i), true, false, 45))
+	}
+	for i := 0; i < engine.STEADY_SAILOR_TOP_MATCHES; i++ {
+		similar := makeSailor("similar"+string(rune('a'+i))+"@glukit.com", int64(400+i), true, false, 16)
+		similar.Sailing.Therapy = model.THERAPY_PUMP
+		candidates = append(candidates, similar)
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		sailor := engine.MatchSteadySailor(recipient, candidates, sailingNow, rand.New(rand.NewSource(seed)))
+		if sailor == nil || sailor.Sailing.Therapy != model.THERAPY_PUMP {
+			t.Fatalf("TestMatchSteadySailorPrefersSimilarUsers failed: got [%v] but expected one of the similar users", sailor)
+		}
+	}
+
+	// Without the similar users, the match is one of the users with the best scores
+	for seed := int64(0); seed < 20; seed++ {
+		sailor := engine.MatchSteadySailor(recipient, candidates[:10], sailingNow, rand.New(rand.NewSource(seed)))
+		if sailor == nil || sailor.MostRecentScore.Value >= engine.STEADY_SAILOR_TOP_MATCHES {
+			t.Fatalf("TestMatchSteadySailorPrefersSimilarUsers failed: got [%v] but expected one of the top [%d] scores", sailor,
+				engine.STEADY_SAILOR_TOP_MATCHES)
+		}
+	}
+}
+
+func TestAnonymizeSteadySailor(t *testing.T) {
+	user := makeSailor("sailor@glukit.com", 100, true, false, 30)
+	user.FirstName = "Real"
+	user.PictureUrl = "https://example.com/real.png"
+
+	sailor := engine.AnonymizeSteadySailor(user)
+	if sailor.DisplayName == "" || sailor.DisplayName == user.FirstName || sailor.PictureUrl != engine.STEADY_SAILOR_PICTURE_URL {
+		t.Errorf("TestAnonymizeSteadySailor failed: got [%s] with picture [%s] but expected an alias and the sailor picture", sailor.DisplayName,
+			sailor.PictureUrl)
+	}
+
+	user.Sailing.DisplayName = "Captain"
+	if sailor = engine.AnonymizeSteadySailor(user); sailor.DisplayName != "Captain" {
+		t.Errorf("TestAnonymizeSteadySailor failed: got [%s] but expected [%s]", sailor.DisplayName, "Captain")
+	}
+}
+
+func TestGetAgeBand(t *testing.T) {
+	user := makeSailor("sailor@glukit.com", 100, true, false, 17)
+	if band := engine.GetAgeBand(user, sailingNow); band != 1 {
+		t.Errorf("TestGetAgeBand failed: got [%d] but expected [%d]", band, 1)
+	}
+
+	// Accounts are created with a date of birth at the time of creation
+	user.DateOfBirth = user.AccountCreated
+	if band := engine.GetAgeBand(user, sailingNow); band != engine.UNKNOWN_BAND {
+		t.Errorf("TestGetAgeBand failed: got [%d] but expected [%d]", band, engine.UNKNOWN_BAND)
+	}
+}
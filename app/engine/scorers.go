@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"sort"
+	"time"
+)
+
+const (
+	GLUKIT_SCORE_RECALCULATION_FUNCTION_NAME = "runGlukitScoreRecalculationChunk"
+	A1C_RECALCULATION_FUNCTION_NAME          = "runA1CRecalculationChunk"
+)
+
+var ErrNothingToRecalculate = errors.New("No scores calculated yet to recalculate")
+
+// GlukitScorer calculates GlukitScores with one version of the scoring algorithm. Scorers of new versions can be plugged in
+// with RegisterGlukitScorer.
+type GlukitScorer interface {
+	// Version returns the scoring version of the scores it calculates
+	Version() int
+	// Score returns the GlukitScores of the user for the periods ending before each of the endsOfPeriods, which are sorted, in the
+	// same order. The score of a period is the UNDEFINED_SCORE if there aren't enough reads for it.
+	Score(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (glukitScores []model.GlukitScore, err error)
+}
+
+// A1CEstimator estimates a1cs with one version of the estimation algorithm. Estimators of new versions can be plugged in with
+// RegisterA1CEstimator.
+type A1CEstimator interface {
+	// Version returns the scoring version of the estimates it calculates
+	Version() int
+	// Estimate returns the A1CEstimates of the user for the periods ending before each of the endsOfPeriods, which are sorted, in
+	// the same order. The estimate of a period is nil if there aren't enough reads for it.
+	Estimate(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (a1cs []*model.A1CEstimate, err error)
+}
+
+// glukitScorerFunc is a GlukitScorer calculating scores with a function
+type glukitScorerFunc struct {
+	version int
+	score   func(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) ([]model.GlukitScore, error)
+}
+
+func (scorer glukitScorerFunc) Version() int {
+	return scorer.version
+}
+
+func (scorer glukitScorerFunc) Score(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (glukitScores []model.GlukitScore, err error) {
+	return scorer.score(context, repository, glukitUser, endsOfPeriods)
+}
+
+// a1cEstimatorFunc is an A1CEstimator estimating a1cs with a function
+type a1cEstimatorFunc struct {
+	version  int
+	estimate func(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) ([]*model.A1CEstimate, error)
+}
+
+func (estimator a1cEstimatorFunc) Version() int {
+	return estimator.version
+}
+
+func (estimator a1cEstimatorFunc) Estimate(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (a1cs []*model.A1CEstimate, err error) {
+	return estimator.estimate(context, repository, glukitUser, endsOfPeriods)
+}
+
+// The registered scorers and estimators by version, starting with the ones of the current versions
+var (
+	glukitScorers = map[int]GlukitScorer{SCORING_VERSION: glukitScorerFunc{SCORING_VERSION, CalculateGlukitScores}}
+	a1cEstimators = map[int]A1CEstimator{A1C_SCORING_VERSION: a1cEstimatorFunc{A1C_SCORING_VERSION, EstimateA1Cs}}
+)
+
+// RegisterGlukitScorer makes a GlukitScorer available by its version, replacing any scorer registered with the same version.
+// Registering a new version doesn't change the scores calculated as data comes in, that's the SCORING_VERSION one, but scores
+// of any registered version can be recalculated and stored alongside the current ones. Scorers must be registered before the
+// recalculation jobs are, when the web package is initialized.
+func RegisterGlukitScorer(scorer GlukitScorer) {
+	glukitScorers[scorer.Version()] = scorer
+}
+
+// GetGlukitScorer returns the registered GlukitScorer of the given version
+func GetGlukitScorer(version int) (scorer GlukitScorer, ok bool) {
+	scorer, ok = glukitScorers[version]
+	return scorer, ok
+}
+
+// GetGlukitScorers returns all registered GlukitScorers sorted by version
+func GetGlukitScorers() (scorers []GlukitScorer) {
+	versions := make([]int, 0, len(glukitScorers))
+	for version := range glukitScorers {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	scorers = make([]GlukitScorer, len(versions))
+	for i, version := range versions {
+		scorers[i] = glukitScorers[version]
+	}
+
+	return scorers
+}
+
+// RegisterA1CEstimator makes an A1CEstimator available by its version, replacing any estimator registered with the same version.
+// Like with scorers, a1cs are estimated with the A1C_SCORING_VERSION as data comes in and other versions are only recalculated.
+// Estimators must also be registered before the web package is initialized.
+func RegisterA1CEstimator(estimator A1CEstimator) {
+	a1cEstimators[estimator.Version()] = estimator
+}
+
+// GetA1CEstimator returns the registered A1CEstimator of the given version
+func GetA1CEstimator(version int) (estimator A1CEstimator, ok bool) {
+	estimator, ok = a1cEstimators[version]
+	return estimator, ok
+}
+
+// GetA1CEstimators returns all registered A1CEstimators sorted by version
+func GetA1CEstimators() (estimators []A1CEstimator) {
+	versions := make([]int, 0, len(a1cEstimators))
+	for version := range a1cEstimators {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	estimators = make([]A1CEstimator, len(versions))
+	for i, version := range versions {
+		estimators[i] = a1cEstimators[version]
+	}
+
+	return estimators
+}
+
+// GlukitScoreRecalculationJobName returns the name of the job recalculating GlukitScores with the given version
+func GlukitScoreRecalculationJobName(version int) string {
+	return fmt.Sprintf("%s-v%d", GLUKIT_SCORE_RECALCULATION_FUNCTION_NAME, version)
+}
+
+// A1CRecalculationJobName returns the name of the job recalculating A1CEstimates with the given version
+func A1CRecalculationJobName(version int) string {
+	return fmt.Sprintf("%s-v%d", A1C_RECALCULATION_FUNCTION_NAME, version)
+}
+
+// StartGlukitScoreRecalculation queues the recalculation of the glukit scores of a user with the given registered version, from their
+// oldest score of any version onwards. It returns ErrNothingToRecalculate if the user doesn't have any score yet.
+func StartGlukitScoreRecalculation(context context.Context, repository store.ScoreRepository, jobQueue queue.Queue, email string, version int) (err error) {
+	scores, err := repository.GetGlukitScores(context, email, store.ScoreScanQuery{})
+	if err != nil {
+		return err
+	}
+
+	if len(scores) == 0 {
+		return ErrNothingToRecalculate
+	}
+
+	return startRecalculation(context, jobQueue, GlukitScoreRecalculationJobName(version), email, scores[len(scores)-1].UpperBound)
+}
+
+// StartA1CRecalculation queues the recalculation of the a1c estimates of a user with the given registered version, from their oldest
+// estimate of any version onwards. It returns ErrNothingToRecalculate if the user doesn't have any estimate yet.
+func StartA1CRecalculation(context context.Context, repository store.ScoreRepository, jobQueue queue.Queue, email string, version int) (err error) {
+	a1cs, err := repository.GetA1CEstimates(context, email, store.ScoreScanQuery{})
+	if err != nil {
+		return err
+	}
+
+	if len(a1cs) == 0 {
+		return ErrNothingToRecalculate
+	}
+
+	return startRecalculation(context, jobQueue, A1CRecalculationJobName(version), email, a1cs[len(a1cs)-1].UpperBound)
+}
+
+// startRecalculation queues the first chunk of a recalculation job so that its first period ends on the day of the oldest upper bound
+func startRecalculation(context context.Context, jobQueue queue.Queue, jobName string, email string, oldestUpperBound time.Time) (err error) {
+	lowerBound := util.GetMidnightUTCBefore(oldestUpperBound).AddDate(0, 0, -1)
+
+	err = jobQueue.Enqueue(context, BATCH_CALCULATION_QUEUE_NAME, queue.Job{Name: jobName, UserEmail: email, LowerBound: lowerBound})
+	if err != nil {
+		log.Criticalf(context, "Couldn't schedule the execution of [%s] for user [%s]: %v", jobName, email, err)
+		return err
+	}
+
+	log.Infof(context, "Queued up first chunk of [%s] for user [%s] and lowerBound [%s]", jobName, email, lowerBound.Format(util.TIMEFORMAT))
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package engine_test
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"math"
+	"testing"
+	"time"
+)
+
+// readRepository is a GlucoseReadRepository of sorted reads that counts how many times they're loaded
+type readRepository struct {
+	reads []apimodel.GlucoseRead
+	loads int
+}
+
+func (r *readRepository) GetGlucoseReads(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (reads []apimodel.GlucoseRead, err error) {
+	r.loads = r.loads + 1
+	return readsBetween(r.reads, lowerBound, upperBound), nil
+}
+
+func (r *readRepository) StoreDaysOfReads(context context.Context, email string, daysOfReads []apimodel.DayOfGlucoseReads) (err error) {
+	return nil
+}
+
+func readsBetween(reads []apimodel.GlucoseRead, lowerBound time.Time, upperBound time.Time) (between []apimodel.GlucoseRead) {
+	between = make([]apimodel.GlucoseRead, 0)
+	for _, read := range reads {
+		if !read.GetTime().Before(lowerBound) && !read.GetTime().After(upperBound) {
+			between = append(between, read)
+		}
+	}
+
+	return between
+}
+
+// makeVaryingReads returns reads every 5 minutes, for the given number of days, with values scattered between 60 and 240
+func makeVaryingReads(start time.Time, days int) (reads []apimodel.GlucoseRead) {
+	reads = make([]apimodel.GlucoseRead, days*288)
+	for i := range reads {
+		readTime := start.Add(time.Duration(i*5) * time.Minute)
+		reads[i] = apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(readTime), TimeZoneId: "UTC"},
+			Unit: apimodel.MG_PER_DL, Value: 60 + float32((i*7919)%18000)/100}
+	}
+
+	return reads
+}
+
+func TestCalculateGlukitScores(t *testing.T) {
+	start := time.Date(2014, time.April, 1, 0, 0, 0, 0, time.UTC)
+	reads := makeVaryingReads(start, 12)
+	// A day without reads
+	reads = append(reads[:5*288], reads[6*288:]...)
+	repository := &readRepository{reads: reads}
+	user := &model.GlukitUser{Email: "sliding@glukit.com"}
+
+	endsOfPeriods := make([]time.Time, 0)
+	for day := 6; day <= 12; day++ {
+		endsOfPeriods = append(endsOfPeriods, start.AddDate(0, 0, day).Add(time.Hour))
+	}
+
+	glukitScores, err := engine.CalculateGlukitScores(context.Background(), repository, user, endsOfPeriods)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repository.loads != 1 {
+		t.Errorf("TestCalculateGlukitScores failed: got [%d] loads of reads but expected [%d]", repository.loads, 1)
+	}
+
+	for i, endOfPeriod := range endsOfPeriods {
+		upperBound := endOfPeriod.Truncate(24 * time.Hour)
+		window := readsBetween(reads, upperBound.AddDate(0, 0, -1*engine.GLUKIT_SCORE_PERIOD), upperBound)
+
+		expected := int64(model.UNDEFINED_SCORE_VALUE)
+		if len(window) >= engine.READS_REQUIREMENT {
+			expected = 0
+			for _, read := range window[:engine.READS_REQUIREMENT] {
+				expected = expected + int64(engine.CalculateIndividualReadScoreWeight(context.Background(), read, model.DEFAULT_SCORING_TARGET))
+			}
+		}
+
+		if glukitScores[i].Value != expected {
+			t.Errorf("TestCalculateGlukitScores failed: got [%d] for the period ending at [%s] but expected [%d]", glukitScores[i].Value,
+				upperBound, expected)
+		}
+	}
+}
+
+func TestEstimateA1Cs(t *testing.T) {
+	start := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+	reads := makeVaryingReads(start, 100)
+	repository := &readRepository{reads: reads}
+	user := &model.GlukitUser{Email: "sliding@glukit.com"}
+
+	endsOfPeriods := make([]time.Time, 0)
+	for day := 89; day <= 100; day++ {
+		endsOfPeriods = append(endsOfPeriods, start.AddDate(0, 0, day))
+	}
+
+	a1cs, err := engine.EstimateA1Cs(context.Background(), repository, user, endsOfPeriods)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repository.loads != 1 {
+		t.Errorf("TestEstimateA1Cs failed: got [%d] loads of reads but expected [%d]", repository.loads, 1)
+	}
+
+	for i, endOfPeriod := range endsOfPeriods {
+		window := readsBetween(reads, endOfPeriod.AddDate(0, 0, -1*engine.A1C_ESTIMATION_SCORE_PERIOD), endOfPeriod)
+		expected, err := engine.CalculateA1CEstimate(context.Background(), window)
+
+		if err != nil && a1cs[i] != nil {
+			t.Errorf("TestEstimateA1Cs failed: got [%v] for the period ending at [%s] but expected no estimate", *a1cs[i], endOfPeriod)
+		} else if err == nil && (a1cs[i] == nil || math.Abs(a1cs[i].Value-expected.Value) > 1e-9) {
+			t.Errorf("TestEstimateA1Cs failed: got [%v] for the period ending at [%s] but expected [%f]", a1cs[i], endOfPeriod, expected.Value)
+		}
+	}
+}
+
+// constantScorer is a GlukitScorer that gives the same score to every period
+type constantScorer struct {
+	version int
+}
+
+func (scorer constantScorer) Version() int {
+	return scorer.version
+}
+
+func (scorer constantScorer) Score(context context.Context, repository store.GlucoseReadRepository, glukitUser *model.GlukitUser, endsOfPeriods []time.Time) (glukitScores []model.GlukitScore, err error) {
+	glukitScores = make([]model.GlukitScore, len(endsOfPeriods))
+	for i, endOfPeriod := range endsOfPeriods {
+		glukitScores[i] = model.GlukitScore{Value: 100, UpperBound: endOfPeriod, ScoringVersion: scorer.version}
+	}
+
+	return glukitScores, nil
+}
+
+func TestRegisterGlukitScorer(t *testing.T) {
+	if scorer, ok := engine.GetGlukitScorer(engine.SCORING_VERSION); !ok || scorer.Version() != engine.SCORING_VERSION {
+		t.Fatalf("TestRegisterGlukitScorer failed: got no scorer for the current version [%d]", engine.SCORING_VERSION)
+	}
+
+	engine.RegisterGlukitScorer(constantScorer{version: engine.SCORING_VERSION + 1})
+
+	scorers := engine.GetGlukitScorers()
+	if len(scorers) != 2 {
+		t.Fatalf("TestRegisterGlukitScorer failed: got [%d] scorers but expected [%d]", len(scorers), 2)
+	}
+
+	if scorers[0].Version() != engine.SCORING_VERSION || scorers[1].Version() != engine.SCORING_VERSION+1 {
+		t.Errorf("TestRegisterGlukitScorer failed: got versions [%d, %d] but expected [%d, %d]", scorers[0].Version(), scorers[1].Version(),
+			engine.SCORING_VERSION, engine.SCORING_VERSION+1)
+	}
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"sort"
+	"time"
+)
+
+const (
+	RATE_OF_CHANGE_TAG = "RateOfChange"
+	// The window of reads leading to a read its rate of change is calculated from
+	RATE_OF_CHANGE_WINDOW = time.Duration(15) * time.Minute
+	// The minimum number of reads in the window to calculate a rate of change
+	RATE_OF_CHANGE_MIN_READS = 3
+	// Reads further apart than this, which is more than one missed read, don't count towards the same rate of change
+	RATE_OF_CHANGE_MAX_READ_GAP = time.Duration(12) * time.Minute
+	// The rates of change, in mg/dL per minute, from which the trend arrows are at 45 degrees, single and double
+	FORTY_FIVE_TREND_RATE = 1.
+	SINGLE_TREND_RATE     = 2.
+	DOUBLE_TREND_RATE     = 3.
+)
+
+// CalculateTrend returns the trend (one of the TREND_* values) at the most recent of the reads. The reads don't need to be sorted.
+// The trend can't be computed when there aren't enough reads, without gaps, leading to the most recent one.
+func CalculateTrend(reads []apimodel.GlucoseRead) (trend string, err error) {
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values, err := glucoseValues(sortedReads)
+	if err != nil {
+		return "", err
+	}
+
+	if len(values) == 0 {
+		return model.TREND_NOT_COMPUTABLE, nil
+	}
+
+	rate, ok := rateOfChange(values, len(values)-1)
+	if !ok {
+		return model.TREND_NOT_COMPUTABLE, nil
+	}
+
+	return ClassifyTrend(rate), nil
+}
+
+// ClassifyTrend returns the trend (one of the TREND_* values) of a rate of change in mg/dL per minute
+func ClassifyTrend(rate float64) string {
+	switch {
+	case rate <= -DOUBLE_TREND_RATE:
+		return model.TREND_DOUBLE_DOWN
+	case rate <= -SINGLE_TREND_RATE:
+		return model.TREND_SINGLE_DOWN
+	case rate <= -FORTY_FIVE_TREND_RATE:
+		return model.TREND_FORTY_FIVE_DOWN
+	case rate < FORTY_FIVE_TREND_RATE:
+		return model.TREND_FLAT
+	case rate < SINGLE_TREND_RATE:
+		return model.TREND_FORTY_FIVE_UP
+	case rate < DOUBLE_TREND_RATE:
+		return model.TREND_SINGLE_UP
+	default:
+		return model.TREND_DOUBLE_UP
+	}
+}
+
+// CalculateRateOfChange returns the rate of change of glucose, per minute in the requested unit, at each read that has enough reads
+// leading to it. The reads don't need to be sorted.
+func CalculateRateOfChange(reads []apimodel.GlucoseRead, glucoseUnit apimodel.GlucoseUnit) (dataPoints []apimodel.DataPoint, err error) {
+	sortedReads := make(apimodel.GlucoseReadSlice, len(reads))
+	copy(sortedReads, reads)
+	sort.Sort(sortedReads)
+
+	values, err := glucoseValues(sortedReads)
+	if err != nil {
+		return nil, err
+	}
+
+	rateUnit := apimodel.GlucoseUnit(string(glucoseUnit) + "PerMinute")
+	dataPoints = make([]apimodel.DataPoint, 0)
+	for i, read := range sortedReads {
+		rate, ok := rateOfChange(values, i)
+		if !ok {
+			continue
+		}
+
+		localTime, err := read.Time.Format()
+		if err != nil {
+			return nil, err
+		}
+
+		rateRead := apimodel.GlucoseRead{Time: read.Time, Unit: apimodel.MG_PER_DL, Value: float32(rate)}
+		convertedRate, err := rateRead.GetNormalizedValue(glucoseUnit)
+		if err != nil {
+			return nil, err
+		}
+
+		dataPoints = append(dataPoints, apimodel.DataPoint{LocalTime: localTime, EpochTime: read.GetTime().Unix(), Y: convertedRate,
+			Value: convertedRate, Tag: RATE_OF_CHANGE_TAG, Unit: rateUnit})
+	}
+
+	return dataPoints, nil
+}
+
+// glucoseValues returns the values of the reads in mg/dL
+func glucoseValues(reads []apimodel.GlucoseRead) (values []timedValue, err error) {
+	values = make([]timedValue, len(reads))
+	for i, read := range reads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = timedValue{read.Time.Timestamp, float64(value)}
+	}
+
+	return values, nil
+}
+
+// rateOfChange returns the rate of change, in mg/dL per minute, at the value of the given index. The values must be sorted by time.
+// It's the median of the slopes between every pair of values of the RATE_OF_CHANGE_WINDOW leading to it (the Theil-Sen estimator)
+// so that a single noisy read doesn't throw it off. It returns false if there aren't RATE_OF_CHANGE_MIN_READS in the window without
+// a gap between them.
+func rateOfChange(values []timedValue, index int) (rate float64, ok bool) {
+	first := index
+	for first > 0 && values[index].timestamp-values[first-1].timestamp <= int64(RATE_OF_CHANGE_WINDOW/time.Millisecond) &&
+		values[first].timestamp-values[first-1].timestamp <= int64(RATE_OF_CHANGE_MAX_READ_GAP/time.Millisecond) {
+		first = first - 1
+	}
+
+	if index-first+1 < RATE_OF_CHANGE_MIN_READS {
+		return 0, false
+	}
+
+	slopes := make([]float64, 0)
+	for i := first; i < index; i++ {
+		for j := i + 1; j <= index; j++ {
+			minutes := float64(values[j].timestamp-values[i].timestamp) / float64(time.Minute/time.Millisecond)
+			if minutes > 0 {
+				slopes = append(slopes, (values[j].value-values[i].value)/minutes)
+			}
+		}
+	}
+
+	if len(slopes) == 0 {
+		return 0, false
+	}
+
+	sort.Float64s(slopes)
+	middle := len(slopes) / 2
+	if len(slopes)%2 == 1 {
+		return slopes[middle], true
+	}
+
+	return (slopes[middle-1] + slopes[middle]) / 2, true
+}
@@ -0,0 +1,91 @@
+package engine_test
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestClassifyTrend(t *testing.T) {
+	for _, c := range []struct {
+		rate     float64
+		expected string
+	}{
+		{-3.5, model.TREND_DOUBLE_DOWN},
+		{-2., model.TREND_SINGLE_DOWN},
+		{-1.2, model.TREND_FORTY_FIVE_DOWN},
+		{-0.5, model.TREND_FLAT},
+		{0.9, model.TREND_FLAT},
+		{1.5, model.TREND_FORTY_FIVE_UP},
+		{2.9, model.TREND_SINGLE_UP},
+		{3., model.TREND_DOUBLE_UP},
+	} {
+		if trend := engine.ClassifyTrend(c.rate); trend != c.expected {
+			t.Errorf("TestClassifyTrend failed: got [%s] for rate [%f] but expected [%s]", trend, c.rate, c.expected)
+		}
+	}
+}
+
+func TestCalculateTrendWithNoisyRead(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+
+	// Rising by 2.5 mg/dL per minute with a noisy read in the window of the last read
+	reads := makeEpisodeReads(start, 100, 112.5, 125, 160, 150, 162.5)
+
+	trend, err := engine.CalculateTrend(reads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trend != model.TREND_SINGLE_UP {
+		t.Errorf("TestCalculateTrendWithNoisyRead failed: got [%s] but expected [%s]", trend, model.TREND_SINGLE_UP)
+	}
+}
+
+func TestCalculateTrendWithGap(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+
+	// 20 minutes without reads before the last two reads
+	reads := makeEpisodeReads(start, 100, 105, 110, 115, 120, 125, 130)
+	reads = append(reads[:3], reads[5:]...)
+
+	trend, err := engine.CalculateTrend(reads)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trend != model.TREND_NOT_COMPUTABLE {
+		t.Errorf("TestCalculateTrendWithGap failed: got [%s] but expected [%s]", trend, model.TREND_NOT_COMPUTABLE)
+	}
+}
+
+func TestCalculateRateOfChange(t *testing.T) {
+	start := time.Date(2014, time.April, 14, 8, 0, 0, 0, time.UTC)
+
+	// Falling by 1 mg/dL per minute
+	reads := makeEpisodeReads(start, 200, 195, 190, 185)
+
+	dataPoints, err := engine.CalculateRateOfChange(reads, apimodel.MMOL_PER_L)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dataPoints) != 2 {
+		t.Fatalf("TestCalculateRateOfChange failed: got [%d] points but expected [%d]", len(dataPoints), 2)
+	}
+
+	for _, dataPoint := range dataPoints {
+		if math.Abs(float64(dataPoint.Value)+0.0555) > 0.0001 || dataPoint.Tag != engine.RATE_OF_CHANGE_TAG ||
+			dataPoint.Unit != apimodel.MMOL_PER_L+"PerMinute" {
+			t.Errorf("TestCalculateRateOfChange failed: got [%v] but expected a rate of [-0.0555] mmolPerLPerMinute", dataPoint)
+		}
+	}
+
+	if dataPoints[0].EpochTime != start.Add(10*time.Minute).Unix() {
+		t.Errorf("TestCalculateRateOfChange failed: got the first rate at [%d] but expected [%d]", dataPoints[0].EpochTime,
+			start.Add(10*time.Minute).Unix())
+	}
+}
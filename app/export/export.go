@@ -0,0 +1,362 @@
+// export package writes archives of all the data of a user for them to take it out of glukit. Archives are zip files
+// holding a JSON Lines and a CSV file for each type of data along with the user profile.
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	EXPORT_DATA_JOB_NAME = "exportData"
+	EXPORT_QUEUE_NAME    = "export"
+
+	// Size of the windows of data loaded from the store while writing an archive
+	EXPORT_SCAN_PERIOD = time.Duration(30*24) * time.Hour
+
+	PROFILE_FILE_NAME = "profile.json"
+	JSONL_EXTENSION   = ".jsonl"
+	CSV_EXTENSION     = ".csv"
+)
+
+// exportedElement is an element of any type written to an archive, along with its csv record
+type exportedElement struct {
+	timestamp int64
+	value     interface{}
+	record    []string
+}
+
+// exportedKind describes how to load and write one type of data
+type exportedKind struct {
+	name   string
+	header []string
+	// load returns the elements of a user between two inclusive bounds, sorted by time
+	load func(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+		upperBound time.Time) (elements []exportedElement, err error)
+}
+
+var dayOfDataKinds = []exportedKind{
+	exportedKind{"glucosereads", []string{"timestamp", "time", "timezone", "value", "unit"}, loadGlucoseReads},
+	exportedKind{"calibrations", []string{"timestamp", "time", "timezone", "value", "unit"}, loadCalibrations},
+	exportedKind{"injections", []string{"timestamp", "time", "timezone", "units", "insulinName", "insulinType"}, loadInjections},
+	exportedKind{"meals", []string{"timestamp", "time", "timezone", "carbohydrates", "proteins", "fat", "saturatedFat"}, loadMeals},
+	exportedKind{"exercises", []string{"timestamp", "time", "timezone", "durationInMinutes", "intensity", "description"}, loadExercises},
+}
+
+var (
+	GLUKIT_SCORES_HEADER = []string{"lowerBound", "upperBound", "value", "calculatedOn", "scoringVersion"}
+	A1C_ESTIMATES_HEADER = []string{"lowerBound", "upperBound", "value", "calculatedOn", "scoringVersion"}
+	LAB_A1CS_HEADER      = []string{"time", "value"}
+)
+
+// RunExport builds the archive of all of a user's data and stores it. The status of the user's DataExport is updated
+// as it progresses so that the user knows when the archive is ready to download.
+func RunExport(context context.Context, repository store.Repository, email string) (err error) {
+	dataExport, err := repository.GetDataExport(context, email)
+	if err == store.ErrNoDataExport {
+		dataExport = &model.DataExport{RequestedOn: time.Now()}
+	} else if err != nil {
+		return err
+	}
+
+	dataExport.Status = model.DATA_EXPORT_STATUS_RUNNING
+	dataExport.Error = ""
+	if err = repository.StoreDataExport(context, email, *dataExport); err != nil {
+		return err
+	}
+
+	archive := new(bytes.Buffer)
+	if err = WriteArchive(context, repository, email, archive); err == nil {
+		err = repository.StoreDataExportArchive(context, email, archive.Bytes())
+	}
+
+	if err != nil {
+		log.Warningf(context, "Error exporting data of user [%s]: %v", email, err)
+		dataExport.Status = model.DATA_EXPORT_STATUS_FAILED
+		dataExport.Error = err.Error()
+		if storeErr := repository.StoreDataExport(context, email, *dataExport); storeErr != nil {
+			log.Warningf(context, "Error storing failed data export of user [%s]: %v", email, storeErr)
+		}
+
+		return err
+	}
+
+	dataExport.Status = model.DATA_EXPORT_STATUS_DONE
+	dataExport.CompletedOn = time.Now()
+	dataExport.Size = archive.Len()
+	log.Infof(context, "Exported [%d] bytes of data for user [%s]", dataExport.Size, email)
+
+	return repository.StoreDataExport(context, email, *dataExport)
+}
+
+// WriteArchive writes the zip archive of all of a user's data. Days of data are loaded EXPORT_SCAN_PERIOD at a time, from the
+// first day of data up to now, so that a user's whole history doesn't have to be held in memory at once.
+func WriteArchive(context context.Context, repository store.Repository, email string, writer io.Writer) (err error) {
+	userProfile, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(writer)
+
+	profileWriter, err := archive.Create(PROFILE_FILE_NAME)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(profileWriter)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(userProfile); err != nil {
+		return err
+	}
+
+	firstDay, err := repository.GetFirstDayOfData(context, email)
+	hasData := err == nil
+	if err != nil && err != store.ErrNoImportedDataFound {
+		return err
+	}
+
+	upperBound := time.Now()
+	for _, kind := range dayOfDataKinds {
+		jsonlWriter, err := archive.Create(kind.name + JSONL_EXTENSION)
+		if err != nil {
+			return err
+		}
+
+		// The zip writer only writes one file at a time so the csv content is buffered until the json lines are written
+		csvContent := new(bytes.Buffer)
+		csvWriter := csv.NewWriter(csvContent)
+		csvWriter.Write(kind.header)
+
+		count := 0
+		for lowerBound := firstDay; hasData && !lowerBound.After(upperBound); lowerBound = lowerBound.Add(EXPORT_SCAN_PERIOD) {
+			periodUpperBound := lowerBound.Add(EXPORT_SCAN_PERIOD - time.Millisecond)
+			elements, err := kind.load(context, repository, email, lowerBound, periodUpperBound)
+			if err != nil {
+				return err
+			}
+
+			for _, element := range elements {
+				// Days overlapping two periods are returned for both so we only keep what's in this period
+				if element.timestamp < apimodel.GetTimeMillis(lowerBound) || element.timestamp > apimodel.GetTimeMillis(periodUpperBound) {
+					continue
+				}
+
+				if err = writeJSONLine(jsonlWriter, element.value); err != nil {
+					return err
+				}
+				csvWriter.Write(element.record)
+				count = count + 1
+			}
+		}
+
+		if err = writeCSV(archive, kind.name, csvWriter, csvContent); err != nil {
+			return err
+		}
+
+		log.Infof(context, "Exported [%d] %s for user [%s]", count, kind.name, email)
+	}
+
+	if err = writeScores(context, archive, repository, email); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// writeScores writes the GlukitScore and A1CEstimate history of a user along with their lab a1c results, in chronological order
+func writeScores(context context.Context, archive *zip.Writer, repository store.Repository, email string) (err error) {
+	scores, err := repository.GetGlukitScores(context, email, store.ScoreScanQuery{})
+	if err != nil {
+		return err
+	}
+
+	scoreElements := make([]exportedElement, len(scores))
+	for i, score := range scores {
+		scoreElements[len(scores)-1-i] = exportedElement{value: score, record: []string{formatTime(score.LowerBound), formatTime(score.UpperBound),
+			strconv.FormatInt(score.Value, 10), formatTime(score.CalculatedOn), strconv.Itoa(score.ScoringVersion)}}
+	}
+
+	if err = writeSeries(archive, "glukitscores", GLUKIT_SCORES_HEADER, scoreElements); err != nil {
+		return err
+	}
+
+	a1cs, err := repository.GetA1CEstimates(context, email, store.ScoreScanQuery{})
+	if err != nil {
+		return err
+	}
+
+	a1cElements := make([]exportedElement, len(a1cs))
+	for i, a1c := range a1cs {
+		a1cElements[len(a1cs)-1-i] = exportedElement{value: a1c, record: []string{formatTime(a1c.LowerBound), formatTime(a1c.UpperBound),
+			strconv.FormatFloat(a1c.Value, 'f', -1, 64), formatTime(a1c.CalculatedOn), strconv.Itoa(a1c.ScoringVersion)}}
+	}
+
+	if err = writeSeries(archive, "a1cestimates", A1C_ESTIMATES_HEADER, a1cElements); err != nil {
+		return err
+	}
+
+	labA1Cs, err := repository.GetLabA1Cs(context, email)
+	if err != nil {
+		return err
+	}
+
+	labA1CElements := make([]exportedElement, len(labA1Cs))
+	for i, labA1C := range labA1Cs {
+		labA1CElements[len(labA1Cs)-1-i] = exportedElement{value: labA1C, record: []string{formatTime(labA1C.Time),
+			strconv.FormatFloat(labA1C.Value, 'f', -1, 64)}}
+	}
+
+	return writeSeries(archive, "laba1cs", LAB_A1CS_HEADER, labA1CElements)
+}
+
+// writeSeries writes the JSON Lines and CSV files of elements already loaded in memory
+func writeSeries(archive *zip.Writer, name string, header []string, elements []exportedElement) (err error) {
+	jsonlWriter, err := archive.Create(name + JSONL_EXTENSION)
+	if err != nil {
+		return err
+	}
+
+	csvContent := new(bytes.Buffer)
+	csvWriter := csv.NewWriter(csvContent)
+	csvWriter.Write(header)
+
+	for _, element := range elements {
+		if err = writeJSONLine(jsonlWriter, element.value); err != nil {
+			return err
+		}
+		csvWriter.Write(element.record)
+	}
+
+	return writeCSV(archive, name, csvWriter, csvContent)
+}
+
+func writeJSONLine(writer io.Writer, value interface{}) (err error) {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(append(line, '\n'))
+	return err
+}
+
+// writeCSV flushes the buffered csv content to its file in the archive
+func writeCSV(archive *zip.Writer, name string, csvWriter *csv.Writer, csvContent *bytes.Buffer) (err error) {
+	csvWriter.Flush()
+	if err = csvWriter.Error(); err != nil {
+		return errors.New(fmt.Sprintf("Error writing csv file for %s: %v", name, err))
+	}
+
+	fileWriter, err := archive.Create(name + CSV_EXTENSION)
+	if err != nil {
+		return err
+	}
+
+	_, err = csvContent.WriteTo(fileWriter)
+	return err
+}
+
+func formatTime(value time.Time) string {
+	return value.Format(time.RFC3339)
+}
+
+// timeRecord returns the timestamp, local time and timezone columns of an element's time
+func timeRecord(elementTime apimodel.Time) []string {
+	return []string{strconv.FormatInt(elementTime.Timestamp, 10), formatTime(elementTime.GetTime()), elementTime.TimeZoneId}
+}
+
+func formatFloat(value float32) string {
+	return strconv.FormatFloat(float64(value), 'f', -1, 32)
+}
+
+func loadGlucoseReads(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+	upperBound time.Time) (elements []exportedElement, err error) {
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = make([]exportedElement, len(reads))
+	for i, read := range reads {
+		elements[i] = exportedElement{read.Time.Timestamp, read, append(timeRecord(read.Time), formatFloat(read.Value), string(read.Unit))}
+	}
+
+	return elements, nil
+}
+
+func loadCalibrations(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+	upperBound time.Time) (elements []exportedElement, err error) {
+	calibrations, err := repository.GetCalibrations(context, email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = make([]exportedElement, len(calibrations))
+	for i, calibration := range calibrations {
+		elements[i] = exportedElement{calibration.Time.Timestamp, calibration,
+			append(timeRecord(calibration.Time), formatFloat(calibration.Value), string(calibration.Unit))}
+	}
+
+	return elements, nil
+}
+
+func loadInjections(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+	upperBound time.Time) (elements []exportedElement, err error) {
+	injections, err := repository.GetInjections(context, email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = make([]exportedElement, len(injections))
+	for i, injection := range injections {
+		elements[i] = exportedElement{injection.Time.Timestamp, injection,
+			append(timeRecord(injection.Time), formatFloat(injection.Units), injection.InsulinName, injection.InsulinType)}
+	}
+
+	return elements, nil
+}
+
+func loadMeals(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+	upperBound time.Time) (elements []exportedElement, err error) {
+	meals, err := repository.GetMeals(context, email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = make([]exportedElement, len(meals))
+	for i, meal := range meals {
+		elements[i] = exportedElement{meal.Time.Timestamp, meal, append(timeRecord(meal.Time), formatFloat(meal.Carbohydrates),
+			formatFloat(meal.Proteins), formatFloat(meal.Fat), formatFloat(meal.SaturatedFat))}
+	}
+
+	return elements, nil
+}
+
+func loadExercises(context context.Context, repository store.Repository, email string, lowerBound time.Time,
+	upperBound time.Time) (elements []exportedElement, err error) {
+	exercises, err := repository.GetExercises(context, email, lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	elements = make([]exportedElement, len(exercises))
+	for i, exercise := range exercises {
+		elements[i] = exportedElement{exercise.Time.Timestamp, exercise, append(timeRecord(exercise.Time),
+			strconv.Itoa(exercise.DurationMinutes), exercise.Intensity, exercise.Description)}
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,166 @@
+package export_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	. "github.com/alexandre-normand/glukit/app/export"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const EXPORT_TEST_USER = "export@glukit.com"
+
+func setupRepository(t *testing.T) (r *store.SQLRepository) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err = store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := model.GlukitUser{Email: EXPORT_TEST_USER, FirstName: "Jane", DateOfBirth: time.Now(), DiabetesType: "T1", LastUpdated: util.GLUKIT_EPOCH_TIME,
+		MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, BestScore: model.UNDEFINED_SCORE, MostRecentScore: model.UNDEFINED_SCORE,
+		AccountCreated: time.Now(), MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE}
+	if err := r.StoreUserProfile(context.Background(), time.Now(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// readArchive returns the content of each file of a zip archive
+func readArchive(t *testing.T, archive []byte) (files map[string]string) {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files = make(map[string]string)
+	for _, file := range reader.File {
+		fileReader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadAll(fileReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileReader.Close()
+		files[file.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestWriteArchive(t *testing.T) {
+	r := setupRepository(t)
+	c := context.Background()
+
+	// Reads spanning more than one scan period to make sure none are lost or duplicated between periods
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := make([]apimodel.DayOfGlucoseReads, 0)
+	for day := 0; day < 45; day++ {
+		dayStart := start.Add(time.Duration(day*24) * time.Hour)
+		reads := []apimodel.GlucoseRead{
+			apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(dayStart), TimeZoneId: "UTC"}, Unit: apimodel.MG_PER_DL, Value: 100},
+			apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(dayStart.Add(12 * time.Hour)), TimeZoneId: "UTC"}, Unit: apimodel.MG_PER_DL, Value: 150},
+		}
+		days = append(days, apimodel.NewDayOfGlucoseReads(reads))
+	}
+
+	if err := r.StoreDaysOfReads(c, EXPORT_TEST_USER, days); err != nil {
+		t.Fatal(err)
+	}
+
+	mealTime := start.Add(time.Duration(40*24+8) * time.Hour)
+	meal := apimodel.Meal{Time: apimodel.Time{Timestamp: apimodel.GetTimeMillis(mealTime), TimeZoneId: "UTC"}, Carbohydrates: 45}
+	if err := r.StoreDaysOfMeals(c, EXPORT_TEST_USER, []apimodel.DayOfMeals{apimodel.DayOfMeals{Meals: []apimodel.Meal{meal},
+		StartTime: mealTime.Truncate(apimodel.DAY_OF_DATA_DURATION), EndTime: mealTime}}); err != nil {
+		t.Fatal(err)
+	}
+
+	score := model.GlukitScore{Value: 42, LowerBound: start, UpperBound: start.Add(7 * 24 * time.Hour), CalculatedOn: start, ScoringVersion: 1}
+	if err := r.StoreGlukitScoreBatch(c, EXPORT_TEST_USER, []model.GlukitScore{score}); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := new(bytes.Buffer)
+	if err := WriteArchive(c, r, EXPORT_TEST_USER, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readArchive(t, archive.Bytes())
+	for _, name := range []string{"profile.json", "glucosereads.jsonl", "glucosereads.csv", "calibrations.jsonl", "calibrations.csv", "injections.jsonl",
+		"injections.csv", "meals.jsonl", "meals.csv", "exercises.jsonl", "exercises.csv", "glukitscores.jsonl", "glukitscores.csv",
+		"a1cestimates.jsonl", "a1cestimates.csv", "laba1cs.jsonl", "laba1cs.csv"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("TestWriteArchive failed: missing file [%s] in archive", name)
+		}
+	}
+
+	if !strings.Contains(files["profile.json"], "\"Jane\"") {
+		t.Errorf("TestWriteArchive failed: got profile [%s] but expected it to contain the first name", files["profile.json"])
+	}
+
+	if lines := strings.Count(files["glucosereads.jsonl"], "\n"); lines != 90 {
+		t.Errorf("TestWriteArchive failed: got [%d] reads in json lines but expected [%d]", lines, 90)
+	}
+
+	if lines := strings.Count(files["glucosereads.csv"], "\n"); lines != 91 {
+		t.Errorf("TestWriteArchive failed: got [%d] csv lines for reads but expected [%d]", lines, 91)
+	}
+
+	expectedMeal := "1423555200000,2015-02-10T08:00:00Z,UTC,45,0,0,0\n"
+	if files["meals.csv"] != "timestamp,time,timezone,carbohydrates,proteins,fat,saturatedFat\n"+expectedMeal {
+		t.Errorf("TestWriteArchive failed: got meals csv [%s] but expected record [%s]", files["meals.csv"], expectedMeal)
+	}
+
+	if !strings.Contains(files["glukitscores.csv"], "2015-01-01T00:00:00Z,2015-01-08T00:00:00Z,42,") {
+		t.Errorf("TestWriteArchive failed: got scores csv [%s] but expected it to contain the score", files["glukitscores.csv"])
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	r := setupRepository(t)
+	c := context.Background()
+
+	if err := RunExport(c, r, EXPORT_TEST_USER); err != nil {
+		t.Fatal(err)
+	}
+
+	dataExport, err := r.GetDataExport(c, EXPORT_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dataExport.Status != model.DATA_EXPORT_STATUS_DONE {
+		t.Errorf("TestRunExport failed: got status [%s] but expected [%s]", dataExport.Status, model.DATA_EXPORT_STATUS_DONE)
+	}
+
+	archive, err := r.GetDataExportArchive(c, EXPORT_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archive) != dataExport.Size {
+		t.Errorf("TestRunExport failed: got archive of [%d] bytes but expected [%d]", len(archive), dataExport.Size)
+	}
+
+	if files := readArchive(t, archive); files["glucosereads.csv"] != "timestamp,time,timezone,value,unit\n" {
+		t.Errorf("TestRunExport failed: got reads csv [%s] for a user without data but expected only a header", files["glucosereads.csv"])
+	}
+}
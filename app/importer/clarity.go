@@ -0,0 +1,118 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/store"
+	"io"
+	"time"
+)
+
+const (
+	CLARITY_FORMAT = "clarity"
+
+	CLARITY_TIMESTAMP_COLUMN      = "Timestamp (YYYY-MM-DDThh:mm:ss)"
+	CLARITY_EVENT_TYPE_COLUMN     = "Event Type"
+	CLARITY_EVENT_SUBTYPE_COLUMN  = "Event Subtype"
+	CLARITY_GLUCOSE_COLUMN_PREFIX = "Glucose Value"
+	CLARITY_INSULIN_COLUMN        = "Insulin Value (u)"
+	CLARITY_CARBS_COLUMN          = "Carb Value (grams)"
+	CLARITY_DURATION_COLUMN       = "Duration (hh:mm:ss)"
+	CLARITY_TIMESTAMP_FORMAT      = "2006-01-02T15:04:05"
+)
+
+// ClarityImporter imports the csv exports of Dexcom Clarity. Besides the CGM reads, the exports include the calibrations
+// and the events entered on the receiver. Rows that aren't data, like the patient and device information, are skipped.
+type ClarityImporter struct {
+}
+
+func (importer *ClarityImporter) Name() string {
+	return CLARITY_FORMAT
+}
+
+func (importer *ClarityImporter) Detect(head []byte) bool {
+	return bytes.Contains(head, []byte(CLARITY_TIMESTAMP_COLUMN)) && bytes.Contains(head, []byte(CLARITY_EVENT_TYPE_COLUMN))
+}
+
+func (importer *ClarityImporter) Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+	location *time.Location) (lastReadTime time.Time, err error) {
+	table, err := newCSVTable(reader, ',', CLARITY_TIMESTAMP_COLUMN, CLARITY_EVENT_TYPE_COLUMN)
+	if err != nil {
+		return lastReadTime, err
+	}
+
+	glucoseColumn := table.columnWithPrefix(CLARITY_GLUCOSE_COLUMN_PREFIX)
+	unit := unitOfColumn(glucoseColumn)
+
+	records := newRecords(startTime)
+	for {
+		row, err := table.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return lastReadTime, err
+		}
+
+		// Patient, device and alert settings rows don't have a timestamp
+		if row.get(CLARITY_TIMESTAMP_COLUMN) == "" {
+			continue
+		}
+
+		rowTime, err := time.ParseInLocation(CLARITY_TIMESTAMP_FORMAT, row.get(CLARITY_TIMESTAMP_COLUMN), location)
+		if err != nil {
+			return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+		}
+		timestamp := apimodel.Time{Timestamp: apimodel.GetTimeMillis(rowTime), TimeZoneId: location.String()}
+
+		switch row.get(CLARITY_EVENT_TYPE_COLUMN) {
+		case "EGV":
+			if value, ok, err := parseGlucoseValue(row.get(glucoseColumn), unit); err != nil {
+				return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+			} else if ok {
+				records.addGlucoseRead(apimodel.GlucoseRead{Time: timestamp, Unit: unit, Value: value})
+			}
+		case "Calibration":
+			if value, ok, err := parseGlucoseValue(row.get(glucoseColumn), unit); err != nil {
+				return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+			} else if ok {
+				records.addCalibration(apimodel.CalibrationRead{Time: timestamp, Unit: unit, Value: value})
+			}
+		case "Carbs":
+			if carbs, ok, err := parseQuantity(row.get(CLARITY_CARBS_COLUMN)); err != nil {
+				return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+			} else if ok {
+				records.addMeal(apimodel.Meal{Time: timestamp, Carbohydrates: carbs})
+			}
+		case "Insulin":
+			if units, ok, err := parseQuantity(row.get(CLARITY_INSULIN_COLUMN)); err != nil {
+				return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+			} else if ok {
+				records.addInjection(apimodel.Injection{Time: timestamp, Units: units, InsulinType: row.get(CLARITY_EVENT_SUBTYPE_COLUMN)})
+			}
+		case "Exercise":
+			duration, err := parseClarityDuration(row.get(CLARITY_DURATION_COLUMN))
+			if err != nil {
+				return lastReadTime, parseError(CLARITY_FORMAT, table.line, err)
+			}
+
+			records.addExercise(apimodel.Exercise{Time: timestamp, DurationMinutes: duration, Intensity: row.get(CLARITY_EVENT_SUBTYPE_COLUMN)})
+		}
+	}
+
+	return records.store(context, repository, email)
+}
+
+// parseClarityDuration parses a duration formatted as hh:mm:ss into minutes
+func parseClarityDuration(value string) (minutes int, err error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	duration, err := time.Parse("15:04:05", value)
+	if err != nil {
+		return 0, err
+	}
+
+	return duration.Hour()*60 + duration.Minute(), nil
+}
@@ -0,0 +1,394 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/store"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GENERIC_CSV_FORMAT = "csv"
+
+	// The values stored for reads reported as out of the sensor's range
+	LOW_READ_MG_PER_DL    = 40.
+	HIGH_READ_MG_PER_DL   = 400.
+	LOW_READ_MMOL_PER_L   = 2.2
+	HIGH_READ_MMOL_PER_L  = 22.2
+	MAX_HEADER_SEARCH_ROW = 50
+)
+
+var utf8ByteOrderMark = []byte("\xef\xbb\xbf")
+
+// ErrMissingHeader is returned when a csv file doesn't have a header row with the expected columns
+var ErrMissingHeader = errors.New("No header row with the expected columns found")
+
+// CSVColumnMapping describes the columns of a generic csv export. Only the Time and Glucose columns are required and the
+// other ones are imported when they are set.
+type CSVColumnMapping struct {
+	// The column of the local time of the row
+	Time string `json:"time"`
+	// The layout of the time values, as defined by the time package
+	TimeFormat string `json:"timeFormat"`
+	// The column of the CGM glucose reads
+	Glucose string `json:"glucose"`
+	// The unit of the glucose and calibration values
+	GlucoseUnit apimodel.GlucoseUnit `json:"glucoseUnit"`
+	// The column of the meter reads used to calibrate
+	Calibration string `json:"calibration"`
+	// The column of the carbohydrates eaten, in grams
+	Carbohydrates string `json:"carbohydrates"`
+	// The column of the insulin units injected
+	Insulin string `json:"insulin"`
+	// The separator of the values, a comma if empty
+	Separator string `json:"separator"`
+}
+
+// GenericCSVImporter imports csv files that have one row per time with a column for each type of value. Since the columns
+// vary from one file to the other, the format isn't detected and the importer must be created with the mapping of the file.
+type GenericCSVImporter struct {
+	mapping CSVColumnMapping
+}
+
+// NewGenericCSVImporter creates an importer for csv files with the given mapping.
+func NewGenericCSVImporter(mapping CSVColumnMapping) (importer *GenericCSVImporter, err error) {
+	if mapping.Time == "" || mapping.Glucose == "" {
+		return nil, errors.New("The time and glucose columns are required")
+	}
+
+	if mapping.TimeFormat == "" {
+		return nil, errors.New("The time format is required")
+	}
+
+	if mapping.GlucoseUnit != apimodel.MG_PER_DL && mapping.GlucoseUnit != apimodel.MMOL_PER_L {
+		return nil, errors.New(fmt.Sprintf("Bad glucose unit, [%s] is not one of [%s, %s]", mapping.GlucoseUnit, apimodel.MG_PER_DL, apimodel.MMOL_PER_L))
+	}
+
+	if len([]rune(mapping.Separator)) > 1 {
+		return nil, errors.New(fmt.Sprintf("Bad separator [%s], must be a single character", mapping.Separator))
+	}
+
+	return &GenericCSVImporter{mapping}, nil
+}
+
+func (importer *GenericCSVImporter) Name() string {
+	return GENERIC_CSV_FORMAT
+}
+
+// Detect always returns false since generic files can only be imported with their mapping
+func (importer *GenericCSVImporter) Detect(head []byte) bool {
+	return false
+}
+
+func (importer *GenericCSVImporter) Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+	location *time.Location) (lastReadTime time.Time, err error) {
+	mapping := importer.mapping
+	separator := ','
+	if mapping.Separator != "" {
+		separator = []rune(mapping.Separator)[0]
+	}
+
+	table, err := newCSVTable(reader, separator, mapping.Time, mapping.Glucose)
+	if err != nil {
+		return lastReadTime, err
+	}
+
+	records := newRecords(startTime)
+	for {
+		row, err := table.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return lastReadTime, err
+		}
+
+		if row.get(mapping.Time) == "" {
+			continue
+		}
+
+		rowTime, err := time.ParseInLocation(mapping.TimeFormat, row.get(mapping.Time), location)
+		if err != nil {
+			return lastReadTime, parseError(GENERIC_CSV_FORMAT, table.line, err)
+		}
+		timestamp := apimodel.Time{Timestamp: apimodel.GetTimeMillis(rowTime), TimeZoneId: location.String()}
+
+		if value, ok, err := parseGlucoseValue(row.get(mapping.Glucose), mapping.GlucoseUnit); err != nil {
+			return lastReadTime, parseError(GENERIC_CSV_FORMAT, table.line, err)
+		} else if ok {
+			records.addGlucoseRead(apimodel.GlucoseRead{Time: timestamp, Unit: mapping.GlucoseUnit, Value: value})
+		}
+
+		if value, ok, err := parseGlucoseValue(row.get(mapping.Calibration), mapping.GlucoseUnit); err != nil {
+			return lastReadTime, parseError(GENERIC_CSV_FORMAT, table.line, err)
+		} else if ok {
+			records.addCalibration(apimodel.CalibrationRead{Time: timestamp, Unit: mapping.GlucoseUnit, Value: value})
+		}
+
+		if carbs, ok, err := parseQuantity(row.get(mapping.Carbohydrates)); err != nil {
+			return lastReadTime, parseError(GENERIC_CSV_FORMAT, table.line, err)
+		} else if ok {
+			records.addMeal(apimodel.Meal{Time: timestamp, Carbohydrates: carbs})
+		}
+
+		if units, ok, err := parseQuantity(row.get(mapping.Insulin)); err != nil {
+			return lastReadTime, parseError(GENERIC_CSV_FORMAT, table.line, err)
+		} else if ok {
+			records.addInjection(apimodel.Injection{Time: timestamp, Units: units})
+		}
+	}
+
+	return records.store(context, repository, email)
+}
+
+// csvTable reads the rows of a csv file that follow its header row and gives access to their values by column name
+type csvTable struct {
+	reader  *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+// csvRow is a row of a csvTable
+type csvRow struct {
+	values  []string
+	columns map[string]int
+}
+
+// newCSVTable creates a csvTable after skipping the rows before the header row, which is the first one with all the
+// required columns
+func newCSVTable(reader io.Reader, separator rune, requiredColumns ...string) (table *csvTable, err error) {
+	table = new(csvTable)
+	table.reader = csv.NewReader(reader)
+	table.reader.Comma = separator
+	table.reader.FieldsPerRecord = -1
+	table.reader.LazyQuotes = true
+
+	for table.line < MAX_HEADER_SEARCH_ROW {
+		values, err := table.reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		table.line = table.line + 1
+
+		columns := make(map[string]int)
+		for i, value := range values {
+			if i == 0 {
+				value = string(bytes.TrimPrefix([]byte(value), utf8ByteOrderMark))
+			}
+			columns[strings.TrimSpace(value)] = i
+		}
+
+		if hasColumns(columns, requiredColumns) {
+			table.columns = columns
+			return table, nil
+		}
+	}
+
+	return nil, ErrMissingHeader
+}
+
+func hasColumns(columns map[string]int, requiredColumns []string) bool {
+	for _, column := range requiredColumns {
+		if _, ok := columns[column]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// columnWithPrefix returns the first column of the header that starts with the prefix, or an empty string if there's none
+func (table *csvTable) columnWithPrefix(prefix string) string {
+	names := make([]string, 0, len(table.columns))
+	for name := range table.columns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// next returns the next row of the table or io.EOF after the last one
+func (table *csvTable) next() (row csvRow, err error) {
+	values, err := table.reader.Read()
+	if err != nil {
+		return row, err
+	}
+	table.line = table.line + 1
+
+	return csvRow{values, table.columns}, nil
+}
+
+// get returns the trimmed value of the column or an empty string if the row doesn't have it
+func (row csvRow) get(column string) string {
+	i, ok := row.columns[column]
+	if !ok || i >= len(row.values) {
+		return ""
+	}
+
+	return strings.TrimSpace(row.values[i])
+}
+
+// unitOfColumn returns the glucose unit mentioned in the name of a column, mg/dL if it's not mmol/L
+func unitOfColumn(column string) apimodel.GlucoseUnit {
+	if strings.Contains(strings.ToLower(column), "mmol") {
+		return apimodel.MMOL_PER_L
+	}
+
+	return apimodel.MG_PER_DL
+}
+
+// parseGlucoseValue parses a glucose value. Values reported as low or high are set to the limits of the sensor's range.
+// It returns false if the value is empty.
+func parseGlucoseValue(value string, unit apimodel.GlucoseUnit) (glucose float32, ok bool, err error) {
+	switch strings.ToLower(value) {
+	case "":
+		return 0., false, nil
+	case "low", "lo":
+		if unit == apimodel.MMOL_PER_L {
+			return LOW_READ_MMOL_PER_L, true, nil
+		}
+		return LOW_READ_MG_PER_DL, true, nil
+	case "high", "hi":
+		if unit == apimodel.MMOL_PER_L {
+			return HIGH_READ_MMOL_PER_L, true, nil
+		}
+		return HIGH_READ_MG_PER_DL, true, nil
+	}
+
+	return parseQuantity(value)
+}
+
+// parseQuantity parses a number that can use a comma as decimal separator. It returns false if the value is empty.
+func parseQuantity(value string) (quantity float32, ok bool, err error) {
+	if value == "" {
+		return 0., false, nil
+	}
+
+	parsed, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 32)
+	if err != nil {
+		return 0., false, err
+	}
+
+	return float32(parsed), true, nil
+}
+
+// records holds the data of a csv file. Since csv exports aren't always sorted by time, everything is kept in memory
+// and sorted before it's streamed to the repository.
+type records struct {
+	startTime    time.Time
+	glucoseReads apimodel.GlucoseReadSlice
+	calibrations apimodel.CalibrationReadSlice
+	injections   apimodel.InjectionSlice
+	meals        apimodel.MealSlice
+	exercises    apimodel.ExerciseSlice
+}
+
+// newRecords creates records that skip everything before the startTime
+func newRecords(startTime time.Time) *records {
+	r := new(records)
+	r.startTime = startTime
+	r.glucoseReads = make(apimodel.GlucoseReadSlice, 0)
+	r.calibrations = make(apimodel.CalibrationReadSlice, 0)
+	r.injections = make(apimodel.InjectionSlice, 0)
+	r.meals = make(apimodel.MealSlice, 0)
+	r.exercises = make(apimodel.ExerciseSlice, 0)
+
+	return r
+}
+
+func (r *records) isNew(t apimodel.Time) bool {
+	return t.GetTime().Unix() > r.startTime.Unix()
+}
+
+func (r *records) addGlucoseRead(read apimodel.GlucoseRead) {
+	if r.isNew(read.Time) && read.Value > 0 {
+		r.glucoseReads = append(r.glucoseReads, read)
+	}
+}
+
+func (r *records) addCalibration(calibration apimodel.CalibrationRead) {
+	if r.isNew(calibration.Time) && calibration.Value > 0 {
+		r.calibrations = append(r.calibrations, calibration)
+	}
+}
+
+func (r *records) addInjection(injection apimodel.Injection) {
+	if r.isNew(injection.Time) {
+		r.injections = append(r.injections, injection)
+	}
+}
+
+func (r *records) addMeal(meal apimodel.Meal) {
+	if r.isNew(meal.Time) {
+		r.meals = append(r.meals, meal)
+	}
+}
+
+func (r *records) addExercise(exercise apimodel.Exercise) {
+	if r.isNew(exercise.Time) {
+		r.exercises = append(r.exercises, exercise)
+	}
+}
+
+// store sorts the records and streams them to the repository. It returns the time of the last glucose read or the
+// startTime if there's no new read.
+func (r *records) store(context context.Context, repository store.Repository, email string) (lastReadTime time.Time, err error) {
+	sort.Sort(r.glucoseReads)
+	sort.Sort(r.calibrations)
+	sort.Sort(r.injections)
+	sort.Sort(r.meals)
+	sort.Sort(r.exercises)
+
+	log.Debugf(context, "Storing [%d] reads, [%d] calibrations, [%d] injections, [%d] meals and [%d] exercises for [%s]",
+		len(r.glucoseReads), len(r.calibrations), len(r.injections), len(r.meals), len(r.exercises), email)
+
+	lastReadTime = r.startTime
+	streams := newStreams(context, repository, email)
+	if streams.glucoseReads, err = streams.glucoseReads.WriteGlucoseReads(r.glucoseReads); err != nil {
+		return lastReadTime, err
+	}
+
+	if streams.calibrations, err = streams.calibrations.WriteCalibrations(r.calibrations); err != nil {
+		return lastReadTime, err
+	}
+
+	if streams.injections, err = streams.injections.WriteInjections(r.injections); err != nil {
+		return lastReadTime, err
+	}
+
+	if streams.meals, err = streams.meals.WriteMeals(r.meals); err != nil {
+		return lastReadTime, err
+	}
+
+	if streams.exercises, err = streams.exercises.WriteExercises(r.exercises); err != nil {
+		return lastReadTime, err
+	}
+
+	if err = streams.close(); err != nil {
+		return lastReadTime, err
+	}
+
+	if len(r.glucoseReads) > 0 {
+		lastReadTime = r.glucoseReads[len(r.glucoseReads)-1].GetTime()
+	}
+
+	log.Infof(context, "Done storing all data for [%s]", email)
+	return lastReadTime, nil
+}
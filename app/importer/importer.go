@@ -0,0 +1,168 @@
+// The importer package parses the files exported by CGM software and streams their content to the store. Each supported
+// format has its Importer and the format of a file is detected from its first bytes.
+package importer
+
+import (
+	stdbufio "bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/bufio"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/streaming"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// The number of bytes at the beginning of a file given to importers to detect its format
+	DETECTION_HEAD_SIZE = 4096
+)
+
+// ErrUnknownFormat is returned when no registered importer recognizes the format of a file
+var ErrUnknownFormat = errors.New("Unknown file format")
+
+// Importer parses a file format and streams its content to the repository.
+type Importer interface {
+	// Name returns the unique name of the format
+	Name() string
+
+	// Detect returns true if the head of a file, which is at most DETECTION_HEAD_SIZE bytes, is in the importer's format
+	Detect(head []byte) bool
+
+	// Import parses the file and stores its content. Data before the startTime is skipped. The location is the timezone of the
+	// file's local times, for formats that don't include it. It returns the time of the last glucose read.
+	Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+		location *time.Location) (lastReadTime time.Time, err error)
+}
+
+var importers = make([]Importer, 0)
+var importersLock sync.RWMutex
+
+func init() {
+	Register(new(DexcomStudioImporter))
+	Register(new(ClarityImporter))
+	Register(new(LibreImporter))
+}
+
+// Register adds an importer to the ones used to detect the format of files.
+func Register(importer Importer) {
+	importersLock.Lock()
+	defer importersLock.Unlock()
+
+	importers = append(importers, importer)
+}
+
+// ForName returns the registered importer with the given name or nil if there's none
+func ForName(name string) Importer {
+	importersLock.RLock()
+	defer importersLock.RUnlock()
+
+	for _, importer := range importers {
+		if importer.Name() == name {
+			return importer
+		}
+	}
+
+	return nil
+}
+
+// Detect finds the importer for the content of the reader. It returns a reader that still includes the bytes read to detect
+// the format.
+func Detect(reader io.Reader) (importer Importer, content io.Reader, err error) {
+	bufferedReader := stdbufio.NewReaderSize(reader, DETECTION_HEAD_SIZE)
+	head, err := bufferedReader.Peek(DETECTION_HEAD_SIZE)
+	if err != nil && err != io.EOF && err != stdbufio.ErrBufferFull {
+		return nil, bufferedReader, err
+	}
+
+	importersLock.RLock()
+	defer importersLock.RUnlock()
+
+	for _, importer := range importers {
+		if importer.Detect(head) {
+			return importer, bufferedReader, nil
+		}
+	}
+
+	return nil, bufferedReader, ErrUnknownFormat
+}
+
+// Import detects the format of the file and imports it with the matching importer
+func Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+	location *time.Location) (lastReadTime time.Time, err error) {
+	importer, content, err := Detect(reader)
+	if err != nil {
+		return lastReadTime, err
+	}
+
+	return importer.Import(context, content, repository, email, startTime, location)
+}
+
+// streams holds the streamers that write each kind of data to the repository, in batches of days of data
+type streams struct {
+	calibrations *streaming.CalibrationReadStreamer
+	glucoseReads *streaming.GlucoseReadStreamer
+	injections   *streaming.InjectionStreamer
+	meals        *streaming.MealStreamer
+	exercises    *streaming.ExerciseStreamer
+}
+
+// newStreams creates the streamers that write to the repository for the given user
+func newStreams(context context.Context, repository store.Repository, email string) *streams {
+	s := new(streams)
+
+	calibrationRepositoryWriter := store.NewRepositoryCalibrationBatchWriter(context, repository, email)
+	calibrationBatchingWriter := bufio.NewCalibrationWriterSize(calibrationRepositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	s.calibrations = streaming.NewCalibrationReadStreamerDuration(calibrationBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+
+	glucoseRepositoryWriter := store.NewRepositoryGlucoseReadBatchWriter(context, repository, email)
+	glucoseBatchingWriter := bufio.NewGlucoseReadWriterSize(glucoseRepositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	s.glucoseReads = streaming.NewGlucoseStreamerDuration(glucoseBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+
+	injectionRepositoryWriter := store.NewRepositoryInjectionBatchWriter(context, repository, email)
+	injectionBatchingWriter := bufio.NewInjectionWriterSize(injectionRepositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	s.injections = streaming.NewInjectionStreamerDuration(injectionBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+
+	mealRepositoryWriter := store.NewRepositoryMealBatchWriter(context, repository, email)
+	mealBatchingWriter := bufio.NewMealWriterSize(mealRepositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	s.meals = streaming.NewMealStreamerDuration(mealBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+
+	exerciseRepositoryWriter := store.NewRepositoryExerciseBatchWriter(context, repository, email)
+	exerciseBatchingWriter := bufio.NewExerciseWriterSize(exerciseRepositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	s.exercises = streaming.NewExerciseStreamerDuration(exerciseBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+
+	return s
+}
+
+// close closes the streams and flushes anything pending
+func (s *streams) close() (err error) {
+	if s.glucoseReads, err = s.glucoseReads.Close(); err != nil {
+		return err
+	}
+
+	if s.calibrations, err = s.calibrations.Close(); err != nil {
+		return err
+	}
+
+	if s.injections, err = s.injections.Close(); err != nil {
+		return err
+	}
+
+	if s.meals, err = s.meals.Close(); err != nil {
+		return err
+	}
+
+	if s.exercises, err = s.exercises.Close(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseError returns an error about a line of a file that couldn't be parsed
+func parseError(format string, line int, err error) error {
+	return errors.New(fmt.Sprintf("Error parsing line [%d] of %s file: %v", line, format, err))
+}
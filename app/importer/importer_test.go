@@ -0,0 +1,207 @@
+package importer_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	. "github.com/alexandre-normand/glukit/app/importer"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"testing"
+	"time"
+)
+
+const IMPORT_TEST_USER = "import@glukit.com"
+
+const CLARITY_EXPORT = "\xef\xbb\xbfIndex,Timestamp (YYYY-MM-DDThh:mm:ss),Event Type,Event Subtype,Patient Info,Device Info,Source Device ID,Glucose Value (mg/dL),Insulin Value (u),Carb Value (grams),Duration (hh:mm:ss),Glucose Rate of Change (mg/dL/min),Transmitter Time (Long Integer),Transmitter ID\n" +
+	"1,,FirstName,,Jane,,,,,,,,,\n" +
+	"2,,Device,,,G6 Mobile App,Android G6,,,,,,,\n" +
+	"3,2019-05-01T08:05:00,EGV,,,,Android G6,105,,,,,1000,80AAAA\n" +
+	"4,2019-05-01T08:00:00,EGV,,,,Android G6,Low,,,,,700,80AAAA\n" +
+	"5,2019-05-01T08:10:00,Calibration,,,,Android G6,110,,,,,,\n" +
+	"6,2019-05-01T08:15:00,Carbs,,,,Android G6,,,45,,,,\n" +
+	"7,2019-05-01T08:20:00,Insulin,Fast-Acting,,,Android G6,,4.5,,,,,\n" +
+	"8,2019-05-01T09:00:00,Exercise,Medium,,,Android G6,,,,00:45:00,,,\n" +
+	"9,2019-05-01T08:25:00,EGV,,,,Android G6,High,,,,,1300,80AAAA\n"
+
+const LIBRE_EXPORT = "Patient report,Generated on,5/2/2019 10:00 UTC,Generated by,Jane Doe\n" +
+	"Device,Serial Number,Device Timestamp,Record Type,Historic Glucose mmol/L,Scan Glucose mmol/L,Non-numeric Rapid-Acting Insulin,Rapid-Acting Insulin (units),Non-numeric Food,Carbohydrates (grams),Carbohydrates (servings),Non-numeric Long-Acting Insulin,Long-Acting Insulin Value (units),Notes,Strip Glucose mmol/L\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:00,0,6.1,,,,,,,,,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:07,1,,6.4,,,,,,,,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:15,0,6.8,,,,,,,,,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:20,4,,,,3,,,,,,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:22,4,,,,,,,,,10,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:25,5,,,,,,30,,,,,\n" +
+	"FreeStyle LibreLink,ABC,05-01-2019 08:30,2,,,,,,,,,,,5.9\n"
+
+const GENERIC_EXPORT = "date;bg;carbs;bolus\n" +
+	"01/05/2019 08:00;120;;\n" +
+	"01/05/2019 08:05;125,5;30;2\n"
+
+func setupRepository(t *testing.T) (r *store.SQLRepository) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err = store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := model.GlukitUser{Email: IMPORT_TEST_USER, DateOfBirth: time.Now(), DiabetesType: "T1", LastUpdated: util.GLUKIT_EPOCH_TIME,
+		MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, BestScore: model.UNDEFINED_SCORE, MostRecentScore: model.UNDEFINED_SCORE,
+		AccountCreated: time.Now(), MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE}
+	if err := r.StoreUserProfile(context.Background(), time.Now(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestDetectFormats(t *testing.T) {
+	for expected, content := range map[string]string{CLARITY_FORMAT: CLARITY_EXPORT, LIBRE_FORMAT: LIBRE_EXPORT, DEXCOM_STUDIO_FORMAT: "\xef\xbb\xbf<Patient Id=\"{1}\">"} {
+		importer, _, err := Detect(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if importer.Name() != expected {
+			t.Errorf("TestDetectFormats failed: got format [%s] but expected [%s]", importer.Name(), expected)
+		}
+	}
+
+	if _, _, err := Detect(strings.NewReader(GENERIC_EXPORT)); err != ErrUnknownFormat {
+		t.Errorf("TestDetectFormats failed: got error [%v] but expected [%v]", err, ErrUnknownFormat)
+	}
+}
+
+func TestImportClarity(t *testing.T) {
+	r := setupRepository(t)
+	c := context.Background()
+	location, _ := time.LoadLocation("America/Los_Angeles")
+
+	lastReadTime, err := Import(c, strings.NewReader(CLARITY_EXPORT), r, IMPORT_TEST_USER, util.GLUKIT_EPOCH_TIME, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLastReadTime := time.Date(2019, time.May, 1, 8, 25, 0, 0, location)
+	if !lastReadTime.Equal(expectedLastReadTime) {
+		t.Errorf("TestImportClarity failed: got last read time [%v] but expected [%v]", lastReadTime, expectedLastReadTime)
+	}
+
+	lowerBound := time.Date(2019, time.May, 1, 0, 0, 0, 0, location)
+	upperBound := lowerBound.AddDate(0, 0, 1)
+	reads, err := r.GetGlucoseReads(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reads are stored sorted even if the export isn't and reads out of the sensor's range are kept at its limits
+	expectedValues := []float32{LOW_READ_MG_PER_DL, 105, HIGH_READ_MG_PER_DL}
+	if len(reads) != len(expectedValues) {
+		t.Fatalf("TestImportClarity failed: got [%d] reads but expected [%d]", len(reads), len(expectedValues))
+	}
+	for i, read := range reads {
+		if read.Value != expectedValues[i] || read.Time.TimeZoneId != "America/Los_Angeles" {
+			t.Errorf("TestImportClarity failed: got read [%v] but expected a value of [%f] in America/Los_Angeles", read, expectedValues[i])
+		}
+	}
+
+	calibrations, _ := r.GetCalibrations(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	meals, _ := r.GetMeals(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	injections, _ := r.GetInjections(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	exercises, _ := r.GetExercises(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(calibrations) != 1 || calibrations[0].Value != 110 {
+		t.Errorf("TestImportClarity failed: got calibrations [%v] but expected one of [%d]", calibrations, 110)
+	}
+	if len(meals) != 1 || meals[0].Carbohydrates != 45 {
+		t.Errorf("TestImportClarity failed: got meals [%v] but expected one of [%d] grams", meals, 45)
+	}
+	if len(injections) != 1 || injections[0].Units != 4.5 || injections[0].InsulinType != "Fast-Acting" {
+		t.Errorf("TestImportClarity failed: got injections [%v] but expected one of [%f] fast-acting units", injections, 4.5)
+	}
+	if len(exercises) != 1 || exercises[0].DurationMinutes != 45 || exercises[0].Intensity != "Medium" {
+		t.Errorf("TestImportClarity failed: got exercises [%v] but expected one of [%d] minutes", exercises, 45)
+	}
+}
+
+func TestImportLibre(t *testing.T) {
+	r := setupRepository(t)
+	c := context.Background()
+
+	// Skip the first read to check that data before the start time isn't imported
+	startTime := time.Date(2019, time.May, 1, 8, 0, 0, 0, time.UTC)
+	if _, err := Import(c, strings.NewReader(LIBRE_EXPORT), r, IMPORT_TEST_USER, startTime, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+
+	lowerBound := time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC)
+	upperBound := lowerBound.AddDate(0, 0, 1)
+	reads, _ := r.GetGlucoseReads(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(reads) != 2 || reads[0].Value != 6.4 || reads[0].Unit != apimodel.MMOL_PER_L || reads[1].Value != 6.8 {
+		t.Errorf("TestImportLibre failed: got reads [%v] but expected a scan of 6.4 and a historic read of 6.8 mmol/L", reads)
+	}
+
+	injections, _ := r.GetInjections(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(injections) != 2 {
+		t.Errorf("TestImportLibre failed: got injections [%v] but expected a rapid-acting and a long-acting one", injections)
+	}
+
+	meals, _ := r.GetMeals(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(meals) != 1 || meals[0].Carbohydrates != 30 {
+		t.Errorf("TestImportLibre failed: got meals [%v] but expected one of [%d] grams", meals, 30)
+	}
+
+	calibrations, _ := r.GetCalibrations(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(calibrations) != 1 || calibrations[0].Value != 5.9 {
+		t.Errorf("TestImportLibre failed: got calibrations [%v] but expected a strip test of 5.9 mmol/L", calibrations)
+	}
+}
+
+func TestImportGenericCSV(t *testing.T) {
+	r := setupRepository(t)
+	c := context.Background()
+
+	if _, err := NewGenericCSVImporter(CSVColumnMapping{Time: "date", TimeFormat: "02/01/2006 15:04"}); err == nil {
+		t.Errorf("TestImportGenericCSV failed: expected an error for a mapping without a glucose column")
+	}
+
+	importer, err := NewGenericCSVImporter(CSVColumnMapping{Time: "date", TimeFormat: "02/01/2006 15:04", Glucose: "bg", GlucoseUnit: apimodel.MG_PER_DL,
+		Carbohydrates: "carbs", Insulin: "bolus", Separator: ";"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := importer.Import(c, strings.NewReader(GENERIC_EXPORT), r, IMPORT_TEST_USER, util.GLUKIT_EPOCH_TIME, time.UTC); err != nil {
+		t.Fatal(err)
+	}
+
+	lowerBound := time.Date(2019, time.May, 1, 0, 0, 0, 0, time.UTC)
+	upperBound := lowerBound.AddDate(0, 0, 1)
+	reads, _ := r.GetGlucoseReads(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(reads) != 2 || reads[1].Value != 125.5 {
+		t.Errorf("TestImportGenericCSV failed: got reads [%v] but expected 2 reads ending with [%f]", reads, 125.5)
+	}
+
+	meals, _ := r.GetMeals(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	injections, _ := r.GetInjections(c, IMPORT_TEST_USER, lowerBound, upperBound)
+	if len(meals) != 1 || len(injections) != 1 {
+		t.Errorf("TestImportGenericCSV failed: got meals [%v] and injections [%v] but expected one of each", meals, injections)
+	}
+}
+
+func TestImportBadRow(t *testing.T) {
+	r := setupRepository(t)
+	content := strings.Replace(CLARITY_EXPORT, "105", "abc", 1)
+
+	if _, err := Import(context.Background(), strings.NewReader(content), r, IMPORT_TEST_USER, util.GLUKIT_EPOCH_TIME, time.UTC); err == nil ||
+		!strings.Contains(err.Error(), "line [4]") {
+		t.Errorf("TestImportBadRow failed: got error [%v] but expected an error about line [4]", err)
+	}
+}
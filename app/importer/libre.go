@@ -0,0 +1,126 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/store"
+	"io"
+	"time"
+)
+
+const (
+	LIBRE_FORMAT = "libre"
+
+	LIBRE_TIMESTAMP_COLUMN             = "Device Timestamp"
+	LIBRE_RECORD_TYPE_COLUMN           = "Record Type"
+	LIBRE_HISTORIC_GLUCOSE_PREFIX      = "Historic Glucose"
+	LIBRE_SCAN_GLUCOSE_PREFIX          = "Scan Glucose"
+	LIBRE_STRIP_GLUCOSE_PREFIX         = "Strip Glucose"
+	LIBRE_RAPID_INSULIN_COLUMN         = "Rapid-Acting Insulin (units)"
+	LIBRE_LONG_INSULIN_COLUMN          = "Long-Acting Insulin Value (units)"
+	LIBRE_CARBS_COLUMN                 = "Carbohydrates (grams)"
+	LIBRE_HISTORIC_GLUCOSE_RECORD_TYPE = "0"
+	LIBRE_SCAN_GLUCOSE_RECORD_TYPE     = "1"
+	LIBRE_STRIP_GLUCOSE_RECORD_TYPE    = "2"
+	LIBRE_INSULIN_RECORD_TYPE          = "4"
+	LIBRE_FOOD_RECORD_TYPE             = "5"
+)
+
+// The timestamp layouts of LibreView exports, which depend on the region of the account
+var libreTimestampFormats = []string{"01-02-2006 15:04", "01-02-2006 03:04 PM", "2006-01-02 15:04", "01/02/2006 15:04", "01/02/2006 03:04 PM"}
+
+// LibreImporter imports the csv exports of LibreView for FreeStyle Libre sensors. The historic reads, taken every 15
+// minutes, and the scans are imported as glucose reads and strip tests as calibrations.
+type LibreImporter struct {
+}
+
+func (importer *LibreImporter) Name() string {
+	return LIBRE_FORMAT
+}
+
+func (importer *LibreImporter) Detect(head []byte) bool {
+	return bytes.Contains(head, []byte(LIBRE_TIMESTAMP_COLUMN)) && bytes.Contains(head, []byte(LIBRE_RECORD_TYPE_COLUMN))
+}
+
+func (importer *LibreImporter) Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+	location *time.Location) (lastReadTime time.Time, err error) {
+	table, err := newCSVTable(reader, ',', LIBRE_TIMESTAMP_COLUMN, LIBRE_RECORD_TYPE_COLUMN)
+	if err != nil {
+		return lastReadTime, err
+	}
+
+	historicColumn := table.columnWithPrefix(LIBRE_HISTORIC_GLUCOSE_PREFIX)
+	scanColumn := table.columnWithPrefix(LIBRE_SCAN_GLUCOSE_PREFIX)
+	stripColumn := table.columnWithPrefix(LIBRE_STRIP_GLUCOSE_PREFIX)
+	unit := unitOfColumn(historicColumn)
+
+	records := newRecords(startTime)
+	for {
+		row, err := table.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return lastReadTime, err
+		}
+
+		rowTime, err := parseLibreTimestamp(row.get(LIBRE_TIMESTAMP_COLUMN), location)
+		if err != nil {
+			return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+		}
+		timestamp := apimodel.Time{Timestamp: apimodel.GetTimeMillis(rowTime), TimeZoneId: location.String()}
+
+		switch row.get(LIBRE_RECORD_TYPE_COLUMN) {
+		case LIBRE_HISTORIC_GLUCOSE_RECORD_TYPE, LIBRE_SCAN_GLUCOSE_RECORD_TYPE:
+			column := historicColumn
+			if row.get(LIBRE_RECORD_TYPE_COLUMN) == LIBRE_SCAN_GLUCOSE_RECORD_TYPE {
+				column = scanColumn
+			}
+
+			if value, ok, err := parseGlucoseValue(row.get(column), unit); err != nil {
+				return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+			} else if ok {
+				records.addGlucoseRead(apimodel.GlucoseRead{Time: timestamp, Unit: unit, Value: value})
+			}
+		case LIBRE_STRIP_GLUCOSE_RECORD_TYPE:
+			if value, ok, err := parseGlucoseValue(row.get(stripColumn), unit); err != nil {
+				return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+			} else if ok {
+				records.addCalibration(apimodel.CalibrationRead{Time: timestamp, Unit: unit, Value: value})
+			}
+		case LIBRE_INSULIN_RECORD_TYPE:
+			if units, ok, err := parseQuantity(row.get(LIBRE_RAPID_INSULIN_COLUMN)); err != nil {
+				return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+			} else if ok {
+				records.addInjection(apimodel.Injection{Time: timestamp, Units: units, InsulinType: "Rapid-Acting"})
+			}
+
+			if units, ok, err := parseQuantity(row.get(LIBRE_LONG_INSULIN_COLUMN)); err != nil {
+				return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+			} else if ok {
+				records.addInjection(apimodel.Injection{Time: timestamp, Units: units, InsulinType: "Long-Acting"})
+			}
+		case LIBRE_FOOD_RECORD_TYPE:
+			if carbs, ok, err := parseQuantity(row.get(LIBRE_CARBS_COLUMN)); err != nil {
+				return lastReadTime, parseError(LIBRE_FORMAT, table.line, err)
+			} else if ok {
+				records.addMeal(apimodel.Meal{Time: timestamp, Carbohydrates: carbs})
+			}
+		}
+	}
+
+	return records.store(context, repository, email)
+}
+
+// parseLibreTimestamp parses a local timestamp in any of the libreTimestampFormats
+func parseLibreTimestamp(value string, location *time.Location) (timestamp time.Time, err error) {
+	for _, format := range libreTimestampFormats {
+		if timestamp, err = time.ParseInLocation(format, value, location); err == nil {
+			return timestamp, nil
+		}
+	}
+
+	return timestamp, errors.New(fmt.Sprintf("Unsupported timestamp [%s]", value))
+}
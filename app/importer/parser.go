@@ -1,47 +1,31 @@
 package importer
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"github.com/alexandre-normand/glukit/app/apimodel"
-	"github.com/alexandre-normand/glukit/app/bufio"
 	"github.com/alexandre-normand/glukit/app/dexcomimporter"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/store"
-	"github.com/alexandre-normand/glukit/app/streaming"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"io"
 	"strings"
 	"time"
 )
 
+const (
+	DEXCOM_STUDIO_FORMAT = "dexcom"
+)
+
 // ParseContent is the big function that parses the Dexcom xml file. It is given a reader to the file and it parses batches of days of GlucoseReads/Events. It streams the content but
-// keeps some in memory until it reaches a full batch of a type. A batch is an array of DayOf[GlucoseReads,Injection,Meals,Exercises]. A batch is flushed to the datastore once it reaches
+// keeps some in memory until it reaches a full batch of a type. A batch is an array of DayOf[GlucoseReads,Injection,Meals,Exercises]. A batch is flushed to the repository once it reaches
 // the given batchSize or we reach the end of the file.
-func ParseContent(context context.Context, reader io.Reader, parentKey *datastore.Key, startTime time.Time, readsBatchHandler func(context context.Context, userProfileKey *datastore.Key, meals []apimodel.DayOfGlucoseReads) ([]*datastore.Key, error), mealsBatchHandler func(context context.Context, userProfileKey *datastore.Key, daysOfMeals []apimodel.DayOfMeals) ([]*datastore.Key, error), injectionBatchHandler func(context context.Context, userProfileKey *datastore.Key, daysOfInjections []apimodel.DayOfInjections) ([]*datastore.Key, error), exerciseBatchHandler func(context context.Context, userProfileKey *datastore.Key, daysOfExercises []apimodel.DayOfExercises) ([]*datastore.Key, error)) (lastReadTime time.Time, err error) {
+func ParseContent(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time) (lastReadTime time.Time, err error) {
 	decoder := xml.NewDecoder(reader)
 
-	calibrationDataStoreWriter := store.NewDataStoreCalibrationBatchWriter(context, parentKey)
-	calibrationBatchingWriter := bufio.NewCalibrationWriterSize(calibrationDataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
-	calibrationStreamer := streaming.NewCalibrationReadStreamerDuration(calibrationBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
-
-	glucoseDataStoreWriter := store.NewDataStoreGlucoseReadBatchWriter(context, parentKey)
-	glucoseBatchingWriter := bufio.NewGlucoseReadWriterSize(glucoseDataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
-	glucoseStreamer := streaming.NewGlucoseStreamerDuration(glucoseBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
-
-	injectionDataStoreWriter := store.NewDataStoreInjectionBatchWriter(context, parentKey)
-	injectionBatchingWriter := bufio.NewInjectionWriterSize(injectionDataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
-	injectionStreamer := streaming.NewInjectionStreamerDuration(injectionBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
-
-	mealDataStoreWriter := store.NewDataStoreMealBatchWriter(context, parentKey)
-	mealBatchingWriter := bufio.NewMealWriterSize(mealDataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
-	mealStreamer := streaming.NewMealStreamerDuration(mealBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
-
-	exerciseDataStoreWriter := store.NewDataStoreExerciseBatchWriter(context, parentKey)
-	exerciseBatchingWriter := bufio.NewExerciseWriterSize(exerciseDataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
-	exerciseStreamer := streaming.NewExerciseStreamerDuration(exerciseBatchingWriter, apimodel.DAY_OF_DATA_DURATION)
+	streams := newStreams(context, repository, email)
 
 	var lastRead *apimodel.GlucoseRead
 	for {
@@ -68,7 +52,7 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 				}
 
 				if glucoseRead != nil && glucoseRead.Value > 0 {
-					glucoseStreamer, err = glucoseStreamer.WriteGlucoseRead(*glucoseRead)
+					streams.glucoseReads, err = streams.glucoseReads.WriteGlucoseRead(*glucoseRead)
 
 					if err != nil {
 						return lastRead.GetTime(), err
@@ -101,7 +85,7 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 
 						meal := apimodel.Meal{apimodel.Time{apimodel.GetTimeMillis(eventTime), location.String()}, float32(mealQuantityInGrams), 0., 0., 0.}
 
-						mealStreamer, err = mealStreamer.WriteMeal(meal)
+						streams.meals, err = streams.meals.WriteMeal(meal)
 						if err != nil {
 							return lastRead.GetTime(), err
 						}
@@ -114,7 +98,7 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 						} else {
 							injection := apimodel.Injection{apimodel.Time{apimodel.GetTimeMillis(eventTime), location.String()}, float32(insulinUnits), "", ""}
 
-							injectionStreamer, err = injectionStreamer.WriteInjection(injection)
+							streams.injections, err = streams.injections.WriteInjection(injection)
 
 							if err != nil {
 								return lastRead.GetTime(), err
@@ -126,7 +110,7 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 						fmt.Sscanf(event.Description, "Exercise %s (%d minutes)", &intensity, &duration)
 
 						exercise := apimodel.Exercise{apimodel.Time{apimodel.GetTimeMillis(eventTime), location.String()}, duration, intensity, ""}
-						exerciseStreamer, err = exerciseStreamer.WriteExercise(exercise)
+						streams.exercises, err = streams.exercises.WriteExercise(exercise)
 						if err != nil {
 							return lastRead.GetTime(), err
 						}
@@ -139,7 +123,7 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 				if calibrationRead, err := dexcomimporter.ConvertXmlCalibrationRead(c); err != nil {
 					return lastRead.GetTime(), err
 				} else {
-					calibrationStreamer, err = calibrationStreamer.WriteCalibration(*calibrationRead)
+					streams.calibrations, err = streams.calibrations.WriteCalibration(*calibrationRead)
 
 					if err != nil {
 						return lastRead.GetTime(), err
@@ -150,30 +134,28 @@ func ParseContent(context context.Context, reader io.Reader, parentKey *datastor
 	}
 
 	// Close the streams and flush anything pending
-	glucoseStreamer, err = glucoseStreamer.Close()
-	if err != nil {
-		return lastRead.GetTime(), err
-	}
-	calibrationStreamer, err = calibrationStreamer.Close()
-	if err != nil {
+	if err := streams.close(); err != nil {
 		return lastRead.GetTime(), err
 	}
 
-	injectionStreamer, err = injectionStreamer.Close()
-	if err != nil {
-		return lastRead.GetTime(), err
-	}
+	log.Infof(context, "Done parsing and storing all data")
+	return lastRead.GetTime(), nil
+}
 
-	mealStreamer, err = mealStreamer.Close()
-	if err != nil {
-		return lastRead.GetTime(), err
-	}
+// DexcomStudioImporter imports the xml exports of Dexcom Studio. The location isn't used since the xml has both the local
+// and internal times of every read and event.
+type DexcomStudioImporter struct {
+}
 
-	exerciseStreamer, err = exerciseStreamer.Close()
-	if err != nil {
-		return lastRead.GetTime(), err
-	}
+func (importer *DexcomStudioImporter) Name() string {
+	return DEXCOM_STUDIO_FORMAT
+}
 
-	log.Infof(context, "Done parsing and storing all data")
-	return lastRead.GetTime(), nil
+func (importer *DexcomStudioImporter) Detect(head []byte) bool {
+	return bytes.Contains(head, []byte("<Patient"))
+}
+
+func (importer *DexcomStudioImporter) Import(context context.Context, reader io.Reader, repository store.Repository, email string, startTime time.Time,
+	location *time.Location) (lastReadTime time.Time, err error) {
+	return ParseContent(context, reader, repository, email, startTime)
 }
@@ -0,0 +1,63 @@
+// log package is a thin wrapper over the App Engine logging functions that falls back to the standard
+// library logger when glukit runs outside of App Engine (i.e. as a standalone server). The App Engine functions
+// panic when given a context that doesn't come from an App Engine request.
+package log
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/appengine"
+	aelog "google.golang.org/appengine/log"
+	stdlog "log"
+)
+
+// Debugf formats its arguments according to the format, analogous to fmt.Printf,
+// and records the text as a log message at Debug level.
+func Debugf(context context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Debugf(context, format, args...)
+	} else {
+		logf("DEBUG", format, args...)
+	}
+}
+
+// Infof is like Debugf, but at Info level.
+func Infof(context context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Infof(context, format, args...)
+	} else {
+		logf("INFO", format, args...)
+	}
+}
+
+// Warningf is like Debugf, but at Warning level.
+func Warningf(context context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Warningf(context, format, args...)
+	} else {
+		logf("WARNING", format, args...)
+	}
+}
+
+// Errorf is like Debugf, but at Error level.
+func Errorf(context context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Errorf(context, format, args...)
+	} else {
+		logf("ERROR", format, args...)
+	}
+}
+
+// Criticalf is like Debugf, but at Critical level.
+func Criticalf(context context.Context, format string, args ...interface{}) {
+	if appengine.IsAppEngine() {
+		aelog.Criticalf(context, format, args...)
+	} else {
+		logf("CRITICAL", format, args...)
+	}
+}
+
+// logf writes a log line prefixed with its level to the standard logger
+func logf(level string, format string, args ...interface{}) {
+	stdlog.Printf("%s: %s", level, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,43 @@
+package model
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"time"
+)
+
+// AmbulatoryGlucoseProfile is the standard percentile summary of many days of reads collapsed into a single day. The
+// Buckets hold the percentile curves by time of day and the DailyOverlay holds each day's reads on the same time of day axis.
+// Times of day are in minutes since midnight, in the timezone of each read.
+type AmbulatoryGlucoseProfile struct {
+	LowerBound    time.Time            `json:"lowerBound"`
+	UpperBound    time.Time            `json:"upperBound"`
+	Days          int                  `json:"days"`
+	Unit          apimodel.GlucoseUnit `json:"unit"`
+	BucketMinutes int                  `json:"bucketMinutes"`
+	Buckets       []AGPBucket          `json:"buckets"`
+	DailyOverlay  []AGPDay             `json:"dailyOverlay"`
+	Metrics       *GlycemicMetrics     `json:"metrics,omitempty"`
+}
+
+// AGPBucket holds the percentiles of the reads of a time of day bucket. Buckets without reads are omitted.
+type AGPBucket struct {
+	TimeOfDay    int     `json:"timeOfDay"`
+	Count        int     `json:"count"`
+	Percentile5  float64 `json:"p5"`
+	Percentile25 float64 `json:"p25"`
+	Percentile50 float64 `json:"p50"`
+	Percentile75 float64 `json:"p75"`
+	Percentile95 float64 `json:"p95"`
+}
+
+// AGPDay is the series of reads of a single local day, identified by its date (i.e. "2014-04-18")
+type AGPDay struct {
+	Date   string     `json:"date"`
+	Points []AGPPoint `json:"points"`
+}
+
+// AGPPoint is a read positioned on the time of day axis
+type AGPPoint struct {
+	TimeOfDay int     `json:"timeOfDay"`
+	Value     float64 `json:"value"`
+}
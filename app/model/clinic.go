@@ -0,0 +1,87 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Clinic is a practice whose practitioners follow the patients who enrolled in it. Enrolled patients give the practitioners of
+// the clinic read-only access to all their data.
+type Clinic struct {
+	Id                 string    `json:"id" datastore:"id,noindex"`
+	Name               string    `json:"name" datastore:"name,noindex"`
+	PractitionerEmails []string  `json:"practitionerEmails" datastore:"practitionerEmails"`
+	CreatedOn          time.Time `json:"createdOn" datastore:"createdOn,noindex"`
+}
+
+// ClinicInvite is a single-use code a practitioner gives to a patient for them to enroll in the clinic
+type ClinicInvite struct {
+	Code       string    `json:"code" datastore:"code,noindex"`
+	ClinicId   string    `json:"clinicId" datastore:"clinicId,noindex"`
+	CreatedBy  string    `json:"createdBy" datastore:"createdBy,noindex"`
+	CreatedOn  time.Time `json:"createdOn" datastore:"createdOn,noindex"`
+	ExpiresOn  time.Time `json:"expiresOn" datastore:"expiresOn,noindex"`
+	RedeemedBy string    `json:"redeemedBy,omitempty" datastore:"redeemedBy,noindex"`
+	RedeemedOn time.Time `json:"redeemedOn,omitempty" datastore:"redeemedOn,noindex"`
+}
+
+// ClinicEnrollment is the consent of a patient to be followed by a clinic, it lasts until the patient withdraws it
+type ClinicEnrollment struct {
+	ClinicId     string    `json:"clinicId" datastore:"clinicId"`
+	PatientEmail string    `json:"patientEmail" datastore:"patientEmail,noindex"`
+	EnrolledOn   time.Time `json:"enrolledOn" datastore:"enrolledOn,noindex"`
+}
+
+// PatientSummary is the overview of a patient of a clinic. Values the patient doesn't have yet are left out.
+type PatientSummary struct {
+	Email        string     `json:"email"`
+	FirstName    string     `json:"firstName"`
+	LastName     string     `json:"lastName"`
+	DiabetesType string     `json:"diabetesType"`
+	EnrolledOn   time.Time  `json:"enrolledOn"`
+	GlukitScore  *int64     `json:"glukitScore,omitempty"`
+	A1C          *float64   `json:"a1c,omitempty"`
+	TimeInRange  *float64   `json:"timeInRange,omitempty"`
+	LastSync     *time.Time `json:"lastSync,omitempty"`
+}
+
+// Validate returns an error if the clinic doesn't have a name or practitioners
+func (clinic Clinic) Validate() (err error) {
+	if len(clinic.Name) == 0 {
+		return errors.New("Invalid clinic, it must have a name")
+	}
+
+	if len(clinic.PractitionerEmails) == 0 {
+		return errors.New(fmt.Sprintf("Invalid clinic [%s], it must have at least one practitioner", clinic.Name))
+	}
+
+	return nil
+}
+
+// NormalizePractitionerEmails returns the clinic with the emails of its practitioners normalized
+func (clinic Clinic) NormalizePractitionerEmails() Clinic {
+	practitionerEmails := make([]string, len(clinic.PractitionerEmails))
+	for i, practitionerEmail := range clinic.PractitionerEmails {
+		practitionerEmails[i] = NormalizeEmail(practitionerEmail)
+	}
+	clinic.PractitionerEmails = practitionerEmails
+
+	return clinic
+}
+
+// HasPractitioner returns true if the user is a practitioner of the clinic, matching emails regardless of case
+func (clinic Clinic) HasPractitioner(email string) bool {
+	for _, practitionerEmail := range clinic.PractitionerEmails {
+		if NormalizeEmail(practitionerEmail) == NormalizeEmail(email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRedeemable returns true if the invite hasn't been redeemed yet and hasn't expired
+func (invite ClinicInvite) IsRedeemable(now time.Time) bool {
+	return len(invite.RedeemedBy) == 0 && now.Before(invite.ExpiresOn)
+}
@@ -0,0 +1,93 @@
+package model
+
+import (
+	"sort"
+	"time"
+)
+
+// Metrics users are ranked on within their cohorts
+const (
+	COHORT_METRIC_GLUKIT_SCORE  = "glukitScore"
+	COHORT_METRIC_TIME_IN_RANGE = "timeInRange"
+	COHORT_METRIC_A1C           = "a1c"
+)
+
+// COHORT_METRICS_LOWER_IS_BETTER tells, for each metric, if a lower value is better
+var COHORT_METRICS_LOWER_IS_BETTER = map[string]bool{
+	COHORT_METRIC_GLUKIT_SCORE:  true,
+	COHORT_METRIC_TIME_IN_RANGE: false,
+	COHORT_METRIC_A1C:           true,
+}
+
+// CohortDistribution is the anonymized distribution of a metric among the users of a cohort, the users with the same type of diabetes
+// and in the same age band. Only the quantiles of the values are kept, the values of the 0th to the 100th percentiles, in ascending order.
+type CohortDistribution struct {
+	DiabetesType string    `json:"diabetesType" datastore:"diabetesType,noindex"`
+	AgeBand      int       `json:"ageBand" datastore:"ageBand,noindex"`
+	Metric       string    `json:"metric" datastore:"metric,noindex"`
+	Size         int       `json:"size" datastore:"size,noindex"`
+	Quantiles    []float64 `json:"quantiles" datastore:"quantiles,noindex"`
+}
+
+// CohortAggregation is the result of the most recent aggregation of the distributions of all cohorts. Cohorts that are too small to
+// keep their users anonymous don't have distributions.
+type CohortAggregation struct {
+	CalculatedOn  time.Time            `json:"calculatedOn" datastore:"calculatedOn,noindex"`
+	MemberCount   int                  `json:"memberCount" datastore:"memberCount,noindex"`
+	Distributions []CohortDistribution `json:"distributions" datastore:"-"`
+}
+
+// CohortRanking is how a user's value of a metric ranks within their cohort
+type CohortRanking struct {
+	DiabetesType string  `json:"diabetesType"`
+	AgeBand      int     `json:"ageBand"`
+	Metric       string  `json:"metric"`
+	CohortSize   int     `json:"cohortSize"`
+	Value        float64 `json:"value"`
+	// The percentage of the cohort the value is better than
+	BetterThan   float64   `json:"betterThan"`
+	CalculatedOn time.Time `json:"calculatedOn"`
+}
+
+// BetterThan returns the percentage of the cohort whose value of the metric is worse than the given one. Values between quantiles are
+// located by linear interpolation, the same way the quantiles are calculated from the values of the cohort, so that the percentage is
+// exact for values of the cohort.
+func (distribution CohortDistribution) BetterThan(value float64) float64 {
+	quantiles := distribution.Quantiles
+	last := len(quantiles) - 1
+	if last < 1 || distribution.Size < 2 {
+		return 0
+	}
+
+	lowerIsBetter := COHORT_METRICS_LOWER_IS_BETTER[distribution.Metric]
+	// The value is between the quantiles i-1 and i, at the worse end of quantiles equal to it
+	var i int
+	if lowerIsBetter {
+		if value < quantiles[0] {
+			return 100
+		} else if value >= quantiles[last] {
+			return 0
+		}
+
+		i = sort.Search(len(quantiles), func(i int) bool {
+			return quantiles[i] > value
+		})
+	} else {
+		if value > quantiles[last] {
+			return 100
+		} else if value <= quantiles[0] {
+			return 0
+		}
+
+		i = sort.SearchFloat64s(quantiles, value)
+	}
+
+	// The position of the value in the cohort, from 0 for the lowest value to 1 for the highest
+	position := (float64(i-1) + (value-quantiles[i-1])/(quantiles[i]-quantiles[i-1])) / float64(last)
+	if lowerIsBetter {
+		position = 1 - position
+	}
+
+	// A value at a position has position * (size - 1) values of the cohort on its side
+	return 100 * position * float64(distribution.Size-1) / float64(distribution.Size)
+}
@@ -0,0 +1,53 @@
+package model
+
+import (
+	"time"
+)
+
+// Types of glycemic episodes
+const (
+	EPISODE_TYPE_LOW  = "low"
+	EPISODE_TYPE_HIGH = "high"
+)
+
+// Levels of glycemic episodes, as defined by the international consensus on CGM metrics
+const (
+	// Below the Low threshold or above the High threshold
+	EPISODE_LEVEL_1 = 1
+	// Below the VeryLow threshold or above the VeryHigh threshold
+	EPISODE_LEVEL_2 = 2
+)
+
+// GlycemicEpisode is a low or high glycemic event detected from a sequence of reads. Glucose values are in mg/dL.
+type GlycemicEpisode struct {
+	Type  string `json:"type" datastore:"type,noindex"`
+	Level int    `json:"level" datastore:"level,noindex"`
+	// Set for lows that started at night
+	Nocturnal bool `json:"nocturnal" datastore:"nocturnal,noindex"`
+	// Set for highs that lasted long enough to be considered prolonged
+	Prolonged bool `json:"prolonged" datastore:"prolonged,noindex"`
+
+	Start time.Time `json:"start" datastore:"start"`
+	// The time glucose went back in range or the time of the last read if it hasn't recovered yet
+	End time.Time `json:"end" datastore:"end,noindex"`
+	// The nadir of a low or the peak of a high
+	ExtremeValue float64   `json:"extremeValue" datastore:"extremeValue,noindex"`
+	ExtremeTime  time.Time `json:"extremeTime" datastore:"extremeTime,noindex"`
+
+	DurationMinutes float64 `json:"durationMinutes" datastore:"durationMinutes,noindex"`
+	// The time it took to go back in range from the nadir or peak
+	RecoveryMinutes float64 `json:"recoveryMinutes" datastore:"recoveryMinutes,noindex"`
+	// False if the episode was still going on at the time of the last read
+	Recovered bool `json:"recovered" datastore:"recovered,noindex"`
+}
+
+// WeeklyEpisodeCounts is the number of episodes of each kind that started during a week
+type WeeklyEpisodeCounts struct {
+	WeekStart      time.Time `json:"weekStart"`
+	Lows           int       `json:"lows"`
+	Level2Lows     int       `json:"level2Lows"`
+	NocturnalLows  int       `json:"nocturnalLows"`
+	Highs          int       `json:"highs"`
+	Level2Highs    int       `json:"level2Highs"`
+	ProlongedHighs int       `json:"prolongedHighs"`
+}
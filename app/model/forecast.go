@@ -0,0 +1,41 @@
+package model
+
+import (
+	"time"
+)
+
+// ForecastPoint is the glucose predicted some minutes after the forecast was made along with its 95% prediction interval. Values are
+// in mg/dL.
+type ForecastPoint struct {
+	HorizonMinutes int       `json:"horizonMinutes"`
+	Time           time.Time `json:"time"`
+	Value          float64   `json:"value"`
+	Low            float64   `json:"low"`
+	High           float64   `json:"high"`
+}
+
+// Forecast is the glucose predicted by a forecast model from the data up to the time it was made
+type Forecast struct {
+	Model  string          `json:"model"`
+	MadeAt time.Time       `json:"madeAt"`
+	Points []ForecastPoint `json:"points"`
+}
+
+// ForecastError measures how far off the forecasts of a model were at one horizon. The errors are in mg/dL except for the mean
+// absolute percentage error. Coverage is the percentage of actual values that were within the prediction interval.
+type ForecastError struct {
+	HorizonMinutes              int     `json:"horizonMinutes"`
+	SampleCount                 int     `json:"sampleCount"`
+	MeanAbsoluteError           float64 `json:"meanAbsoluteError"`
+	RootMeanSquareError         float64 `json:"rootMeanSquareError"`
+	MeanAbsolutePercentageError float64 `json:"meanAbsolutePercentageError"`
+	Coverage                    float64 `json:"coverage"`
+}
+
+// ForecastBacktest holds the errors of the forecasts a model would have made between the lower and upper bounds
+type ForecastBacktest struct {
+	Model      string          `json:"model"`
+	LowerBound time.Time       `json:"lowerBound"`
+	UpperBound time.Time       `json:"upperBound"`
+	Errors     []ForecastError `json:"errors"`
+}
@@ -21,6 +21,9 @@ type GlukitUser struct {
 	PictureUrl      string               `datastore:"pictureUrl,noindex"`
 	AccountCreated  time.Time            `datastore:"joinedOn"`
 	MostRecentA1C   A1CEstimate          `datastore:"mostRecentA1C"`
+	Targets         GlucoseTargets       `datastore:"targets"`
+	Sailing         SailingProfile       `datastore:"sailing"`
+	CohortOptIn     bool                 `datastore:"cohortOptIn"`
 }
 
 // Represents a GlukitScore value, the lower and upper bounds
@@ -36,6 +39,8 @@ type GlukitScore struct {
 	UpperBound     time.Time `datastore:"upperBound"`
 	CalculatedOn   time.Time `datastore:"calculatedOn"`
 	ScoringVersion int       `datastore:"scoringVersion`
+	// The target the score was calculated against, scores are only comparable if they have the same target
+	Target ScoringTarget `datastore:"target"`
 }
 
 // Type of diabetes
@@ -51,3 +56,27 @@ const (
 func (score GlukitScore) IsBetterThan(reference GlukitScore) bool {
 	return score.Value < reference.Value
 }
+
+// IsComparableTo returns true if the score was calculated with the same scoring version and against the same target as the reference
+// score. Scores calculated before targets could be set were calculated against the DEFAULT_SCORING_TARGET.
+func (score GlukitScore) IsComparableTo(reference GlukitScore) bool {
+	return score.ScoringVersion == reference.ScoringVersion && score.GetTarget() == reference.GetTarget()
+}
+
+// GetTarget returns the target the score was calculated against
+func (score GlukitScore) GetTarget() ScoringTarget {
+	if score.Target == (ScoringTarget{}) {
+		return DEFAULT_SCORING_TARGET
+	}
+
+	return score.Target
+}
+
+// GetTargets returns the targets of the user or the DEFAULT_GLUCOSE_TARGETS if they haven't set any
+func (user GlukitUser) GetTargets() GlucoseTargets {
+	if user.Targets.Profile == "" {
+		return DEFAULT_GLUCOSE_TARGETS
+	}
+
+	return user.Targets
+}
@@ -0,0 +1,60 @@
+package model
+
+import (
+	"time"
+)
+
+// Kinds of samples insulin ratios are estimated from
+const (
+	// A meal with the bolus that covered it
+	INSULIN_RATIO_SAMPLE_MEAL = "meal"
+	// A correction bolus without any meal around it
+	INSULIN_RATIO_SAMPLE_CORRECTION = "correction"
+)
+
+// The time of day of the estimates calculated from all samples
+const TIME_OF_DAY_ALL = "all"
+
+// RatioEstimate is the mean of the ratios of a set of samples along with its 95% confidence interval
+type RatioEstimate struct {
+	Value          float64 `json:"value" datastore:"value,noindex"`
+	ConfidenceLow  float64 `json:"confidenceLow" datastore:"confidenceLow,noindex"`
+	ConfidenceHigh float64 `json:"confidenceHigh" datastore:"confidenceHigh,noindex"`
+	SampleCount    int     `json:"sampleCount" datastore:"sampleCount,noindex"`
+}
+
+// InsulinRatioEstimate holds the estimated ratios for a time of day (one of the TIME_OF_DAY_* values). An estimate without
+// enough samples has a SampleCount that's too low and a zero Value.
+type InsulinRatioEstimate struct {
+	TimeOfDay string `json:"timeOfDay" datastore:"timeOfDay,noindex"`
+	// Grams of carbs covered by one unit of insulin
+	CarbRatio RatioEstimate `json:"carbRatio" datastore:"carbRatio,noindex"`
+	// Drop in mg/dL caused by one unit of insulin
+	SensitivityFactor RatioEstimate `json:"sensitivityFactor" datastore:"sensitivityFactor,noindex"`
+}
+
+// InsulinRatioSample is a meal or a correction the ratios are estimated from. It's kept with the estimates so that they
+// can be reviewed. Glucose values are in mg/dL.
+type InsulinRatioSample struct {
+	Kind          string    `json:"kind" datastore:"kind,noindex"`
+	Time          time.Time `json:"time" datastore:"time,noindex"`
+	TimeOfDay     string    `json:"timeOfDay" datastore:"timeOfDay,noindex"`
+	Carbohydrates float64   `json:"carbohydrates" datastore:"carbohydrates,noindex"`
+	Units         float64   `json:"units" datastore:"units,noindex"`
+	StartGlucose  float64   `json:"startGlucose" datastore:"startGlucose,noindex"`
+	EndGlucose    float64   `json:"endGlucose" datastore:"endGlucose,noindex"`
+	// The carb ratio of a meal or the sensitivity factor of a correction
+	Ratio float64 `json:"ratio" datastore:"ratio,noindex"`
+}
+
+// InsulinRatios are the carb ratios and insulin sensitivity factors estimated from the samples found between the lower
+// and upper bounds. The calculation version is the version of the estimation algorithm so that estimates of older
+// versions can be recalculated.
+type InsulinRatios struct {
+	LowerBound         time.Time              `json:"lowerBound" datastore:"lowerBound,noindex"`
+	UpperBound         time.Time              `json:"upperBound" datastore:"upperBound"`
+	CalculatedOn       time.Time              `json:"calculatedOn" datastore:"calculatedOn,noindex"`
+	CalculationVersion int                    `json:"calculationVersion" datastore:"calculationVersion,noindex"`
+	Estimates          []InsulinRatioEstimate `json:"estimates" datastore:"estimates,noindex"`
+	Samples            []InsulinRatioSample   `json:"samples" datastore:"samples,noindex"`
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The range of plausible lab a1c results, in percent
+const (
+	MIN_LAB_A1C_VALUE = 3.
+	MAX_LAB_A1C_VALUE = 20.
+)
+
+// LabA1C is the result, in percent, of an a1c lab test recorded by the user. The time is the one of the blood draw.
+type LabA1C struct {
+	Value float64   `json:"value" datastore:"value,noindex"`
+	Time  time.Time `json:"time" datastore:"time"`
+}
+
+// Validate returns an error if the result is outside of the plausible range or doesn't have a time in the past
+func (labA1C LabA1C) Validate() (err error) {
+	if labA1C.Value < MIN_LAB_A1C_VALUE || labA1C.Value > MAX_LAB_A1C_VALUE {
+		return errors.New(fmt.Sprintf("Invalid lab a1c [%.1f], it must be between [%.0f] and [%.0f]", labA1C.Value, MIN_LAB_A1C_VALUE,
+			MAX_LAB_A1C_VALUE))
+	}
+
+	if labA1C.Time.IsZero() || labA1C.Time.After(time.Now()) {
+		return errors.New(fmt.Sprintf("Invalid lab a1c time [%s], it must be in the past", labA1C.Time))
+	}
+
+	return nil
+}
+
+// A1CPair is a lab result along with the a1c estimate at the time of the test
+type A1CPair struct {
+	Lab      LabA1C      `json:"lab"`
+	Estimate A1CEstimate `json:"estimate"`
+}
+
+// A1CCalibration is the personal adjustment of a1c estimates fitted from the lab results of a user. The offset is the average
+// of the differences between the lab results and the estimates, the equivalent of a hemoglobin glycation index: for the
+// same glucose, some people have a consistently higher or lower a1c than others.
+type A1CCalibration struct {
+	Offset    float64 `json:"offset"`
+	PairCount int     `json:"pairCount"`
+}
+
+// Apply returns the calibrated value of an a1c estimate
+func (calibration A1CCalibration) Apply(estimate float64) float64 {
+	return estimate + calibration.Offset
+}
+
+// A1CReport is the most recent a1c estimate of a user along with its calibrated value, when there are enough lab results to calibrate
+// it, and the glucose management indicator (GMI) of the same reads. The estimate is based on the median glucose and the GMI on the mean
+// so they differ when glucose isn't evenly spread around its average. Both differ from the lab results by the user's calibration offset.
+type A1CReport struct {
+	Estimate   A1CEstimate `json:"estimate"`
+	Calibrated *float64    `json:"calibrated"`
+	GMI        float64     `json:"gmi"`
+	// The calibration applied to the estimate, nil if there aren't enough pairs of lab results and estimates yet
+	Calibration *A1CCalibration `json:"calibration"`
+	Pairs       []A1CPair       `json:"pairs"`
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"time"
+)
+
+// Times of day meals are grouped by, in the local time of the meal
+const (
+	// From 5 AM to 11 AM
+	TIME_OF_DAY_MORNING = "morning"
+	// From 11 AM to 5 PM
+	TIME_OF_DAY_AFTERNOON = "afternoon"
+	// From 5 PM to 10 PM
+	TIME_OF_DAY_EVENING = "evening"
+	// From 10 PM to 5 AM
+	TIME_OF_DAY_NIGHT = "night"
+)
+
+// Carb sizes meals are grouped by
+const (
+	// Less than 20 grams of carbs
+	CARB_SIZE_SMALL = "small"
+	// From 20 to 60 grams of carbs
+	CARB_SIZE_MEDIUM = "medium"
+	// 60 grams of carbs or more
+	CARB_SIZE_LARGE = "large"
+)
+
+// MealResponse is the glucose response following a meal. Glucose values are in mg/dL.
+type MealResponse struct {
+	Meal      apimodel.Meal `json:"meal"`
+	TimeOfDay string        `json:"timeOfDay"`
+	CarbSize  string        `json:"carbSize"`
+	// The glucose at the time of the meal
+	Baseline float64 `json:"baseline"`
+	// The rise from the baseline to the highest glucose after the meal
+	PeakDelta     float64 `json:"peakDelta"`
+	MinutesToPeak float64 `json:"minutesToPeak"`
+	// The glucose two hours after the meal
+	TwoHourValue float64 `json:"twoHourValue"`
+	// The incremental area under the curve above the baseline over two hours, in mg/dL x minutes
+	AreaUnderCurve float64 `json:"areaUnderCurve"`
+	// Set when another meal was eaten during the two hours following this one, which makes the response a mix of both
+	Overlapping bool `json:"overlapping"`
+}
+
+// MealGroupAnalysis holds the averages of the responses to the meals of a time of day and carb size. Overlapping meals
+// are left out.
+type MealGroupAnalysis struct {
+	TimeOfDay string `json:"timeOfDay"`
+	CarbSize  string `json:"carbSize"`
+	MealCount int    `json:"mealCount"`
+
+	AveragePeakDelta      float64 `json:"averagePeakDelta"`
+	AverageMinutesToPeak  float64 `json:"averageMinutesToPeak"`
+	AverageTwoHourValue   float64 `json:"averageTwoHourValue"`
+	AverageAreaUnderCurve float64 `json:"averageAreaUnderCurve"`
+	// Percentage of meals followed by a spike
+	SpikeRate float64 `json:"spikeRate"`
+	// Set when enough meals of the group were followed by a spike to call it a pattern
+	ConsistentlySpikes bool `json:"consistentlySpikes"`
+}
+
+// MealAnalysis is the analysis of the responses to the meals of a window
+type MealAnalysis struct {
+	LowerBound time.Time `json:"lowerBound"`
+	UpperBound time.Time `json:"upperBound"`
+	// The meals with enough reads to analyze their response, sorted chronologically
+	Meals  []MealResponse      `json:"meals"`
+	Groups []MealGroupAnalysis `json:"groups"`
+}
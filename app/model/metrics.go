@@ -0,0 +1,53 @@
+package model
+
+import (
+	"time"
+)
+
+// GlucoseThresholds are the boundaries, in mg/dL, of the glucose ranges used to calculate the time spent in, below
+// and above range. A read is in range if it is between Low and High, inclusively.
+type GlucoseThresholds struct {
+	VeryLow  float64 `json:"veryLow"`
+	Low      float64 `json:"low"`
+	High     float64 `json:"high"`
+	VeryHigh float64 `json:"veryHigh"`
+}
+
+// The thresholds of the international consensus on time in range
+var DEFAULT_GLUCOSE_THRESHOLDS = GlucoseThresholds{VeryLow: 54, Low: 70, High: 180, VeryHigh: 250}
+
+// GlycemicMetrics holds the clinical metrics of glycemic control and variability calculated over a window of reads. All
+// glucose values are in mg/dL and all time in range values are percentages of reads.
+type GlycemicMetrics struct {
+	LowerBound time.Time         `json:"lowerBound"`
+	UpperBound time.Time         `json:"upperBound"`
+	ReadCount  int               `json:"readCount"`
+	Thresholds GlucoseThresholds `json:"thresholds"`
+
+	// Percentage of reads below the VeryLow threshold
+	TimeVeryLow float64 `json:"timeVeryLow"`
+	// Percentage of reads below the Low threshold, including the very low ones
+	TimeBelowRange float64 `json:"timeBelowRange"`
+	// Percentage of reads between the Low and High thresholds
+	TimeInRange float64 `json:"timeInRange"`
+	// Percentage of reads above the High threshold, including the very high ones
+	TimeAboveRange float64 `json:"timeAboveRange"`
+	// Percentage of reads above the VeryHigh threshold
+	TimeVeryHigh float64 `json:"timeVeryHigh"`
+
+	Average           float64 `json:"average"`
+	StandardDeviation float64 `json:"standardDeviation"`
+	// Coefficient of variation, as a percentage
+	CoefficientOfVariation float64 `json:"coefficientOfVariation"`
+	// Glucose management indicator, the a1c equivalent of the average, as a percentage
+	GMI float64 `json:"gmi"`
+	// Mean amplitude of glycemic excursions
+	MAGE float64 `json:"mage"`
+	// Mean of daily differences
+	MODD float64 `json:"modd"`
+	// Continuous overall net glycemic action over one hour
+	CONGA float64 `json:"conga"`
+	// Low and high blood glucose indices
+	LBGI float64 `json:"lbgi"`
+	HBGI float64 `json:"hbgi"`
+}
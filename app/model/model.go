@@ -34,6 +34,46 @@ type FileImportLog struct {
 	ImportResult      string
 }
 
+// Represents the owner of an api secret, stored under the hash of the secret
+type ApiSecret struct {
+	Email string `datastore:"email"`
+}
+
+// Represents the data export of a user. A user only has one, the one they most recently requested
+type DataExport struct {
+	Status      string    `json:"status" datastore:"status,noindex"`
+	RequestedOn time.Time `json:"requestedOn" datastore:"requestedOn,noindex"`
+	CompletedOn time.Time `json:"completedOn" datastore:"completedOn,noindex"`
+	Size        int       `json:"size" datastore:"size,noindex"`
+	Error       string    `json:"error,omitempty" datastore:"error,noindex"`
+}
+
+// Status of a data export
+const (
+	DATA_EXPORT_STATUS_PENDING = "pending"
+	DATA_EXPORT_STATUS_RUNNING = "running"
+	DATA_EXPORT_STATUS_DONE    = "done"
+	DATA_EXPORT_STATUS_FAILED  = "failed"
+)
+
+// Represents the deletion of a user's data, which runs in the background. Unless KeepAccount is set, the user profile
+// and the user's oauth tokens and api secret are deleted as well. It outlives the deletion so that its completion can
+// be reported.
+type AccountDeletion struct {
+	KeepAccount bool      `json:"keepAccount" datastore:"keepAccount,noindex"`
+	Status      string    `json:"status" datastore:"status,noindex"`
+	RequestedOn time.Time `json:"requestedOn" datastore:"requestedOn,noindex"`
+	CompletedOn time.Time `json:"completedOn" datastore:"completedOn,noindex"`
+	Deleted     int       `json:"deleted" datastore:"deleted,noindex"`
+}
+
+// Status of an account deletion
+const (
+	ACCOUNT_DELETION_STATUS_PENDING = "pending"
+	ACCOUNT_DELETION_STATUS_RUNNING = "running"
+	ACCOUNT_DELETION_STATUS_DONE    = "done"
+)
+
 type DataStoreDayOfGlucoseReads apimodel.DayOfGlucoseReads
 type DataStoreDayOfCalibrationReads apimodel.DayOfCalibrationReads
 type DataStoreDayOfInjections apimodel.DayOfInjections
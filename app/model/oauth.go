@@ -0,0 +1,158 @@
+package model
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Scopes of the api access users can give to applications
+const (
+	OAUTH_SCOPE_GLUCOSE_READ  = "glucose:read"
+	OAUTH_SCOPE_GLUCOSE_WRITE = "glucose:write"
+	OAUTH_SCOPE_EVENTS_READ   = "events:read"
+	OAUTH_SCOPE_EVENTS_WRITE  = "events:write"
+	OAUTH_SCOPE_PROFILE_READ  = "profile:read"
+)
+
+// OAUTH_SCOPES are all the scopes applications can request
+var OAUTH_SCOPES = []string{OAUTH_SCOPE_GLUCOSE_READ, OAUTH_SCOPE_GLUCOSE_WRITE, OAUTH_SCOPE_EVENTS_READ, OAUTH_SCOPE_EVENTS_WRITE,
+	OAUTH_SCOPE_PROFILE_READ}
+
+// Methods of PKCE code challenges
+const (
+	CODE_CHALLENGE_METHOD_PLAIN = "plain"
+	CODE_CHALLENGE_METHOD_S256  = "S256"
+)
+
+// The redirect uri of applications that can't receive redirects and show the code to the user instead
+const OOB_REDIRECT_URI = "urn:ietf:wg:oauth:2.0:oob"
+
+// OauthClient is the registration of an application by a developer. Public clients, like mobile and desktop applications, can't keep a
+// secret and must use PKCE instead. Clients registered before scopes existed don't have a registration and can request any scope.
+type OauthClient struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	OwnerEmail  string    `json:"ownerEmail"`
+	RedirectUri string    `json:"redirectUri"`
+	Scopes      []string  `json:"scopes"`
+	Public      bool      `json:"public"`
+	CreatedOn   time.Time `json:"createdOn"`
+}
+
+// OauthToken is an access token a user authorized an application to get. Tokens are identified by a hash of the access token since
+// the token itself is a secret of the application.
+type OauthToken struct {
+	Id        string    `json:"id"`
+	ClientId  string    `json:"clientId"`
+	Scopes    []string  `json:"scopes"`
+	CreatedOn time.Time `json:"createdOn"`
+	ExpiresOn time.Time `json:"expiresOn"`
+	// Whether the token can be refreshed once it expires
+	Refreshable bool `json:"refreshable"`
+}
+
+// OauthAuthorization is an application a user authorized along with the tokens it got
+type OauthAuthorization struct {
+	ClientId   string       `json:"clientId"`
+	ClientName string       `json:"clientName"`
+	Tokens     []OauthToken `json:"tokens"`
+}
+
+// CodeChallenge is the PKCE challenge of an authorization code, only the client that made it can exchange the code for a token
+type CodeChallenge struct {
+	Challenge string `json:"challenge" datastore:"challenge,noindex"`
+	Method    string `json:"method" datastore:"method,noindex"`
+}
+
+// Validate returns an error if the client doesn't have a name, has an invalid redirect uri or doesn't have scopes or has unknown ones
+func (client OauthClient) Validate() (err error) {
+	if len(client.Name) == 0 {
+		return errors.New("Invalid client, it must have a name")
+	}
+
+	if client.RedirectUri != OOB_REDIRECT_URI {
+		redirectUri, err := url.Parse(client.RedirectUri)
+		if err != nil || len(redirectUri.Scheme) == 0 || len(redirectUri.Fragment) > 0 {
+			return errors.New(fmt.Sprintf("Invalid redirect uri [%s], it must be an absolute uri without a fragment or [%s]",
+				client.RedirectUri, OOB_REDIRECT_URI))
+		}
+	}
+
+	if len(client.Scopes) == 0 {
+		return errors.New(fmt.Sprintf("Invalid scopes, at least one of %v must be registered", OAUTH_SCOPES))
+	}
+
+	return ValidateOauthScopes(client.Scopes, OAUTH_SCOPES)
+}
+
+// ParseOauthScopes returns the scopes of a space-delimited scope parameter
+func ParseOauthScopes(scope string) (scopes []string) {
+	return strings.Fields(scope)
+}
+
+// ValidateOauthScopes returns an error if any of the scopes isn't one of the allowed ones
+func ValidateOauthScopes(scopes []string, allowed []string) (err error) {
+	for _, scope := range scopes {
+		if !containsString(allowed, scope) {
+			return errors.New(fmt.Sprintf("Invalid scope [%s], expected one of %v", scope, allowed))
+		}
+	}
+
+	return nil
+}
+
+// GrantedOauthScopes returns the scopes granted by the space-delimited scope of a token. Tokens issued before scopes existed have
+// an empty scope and keep access to all scopes.
+func GrantedOauthScopes(scope string) (scopes []string) {
+	if len(strings.TrimSpace(scope)) == 0 {
+		return OAUTH_SCOPES
+	}
+
+	return ParseOauthScopes(scope)
+}
+
+// HasOauthScope returns true if the space-delimited scope of a token grants the required scope
+func HasOauthScope(scope string, required string) bool {
+	return containsString(GrantedOauthScopes(scope), required)
+}
+
+// Validate returns an error if the challenge method isn't supported or the challenge isn't the length of a valid one
+func (challenge CodeChallenge) Validate() (err error) {
+	if challenge.Method != CODE_CHALLENGE_METHOD_PLAIN && challenge.Method != CODE_CHALLENGE_METHOD_S256 {
+		return errors.New(fmt.Sprintf("Invalid code challenge method [%s], expected [%s] or [%s]", challenge.Method,
+			CODE_CHALLENGE_METHOD_S256, CODE_CHALLENGE_METHOD_PLAIN))
+	}
+
+	if len(challenge.Challenge) < 43 || len(challenge.Challenge) > 128 {
+		return errors.New("Invalid code challenge, it must be between 43 and 128 characters")
+	}
+
+	return nil
+}
+
+// Verify returns true if the verifier is the one the challenge was made from
+func (challenge CodeChallenge) Verify(verifier string) bool {
+	expected := verifier
+	if challenge.Method == CODE_CHALLENGE_METHOD_S256 {
+		hash := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+
+	return len(verifier) > 0 && subtle.ConstantTimeCompare([]byte(expected), []byte(challenge.Challenge)) == 1
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Classes of insulin, each with its own action curve
+const (
+	INSULIN_CLASS_RAPID   = "rapid"
+	INSULIN_CLASS_REGULAR = "regular"
+	INSULIN_CLASS_LONG    = "long"
+)
+
+// Carb absorption models
+const (
+	// Carbs are absorbed at a constant rate
+	CARB_ABSORPTION_LINEAR = "linear"
+	// Carbs are absorbed slowly at first, faster midway and slowly again at the end
+	CARB_ABSORPTION_PARABOLIC = "parabolic"
+)
+
+// InsulinActionCurve is an exponential insulin activity curve defined by the time of peak activity and the total duration
+// of action, both in minutes since the injection. The peak has to be less than half of the duration.
+type InsulinActionCurve struct {
+	PeakMinutes     int `json:"peakMinutes"`
+	DurationMinutes int `json:"durationMinutes"`
+}
+
+// CarbAbsorptionModel describes how the carbs of a meal are absorbed. Absorption starts DelayMinutes after the meal and lasts
+// AbsorptionMinutes.
+type CarbAbsorptionModel struct {
+	Model             string `json:"model"`
+	DelayMinutes      int    `json:"delayMinutes"`
+	AbsorptionMinutes int    `json:"absorptionMinutes"`
+}
+
+// OnBoardSettings configures the insulin on board and carbs on board calculations. InsulinCurves has an action curve for each
+// of the INSULIN_CLASS_* values.
+type OnBoardSettings struct {
+	InsulinCurves  map[string]InsulinActionCurve `json:"insulinCurves"`
+	CarbAbsorption CarbAbsorptionModel           `json:"carbAbsorption"`
+	// The interval between two points of the series
+	IntervalMinutes int `json:"intervalMinutes"`
+}
+
+// DEFAULT_ONBOARD_SETTINGS are commonly used curves for adults: rapid-acting analogs peaking at 75 minutes for 6 hours, regular
+// insulin peaking at 3 hours for 8 hours and long-acting insulin spread over a day
+var DEFAULT_ONBOARD_SETTINGS = OnBoardSettings{
+	InsulinCurves: map[string]InsulinActionCurve{
+		INSULIN_CLASS_RAPID:   InsulinActionCurve{PeakMinutes: 75, DurationMinutes: 360},
+		INSULIN_CLASS_REGULAR: InsulinActionCurve{PeakMinutes: 180, DurationMinutes: 480},
+		INSULIN_CLASS_LONG:    InsulinActionCurve{PeakMinutes: 600, DurationMinutes: 1440},
+	},
+	CarbAbsorption:  CarbAbsorptionModel{Model: CARB_ABSORPTION_PARABOLIC, DelayMinutes: 10, AbsorptionMinutes: 180},
+	IntervalMinutes: 5,
+}
+
+// Validate returns an error if the settings are missing a curve or have values the calculations can't work with
+func (settings OnBoardSettings) Validate() (err error) {
+	for _, insulinClass := range []string{INSULIN_CLASS_RAPID, INSULIN_CLASS_REGULAR, INSULIN_CLASS_LONG} {
+		curve, ok := settings.InsulinCurves[insulinClass]
+		if !ok {
+			return errors.New(fmt.Sprintf("Missing action curve for insulin class [%s]", insulinClass))
+		}
+
+		if curve.PeakMinutes <= 0 || curve.PeakMinutes*2 >= curve.DurationMinutes {
+			return errors.New(fmt.Sprintf("Invalid action curve for insulin class [%s], the peak [%d] must be positive and less than half of the duration [%d]",
+				insulinClass, curve.PeakMinutes, curve.DurationMinutes))
+		}
+	}
+
+	if settings.CarbAbsorption.Model != CARB_ABSORPTION_LINEAR && settings.CarbAbsorption.Model != CARB_ABSORPTION_PARABOLIC {
+		return errors.New(fmt.Sprintf("Invalid carb absorption model [%s], expected one of [%s, %s]", settings.CarbAbsorption.Model,
+			CARB_ABSORPTION_LINEAR, CARB_ABSORPTION_PARABOLIC))
+	}
+
+	if settings.CarbAbsorption.DelayMinutes < 0 || settings.CarbAbsorption.AbsorptionMinutes <= 0 {
+		return errors.New("Invalid carb absorption, the delay can't be negative and the absorption time must be positive")
+	}
+
+	if settings.IntervalMinutes <= 0 {
+		return errors.New(fmt.Sprintf("Invalid interval [%d], it must be positive", settings.IntervalMinutes))
+	}
+
+	return nil
+}
+
+// MaxActionDuration returns how long before a point in time injections and meals can still be on board
+func (settings OnBoardSettings) MaxActionDuration() time.Duration {
+	maxMinutes := settings.CarbAbsorption.DelayMinutes + settings.CarbAbsorption.AbsorptionMinutes
+	for _, curve := range settings.InsulinCurves {
+		if curve.DurationMinutes > maxMinutes {
+			maxMinutes = curve.DurationMinutes
+		}
+	}
+
+	return time.Duration(maxMinutes) * time.Minute
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Insulin therapies
+const (
+	THERAPY_MDI  = "MDI"
+	THERAPY_PUMP = "PUMP"
+)
+
+const (
+	// The longest display name a steady sailor can choose
+	MAX_SAILOR_DISPLAY_NAME_LENGTH = 32
+)
+
+// SailingProfile is what a user agrees to share as the steady sailor of other users and what they're matched on. Only users who
+// opted in are ever shown to others and then only anonymously, under their display name. The diagnosis date and therapy are
+// optional, users are matched on them only when they're known.
+type SailingProfile struct {
+	OptIn       bool      `json:"optIn" datastore:"optIn"`
+	DisplayName string    `json:"displayName" datastore:"displayName,noindex"`
+	DiagnosedOn time.Time `json:"diagnosedOn" datastore:"diagnosedOn,noindex"`
+	Therapy     string    `json:"therapy" datastore:"therapy,noindex"`
+}
+
+// SteadySailor is the anonymized profile of a user matched as the steady sailor of another one
+type SteadySailor struct {
+	// The email is only used to load the sailor's reads, it's never shown to the recipient
+	Email           string      `json:"-"`
+	DisplayName     string      `json:"displayName"`
+	PictureUrl      string      `json:"picture"`
+	MostRecentRead  time.Time   `json:"lastSync"`
+	MostRecentScore GlukitScore `json:"scoreDetails"`
+}
+
+// Validate returns an error if the therapy is unknown, the display name is too long or the diagnosis date is in the future
+func (profile SailingProfile) Validate() (err error) {
+	if profile.Therapy != "" && profile.Therapy != THERAPY_MDI && profile.Therapy != THERAPY_PUMP {
+		return errors.New(fmt.Sprintf("Invalid therapy [%s], expected one of [%s, %s]", profile.Therapy, THERAPY_MDI, THERAPY_PUMP))
+	}
+
+	if len([]rune(profile.DisplayName)) > MAX_SAILOR_DISPLAY_NAME_LENGTH {
+		return errors.New(fmt.Sprintf("Invalid display name [%s], it can't be longer than [%d] characters", profile.DisplayName,
+			MAX_SAILOR_DISPLAY_NAME_LENGTH))
+	}
+
+	if profile.DiagnosedOn.After(time.Now()) {
+		return errors.New(fmt.Sprintf("Invalid diagnosis date [%s], it can't be in the future", profile.DiagnosedOn))
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scopes of the data a user can share with a viewer
+const (
+	// The reads, injections, meals and exercises along with the trend and forecast
+	SHARING_SCOPE_LIVE_DATA = "liveData"
+	// The dashboard, metrics, ambulatory glucose profile, episodes, meal analysis and insulin ratios
+	SHARING_SCOPE_REPORTS = "reports"
+	// The glukit scores, a1c estimates and lab a1c results
+	SHARING_SCOPE_SCORES = "scores"
+)
+
+// SHARING_SCOPES are all the scopes a user can share
+var SHARING_SCOPES = []string{SHARING_SCOPE_LIVE_DATA, SHARING_SCOPE_REPORTS, SHARING_SCOPE_SCORES}
+
+// SharingGrant gives a viewer, like the parent of a child with diabetes, read-only access to the scopes of the data of the user who
+// owns it. Grants are revoked by deleting them.
+type SharingGrant struct {
+	OwnerEmail  string    `json:"ownerEmail" datastore:"ownerEmail"`
+	ViewerEmail string    `json:"viewerEmail" datastore:"viewerEmail"`
+	Scopes      []string  `json:"scopes" datastore:"scopes,noindex"`
+	GrantedOn   time.Time `json:"grantedOn" datastore:"grantedOn,noindex"`
+}
+
+// ViewerAccess is the audit log entry of an access of a viewer to the data of another user
+type ViewerAccess struct {
+	ViewerEmail string    `json:"viewerEmail" datastore:"viewerEmail,noindex"`
+	Scope       string    `json:"scope" datastore:"scope,noindex"`
+	Path        string    `json:"path" datastore:"path,noindex"`
+	Time        time.Time `json:"time" datastore:"time"`
+}
+
+// NormalizeEmail returns the email trimmed and lowercased, the way users log in, so that emails typed by other users match theirs
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Validate returns an error if the grant is given to its owner or doesn't have scopes or has unknown ones
+func (grant SharingGrant) Validate() (err error) {
+	if NormalizeEmail(grant.ViewerEmail) == "" || NormalizeEmail(grant.ViewerEmail) == NormalizeEmail(grant.OwnerEmail) {
+		return errors.New(fmt.Sprintf("Invalid viewer [%s], it must be another user", grant.ViewerEmail))
+	}
+
+	if len(grant.Scopes) == 0 {
+		return errors.New(fmt.Sprintf("Invalid scopes, at least one of %v must be granted", SHARING_SCOPES))
+	}
+
+	for _, scope := range grant.Scopes {
+		if !isSharingScope(scope) {
+			return errors.New(fmt.Sprintf("Invalid scope [%s], expected one of %v", scope, SHARING_SCOPES))
+		}
+	}
+
+	return nil
+}
+
+// HasScope returns true if the grant gives access to the given scope
+func (grant SharingGrant) HasScope(scope string) bool {
+	for _, granted := range grant.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSharingScope(scope string) bool {
+	for _, sharingScope := range SHARING_SCOPES {
+		if sharingScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Profiles of glucose targets. All but the custom one are presets.
+const (
+	TARGETS_PROFILE_STANDARD     = "standard"
+	TARGETS_PROFILE_PREGNANCY    = "pregnancy"
+	TARGETS_PROFILE_OLDER_ADULTS = "olderAdults"
+	TARGETS_PROFILE_CUSTOM       = "custom"
+)
+
+// ScoringTarget is the glucose value, in mg/dL, a GlukitScore measures deviations from. Deviations below the target are
+// weighted by the low multiplier and deviations above it by the high multiplier.
+type ScoringTarget struct {
+	Value          float64 `json:"value" datastore:"value,noindex"`
+	LowMultiplier  float64 `json:"lowMultiplier" datastore:"lowMultiplier,noindex"`
+	HighMultiplier float64 `json:"highMultiplier" datastore:"highMultiplier,noindex"`
+}
+
+// GlucoseTargets are the target and range thresholds a user is scored and measured against, either from one of the presets
+// or custom
+type GlucoseTargets struct {
+	Profile    string            `json:"profile" datastore:"profile,noindex"`
+	Scoring    ScoringTarget     `json:"scoring" datastore:"scoring,noindex"`
+	Thresholds GlucoseThresholds `json:"thresholds" datastore:"thresholds,noindex"`
+}
+
+// The original scoring target, where highs count twice as much as lows
+var DEFAULT_SCORING_TARGET = ScoringTarget{Value: TARGET_GLUCOSE_VALUE, LowMultiplier: 1, HighMultiplier: 2}
+
+// GLUCOSE_TARGETS_PRESETS are the preset targets by profile. The thresholds are the ones of the international consensus on time
+// in range for each population. Pregnancy has a tighter range, and older adults a higher target where lows count more than highs.
+var GLUCOSE_TARGETS_PRESETS = map[string]GlucoseTargets{
+	TARGETS_PROFILE_STANDARD: GlucoseTargets{Profile: TARGETS_PROFILE_STANDARD, Scoring: DEFAULT_SCORING_TARGET,
+		Thresholds: DEFAULT_GLUCOSE_THRESHOLDS},
+	TARGETS_PROFILE_PREGNANCY: GlucoseTargets{Profile: TARGETS_PROFILE_PREGNANCY, Scoring: DEFAULT_SCORING_TARGET,
+		Thresholds: GlucoseThresholds{VeryLow: 54, Low: 63, High: 140, VeryHigh: 250}},
+	TARGETS_PROFILE_OLDER_ADULTS: GlucoseTargets{Profile: TARGETS_PROFILE_OLDER_ADULTS,
+		Scoring:    ScoringTarget{Value: 120, LowMultiplier: 2, HighMultiplier: 1},
+		Thresholds: GlucoseThresholds{VeryLow: 54, Low: 70, High: 180, VeryHigh: 250}},
+}
+
+// The targets of users who haven't set any
+var DEFAULT_GLUCOSE_TARGETS = GLUCOSE_TARGETS_PRESETS[TARGETS_PROFILE_STANDARD]
+
+// Validate returns an error if the targets have an unknown profile or values the calculations can't work with
+func (targets GlucoseTargets) Validate() (err error) {
+	if _, ok := GLUCOSE_TARGETS_PRESETS[targets.Profile]; !ok && targets.Profile != TARGETS_PROFILE_CUSTOM {
+		return errors.New(fmt.Sprintf("Invalid profile [%s], expected one of [%s, %s, %s, %s]", targets.Profile, TARGETS_PROFILE_STANDARD,
+			TARGETS_PROFILE_PREGNANCY, TARGETS_PROFILE_OLDER_ADULTS, TARGETS_PROFILE_CUSTOM))
+	}
+
+	thresholds := targets.Thresholds
+	if thresholds.VeryLow <= 0 || thresholds.VeryLow > thresholds.Low || thresholds.Low >= thresholds.High || thresholds.High > thresholds.VeryHigh {
+		return errors.New(fmt.Sprintf("Invalid thresholds [%.0f, %.0f, %.0f, %.0f], they must be positive and in increasing order",
+			thresholds.VeryLow, thresholds.Low, thresholds.High, thresholds.VeryHigh))
+	}
+
+	scoring := targets.Scoring
+	if scoring.Value < thresholds.Low || scoring.Value > thresholds.High {
+		return errors.New(fmt.Sprintf("Invalid target [%.0f], it must be between the low [%.0f] and high [%.0f] thresholds", scoring.Value,
+			thresholds.Low, thresholds.High))
+	}
+
+	if scoring.LowMultiplier <= 0 || scoring.HighMultiplier <= 0 {
+		return errors.New("Invalid scoring multipliers, they must be positive")
+	}
+
+	return nil
+}
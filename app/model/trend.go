@@ -0,0 +1,14 @@
+package model
+
+// Trends of glucose, named like the Dexcom and Nightscout arrows
+const (
+	TREND_DOUBLE_DOWN     = "DoubleDown"
+	TREND_SINGLE_DOWN     = "SingleDown"
+	TREND_FORTY_FIVE_DOWN = "FortyFiveDown"
+	TREND_FLAT            = "Flat"
+	TREND_FORTY_FIVE_UP   = "FortyFiveUp"
+	TREND_SINGLE_UP       = "SingleUp"
+	TREND_DOUBLE_UP       = "DoubleUp"
+	// There aren't enough recent reads to tell the trend
+	TREND_NOT_COMPUTABLE = "NOT COMPUTABLE"
+)
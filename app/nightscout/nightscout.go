@@ -0,0 +1,311 @@
+// The nightscout package maps the entries and treatments documents of the Nightscout REST API to and from the glukit
+// model so that Nightscout uploaders can write to glukit unchanged.
+package nightscout
+
+import (
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ENTRY_TYPE_SGV = "sgv"
+	ENTRY_TYPE_MBG = "mbg"
+
+	EVENT_TYPE_BG_CHECK         = "BG Check"
+	EVENT_TYPE_CORRECTION_BOLUS = "Correction Bolus"
+	EVENT_TYPE_CARB_CORRECTION  = "Carb Correction"
+	EVENT_TYPE_EXERCISE         = "Exercise"
+
+	// The unit of BG checks in mmol/L, Nightscout values are in mg/dL otherwise
+	MMOL_UNITS = "mmol"
+)
+
+// Entry is a Nightscout entries document. Glukit only keeps sensor glucose values (sgv) and meter blood glucose
+// values (mbg) which are stored as calibrations.
+type Entry struct {
+	Id         string  `json:"_id,omitempty"`
+	Type       string  `json:"type"`
+	Sgv        float32 `json:"sgv,omitempty"`
+	Mbg        float32 `json:"mbg,omitempty"`
+	Date       int64   `json:"date"`
+	DateString string  `json:"dateString,omitempty"`
+	Direction  string  `json:"direction,omitempty"`
+	Device     string  `json:"device,omitempty"`
+	UtcOffset  *int    `json:"utcOffset,omitempty"`
+}
+
+// Treatment is a Nightscout treatments document. A single treatment can hold insulin, carbs and a BG check.
+type Treatment struct {
+	Id          string  `json:"_id,omitempty"`
+	EventType   string  `json:"eventType"`
+	CreatedAt   string  `json:"created_at"`
+	Mills       int64   `json:"mills,omitempty"`
+	Insulin     float32 `json:"insulin,omitempty"`
+	Carbs       float32 `json:"carbs,omitempty"`
+	Protein     float32 `json:"protein,omitempty"`
+	Fat         float32 `json:"fat,omitempty"`
+	Duration    float32 `json:"duration,omitempty"`
+	Glucose     float32 `json:"glucose,omitempty"`
+	GlucoseType string  `json:"glucoseType,omitempty"`
+	Units       string  `json:"units,omitempty"`
+	Notes       string  `json:"notes,omitempty"`
+	EnteredBy   string  `json:"enteredBy,omitempty"`
+	UtcOffset   *int    `json:"utcOffset,omitempty"`
+}
+
+// Data holds the glukit data of Nightscout documents, sorted by time
+type Data struct {
+	Reads        []apimodel.GlucoseRead
+	Calibrations []apimodel.CalibrationRead
+	Injections   []apimodel.Injection
+	Meals        []apimodel.Meal
+	Exercises    []apimodel.Exercise
+}
+
+// ConvertEntries converts entries to glukit data. The location is used for entries that don't have a utc offset.
+// Entries of other types than sgv and mbg are ignored.
+func ConvertEntries(entries []Entry, location *time.Location) (data *Data, err error) {
+	data = newData()
+	for _, entry := range entries {
+		entryTime, err := newTime(entry.Date, entry.DateString, entry.UtcOffset, location)
+		if err != nil {
+			return nil, err
+		}
+
+		switch entry.Type {
+		case ENTRY_TYPE_SGV:
+			if entry.Sgv > 0 {
+				data.Reads = append(data.Reads, apimodel.GlucoseRead{Time: entryTime, Unit: apimodel.MG_PER_DL, Value: entry.Sgv})
+			}
+		case ENTRY_TYPE_MBG:
+			if entry.Mbg > 0 {
+				data.Calibrations = append(data.Calibrations, apimodel.CalibrationRead{Time: entryTime, Unit: apimodel.MG_PER_DL, Value: entry.Mbg})
+			}
+		}
+	}
+
+	data.sort()
+	return data, nil
+}
+
+// ConvertTreatments converts treatments to glukit data. The location is used for treatments that don't have a utc offset.
+func ConvertTreatments(treatments []Treatment, location *time.Location) (data *Data, err error) {
+	data = newData()
+	for _, treatment := range treatments {
+		treatmentTime, err := newTime(treatment.Mills, treatment.CreatedAt, treatment.UtcOffset, location)
+		if err != nil {
+			return nil, err
+		}
+
+		if treatment.Insulin > 0 {
+			data.Injections = append(data.Injections, apimodel.Injection{Time: treatmentTime, Units: treatment.Insulin, InsulinType: treatment.EventType})
+		}
+
+		if treatment.Carbs > 0 {
+			data.Meals = append(data.Meals, apimodel.Meal{Time: treatmentTime, Carbohydrates: treatment.Carbs, Proteins: treatment.Protein, Fat: treatment.Fat})
+		}
+
+		if treatment.Glucose > 0 {
+			unit := apimodel.GlucoseUnit(apimodel.MG_PER_DL)
+			if strings.HasPrefix(treatment.Units, MMOL_UNITS) {
+				unit = apimodel.MMOL_PER_L
+			}
+
+			data.Calibrations = append(data.Calibrations, apimodel.CalibrationRead{Time: treatmentTime, Unit: unit, Value: treatment.Glucose})
+		}
+
+		if treatment.EventType == EVENT_TYPE_EXERCISE {
+			data.Exercises = append(data.Exercises, apimodel.Exercise{Time: treatmentTime, DurationMinutes: int(treatment.Duration), Description: treatment.Notes})
+		}
+	}
+
+	data.sort()
+	return data, nil
+}
+
+// NewEntries converts reads and calibrations to entries, most recent first
+func NewEntries(reads []apimodel.GlucoseRead, calibrations []apimodel.CalibrationRead) (entries []Entry, err error) {
+	entries = make([]Entry, 0, len(reads)+len(calibrations))
+	for _, read := range reads {
+		value, err := read.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, newEntry(ENTRY_TYPE_SGV, read.Time, func(entry *Entry) { entry.Sgv = value }))
+	}
+
+	for _, calibration := range calibrations {
+		value, err := calibration.GetNormalizedValue(apimodel.MG_PER_DL)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, newEntry(ENTRY_TYPE_MBG, calibration.Time, func(entry *Entry) { entry.Mbg = value }))
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date > entries[j].Date
+	})
+
+	return entries, nil
+}
+
+// NewTreatments converts injections, meals, exercises and calibrations to treatments, most recent first
+func NewTreatments(injections []apimodel.Injection, meals []apimodel.Meal, exercises []apimodel.Exercise,
+	calibrations []apimodel.CalibrationRead) (treatments []Treatment) {
+	treatments = make([]Treatment, 0, len(injections)+len(meals)+len(exercises)+len(calibrations))
+	for _, injection := range injections {
+		// Injections from Nightscout keep their event type as insulin type while other sources use the name of the insulin type
+		eventType := injection.InsulinType
+		if !strings.HasSuffix(eventType, "Bolus") {
+			eventType = EVENT_TYPE_CORRECTION_BOLUS
+		}
+
+		treatments = append(treatments, newTreatment(eventType, "injection", injection.Time,
+			func(treatment *Treatment) { treatment.Insulin = injection.Units }))
+	}
+
+	for _, meal := range meals {
+		treatments = append(treatments, newTreatment(EVENT_TYPE_CARB_CORRECTION, "meal", meal.Time, func(treatment *Treatment) {
+			treatment.Carbs, treatment.Protein, treatment.Fat = meal.Carbohydrates, meal.Proteins, meal.Fat
+		}))
+	}
+
+	for _, exercise := range exercises {
+		treatments = append(treatments, newTreatment(EVENT_TYPE_EXERCISE, "exercise", exercise.Time, func(treatment *Treatment) {
+			treatment.Duration, treatment.Notes = float32(exercise.DurationMinutes), exercise.Description
+		}))
+	}
+
+	for _, calibration := range calibrations {
+		treatments = append(treatments, newTreatment(EVENT_TYPE_BG_CHECK, "calibration", calibration.Time, func(treatment *Treatment) {
+			treatment.Glucose, treatment.GlucoseType = calibration.Value, "Finger"
+			treatment.Units = "mg/dl"
+			if calibration.Unit == apimodel.MMOL_PER_L {
+				treatment.Units = MMOL_UNITS
+			}
+		}))
+	}
+
+	sort.SliceStable(treatments, func(i, j int) bool {
+		return treatments[i].Mills > treatments[j].Mills
+	})
+
+	return treatments
+}
+
+func newData() *Data {
+	data := new(Data)
+	data.Reads = make([]apimodel.GlucoseRead, 0)
+	data.Calibrations = make([]apimodel.CalibrationRead, 0)
+	data.Injections = make([]apimodel.Injection, 0)
+	data.Meals = make([]apimodel.Meal, 0)
+	data.Exercises = make([]apimodel.Exercise, 0)
+
+	return data
+}
+
+// sort sorts the data by time since uploaders don't always send documents in order
+func (data *Data) sort() {
+	sort.Sort(apimodel.GlucoseReadSlice(data.Reads))
+	sort.Sort(apimodel.CalibrationReadSlice(data.Calibrations))
+	sort.Sort(apimodel.InjectionSlice(data.Injections))
+	sort.Sort(apimodel.MealSlice(data.Meals))
+	sort.Sort(apimodel.ExerciseSlice(data.Exercises))
+}
+
+// newTime returns the time of a document. The epoch milliseconds are used when set and the date string otherwise. The
+// timezone is, in order of preference, the utc offset, the offset of the date string or the given location.
+func newTime(millis int64, dateString string, utcOffset *int, location *time.Location) (documentTime apimodel.Time, err error) {
+	parsed, err := parseDate(dateString)
+	if err != nil && millis == 0 {
+		return documentTime, err
+	} else if err != nil {
+		// The epoch milliseconds are enough when the date string can't be parsed
+		dateString = ""
+	}
+
+	switch {
+	case millis > 0:
+		documentTime.Timestamp = millis
+	case dateString != "":
+		documentTime.Timestamp = parsed.UnixNano() / int64(time.Millisecond)
+	default:
+		return documentTime, errors.New("Document without a date")
+	}
+
+	switch {
+	case utcOffset != nil:
+		documentTime.TimeZoneId = fixedZoneName(*utcOffset, documentTime.Timestamp, location)
+	case dateString != "" && !strings.HasSuffix(dateString, "Z"):
+		_, offset := parsed.Zone()
+		documentTime.TimeZoneId = fixedZoneName(offset/60, documentTime.Timestamp, location)
+	default:
+		documentTime.TimeZoneId = location.String()
+	}
+
+	return documentTime, nil
+}
+
+// The layouts of the dates of documents. Besides RFC 3339, some uploaders don't put a colon in the offset.
+var dateFormats = []string{time.RFC3339, "2006-01-02T15:04:05.000-0700", "2006-01-02T15:04:05-0700"}
+
+// parseDate parses the date string of a document, returning the zero time if it's empty
+func parseDate(dateString string) (date time.Time, err error) {
+	if dateString == "" {
+		return date, nil
+	}
+
+	for _, format := range dateFormats {
+		if date, err = time.Parse(format, dateString); err == nil {
+			return date, nil
+		}
+	}
+
+	return date, errors.New(fmt.Sprintf("Invalid date [%s]", dateString))
+}
+
+// fixedZoneName returns the name of the zone with the offset in minutes. If the location has that offset at the given time, the
+// name of the location is used so that the actual timezone is kept
+func fixedZoneName(offsetInMinutes int, millis int64, location *time.Location) string {
+	if _, offset := time.Unix(millis/1000, 0).In(location).Zone(); offset == offsetInMinutes*60 {
+		return location.String()
+	}
+
+	sign := "+"
+	if offsetInMinutes < 0 {
+		sign = "-"
+		offsetInMinutes = -offsetInMinutes
+	}
+
+	return fmt.Sprintf("%s%02d%02d", sign, offsetInMinutes/60, offsetInMinutes%60)
+}
+
+func newEntry(entryType string, entryTime apimodel.Time, setValue func(entry *Entry)) Entry {
+	localTime := entryTime.GetTime()
+	_, offset := localTime.Zone()
+	utcOffset := offset / 60
+
+	entry := Entry{Id: fmt.Sprintf("%s-%d", entryType, entryTime.Timestamp), Type: entryType, Date: entryTime.Timestamp,
+		DateString: localTime.Format(time.RFC3339), UtcOffset: &utcOffset}
+	setValue(&entry)
+
+	return entry
+}
+
+func newTreatment(eventType string, kind string, treatmentTime apimodel.Time, setValue func(treatment *Treatment)) Treatment {
+	localTime := treatmentTime.GetTime()
+	_, offset := localTime.Zone()
+	utcOffset := offset / 60
+
+	treatment := Treatment{Id: fmt.Sprintf("%s-%d", kind, treatmentTime.Timestamp), EventType: eventType,
+		CreatedAt: localTime.Format(time.RFC3339), Mills: treatmentTime.Timestamp, UtcOffset: &utcOffset}
+	setValue(&treatment)
+
+	return treatment
+}
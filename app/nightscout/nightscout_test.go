@@ -0,0 +1,101 @@
+package nightscout_test
+
+import (
+	"encoding/json"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	. "github.com/alexandre-normand/glukit/app/nightscout"
+	"testing"
+	"time"
+)
+
+func TestConvertEntries(t *testing.T) {
+	location, _ := time.LoadLocation("America/Los_Angeles")
+	var entries []Entry
+	// An xDrip upload with a utc offset, one with only a date string and one without a timezone at all
+	if err := json.Unmarshal([]byte(`[
+		{"type": "sgv", "sgv": 120, "date": 1556722800000, "dateString": "2019-05-01T08:00:00.000-0700", "direction": "Flat", "utcOffset": -420},
+		{"type": "mbg", "mbg": 110, "date": 1556722500000, "dateString": "2019-05-01T16:55:00+02:00"},
+		{"type": "sgv", "sgv": 115, "date": 1556722500000},
+		{"type": "cal", "slope": 1000, "date": 1556722500000}]`), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ConvertEntries(entries, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data.Reads) != 2 || len(data.Calibrations) != 1 {
+		t.Fatalf("TestConvertEntries failed: got [%d] reads and [%d] calibrations but expected [%d] and [%d]", len(data.Reads), len(data.Calibrations), 2, 1)
+	}
+
+	// Reads are sorted and the offset of the user's timezone maps back to the timezone
+	expectedRead := apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: 1556722500000, TimeZoneId: "America/Los_Angeles"}, Unit: apimodel.MG_PER_DL, Value: 115}
+	if data.Reads[0] != expectedRead || data.Reads[1].Time.TimeZoneId != "America/Los_Angeles" {
+		t.Errorf("TestConvertEntries failed: got reads [%v] but expected the first one to be [%v]", data.Reads, expectedRead)
+	}
+
+	if data.Calibrations[0].Time.TimeZoneId != "+0200" || data.Calibrations[0].GetTime().Hour() != 16 {
+		t.Errorf("TestConvertEntries failed: got calibration [%v] but expected it at 16:55 in [%s]", data.Calibrations[0], "+0200")
+	}
+}
+
+func TestConvertTreatments(t *testing.T) {
+	var treatments []Treatment
+	if err := json.Unmarshal([]byte(`[
+		{"eventType": "Meal Bolus", "created_at": "2019-05-01T15:00:00Z", "insulin": 4.5, "carbs": 45, "fat": 10},
+		{"eventType": "BG Check", "created_at": "2019-05-01T14:00:00Z", "glucose": 5.5, "glucoseType": "Finger", "units": "mmol"},
+		{"eventType": "Exercise", "created_at": "2019-05-01T16:00:00Z", "duration": 30, "notes": "Run"},
+		{"eventType": "Note", "created_at": "2019-05-01T16:00:00Z", "notes": "Nothing to import"}]`), &treatments); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ConvertTreatments(treatments, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data.Injections) != 1 || data.Injections[0].Units != 4.5 || data.Injections[0].InsulinType != "Meal Bolus" {
+		t.Errorf("TestConvertTreatments failed: got injections [%v] but expected a meal bolus of [%f] units", data.Injections, 4.5)
+	}
+	if len(data.Meals) != 1 || data.Meals[0].Carbohydrates != 45 || data.Meals[0].Fat != 10 {
+		t.Errorf("TestConvertTreatments failed: got meals [%v] but expected one of [%d] grams of carbs", data.Meals, 45)
+	}
+	if len(data.Calibrations) != 1 || data.Calibrations[0].Unit != apimodel.MMOL_PER_L {
+		t.Errorf("TestConvertTreatments failed: got calibrations [%v] but expected one in mmol/L", data.Calibrations)
+	}
+	if len(data.Exercises) != 1 || data.Exercises[0].DurationMinutes != 30 {
+		t.Errorf("TestConvertTreatments failed: got exercises [%v] but expected one of [%d] minutes", data.Exercises, 30)
+	}
+
+	// Converting back gives the same treatments, most recent first
+	converted := NewTreatments(data.Injections, data.Meals, data.Exercises, data.Calibrations)
+	if len(converted) != 4 || converted[0].EventType != "Exercise" || converted[3].EventType != "BG Check" || converted[3].Units != "mmol" {
+		t.Errorf("TestConvertTreatments failed: got treatments [%v] but expected an exercise, a bolus, carbs and a bg check", converted)
+	}
+}
+
+func TestConvertTreatmentWithoutDate(t *testing.T) {
+	if _, err := ConvertTreatments([]Treatment{Treatment{EventType: "Correction Bolus", Insulin: 1}}, time.UTC); err == nil {
+		t.Errorf("TestConvertTreatmentWithoutDate failed: expected an error for a treatment without a date")
+	}
+}
+
+func TestNewEntries(t *testing.T) {
+	reads := []apimodel.GlucoseRead{
+		apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: 1556722500000, TimeZoneId: "America/Los_Angeles"}, Unit: apimodel.MMOL_PER_L, Value: 5.5},
+		apimodel.GlucoseRead{Time: apimodel.Time{Timestamp: 1556722800000, TimeZoneId: "America/Los_Angeles"}, Unit: apimodel.MG_PER_DL, Value: 120}}
+
+	entries, err := NewEntries(reads, []apimodel.CalibrationRead{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Sgv != 120 || entries[0].DateString != "2019-05-01T08:00:00-07:00" || *entries[0].UtcOffset != -420 {
+		t.Errorf("TestNewEntries failed: got entries [%v] but expected the most recent first at [%s]", entries, "2019-05-01T08:00:00-07:00")
+	}
+
+	if entries[1].Sgv < 98 || entries[1].Sgv > 100 {
+		t.Errorf("TestNewEntries failed: got sgv [%f] but expected 5.5 mmol/L converted to mg/dL", entries[1].Sgv)
+	}
+}
@@ -4,9 +4,9 @@ package payment
 import (
 	"fmt"
 	"github.com/alexandre-normand/glukit/app/config"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/cosn/stripe"
 	"context"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
 	"google.golang.org/appengine/user"
 	"strconv"
@@ -1,8 +1,11 @@
+//go:build appengine_legacy
+// +build appengine_legacy
+
 package payment_test
 
 import (
-	"github.com/alexandre-normand/glukit/app/config"
 	. "github.com/alexandre-normand/glukit/app/payment"
+	"github.com/alexandre-normand/glukit/app/secrets"
 	"github.com/cosn/stripe"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/urlfetch"
@@ -19,7 +22,7 @@ func TestDonationWithNoUser(t *testing.T) {
 	}
 	defer c.Close()
 
-	appConfig := config.NewAppConfig()
+	appConfig := secrets.NewAppConfig()
 	client := NewStripeClient(appConfig)
 
 	err = client.SubmitDonation(c, "testtoken", "100")
@@ -47,7 +50,7 @@ func TestDonationWithInvalidAmount(t *testing.T) {
 	defer c.Close()
 
 	c.Login(&user.User{Email: "test@glukit.com", AuthDomain: "glukit.com", Admin: false})
-	appConfig := config.NewAppConfig()
+	appConfig := secrets.NewAppConfig()
 	client := NewStripeClient(appConfig)
 
 	err = client.SubmitDonation(c, "invalidToken", "invalidVal")
@@ -68,7 +71,7 @@ func TestDonationWithInvalidToken(t *testing.T) {
 	defer c.Close()
 
 	c.Login(&user.User{Email: "test@glukit.com", AuthDomain: "glukit.com", Admin: false})
-	appConfig := config.NewAppConfig()
+	appConfig := secrets.NewAppConfig()
 	client := NewStripeClient(appConfig)
 
 	err = client.SubmitDonation(c, "invalidToken", "100")
@@ -89,7 +92,7 @@ func TestValidDonation(t *testing.T) {
 	defer c.Close()
 
 	c.Login(&user.User{Email: "test@glukit.com", AuthDomain: "glukit.com", Admin: false})
-	appConfig := config.NewAppConfig()
+	appConfig := secrets.NewAppConfig()
 	client := NewStripeClient(appConfig)
 
 	httpClient := urlfetch.Client(c)
@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/taskqueue"
+	"sync"
+)
+
+const (
+	RUN_JOB_FUNCTION_NAME = "runJob"
+)
+
+var appEngineHandlers = make(map[string]HandlerFunc)
+var appEngineHandlersLock sync.RWMutex
+
+// runJob is the single delayed function used to run all jobs on App Engine. It dispatches to the
+// registered handler for the job's name. Returning an error has the task queue retry the job.
+var runJob = delay.Func(RUN_JOB_FUNCTION_NAME, func(context context.Context, job Job) error {
+	appEngineHandlersLock.RLock()
+	handler, ok := appEngineHandlers[job.Name]
+	appEngineHandlersLock.RUnlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("No handler registered for job [%s]", job.Name))
+	}
+
+	return handler(context, job)
+})
+
+// AppEngineQueue is the Queue implementation that runs jobs as App Engine delayed functions. Failed jobs are retried
+// according to the retry parameters of queue.yml and can be inspected from the Cloud Console.
+type AppEngineQueue struct {
+}
+
+// NewAppEngineQueue creates a new Queue that adds jobs to the App Engine task queues
+func NewAppEngineQueue() *AppEngineQueue {
+	return new(AppEngineQueue)
+}
+
+func (q *AppEngineQueue) Register(name string, handler HandlerFunc) {
+	appEngineHandlersLock.Lock()
+	defer appEngineHandlersLock.Unlock()
+
+	appEngineHandlers[name] = handler
+}
+
+func (q *AppEngineQueue) Enqueue(context context.Context, queueName string, job Job) (err error) {
+	task, err := runJob.Task(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = taskqueue.Add(context, task, queueName)
+	return err
+}
@@ -0,0 +1,194 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// A job waiting for its first execution
+	JOB_STATUS_PENDING = "pending"
+	// A job currently executing
+	JOB_STATUS_RUNNING = "running"
+	// A job that failed and is waiting for its next attempt
+	JOB_STATUS_FAILED = "failed"
+	// A job that failed too many times and won't be retried
+	JOB_STATUS_DEAD = "dead"
+)
+
+// JobRecord is the persisted state of a Job.
+type JobRecord struct {
+	Id          string    `json:"id"`
+	QueueName   string    `json:"queueName"`
+	Job         Job       `json:"job"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+// IsWaiting returns true if the job is waiting to be executed, be it for the first time or as a retry
+func (record JobRecord) IsWaiting() bool {
+	return record.Status == JOB_STATUS_PENDING || record.Status == JOB_STATUS_FAILED
+}
+
+// JobStore persists the jobs of a LocalQueue so that they survive restarts of the process.
+type JobStore interface {
+	// Add stores a new waiting job. If a waiting job with the same key already exists, no job is added and the existing
+	// one is moved back to the earliest of both lower bounds so that it covers the work of both.
+	Add(context context.Context, record JobRecord) (err error)
+
+	// Claim marks the next waiting job due at or before now as running and returns it. It returns nil if no job is due.
+	Claim(context context.Context, now time.Time) (record *JobRecord, err error)
+
+	// Complete removes a job that ran successfully.
+	Complete(context context.Context, id string) (err error)
+
+	// Release updates a claimed job with its new status, attempts and next attempt. A job released as waiting is merged
+	// into any waiting job with the same key, like on Add.
+	Release(context context.Context, record JobRecord) (err error)
+
+	// Recover releases the jobs left running by a process that stopped before completing them.
+	Recover(context context.Context) (err error)
+
+	// List returns the jobs with the given status or all jobs if the status is empty, ordered by next attempt.
+	List(context context.Context, status string) (records []JobRecord, err error)
+}
+
+// NewJobId generates a new random job identifier
+func NewJobId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// MemoryJobStore is the JobStore implementation that keeps jobs in memory. Jobs are lost when the process stops.
+type MemoryJobStore struct {
+	records map[string]*JobRecord
+	lock    sync.Mutex
+}
+
+// NewMemoryJobStore creates a new JobStore that keeps jobs in memory
+func NewMemoryJobStore() *MemoryJobStore {
+	s := new(MemoryJobStore)
+	s.records = make(map[string]*JobRecord)
+
+	return s
+}
+
+func (s *MemoryJobStore) Add(context context.Context, record JobRecord) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.addWaiting(record)
+	return nil
+}
+
+// addWaiting adds a waiting record or merges it into the waiting record with the same key. The lock must be held.
+func (s *MemoryJobStore) addWaiting(record JobRecord) {
+	for id, existing := range s.records {
+		if id != record.Id && existing.IsWaiting() && existing.Job.Key() == record.Job.Key() {
+			if record.Job.LowerBound.Before(existing.Job.LowerBound) {
+				existing.Job.LowerBound = record.Job.LowerBound
+				existing.Updated = record.Updated
+			}
+
+			delete(s.records, record.Id)
+			return
+		}
+	}
+
+	s.records[record.Id] = &record
+}
+
+func (s *MemoryJobStore) Claim(context context.Context, now time.Time) (record *JobRecord, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var next *JobRecord
+	for _, candidate := range s.records {
+		if candidate.IsWaiting() && !candidate.NextAttempt.After(now) && (next == nil || isBefore(*candidate, *next)) {
+			next = candidate
+		}
+	}
+
+	if next == nil {
+		return nil, nil
+	}
+
+	next.Status = JOB_STATUS_RUNNING
+	next.Updated = now
+	claimed := *next
+
+	return &claimed, nil
+}
+
+func (s *MemoryJobStore) Complete(context context.Context, id string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.records, id)
+	return nil
+}
+
+func (s *MemoryJobStore) Release(context context.Context, record JobRecord) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if record.IsWaiting() {
+		s.addWaiting(record)
+	} else {
+		s.records[record.Id] = &record
+	}
+
+	return nil
+}
+
+func (s *MemoryJobStore) Recover(context context.Context) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, record := range s.records {
+		if record.Status == JOB_STATUS_RUNNING {
+			recovered := *record
+			recovered.Status = JOB_STATUS_PENDING
+			s.addWaiting(recovered)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryJobStore) List(context context.Context, status string) (records []JobRecord, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	records = make([]JobRecord, 0)
+	for _, record := range s.records {
+		if status == "" || record.Status == status {
+			records = append(records, *record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return isBefore(records[i], records[j])
+	})
+
+	return records, nil
+}
+
+// isBefore orders records by next attempt and then by creation time
+func isBefore(record JobRecord, other JobRecord) bool {
+	if !record.NextAttempt.Equal(other.NextAttempt) {
+		return record.NextAttempt.Before(other.NextAttempt)
+	}
+
+	return record.Created.Before(other.Created)
+}
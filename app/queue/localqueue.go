@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the queue looks for due jobs when nothing wakes it up sooner
+	POLL_INTERVAL = time.Minute
+)
+
+// RetryPolicy defines how failed jobs are retried. The delay before each retry doubles, starting with the
+// InitialBackoff and up to the MaxBackoff. A job is dead after MaxAttempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DEFAULT_RETRY_POLICY retries jobs for roughly a day, which is close to what the App Engine task queues do with the
+// retry parameters of queue.yml.
+var DEFAULT_RETRY_POLICY = RetryPolicy{MaxAttempts: 10, InitialBackoff: 30 * time.Second, MaxBackoff: 4 * time.Hour}
+
+// Backoff returns the delay to wait before the next attempt of a job that has been attempted the given number of times
+func (policy RetryPolicy) Backoff(attempts int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempts && backoff < policy.MaxBackoff; i++ {
+		backoff = backoff * 2
+	}
+
+	if backoff > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+
+	return backoff
+}
+
+// LocalQueue is the Queue implementation that runs jobs in-process with a fixed number of worker goroutines.
+// Jobs are persisted to a JobStore as soon as they are enqueued and failed jobs are retried according
+// to a RetryPolicy. Jobs left over by a previous process are resumed when the queue is started.
+type LocalQueue struct {
+	jobStore    JobStore
+	retryPolicy RetryPolicy
+	workers     int
+	handlers    map[string]HandlerFunc
+	lock        sync.RWMutex
+	started     bool
+	closed      bool
+	wake        chan bool
+	done        chan bool
+	claimed     chan JobRecord
+	running     sync.WaitGroup
+}
+
+// NewLocalQueue creates a new Queue that persists jobs to the given JobStore and runs them with the given number of workers
+// once started
+func NewLocalQueue(jobStore JobStore, workers int, retryPolicy RetryPolicy) *LocalQueue {
+	q := new(LocalQueue)
+	q.jobStore = jobStore
+	q.retryPolicy = retryPolicy
+	q.workers = workers
+	q.handlers = make(map[string]HandlerFunc)
+	q.wake = make(chan bool, 1)
+	q.done = make(chan bool)
+	q.claimed = make(chan JobRecord)
+
+	return q
+}
+
+func (q *LocalQueue) Register(name string, handler HandlerFunc) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.handlers[name] = handler
+}
+
+func (q *LocalQueue) Enqueue(context context.Context, queueName string, job Job) (err error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.closed {
+		return errors.New(fmt.Sprintf("Can't enqueue job [%s] for user [%s], queue is closed", job.Name, job.UserEmail))
+	}
+
+	if _, ok := q.handlers[job.Name]; !ok {
+		return errors.New(fmt.Sprintf("No handler registered for job [%s]", job.Name))
+	}
+
+	now := time.Now()
+	record := JobRecord{Id: NewJobId(), QueueName: queueName, Job: job, Status: JOB_STATUS_PENDING, NextAttempt: now, Created: now, Updated: now}
+	if err = q.jobStore.Add(context, record); err != nil {
+		return err
+	}
+
+	q.notify()
+	return nil
+}
+
+// Jobs returns the persisted jobs with the given status or all jobs if the status is empty
+func (q *LocalQueue) Jobs(context context.Context, status string) (records []JobRecord, err error) {
+	return q.jobStore.List(context, status)
+}
+
+// Start recovers the jobs interrupted by a previous process and starts running jobs. Handlers should all be
+// registered before the queue is started.
+func (q *LocalQueue) Start() (err error) {
+	if err = q.jobStore.Recover(context.Background()); err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	q.started = true
+	q.lock.Unlock()
+
+	for i := 0; i < q.workers; i++ {
+		q.running.Add(1)
+		go q.work()
+	}
+
+	q.running.Add(1)
+	go q.dispatch()
+
+	return nil
+}
+
+// Close stops accepting new jobs and waits for the workers to finish the jobs that are due. Jobs waiting
+// for a retry stay in the JobStore until the next time a queue is started.
+func (q *LocalQueue) Close() {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+
+	started := q.started
+	q.closed = true
+	q.lock.Unlock()
+
+	if started {
+		close(q.done)
+		q.running.Wait()
+	}
+}
+
+// notify wakes up the dispatcher without blocking if it's already been notified
+func (q *LocalQueue) notify() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// dispatch claims due jobs and hands them to the workers until the queue is closed and no job is due
+func (q *LocalQueue) dispatch() {
+	defer q.running.Done()
+	defer close(q.claimed)
+
+	context := context.Background()
+	closing := false
+	for {
+		record, err := q.jobStore.Claim(context, time.Now())
+		if err != nil {
+			log.Errorf(context, "Error claiming next job: %v", err)
+		}
+
+		if record != nil {
+			q.claimed <- *record
+			continue
+		}
+
+		if closing {
+			return
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(POLL_INTERVAL):
+		case <-q.done:
+			closing = true
+		}
+	}
+}
+
+// work runs claimed jobs until the dispatcher stops
+func (q *LocalQueue) work() {
+	defer q.running.Done()
+
+	for record := range q.claimed {
+		q.run(record)
+	}
+}
+
+// run executes a single job and records its outcome. Failed jobs are rescheduled with a backoff until they
+// run out of attempts.
+func (q *LocalQueue) run(record JobRecord) {
+	context := context.Background()
+
+	err := q.execute(context, record.Job)
+	if err == nil {
+		if err = q.jobStore.Complete(context, record.Id); err != nil {
+			log.Errorf(context, "Error completing job [%s] for user [%s]: %v", record.Job.Name, record.Job.UserEmail, err)
+		}
+		return
+	}
+
+	record.Attempts = record.Attempts + 1
+	record.LastError = err.Error()
+	record.Updated = time.Now()
+	if record.Attempts >= q.retryPolicy.MaxAttempts {
+		record.Status = JOB_STATUS_DEAD
+		log.Criticalf(context, "Job [%s] for user [%s] failed for the last time after [%d] attempts: %v", record.Job.Name,
+			record.Job.UserEmail, record.Attempts, err)
+	} else {
+		backoff := q.retryPolicy.Backoff(record.Attempts)
+		record.Status = JOB_STATUS_FAILED
+		record.NextAttempt = record.Updated.Add(backoff)
+		log.Warningf(context, "Job [%s] for user [%s] failed on attempt [%d], retrying in [%s]: %v", record.Job.Name,
+			record.Job.UserEmail, record.Attempts, backoff, err)
+		time.AfterFunc(backoff, q.notify)
+	}
+
+	if err = q.jobStore.Release(context, record); err != nil {
+		log.Errorf(context, "Error releasing job [%s] for user [%s]: %v", record.Job.Name, record.Job.UserEmail, err)
+	}
+}
+
+// execute calls the job's handler, making sure a panicking handler doesn't take the worker down with it
+func (q *LocalQueue) execute(context context.Context, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprintf("Job panicked: %v", r))
+		}
+	}()
+
+	q.lock.RLock()
+	handler, ok := q.handlers[job.Name]
+	q.lock.RUnlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("No handler registered for job [%s]", job.Name))
+	}
+
+	return handler(context, job)
+}
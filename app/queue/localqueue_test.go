@@ -0,0 +1,172 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	. "github.com/alexandre-normand/glukit/app/queue"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+
+func TestLocalQueueRunsJobs(t *testing.T) {
+	q := NewLocalQueue(NewMemoryJobStore(), 2, testRetryPolicy)
+
+	var lock sync.Mutex
+	ran := make(map[string]bool)
+	q.Register("test", func(context context.Context, job Job) error {
+		lock.Lock()
+		defer lock.Unlock()
+		ran[job.UserEmail] = true
+		return nil
+	})
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	emails := []string{"a@glukit.com", "b@glukit.com", "c@glukit.com"}
+	for _, email := range emails {
+		if err := q.Enqueue(context.Background(), "test-queue", Job{Name: "test", UserEmail: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q.Close()
+
+	for _, email := range emails {
+		if !ran[email] {
+			t.Errorf("TestLocalQueueRunsJobs failed: job for [%s] didn't run", email)
+		}
+	}
+}
+
+func TestLocalQueueSurvivesFailingJobs(t *testing.T) {
+	q := NewLocalQueue(NewMemoryJobStore(), 1, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	count := 0
+	q.Register("failing", func(context context.Context, job Job) error {
+		count = count + 1
+		if count == 1 {
+			panic("first job panics")
+		}
+		return errors.New("job failed")
+	})
+
+	for _, email := range []string{"a@glukit.com", "b@glukit.com", "c@glukit.com"} {
+		if err := q.Enqueue(context.Background(), "test-queue", Job{Name: "failing", UserEmail: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if count != 3 {
+		t.Errorf("TestLocalQueueSurvivesFailingJobs failed: got [%d] job executions but expected [%d]", count, 3)
+	}
+
+	failed, err := q.Jobs(context.Background(), JOB_STATUS_FAILED)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(failed) != 3 {
+		t.Errorf("TestLocalQueueSurvivesFailingJobs failed: got [%d] failed jobs but expected [%d]", len(failed), 3)
+	}
+}
+
+func TestLocalQueueRetriesUntilDead(t *testing.T) {
+	q := NewLocalQueue(NewMemoryJobStore(), 1, testRetryPolicy)
+
+	attempts := make(chan bool, testRetryPolicy.MaxAttempts)
+	q.Register("failing", func(context context.Context, job Job) error {
+		attempts <- true
+		return errors.New("job failed")
+	})
+
+	if err := q.Enqueue(context.Background(), "test-queue", Job{Name: "failing", UserEmail: "a@glukit.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	for i := 0; i < testRetryPolicy.MaxAttempts; i++ {
+		select {
+		case <-attempts:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("TestLocalQueueRetriesUntilDead failed: timed out waiting for attempt [%d]", i+1)
+		}
+	}
+
+	var dead []JobRecord
+	for start := time.Now(); len(dead) == 0 && time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		dead, _ = q.Jobs(context.Background(), JOB_STATUS_DEAD)
+	}
+
+	if len(dead) != 1 || dead[0].Attempts != testRetryPolicy.MaxAttempts || dead[0].LastError != "job failed" {
+		t.Errorf("TestLocalQueueRetriesUntilDead failed: got dead jobs [%v] but expected one with [%d] attempts", dead, testRetryPolicy.MaxAttempts)
+	}
+}
+
+func TestLocalQueueDeduplicatesWaitingJobs(t *testing.T) {
+	q := NewLocalQueue(NewMemoryJobStore(), 1, testRetryPolicy)
+
+	var lowerBounds []time.Time
+	q.Register("chain", func(context context.Context, job Job) error {
+		lowerBounds = append(lowerBounds, job.LowerBound)
+		return nil
+	})
+
+	earliest := time.Unix(1400000000, 0)
+	for _, lowerBound := range []time.Time{earliest.AddDate(0, 0, 7), earliest, earliest.AddDate(0, 0, 1)} {
+		if err := q.Enqueue(context.Background(), "test-queue", Job{Name: "chain", UserEmail: "a@glukit.com", LowerBound: lowerBound}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := q.Jobs(context.Background(), JOB_STATUS_PENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 1 {
+		t.Errorf("TestLocalQueueDeduplicatesWaitingJobs failed: got [%d] pending jobs but expected [%d]", len(pending), 1)
+	}
+
+	if err := q.Start(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if len(lowerBounds) != 1 || !lowerBounds[0].Equal(earliest) {
+		t.Errorf("TestLocalQueueDeduplicatesWaitingJobs failed: got executions with lower bounds [%v] but expected one at [%s]", lowerBounds, earliest)
+	}
+}
+
+func TestLocalQueueRejectsUnknownJobs(t *testing.T) {
+	q := NewLocalQueue(NewMemoryJobStore(), 1, testRetryPolicy)
+	defer q.Close()
+
+	if err := q.Enqueue(context.Background(), "test-queue", Job{Name: "unknown"}); err == nil {
+		t.Errorf("TestLocalQueueRejectsUnknownJobs failed: expected an error enqueuing a job without a handler")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if value := policy.Backoff(i + 1); value != backoff {
+			t.Errorf("TestRetryPolicyBackoff failed: got backoff [%s] after [%d] attempts but expected [%s]", value, i+1, backoff)
+		}
+	}
+}
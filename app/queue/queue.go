@@ -0,0 +1,42 @@
+// queue package abstracts the execution of background jobs. On App Engine, jobs run as delayed
+// functions on the task queues while a standalone server runs them in-process from a durable JobStore.
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// Job is a unit of background work done on behalf of a user. The Name identifies the HandlerFunc that runs
+// it and the LowerBound is the point in time from which the job should resume its work, if applicable.
+type Job struct {
+	Name       string    `json:"name"`
+	UserEmail  string    `json:"userEmail"`
+	LowerBound time.Time `json:"lowerBound"`
+}
+
+// Key identifies the work a job does for a user. Waiting jobs sharing the same key are deduplicated so that,
+// for example, two uploads don't start two overlapping chains of batch calculations.
+func (job Job) Key() string {
+	return job.Name + "/" + job.UserEmail
+}
+
+// HandlerFunc runs a job. An error means the job didn't complete.
+type HandlerFunc func(context context.Context, job Job) error
+
+// Queue is the abstraction of a job queue.
+type Queue interface {
+	// Register associates a job name with the HandlerFunc that runs it. All handlers must be registered before
+	// jobs get enqueued.
+	Register(name string, handler HandlerFunc)
+
+	// Enqueue adds a job to the named queue. The queue name is a hint to the implementation that might
+	// have different rates of execution per queue.
+	Enqueue(context context.Context, queueName string, job Job) (err error)
+}
+
+// Inspector is implemented by queues that can list the jobs they hold.
+type Inspector interface {
+	// Jobs returns the jobs with the given status (one of the JOB_STATUS_* values) or all jobs if the status is empty.
+	Jobs(context context.Context, status string) (records []JobRecord, err error)
+}
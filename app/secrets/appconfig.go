@@ -0,0 +1,43 @@
+package secrets
+
+import (
+	"github.com/alexandre-normand/glukit/app/config"
+	"google.golang.org/appengine"
+)
+
+// newTestAppConfig returns the AppConfig for a test environment
+func newTestAppConfig(appSecrets *AppSecrets) *config.AppConfig {
+	appConfig := new(config.AppConfig)
+	appConfig.GoogleClientId = appSecrets.LocalGoogleClientId
+	appConfig.GoogleClientSecret = appSecrets.LocalGoogleClientSecret
+	appConfig.Host = "localhost:8080"
+	appConfig.SSLHost = "http://localhost:8080"
+	appConfig.StripeKey = appSecrets.LocalStripeKey
+	appConfig.StripePublishableKey = appSecrets.LocalStripePublishableKey
+
+	return appConfig
+}
+
+// newProdAppConfig returns the AppConfig for the production environment
+func newProdAppConfig(appSecrets *AppSecrets) *config.AppConfig {
+	appConfig := new(config.AppConfig)
+	appConfig.GoogleClientId = appSecrets.ProdGoogleClientId
+	appConfig.GoogleClientSecret = appSecrets.ProdGoogleClientSecret
+	appConfig.Host = "www.mygluk.it"
+	appConfig.SSLHost = "https://glukit.appspot.com"
+	appConfig.StripeKey = appSecrets.ProdStripeKey
+	appConfig.StripePublishableKey = appSecrets.ProdStripePublishableKey
+
+	return appConfig
+}
+
+// NewAppConfig returns the AppConfig that matches the current environment (test or prod)
+// as returned by appengine.IsDevAppServer()
+func NewAppConfig() *config.AppConfig {
+	appSecrets := NewAppSecrets()
+	if appengine.IsDevAppServer() {
+		return newTestAppConfig(appSecrets)
+	} else {
+		return newProdAppConfig(appSecrets)
+	}
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"google.golang.org/appengine/datastore"
+	"time"
+)
+
+// DataStoreRepository is the Repository implementation backed by the App Engine datastore. All
+// of a user's entities are stored as descendants of the GlukitUser entity key.
+type DataStoreRepository struct {
+}
+
+// NewDataStoreRepository creates a new Repository that persists to the App Engine datastore
+func NewDataStoreRepository() *DataStoreRepository {
+	return new(DataStoreRepository)
+}
+
+// translateNoSuchEntity maps the datastore error for missing entities to the storage agnostic ErrNoSuchUser
+func translateNoSuchEntity(err error) error {
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoSuchUser
+	}
+
+	return err
+}
+
+func (r *DataStoreRepository) GetUserProfile(context context.Context, email string) (userProfile *model.GlukitUser, err error) {
+	userProfile, err = GetUserProfile(context, GetUserKey(context, email))
+	return userProfile, translateNoSuchEntity(err)
+}
+
+func (r *DataStoreRepository) StoreUserProfile(context context.Context, updatedAt time.Time, userProfile model.GlukitUser) (err error) {
+	_, err = StoreUserProfile(context, updatedAt, userProfile)
+	return err
+}
+
+func (r *DataStoreRepository) GetUserData(context context.Context, email string) (userProfile *model.GlukitUser, upperBound time.Time, err error) {
+	userProfile, _, upperBound, err = GetUserData(context, email)
+	return userProfile, upperBound, translateNoSuchEntity(err)
+}
+
+func (r *DataStoreRepository) FindSteadySailorCandidates(context context.Context, diabetesType string, limit int) (candidates []model.GlukitUser, err error) {
+	return FindSteadySailorCandidates(context, diabetesType, limit)
+}
+
+func (r *DataStoreRepository) GetGlucoseReads(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (reads []apimodel.GlucoseRead, err error) {
+	return GetGlucoseReads(context, email, lowerBound, upperBound)
+}
+
+func (r *DataStoreRepository) StoreDaysOfReads(context context.Context, email string, daysOfReads []apimodel.DayOfGlucoseReads) (err error) {
+	_, err = StoreDaysOfReads(context, GetUserKey(context, email), daysOfReads)
+	return err
+}
+
+func (r *DataStoreRepository) GetCalibrations(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (calibrations []apimodel.CalibrationRead, err error) {
+	return GetCalibrations(context, email, lowerBound, upperBound)
+}
+
+func (r *DataStoreRepository) StoreDaysOfCalibrations(context context.Context, email string, daysOfCalibrations []apimodel.DayOfCalibrationReads) (err error) {
+	_, err = StoreCalibrationReads(context, GetUserKey(context, email), daysOfCalibrations)
+	return err
+}
+
+func (r *DataStoreRepository) GetInjections(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (injections []apimodel.Injection, err error) {
+	return GetInjections(context, email, lowerBound, upperBound)
+}
+
+func (r *DataStoreRepository) StoreDaysOfInjections(context context.Context, email string, daysOfInjections []apimodel.DayOfInjections) (err error) {
+	_, err = StoreDaysOfInjections(context, GetUserKey(context, email), daysOfInjections)
+	return err
+}
+
+func (r *DataStoreRepository) GetMeals(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (meals []apimodel.Meal, err error) {
+	return GetMeals(context, email, lowerBound, upperBound)
+}
+
+func (r *DataStoreRepository) StoreDaysOfMeals(context context.Context, email string, daysOfMeals []apimodel.DayOfMeals) (err error) {
+	_, err = StoreDaysOfMeals(context, GetUserKey(context, email), daysOfMeals)
+	return err
+}
+
+func (r *DataStoreRepository) GetExercises(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (exercises []apimodel.Exercise, err error) {
+	return GetExercises(context, email, lowerBound, upperBound)
+}
+
+func (r *DataStoreRepository) StoreDaysOfExercises(context context.Context, email string, daysOfExercises []apimodel.DayOfExercises) (err error) {
+	_, err = StoreDaysOfExercises(context, GetUserKey(context, email), daysOfExercises)
+	return err
+}
+
+func (r *DataStoreRepository) StoreGlukitScoreBatch(context context.Context, email string, glukitScores []model.GlukitScore) (err error) {
+	return StoreGlukitScoreBatch(context, email, glukitScores)
+}
+
+func (r *DataStoreRepository) GetGlukitScores(context context.Context, email string, scanQuery ScoreScanQuery) (scores []model.GlukitScore, err error) {
+	return GetGlukitScores(context, email, scanQuery)
+}
+
+func (r *DataStoreRepository) StoreA1CBatch(context context.Context, email string, a1cs []model.A1CEstimate) (err error) {
+	return StoreA1CBatch(context, email, a1cs)
+}
+
+func (r *DataStoreRepository) GetA1CEstimates(context context.Context, email string, scanQuery ScoreScanQuery) (a1cs []model.A1CEstimate, err error) {
+	return GetA1CEstimates(context, email, scanQuery)
+}
+
+func (r *DataStoreRepository) StoreInsulinRatios(context context.Context, email string, ratios []model.InsulinRatios) (err error) {
+	return StoreInsulinRatios(context, email, ratios)
+}
+
+func (r *DataStoreRepository) GetInsulinRatios(context context.Context, email string, scanQuery ScoreScanQuery) (ratios []model.InsulinRatios, err error) {
+	return GetInsulinRatios(context, email, scanQuery)
+}
+
+func (r *DataStoreRepository) StoreLabA1C(context context.Context, email string, labA1C model.LabA1C) (err error) {
+	return StoreLabA1C(context, email, labA1C)
+}
+
+func (r *DataStoreRepository) GetLabA1Cs(context context.Context, email string) (labA1Cs []model.LabA1C, err error) {
+	return GetLabA1Cs(context, email)
+}
+
+func (r *DataStoreRepository) LogFileImport(context context.Context, email string, fileImport model.FileImportLog) (err error) {
+	_, err = LogFileImport(context, GetUserKey(context, email), fileImport)
+	return err
+}
+
+func (r *DataStoreRepository) GetFileImportLog(context context.Context, email string, fileId string) (fileImport *model.FileImportLog, err error) {
+	return GetFileImportLog(context, GetUserKey(context, email), fileId)
+}
+
+func (r *DataStoreRepository) StoreApiSecret(context context.Context, email string, secretHash string) (err error) {
+	return StoreApiSecret(context, email, secretHash)
+}
+
+func (r *DataStoreRepository) FindUserByApiSecret(context context.Context, secretHash string) (email string, err error) {
+	email, err = FindUserByApiSecret(context, secretHash)
+	return email, translateNoSuchEntity(err)
+}
+
+func (r *DataStoreRepository) GetFirstDayOfData(context context.Context, email string) (startTime time.Time, err error) {
+	return GetFirstDayOfData(context, email)
+}
+
+func (r *DataStoreRepository) StoreDataExport(context context.Context, email string, dataExport model.DataExport) (err error) {
+	return StoreDataExport(context, email, dataExport)
+}
+
+func (r *DataStoreRepository) GetDataExport(context context.Context, email string) (dataExport *model.DataExport, err error) {
+	dataExport, err = GetDataExport(context, email)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoDataExport
+	}
+
+	return dataExport, err
+}
+
+func (r *DataStoreRepository) StoreDataExportArchive(context context.Context, email string, archive []byte) (err error) {
+	return StoreDataExportArchive(context, email, archive)
+}
+
+func (r *DataStoreRepository) GetDataExportArchive(context context.Context, email string) (archive []byte, err error) {
+	return GetDataExportArchive(context, email)
+}
+
+func (r *DataStoreRepository) DeleteUserData(context context.Context, email string, keepAccount bool, limit int) (deleted int, err error) {
+	return DeleteUserData(context, email, keepAccount, limit)
+}
+
+func (r *DataStoreRepository) StoreAccountDeletion(context context.Context, email string, deletion model.AccountDeletion) (err error) {
+	return StoreAccountDeletion(context, email, deletion)
+}
+
+func (r *DataStoreRepository) GetAccountDeletion(context context.Context, email string) (deletion *model.AccountDeletion, err error) {
+	deletion, err = GetAccountDeletion(context, email)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoAccountDeletion
+	}
+
+	return deletion, err
+}
+
+func (r *DataStoreRepository) GetGlycemicEpisodes(context context.Context, email string, scanQuery ScoreScanQuery) (episodes []model.GlycemicEpisode, err error) {
+	return GetGlycemicEpisodes(context, email, scanQuery)
+}
+
+func (r *DataStoreRepository) ReplaceGlycemicEpisodes(context context.Context, email string, lowerBound time.Time, upperBound time.Time, episodes []model.GlycemicEpisode) (err error) {
+	return ReplaceGlycemicEpisodes(context, email, lowerBound, upperBound, episodes)
+}
+
+func (r *DataStoreRepository) FindCohortMembers(context context.Context) (members []model.GlukitUser, err error) {
+	return FindCohortMembers(context)
+}
+
+func (r *DataStoreRepository) StoreCohortAggregation(context context.Context, aggregation model.CohortAggregation) (err error) {
+	return StoreCohortAggregation(context, aggregation)
+}
+
+func (r *DataStoreRepository) GetCohortAggregation(context context.Context) (aggregation *model.CohortAggregation, err error) {
+	aggregation, err = GetCohortAggregation(context)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoCohortAggregation
+	}
+
+	return aggregation, err
+}
+
+func (r *DataStoreRepository) StoreSharingGrant(context context.Context, grant model.SharingGrant) (err error) {
+	return StoreSharingGrant(context, grant)
+}
+
+func (r *DataStoreRepository) DeleteSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (err error) {
+	err = DeleteSharingGrant(context, ownerEmail, viewerEmail)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoSharingGrant
+	}
+
+	return err
+}
+
+func (r *DataStoreRepository) GetSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (grant *model.SharingGrant, err error) {
+	grant, err = GetSharingGrant(context, ownerEmail, viewerEmail)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSharingGrant
+	}
+
+	return grant, err
+}
+
+func (r *DataStoreRepository) GetSharingGrantsByOwner(context context.Context, ownerEmail string) (grants []model.SharingGrant, err error) {
+	return GetSharingGrantsByOwner(context, ownerEmail)
+}
+
+func (r *DataStoreRepository) GetSharingGrantsByViewer(context context.Context, viewerEmail string) (grants []model.SharingGrant, err error) {
+	return GetSharingGrantsByViewer(context, viewerEmail)
+}
+
+func (r *DataStoreRepository) LogViewerAccess(context context.Context, ownerEmail string, access model.ViewerAccess) (err error) {
+	return LogViewerAccess(context, ownerEmail, access)
+}
+
+func (r *DataStoreRepository) GetViewerAccesses(context context.Context, ownerEmail string, limit int) (accesses []model.ViewerAccess, err error) {
+	return GetViewerAccesses(context, ownerEmail, limit)
+}
+
+func (r *DataStoreRepository) StoreClinic(context context.Context, clinic model.Clinic) (err error) {
+	return StoreClinic(context, clinic)
+}
+
+func (r *DataStoreRepository) GetClinic(context context.Context, clinicId string) (clinic *model.Clinic, err error) {
+	clinic, err = GetClinic(context, clinicId)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchClinic
+	}
+
+	return clinic, err
+}
+
+func (r *DataStoreRepository) GetClinicsByPractitioner(context context.Context, practitionerEmail string) (clinics []model.Clinic, err error) {
+	return GetClinicsByPractitioner(context, practitionerEmail)
+}
+
+func (r *DataStoreRepository) StoreClinicInvite(context context.Context, invite model.ClinicInvite) (err error) {
+	return StoreClinicInvite(context, invite)
+}
+
+func (r *DataStoreRepository) GetClinicInvite(context context.Context, code string) (invite *model.ClinicInvite, err error) {
+	invite, err = GetClinicInvite(context, code)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchClinicInvite
+	}
+
+	return invite, err
+}
+
+func (r *DataStoreRepository) RedeemClinicInvite(context context.Context, code string, patientEmail string, now time.Time) (invite *model.ClinicInvite, err error) {
+	invite, err = RedeemClinicInvite(context, code, patientEmail, now)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchClinicInvite
+	}
+
+	return invite, err
+}
+
+func (r *DataStoreRepository) StoreClinicEnrollment(context context.Context, enrollment model.ClinicEnrollment) (err error) {
+	return StoreClinicEnrollment(context, enrollment)
+}
+
+func (r *DataStoreRepository) DeleteClinicEnrollment(context context.Context, patientEmail string, clinicId string) (err error) {
+	err = DeleteClinicEnrollment(context, patientEmail, clinicId)
+	if err == datastore.ErrNoSuchEntity {
+		return ErrNoClinicEnrollment
+	}
+
+	return err
+}
+
+func (r *DataStoreRepository) GetClinicEnrollmentsByPatient(context context.Context, patientEmail string) (enrollments []model.ClinicEnrollment, err error) {
+	return GetClinicEnrollmentsByPatient(context, patientEmail)
+}
+
+func (r *DataStoreRepository) GetClinicEnrollmentsByClinic(context context.Context, clinicId string) (enrollments []model.ClinicEnrollment, err error) {
+	return GetClinicEnrollmentsByClinic(context, clinicId)
+}
@@ -0,0 +1,363 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/osin"
+	"net/http"
+)
+
+// The owner of clients and the client and user of tokens are kept in their own indexed columns, next to the json content, so that
+// the registrations and tokens of a user can be looked up without decoding every row
+var osinSqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS osin_clients (
+		id VARCHAR(255) PRIMARY KEY,
+		secret VARCHAR(255) NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		user_data TEXT NOT NULL,
+		owner_email VARCHAR(254))`,
+	`CREATE INDEX IF NOT EXISTS osin_clients_by_owner ON osin_clients (owner_email)`,
+	`CREATE TABLE IF NOT EXISTS osin_authorize_data (
+		code VARCHAR(255) PRIMARY KEY,
+		client_id VARCHAR(255) NOT NULL,
+		user_email VARCHAR(254) NOT NULL,
+		content TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS osin_authorize_data_by_user ON osin_authorize_data (user_email, client_id)`,
+	`CREATE TABLE IF NOT EXISTS osin_access_data (
+		token VARCHAR(255) PRIMARY KEY,
+		client_id VARCHAR(255) NOT NULL,
+		user_email VARCHAR(254) NOT NULL,
+		content TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS osin_access_data_by_user ON osin_access_data (user_email, client_id)`,
+	`CREATE TABLE IF NOT EXISTS osin_refresh_data (
+		token VARCHAR(255) PRIMARY KEY,
+		client_id VARCHAR(255) NOT NULL,
+		user_email VARCHAR(254) NOT NULL,
+		content TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS osin_refresh_data_by_user ON osin_refresh_data (user_email, client_id)`,
+}
+
+// The osin tables holding tokens, all of which have the client_id and user_email columns
+var osinSqlTokenTables = []struct {
+	name      string
+	keyColumn string
+}{{"osin_authorize_data", "code"}, {"osin_access_data", "token"}, {"osin_refresh_data", "token"}}
+
+// OsinSQLStore is the osin.Storage implementation backed by a SQL database. It is the standalone
+// counterpart of the OsinAppEngineStore.
+type OsinSQLStore struct {
+	r *SQLRepository
+}
+
+// NewOsinSQLStore creates a new osin.Storage that persists to the given database and creates its schema
+// if it's not already present.
+func NewOsinSQLStore(db *sql.DB, driverName string) (s *OsinSQLStore, err error) {
+	for _, statement := range osinSqlSchema {
+		if _, err = db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+
+	return &OsinSQLStore{&SQLRepository{db, driverName}}, nil
+}
+
+// AddClient stores an oauth client or updates the secret and redirect uri of an existing one so changes to the configuration
+// take effect. Unlike on App Engine, where clients are created with the datastore administration UI, standalone servers register
+// their clients from configuration.
+func (s *OsinSQLStore) AddClient(c *osin.Client) (err error) {
+	userData, _ := c.UserData.(string)
+	_, err = s.r.db.Exec(s.r.rebind(`INSERT INTO osin_clients (id, secret, redirect_uri, user_data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET secret = excluded.secret, redirect_uri = excluded.redirect_uri`), c.Id, c.Secret, c.RedirectUri, userData)
+
+	return err
+}
+
+func (s *OsinSQLStore) GetClient(id string, r *http.Request) (*osin.Client, error) {
+	client := new(oClient)
+	err := s.r.db.QueryRowContext(r.Context(), s.r.rebind("SELECT id, secret, redirect_uri, user_data FROM osin_clients WHERE id = ?"), id).
+		Scan(&client.Id, &client.Secret, &client.RedirectUri, &client.UserData)
+	if err != nil {
+		return nil, errors.New("Client not found")
+	}
+
+	return newOsinClient(client), nil
+}
+
+// put stores the json representation of a value of the client and user in one of the osin tables
+func (s *OsinSQLStore) put(context context.Context, table string, keyColumn string, key string, clientId string, userEmail string,
+	value interface{}) (err error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.r.db.ExecContext(context, s.r.rebind("INSERT INTO "+table+" ("+keyColumn+", client_id, user_email, content) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT ("+keyColumn+") DO UPDATE SET client_id = excluded.client_id, user_email = excluded.user_email, content = excluded.content"),
+		key, clientId, userEmail, string(content))
+
+	return err
+}
+
+// get loads the json representation of a value from one of the osin tables
+func (s *OsinSQLStore) get(context context.Context, table string, keyColumn string, key string, value interface{}) (err error) {
+	var content string
+	err = s.r.db.QueryRowContext(context, s.r.rebind("SELECT content FROM "+table+" WHERE "+keyColumn+" = ?"), key).Scan(&content)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(content), value)
+}
+
+// remove deletes a value from one of the osin tables
+func (s *OsinSQLStore) remove(context context.Context, table string, keyColumn string, key string) (err error) {
+	_, err = s.r.db.ExecContext(context, s.r.rebind("DELETE FROM "+table+" WHERE "+keyColumn+" = ?"), key)
+	return err
+}
+
+func (s *OsinSQLStore) SaveAuthorize(data *osin.AuthorizeData, r *http.Request) error {
+	authorizeData := newInternalAuthorizeData(data)
+	return s.put(r.Context(), "osin_authorize_data", "code", data.Code, authorizeData.ClientId, authorizeData.UserData, authorizeData)
+}
+
+func (s *OsinSQLStore) LoadAuthorize(code string, r *http.Request) (*osin.AuthorizeData, error) {
+	authorizeData := new(oAuthorizeData)
+	if err := s.get(r.Context(), "osin_authorize_data", "code", code, authorizeData); err != nil {
+		return nil, errors.New("Authorize not found")
+	}
+
+	var c *osin.Client
+	if authorizeData.ClientId != "" {
+		var err error
+		if c, err = s.GetClient(authorizeData.ClientId, r); err != nil {
+			return nil, errors.New("Client for AuthorizeData not found")
+		}
+	}
+
+	return newOsinAuthorizeData(authorizeData, c), nil
+}
+
+func (s *OsinSQLStore) RemoveAuthorize(code string, r *http.Request) error {
+	return s.remove(r.Context(), "osin_authorize_data", "code", code)
+}
+
+func (s *OsinSQLStore) SaveAccess(data *osin.AccessData, r *http.Request) error {
+	internalAccessData := newInternalAccessData(data)
+	if err := s.put(r.Context(), "osin_access_data", "token", data.AccessToken, internalAccessData.ClientId, internalAccessData.UserData,
+		internalAccessData); err != nil {
+		return err
+	}
+
+	if data.RefreshToken != "" {
+		return s.put(r.Context(), "osin_refresh_data", "token", data.RefreshToken, internalAccessData.ClientId, internalAccessData.UserData,
+			internalAccessData)
+	}
+
+	return nil
+}
+
+// loadAccessData resolves the client and inner authorize and access data of stored access data
+func (s *OsinSQLStore) loadAccessData(accessData *oAccessData, r *http.Request) (*osin.AccessData, error) {
+	var c *osin.Client
+	if accessData.ClientId != "" {
+		var err error
+		if c, err = s.GetClient(accessData.ClientId, r); err != nil {
+			return nil, errors.New("Client for AccessData not found")
+		}
+	}
+
+	var innerAuthData *osin.AuthorizeData
+	if accessData.AuthorizeDataCode != "" {
+		innerAuthData, _ = s.LoadAuthorize(accessData.AuthorizeDataCode, r)
+	}
+
+	var innerAccessData *osin.AccessData
+	if accessData.AccessDataToken != "" {
+		innerAccessData, _ = s.LoadAccess(accessData.AccessDataToken, r)
+	}
+
+	return newOsinAccessData(accessData, c, innerAuthData, innerAccessData), nil
+}
+
+func (s *OsinSQLStore) LoadAccess(token string, r *http.Request) (*osin.AccessData, error) {
+	accessData := new(oAccessData)
+	if err := s.get(r.Context(), "osin_access_data", "token", token, accessData); err != nil {
+		return nil, errors.New("Access data not found")
+	}
+
+	return s.loadAccessData(accessData, r)
+}
+
+func (s *OsinSQLStore) RemoveAccess(token string, r *http.Request) error {
+	return s.remove(r.Context(), "osin_access_data", "token", token)
+}
+
+func (s *OsinSQLStore) LoadRefresh(token string, r *http.Request) (*osin.AccessData, error) {
+	accessData := new(oAccessData)
+	if err := s.get(r.Context(), "osin_refresh_data", "token", token, accessData); err != nil {
+		return nil, errors.New("Refresh not found")
+	}
+
+	return s.loadAccessData(accessData, r)
+}
+
+func (s *OsinSQLStore) RemoveRefresh(token string, r *http.Request) error {
+	return s.remove(r.Context(), "osin_refresh_data", "token", token)
+}
+
+// RevokeUserTokens deletes the authorize data, access data and refresh data of a user.
+func (s *OsinSQLStore) RevokeUserTokens(context context.Context, email string) (err error) {
+	return s.revokeTokens(context, "user_email = ?", email)
+}
+
+// revokeTokens deletes the authorize data, access data and refresh data matching the condition
+func (s *OsinSQLStore) revokeTokens(context context.Context, condition string, args ...interface{}) (err error) {
+	for _, table := range osinSqlTokenTables {
+		if _, err = s.r.db.ExecContext(context, s.r.rebind("DELETE FROM "+table.name+" WHERE "+condition), args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *OsinSQLStore) RegisterClient(context context.Context, client model.OauthClient, secret string) (err error) {
+	internalClient, err := newInternalRegisteredClient(client, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.r.db.ExecContext(context, s.r.rebind(`INSERT INTO osin_clients (id, secret, redirect_uri, user_data, owner_email)
+		VALUES (?, ?, ?, ?, ?)`), internalClient.Id, internalClient.Secret, internalClient.RedirectUri, internalClient.UserData, client.OwnerEmail)
+
+	return err
+}
+
+func (s *OsinSQLStore) GetOauthClient(context context.Context, clientId string) (client *model.OauthClient, err error) {
+	internalClient := new(oClient)
+	err = s.r.db.QueryRowContext(context, s.r.rebind("SELECT id, redirect_uri, user_data FROM osin_clients WHERE id = ?"), clientId).
+		Scan(&internalClient.Id, &internalClient.RedirectUri, &internalClient.UserData)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchOauthClient
+	} else if err != nil {
+		return nil, err
+	}
+
+	return newOauthClient(internalClient), nil
+}
+
+// GetOauthClientsByOwner returns the clients registered by the developer
+func (s *OsinSQLStore) GetOauthClientsByOwner(context context.Context, ownerEmail string) (clients []model.OauthClient, err error) {
+	rows, err := s.r.db.QueryContext(context, s.r.rebind("SELECT id, redirect_uri, user_data FROM osin_clients WHERE owner_email = ?"),
+		ownerEmail)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients = make([]model.OauthClient, 0)
+	for rows.Next() {
+		internalClient := new(oClient)
+		if err = rows.Scan(&internalClient.Id, &internalClient.RedirectUri, &internalClient.UserData); err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, *newOauthClient(internalClient))
+	}
+
+	return clients, rows.Err()
+}
+
+func (s *OsinSQLStore) SaveCodeChallenge(context context.Context, code string, challenge model.CodeChallenge) (err error) {
+	authorizeData := new(oAuthorizeData)
+	if err = s.get(context, "osin_authorize_data", "code", code, authorizeData); err != nil {
+		return err
+	}
+
+	authorizeData.CodeChallenge = challenge.Challenge
+	authorizeData.CodeChallengeMethod = challenge.Method
+	return s.put(context, "osin_authorize_data", "code", code, authorizeData.ClientId, authorizeData.UserData, authorizeData)
+}
+
+func (s *OsinSQLStore) LoadCodeChallenge(context context.Context, code string) (challenge *model.CodeChallenge, err error) {
+	authorizeData := new(oAuthorizeData)
+	if err = s.get(context, "osin_authorize_data", "code", code, authorizeData); err != nil {
+		return nil, err
+	}
+
+	if authorizeData.CodeChallenge == "" {
+		return nil, ErrNoCodeChallenge
+	}
+
+	return &model.CodeChallenge{Challenge: authorizeData.CodeChallenge, Method: authorizeData.CodeChallengeMethod}, nil
+}
+
+// userAccessData returns the access data of a user by access token
+func (s *OsinSQLStore) userAccessData(context context.Context, email string) (accessData map[string]oAccessData, err error) {
+	rows, err := s.r.db.QueryContext(context, s.r.rebind("SELECT token, content FROM osin_access_data WHERE user_email = ?"), email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accessData = make(map[string]oAccessData)
+	for rows.Next() {
+		var token, content string
+		if err = rows.Scan(&token, &content); err != nil {
+			return nil, err
+		}
+
+		var data oAccessData
+		if err = json.Unmarshal([]byte(content), &data); err != nil {
+			return nil, err
+		}
+		accessData[token] = data
+	}
+
+	return accessData, rows.Err()
+}
+
+func (s *OsinSQLStore) GetUserTokens(context context.Context, email string) (tokens []model.OauthToken, err error) {
+	accessData, err := s.userAccessData(context, email)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens = make([]model.OauthToken, 0, len(accessData))
+	for _, data := range accessData {
+		tokens = append(tokens, newOauthToken(&data))
+	}
+	sortOauthTokens(tokens)
+
+	return tokens, nil
+}
+
+func (s *OsinSQLStore) RevokeUserToken(context context.Context, email string, tokenId string) (err error) {
+	accessData, err := s.userAccessData(context, email)
+	if err != nil {
+		return err
+	}
+
+	for token, data := range accessData {
+		if oauthTokenId(token) != tokenId {
+			continue
+		}
+
+		if data.RefreshToken != "" {
+			if err = s.remove(context, "osin_refresh_data", "token", data.RefreshToken); err != nil {
+				return err
+			}
+		}
+
+		return s.remove(context, "osin_access_data", "token", token)
+	}
+
+	return ErrNoSuchOauthToken
+}
+
+func (s *OsinSQLStore) RevokeClientTokens(context context.Context, email string, clientId string) (err error) {
+	return s.revokeTokens(context, "user_email = ? AND client_id = ?", email, clientId)
+}
@@ -0,0 +1,290 @@
+package store_test
+
+import (
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/model"
+	. "github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/osin"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupOsinSQLStore(t *testing.T) (s *OsinSQLStore) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	s, err = NewOsinSQLStore(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AddClient(&osin.Client{"client", "secret", "x-glukloader://oauth/callback", ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestSQLAddClientUpdatesExistingClient(t *testing.T) {
+	s := setupOsinSQLStore(t)
+
+	if err := s.AddClient(&osin.Client{Id: "client", Secret: "rotated", RedirectUri: "x-glukloader://oauth/redirect", UserData: ""}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := s.GetClient("client", httptest.NewRequest("POST", "/token", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Secret != "rotated" || client.RedirectUri != "x-glukloader://oauth/redirect" {
+		t.Errorf("TestSQLAddClientUpdatesExistingClient failed: got client [%v] but expected the secret and redirect uri of the configuration",
+			client)
+	}
+}
+
+func TestSQLAccessDataStorage(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("POST", "/token", nil)
+
+	client, err := s.GetClient("client", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := osin.AccessData{client, nil, nil, "token", "refresh", 0, "scope", "uri", time.Now(), SQL_TEST_USER}
+	if err = s.SaveAccess(&d, r); err != nil {
+		t.Fatal(err)
+	}
+
+	accessData, err := s.LoadAccess("token", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if accessData.UserData.(string) != SQL_TEST_USER {
+		t.Errorf("TestSQLAccessDataStorage failed: got user data [%v] but expected [%s]", accessData.UserData, SQL_TEST_USER)
+	}
+
+	if accessData.Client == nil || accessData.Client.RedirectUri != client.RedirectUri {
+		t.Errorf("TestSQLAccessDataStorage failed: got client [%v] but expected [%v]", accessData.Client, client)
+	}
+
+	if _, err = s.LoadRefresh("refresh", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.RemoveAccess("token", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadAccess("token", r); err == nil {
+		t.Errorf("TestSQLAccessDataStorage failed: expected access data to be removed")
+	}
+}
+
+func TestSQLAuthorizeDataStorage(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("GET", "/authorize", nil)
+
+	client, err := s.GetClient("client", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := osin.AuthorizeData{client, "code", 0, "scope", "uri", "state", time.Now(), SQL_TEST_USER}
+	if err = s.SaveAuthorize(&d, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadAuthorize("code", r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLRevokeUserTokens(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("POST", "/token", nil)
+
+	client, err := s.GetClient("client", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []osin.AccessData{
+		osin.AccessData{client, nil, nil, "token", "refresh", 0, "scope", "uri", time.Now(), SQL_TEST_USER},
+		osin.AccessData{client, nil, nil, "other", "", 0, "scope", "uri", time.Now(), "other@glukit.com"},
+	} {
+		if err = s.SaveAccess(&d, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = s.RevokeUserTokens(r.Context(), SQL_TEST_USER); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadAccess("token", r); err == nil {
+		t.Errorf("TestSQLRevokeUserTokens failed: expected access token to be revoked")
+	}
+
+	if _, err = s.LoadRefresh("refresh", r); err == nil {
+		t.Errorf("TestSQLRevokeUserTokens failed: expected refresh token to be revoked")
+	}
+
+	if _, err = s.LoadAccess("other", r); err != nil {
+		t.Errorf("TestSQLRevokeUserTokens failed: got error [%v] for the token of another user but expected it to be kept", err)
+	}
+}
+
+func TestSQLRegisterClient(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("POST", "/oauth/clients", nil)
+
+	registered := model.OauthClient{Id: "registered", Name: "Uploader", OwnerEmail: SQL_TEST_USER, RedirectUri: "https://uploader.example.com/callback",
+		Scopes: []string{model.OAUTH_SCOPE_GLUCOSE_WRITE}, Public: true}
+	if err := s.RegisterClient(r.Context(), registered, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := s.GetOauthClient(r.Context(), "registered")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.Name != registered.Name || !client.Public || !reflect.DeepEqual(client.Scopes, registered.Scopes) {
+		t.Errorf("TestSQLRegisterClient failed: got client [%v] but expected [%v]", client, registered)
+	}
+
+	legacy, err := s.GetOauthClient(r.Context(), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(legacy.Scopes, model.OAUTH_SCOPES) {
+		t.Errorf("TestSQLRegisterClient failed: got scopes %v for a client registered without scopes but expected %v", legacy.Scopes, model.OAUTH_SCOPES)
+	}
+
+	clients, err := s.GetOauthClientsByOwner(r.Context(), SQL_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(clients) != 1 || clients[0].Id != "registered" {
+		t.Errorf("TestSQLRegisterClient failed: got clients [%v] but expected only [%s]", clients, "registered")
+	}
+
+	if _, err = s.GetOauthClient(r.Context(), "missing"); err != ErrNoSuchOauthClient {
+		t.Errorf("TestSQLRegisterClient failed: got error [%v] for a missing client but expected [%v]", err, ErrNoSuchOauthClient)
+	}
+}
+
+func TestSQLCodeChallenge(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("GET", "/authorize", nil)
+
+	client, err := s.GetClient("client", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{"code", "plain"} {
+		d := osin.AuthorizeData{client, code, 0, "scope", "uri", "state", time.Now(), SQL_TEST_USER}
+		if err = s.SaveAuthorize(&d, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	challenge := model.CodeChallenge{Challenge: "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", Method: model.CODE_CHALLENGE_METHOD_S256}
+	if err = s.SaveCodeChallenge(r.Context(), "code", challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := s.LoadCodeChallenge(r.Context(), "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.Verify("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk") {
+		t.Errorf("TestSQLCodeChallenge failed: expected challenge [%v] to be verified", loaded)
+	}
+
+	if _, err = s.LoadAuthorize("code", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadCodeChallenge(r.Context(), "plain"); err != ErrNoCodeChallenge {
+		t.Errorf("TestSQLCodeChallenge failed: got error [%v] for a code without challenge but expected [%v]", err, ErrNoCodeChallenge)
+	}
+}
+
+func TestSQLRevokeUserToken(t *testing.T) {
+	s := setupOsinSQLStore(t)
+	r := httptest.NewRequest("DELETE", "/oauth/tokens", nil)
+
+	client, err := s.GetClient("client", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []osin.AccessData{
+		osin.AccessData{client, nil, nil, "token", "refresh", 3600, "", "uri", time.Now().Add(-time.Hour), SQL_TEST_USER},
+		osin.AccessData{client, nil, nil, "recent", "", 3600, model.OAUTH_SCOPE_GLUCOSE_READ, "uri", time.Now(), SQL_TEST_USER},
+		osin.AccessData{client, nil, nil, "other", "", 3600, "", "uri", time.Now(), "other@glukit.com"},
+	} {
+		if err = s.SaveAccess(&d, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := s.GetUserTokens(r.Context(), SQL_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tokens) != 2 {
+		t.Fatalf("TestSQLRevokeUserToken failed: got tokens [%v] but expected 2", tokens)
+	}
+
+	if !reflect.DeepEqual(tokens[0].Scopes, []string{model.OAUTH_SCOPE_GLUCOSE_READ}) || !reflect.DeepEqual(tokens[1].Scopes, model.OAUTH_SCOPES) {
+		t.Errorf("TestSQLRevokeUserToken failed: got tokens [%v] but expected the most recent one first with its scopes", tokens)
+	}
+
+	if !tokens[1].Refreshable || tokens[1].Id == "token" {
+		t.Errorf("TestSQLRevokeUserToken failed: got token [%v] but expected a refreshable token identified by a hash", tokens[1])
+	}
+
+	if err = s.RevokeUserToken(r.Context(), "other@glukit.com", tokens[1].Id); err != ErrNoSuchOauthToken {
+		t.Errorf("TestSQLRevokeUserToken failed: got error [%v] revoking the token of another user but expected [%v]", err, ErrNoSuchOauthToken)
+	}
+
+	if err = s.RevokeUserToken(r.Context(), SQL_TEST_USER, tokens[1].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadAccess("token", r); err == nil {
+		t.Errorf("TestSQLRevokeUserToken failed: expected access token to be revoked")
+	}
+
+	if _, err = s.LoadRefresh("refresh", r); err == nil {
+		t.Errorf("TestSQLRevokeUserToken failed: expected refresh token to be revoked")
+	}
+
+	if err = s.RevokeClientTokens(r.Context(), SQL_TEST_USER, "client"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.LoadAccess("recent", r); err == nil {
+		t.Errorf("TestSQLRevokeUserToken failed: expected the tokens of the client to be revoked")
+	}
+
+	if _, err = s.LoadAccess("other", r); err != nil {
+		t.Errorf("TestSQLRevokeUserToken failed: got error [%v] for the token of another user but expected it to be kept", err)
+	}
+}
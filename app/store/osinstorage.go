@@ -1,16 +1,24 @@
 package store
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/osin"
 	"context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"net/http"
+	"sort"
 	"time"
 )
 
+// OAUTH_REINDEX_BATCH_SIZE is the number of oauth entities put back at once by ReindexUserTokens
+const OAUTH_REINDEX_BATCH_SIZE = 500
+
 type OsinAppEngineStore struct {
 }
 
@@ -18,7 +26,9 @@ type oClient struct {
 	Id          string `datastore:"Id"`
 	Secret      string `datastore:"Secret,noindex"`
 	RedirectUri string `datastore:"RedirectUri,noindex"`
-	UserData    string `datastore:"UserData,noindex"`
+	// The json registration of the client, empty for clients registered before scopes existed
+	UserData   string `datastore:"UserData,noindex"`
+	OwnerEmail string `datastore:"OwnerEmail"`
 }
 
 // Authorization data
@@ -30,7 +40,10 @@ type oAuthorizeData struct {
 	RedirectUri string    `datastore:"RedirectUri"`
 	State       string    `datastore:"State"`
 	CreatedAt   time.Time `datastore:"CreatedAt"`
-	UserData    string    `datastore:"UserData,noindex"`
+	UserData    string    `datastore:"UserData"`
+	// The PKCE challenge of the code, if the client made one
+	CodeChallenge       string `datastore:"CodeChallenge,noindex"`
+	CodeChallengeMethod string `datastore:"CodeChallengeMethod,noindex"`
 }
 
 // AccessData
@@ -44,7 +57,7 @@ type oAccessData struct {
 	Scope             string    `datastore:"Scope,noindex"`
 	RedirectUri       string    `datastore:"RedirectUri,noindex"`
 	CreatedAt         time.Time `datastore:"CreatedAt,noindex"`
-	UserData          string    `datastore:"UserData,noindex"`
+	UserData          string    `datastore:"UserData"`
 }
 
 func NewOsinAppEngineStoreWithRequest(r *http.Request) *OsinAppEngineStore {
@@ -85,7 +98,7 @@ func newInternalClient(c *osin.Client) *oClient {
 	if c == nil {
 		return nil
 	}
-	return &oClient{c.Id, c.Secret, c.RedirectUri, c.UserData.(string)}
+	return &oClient{c.Id, c.Secret, c.RedirectUri, c.UserData.(string), ""}
 }
 
 func newOsinClient(c *oClient) *osin.Client {
@@ -125,7 +138,7 @@ func newInternalAuthorizeData(d *osin.AuthorizeData) *oAuthorizeData {
 		clientId = client.Id
 	}
 
-	return &oAuthorizeData{clientId, d.Code, d.ExpiresIn, d.Scope, d.RedirectUri, d.State, d.CreatedAt, d.UserData.(string)}
+	return &oAuthorizeData{clientId, d.Code, d.ExpiresIn, d.Scope, d.RedirectUri, d.State, d.CreatedAt, d.UserData.(string), "", ""}
 }
 
 func newOsinAuthorizeData(d *oAuthorizeData, c *osin.Client) *osin.AuthorizeData {
@@ -365,3 +378,252 @@ func (s *OsinAppEngineStore) RemoveRefreshWithContext(code string, context conte
 
 	return nil
 }
+
+// RevokeUserTokens deletes the authorize data, access data and refresh data of a user. The UserData of the oauth entities
+// is the user's email.
+func (s *OsinAppEngineStore) RevokeUserTokens(context context.Context, email string) error {
+	for _, kind := range []string{"authorize.data", "access.data", "access.refresh"} {
+		keys, err := datastore.NewQuery(kind).Filter("UserData =", email).KeysOnly().GetAll(context, nil)
+		if err != nil {
+			return err
+		}
+
+		log.Infof(context, "Revoking [%d] %s entities of user [%s]", len(keys), kind, email)
+		if err = datastore.DeleteMulti(context, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReindexUserTokens puts back the authorize data, access data and refresh data in batches. The UserData of the entities
+// stored before it was indexed isn't in the index until they're put again so this one-off migration has to run for the
+// queries on UserData to find them. Running it again is harmless.
+func (s *OsinAppEngineStore) ReindexUserTokens(context context.Context) (count int, err error) {
+	kinds := map[string]func() interface{}{
+		"authorize.data": func() interface{} { return new(oAuthorizeData) },
+		"access.data":    func() interface{} { return new(oAccessData) },
+		"access.refresh": func() interface{} { return new(oAccessData) },
+	}
+
+	for kind, newEntity := range kinds {
+		var cursor *datastore.Cursor
+		for {
+			query := datastore.NewQuery(kind).Limit(OAUTH_REINDEX_BATCH_SIZE)
+			if cursor != nil {
+				query = query.Start(*cursor)
+			}
+
+			keys := make([]*datastore.Key, 0, OAUTH_REINDEX_BATCH_SIZE)
+			entities := make([]interface{}, 0, OAUTH_REINDEX_BATCH_SIZE)
+			iterator := query.Run(context)
+			entity := newEntity()
+			key, err := iterator.Next(entity)
+			for ; err == nil; key, err = iterator.Next(entity) {
+				keys = append(keys, key)
+				entities = append(entities, entity)
+				entity = newEntity()
+			}
+
+			if err != datastore.Done {
+				return count, err
+			}
+
+			if len(keys) == 0 {
+				break
+			}
+
+			if _, err = datastore.PutMulti(context, keys, entities); err != nil {
+				return count, err
+			}
+			count = count + len(keys)
+			log.Infof(context, "Reindexed [%d] %s entities", len(keys), kind)
+
+			if len(keys) < OAUTH_REINDEX_BATCH_SIZE {
+				break
+			}
+
+			nextCursor, err := iterator.Cursor()
+			if err != nil {
+				return count, err
+			}
+			cursor = &nextCursor
+		}
+	}
+
+	return count, nil
+}
+
+// oauthTokenId returns the id of an access token shown to users, a hash that can't be used as the token itself
+func oauthTokenId(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// newInternalRegisteredClient returns a client with its registration as its user data
+func newInternalRegisteredClient(client model.OauthClient, secret string) (*oClient, error) {
+	userData, err := json.Marshal(client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oClient{client.Id, secret, client.RedirectUri, string(userData), client.OwnerEmail}, nil
+}
+
+// newOauthClient returns the registration of a client. Clients registered before scopes existed don't have one and get all scopes.
+func newOauthClient(c *oClient) *model.OauthClient {
+	client := new(model.OauthClient)
+	if err := json.Unmarshal([]byte(c.UserData), client); err != nil || client.Id != c.Id {
+		return &model.OauthClient{Id: c.Id, Name: c.Id, RedirectUri: c.RedirectUri, Scopes: model.OAUTH_SCOPES}
+	}
+
+	return client
+}
+
+// newOauthToken returns the token shown to users for access data
+func newOauthToken(d *oAccessData) model.OauthToken {
+	return model.OauthToken{Id: oauthTokenId(d.AccessToken), ClientId: d.ClientId, Scopes: model.GrantedOauthScopes(d.Scope), CreatedOn: d.CreatedAt,
+		ExpiresOn: d.CreatedAt.Add(time.Duration(d.ExpiresIn) * time.Second), Refreshable: d.RefreshToken != ""}
+}
+
+// sortOauthTokens sorts tokens from the most recent to the oldest
+func sortOauthTokens(tokens []model.OauthToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedOn.After(tokens[j].CreatedOn)
+	})
+}
+
+func (s *OsinAppEngineStore) RegisterClient(context context.Context, client model.OauthClient, secret string) error {
+	internalClient, err := newInternalRegisteredClient(client, secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = datastore.Put(context, datastore.NewKey(context, "osin.client", client.Id, 0, nil), internalClient)
+	return err
+}
+
+func (s *OsinAppEngineStore) GetOauthClient(context context.Context, clientId string) (*model.OauthClient, error) {
+	client := new(oClient)
+	err := datastore.Get(context, datastore.NewKey(context, "osin.client", clientId, 0, nil), client)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchOauthClient
+	} else if err != nil {
+		return nil, err
+	}
+
+	return newOauthClient(client), nil
+}
+
+func (s *OsinAppEngineStore) GetOauthClientsByOwner(context context.Context, ownerEmail string) ([]model.OauthClient, error) {
+	var internalClients []oClient
+	if _, err := datastore.NewQuery("osin.client").Filter("OwnerEmail =", ownerEmail).GetAll(context, &internalClients); err != nil {
+		return nil, err
+	}
+
+	clients := make([]model.OauthClient, len(internalClients))
+	for i := range internalClients {
+		clients[i] = *newOauthClient(&internalClients[i])
+	}
+
+	return clients, nil
+}
+
+func (s *OsinAppEngineStore) SaveCodeChallenge(context context.Context, code string, challenge model.CodeChallenge) error {
+	key := datastore.NewKey(context, "authorize.data", code, 0, nil)
+	authorizeData := new(oAuthorizeData)
+	if err := datastore.Get(context, key, authorizeData); err != nil {
+		return err
+	}
+
+	authorizeData.CodeChallenge = challenge.Challenge
+	authorizeData.CodeChallengeMethod = challenge.Method
+	_, err := datastore.Put(context, key, authorizeData)
+	return err
+}
+
+func (s *OsinAppEngineStore) LoadCodeChallenge(context context.Context, code string) (*model.CodeChallenge, error) {
+	authorizeData := new(oAuthorizeData)
+	if err := datastore.Get(context, datastore.NewKey(context, "authorize.data", code, 0, nil), authorizeData); err != nil {
+		return nil, err
+	}
+
+	if authorizeData.CodeChallenge == "" {
+		return nil, ErrNoCodeChallenge
+	}
+
+	return &model.CodeChallenge{Challenge: authorizeData.CodeChallenge, Method: authorizeData.CodeChallengeMethod}, nil
+}
+
+func (s *OsinAppEngineStore) GetUserTokens(context context.Context, email string) ([]model.OauthToken, error) {
+	var accessData []oAccessData
+	if _, err := datastore.NewQuery("access.data").Filter("UserData =", email).GetAll(context, &accessData); err != nil {
+		return nil, err
+	}
+
+	tokens := make([]model.OauthToken, len(accessData))
+	for i := range accessData {
+		tokens[i] = newOauthToken(&accessData[i])
+	}
+	sortOauthTokens(tokens)
+
+	return tokens, nil
+}
+
+func (s *OsinAppEngineStore) RevokeUserToken(context context.Context, email string, tokenId string) error {
+	var accessData []oAccessData
+	keys, err := datastore.NewQuery("access.data").Filter("UserData =", email).GetAll(context, &accessData)
+	if err != nil {
+		return err
+	}
+
+	for i := range accessData {
+		if oauthTokenId(accessData[i].AccessToken) != tokenId {
+			continue
+		}
+
+		log.Infof(context, "Revoking token [%s] of user [%s]", tokenId, email)
+		if refreshToken := accessData[i].RefreshToken; refreshToken != "" {
+			if err = s.RemoveRefreshWithContext(refreshToken, context); err != nil {
+				return err
+			}
+		}
+
+		return datastore.Delete(context, keys[i])
+	}
+
+	return ErrNoSuchOauthToken
+}
+
+func (s *OsinAppEngineStore) RevokeClientTokens(context context.Context, email string, clientId string) error {
+	var authorizeData []oAuthorizeData
+	keys, err := datastore.NewQuery("authorize.data").Filter("UserData =", email).GetAll(context, &authorizeData)
+	if err != nil {
+		return err
+	}
+
+	revokedKeys := make([]*datastore.Key, 0)
+	for i := range authorizeData {
+		if authorizeData[i].ClientId == clientId {
+			revokedKeys = append(revokedKeys, keys[i])
+		}
+	}
+
+	for _, kind := range []string{"access.data", "access.refresh"} {
+		var accessData []oAccessData
+		keys, err := datastore.NewQuery(kind).Filter("UserData =", email).GetAll(context, &accessData)
+		if err != nil {
+			return err
+		}
+
+		for i := range accessData {
+			if accessData[i].ClientId == clientId {
+				revokedKeys = append(revokedKeys, keys[i])
+			}
+		}
+	}
+
+	log.Infof(context, "Revoking [%d] oauth entities of client [%s] for user [%s]", len(revokedKeys), clientId, email)
+	return datastore.DeleteMulti(context, revokedKeys)
+}
@@ -1,3 +1,6 @@
+//go:build appengine_legacy
+// +build appengine_legacy
+
 package store_test
 
 import (
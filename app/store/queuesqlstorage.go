@@ -0,0 +1,195 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"time"
+)
+
+// Lower bounds are stored as unix seconds, like elsewhere in the schema, while the other times are stored as unix
+// nanoseconds so that short retry backoffs keep their precision. The partial unique index guarantees there is at
+// most one waiting job per key.
+var queueSqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS queue_jobs (
+		id VARCHAR(32) PRIMARY KEY,
+		queue_name VARCHAR(64) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		user_email VARCHAR(254) NOT NULL,
+		lower_bound BIGINT NOT NULL,
+		job_key VARCHAR(512) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INTEGER NOT NULL,
+		next_attempt BIGINT NOT NULL,
+		last_error TEXT NOT NULL,
+		created BIGINT NOT NULL,
+		updated BIGINT NOT NULL)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS queue_jobs_waiting_key ON queue_jobs (job_key) WHERE status IN ('pending', 'failed')`,
+	`CREATE INDEX IF NOT EXISTS queue_jobs_next_attempt ON queue_jobs (status, next_attempt)`,
+}
+
+const queueJobColumns = "id, queue_name, name, user_email, lower_bound, status, attempts, next_attempt, last_error, created, updated"
+
+// QueueSQLStore is the queue.JobStore implementation backed by a SQL database. It's what makes the jobs of a
+// standalone server's queue.LocalQueue survive restarts.
+type QueueSQLStore struct {
+	r *SQLRepository
+}
+
+// NewQueueSQLStore creates a new queue.JobStore that persists to the given database and creates its schema
+// if it's not already present.
+func NewQueueSQLStore(db *sql.DB, driverName string) (s *QueueSQLStore, err error) {
+	for _, statement := range queueSqlSchema {
+		if _, err = db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+
+	return &QueueSQLStore{&SQLRepository{db, driverName}}, nil
+}
+
+func (s *QueueSQLStore) Add(context context.Context, record queue.JobRecord) (err error) {
+	return s.r.inTransaction(context, func(tx *sql.Tx) error {
+		return s.addWaiting(context, tx, record)
+	})
+}
+
+// addWaiting inserts a waiting job or, if there's already a waiting job with the same key, moves the existing job back
+// to the earliest lower bound and drops the new one
+func (s *QueueSQLStore) addWaiting(context context.Context, tx *sql.Tx, record queue.JobRecord) (err error) {
+	var existingId string
+	var existingLowerBound int64
+	err = tx.QueryRowContext(context, s.r.rebind("SELECT id, lower_bound FROM queue_jobs WHERE job_key = ? AND status IN ('pending', 'failed') AND id <> ?"),
+		record.Job.Key(), record.Id).Scan(&existingId, &existingLowerBound)
+
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.ExecContext(context, s.r.rebind(`INSERT INTO queue_jobs (`+queueJobColumns+`, job_key) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET status = excluded.status, attempts = excluded.attempts, next_attempt = excluded.next_attempt,
+			last_error = excluded.last_error, updated = excluded.updated`),
+			record.Id, record.QueueName, record.Job.Name, record.Job.UserEmail, record.Job.LowerBound.Unix(), record.Status, record.Attempts,
+			record.NextAttempt.UnixNano(), record.LastError, record.Created.UnixNano(), record.Updated.UnixNano(), record.Job.Key())
+		return err
+	case err != nil:
+		return err
+	}
+
+	if lowerBound := record.Job.LowerBound.Unix(); lowerBound < existingLowerBound {
+		if _, err = tx.ExecContext(context, s.r.rebind("UPDATE queue_jobs SET lower_bound = ?, updated = ? WHERE id = ?"), lowerBound,
+			record.Updated.UnixNano(), existingId); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(context, s.r.rebind("DELETE FROM queue_jobs WHERE id = ?"), record.Id)
+	return err
+}
+
+func (s *QueueSQLStore) Claim(context context.Context, now time.Time) (record *queue.JobRecord, err error) {
+	err = s.r.inTransaction(context, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(context, s.r.rebind("SELECT "+queueJobColumns+" FROM queue_jobs WHERE status IN ('pending', 'failed') AND next_attempt <= ? "+
+			"ORDER BY next_attempt, created LIMIT 1"), now.UnixNano())
+		if err != nil {
+			return err
+		}
+
+		records, err := scanJobRecords(rows)
+		if err != nil || len(records) == 0 {
+			return err
+		}
+
+		// The status condition makes sure another server sharing the database didn't claim the job first
+		result, err := tx.ExecContext(context, s.r.rebind("UPDATE queue_jobs SET status = ?, updated = ? WHERE id = ? AND status = ?"),
+			queue.JOB_STATUS_RUNNING, now.UnixNano(), records[0].Id, records[0].Status)
+		if err != nil {
+			return err
+		}
+
+		if claimed, err := result.RowsAffected(); err != nil || claimed == 0 {
+			return err
+		}
+
+		record = &records[0]
+		record.Status = queue.JOB_STATUS_RUNNING
+		record.Updated = now
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (s *QueueSQLStore) Complete(context context.Context, id string) (err error) {
+	_, err = s.r.db.ExecContext(context, s.r.rebind("DELETE FROM queue_jobs WHERE id = ?"), id)
+	return err
+}
+
+func (s *QueueSQLStore) Release(context context.Context, record queue.JobRecord) (err error) {
+	return s.r.inTransaction(context, func(tx *sql.Tx) error {
+		if record.IsWaiting() {
+			return s.addWaiting(context, tx, record)
+		}
+
+		_, err := tx.ExecContext(context, s.r.rebind("UPDATE queue_jobs SET status = ?, attempts = ?, next_attempt = ?, last_error = ?, updated = ? WHERE id = ?"),
+			record.Status, record.Attempts, record.NextAttempt.UnixNano(), record.LastError, record.Updated.UnixNano(), record.Id)
+		return err
+	})
+}
+
+func (s *QueueSQLStore) Recover(context context.Context) (err error) {
+	running, err := s.List(context, queue.JOB_STATUS_RUNNING)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range running {
+		record.Status = queue.JOB_STATUS_PENDING
+		if err = s.Release(context, record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *QueueSQLStore) List(context context.Context, status string) (records []queue.JobRecord, err error) {
+	var rows *sql.Rows
+	if status == "" {
+		rows, err = s.r.db.QueryContext(context, "SELECT "+queueJobColumns+" FROM queue_jobs ORDER BY next_attempt, created")
+	} else {
+		rows, err = s.r.db.QueryContext(context, s.r.rebind("SELECT "+queueJobColumns+" FROM queue_jobs WHERE status = ? ORDER BY next_attempt, created"), status)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scanJobRecords(rows)
+}
+
+// scanJobRecords reads all job records from the rows and closes them
+func scanJobRecords(rows *sql.Rows) (records []queue.JobRecord, err error) {
+	defer rows.Close()
+
+	records = make([]queue.JobRecord, 0)
+	for rows.Next() {
+		var record queue.JobRecord
+		var lowerBound, nextAttempt, created, updated int64
+		if err = rows.Scan(&record.Id, &record.QueueName, &record.Job.Name, &record.Job.UserEmail, &lowerBound, &record.Status, &record.Attempts,
+			&nextAttempt, &record.LastError, &created, &updated); err != nil {
+			return nil, err
+		}
+
+		record.Job.LowerBound = time.Unix(lowerBound, 0)
+		record.NextAttempt = time.Unix(0, nextAttempt)
+		record.Created = time.Unix(0, created)
+		record.Updated = time.Unix(0, updated)
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
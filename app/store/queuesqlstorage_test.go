@@ -0,0 +1,135 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/queue"
+	. "github.com/alexandre-normand/glukit/app/store"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+func setupQueueSQLStore(t *testing.T) (s *QueueSQLStore) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	s, err = NewQueueSQLStore(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newJobRecord(lowerBound time.Time, now time.Time) queue.JobRecord {
+	job := queue.Job{Name: "chain", UserEmail: SQL_TEST_USER, LowerBound: lowerBound}
+	return queue.JobRecord{Id: queue.NewJobId(), QueueName: "test-queue", Job: job, Status: queue.JOB_STATUS_PENDING, NextAttempt: now, Created: now, Updated: now}
+}
+
+func TestSQLJobDeduplication(t *testing.T) {
+	s := setupQueueSQLStore(t)
+	c := context.Background()
+	now := time.Now()
+	earliest := time.Unix(1400000000, 0)
+
+	for _, lowerBound := range []time.Time{earliest.AddDate(0, 0, 7), earliest, earliest.AddDate(0, 0, 1)} {
+		if err := s.Add(c, newJobRecord(lowerBound, now)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := s.List(c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || !records[0].Job.LowerBound.Equal(earliest) {
+		t.Errorf("TestSQLJobDeduplication failed: got jobs [%v] but expected one with lower bound [%s]", records, earliest)
+	}
+
+	// A job added while the other is running isn't a duplicate but it absorbs the running one if it fails
+	claimed, err := s.Claim(c, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Add(c, newJobRecord(earliest.AddDate(0, 0, 7), now)); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed.Status = queue.JOB_STATUS_FAILED
+	claimed.Attempts = 1
+	if err = s.Release(c, *claimed); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = s.List(c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].Status != queue.JOB_STATUS_PENDING || !records[0].Job.LowerBound.Equal(earliest) {
+		t.Errorf("TestSQLJobDeduplication failed: got jobs [%v] but expected one pending with lower bound [%s]", records, earliest)
+	}
+}
+
+func TestSQLJobLifecycle(t *testing.T) {
+	s := setupQueueSQLStore(t)
+	c := context.Background()
+	now := time.Now()
+
+	if err := s.Add(c, newJobRecord(time.Time{}, now.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed, err := s.Claim(c, now); err != nil || claimed != nil {
+		t.Fatalf("TestSQLJobLifecycle failed: claimed [%v] before it was due: %v", claimed, err)
+	}
+
+	claimed, err := s.Claim(c, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed == nil || claimed.Status != queue.JOB_STATUS_RUNNING || !claimed.Job.LowerBound.IsZero() {
+		t.Fatalf("TestSQLJobLifecycle failed: got claimed job [%v] but expected a running job", claimed)
+	}
+
+	// A process restarting after dying with a running job gets it back
+	if err = s.Recover(c); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err = s.Claim(c, now.Add(time.Minute))
+	if err != nil || claimed == nil {
+		t.Fatalf("TestSQLJobLifecycle failed: job wasn't recovered: %v", err)
+	}
+
+	claimed.Status = queue.JOB_STATUS_DEAD
+	claimed.Attempts = 10
+	claimed.LastError = "job failed"
+	if err = s.Release(c, *claimed); err != nil {
+		t.Fatal(err)
+	}
+
+	dead, err := s.List(c, queue.JOB_STATUS_DEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dead) != 1 || dead[0].Attempts != 10 || dead[0].LastError != "job failed" {
+		t.Errorf("TestSQLJobLifecycle failed: got dead jobs [%v] but expected the released one", dead)
+	}
+
+	if err = s.Complete(c, claimed.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if records, _ := s.List(c, ""); len(records) != 0 {
+		t.Errorf("TestSQLJobLifecycle failed: got jobs [%v] after completion", records)
+	}
+}
@@ -0,0 +1,359 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"time"
+)
+
+var (
+	// ErrNoSuchUser is returned when no GlukitUser profile exists for a given email address.
+	ErrNoSuchUser = errors.New("store: no such user")
+
+	// ErrNoDataExport is returned when a user never requested a data export or when its archive isn't stored.
+	ErrNoDataExport = errors.New("store: no data export")
+
+	// ErrNoAccountDeletion is returned when a user never requested the deletion of their data.
+	ErrNoAccountDeletion = errors.New("store: no account deletion")
+
+	// ErrNoCohortAggregation is returned when the cohorts were never aggregated.
+	ErrNoCohortAggregation = errors.New("store: no cohort aggregation")
+
+	// ErrNoSharingGrant is returned when a user didn't grant access to their data to a viewer.
+	ErrNoSharingGrant = errors.New("store: no sharing grant")
+
+	// ErrNoSuchClinic is returned when a clinic isn't found.
+	ErrNoSuchClinic = errors.New("store: no such clinic")
+
+	// ErrNoSuchClinicInvite is returned when a clinic invite code isn't found.
+	ErrNoSuchClinicInvite = errors.New("store: no such clinic invite")
+
+	// ErrClinicInviteNotRedeemable is returned when redeeming a clinic invite that expired or was already redeemed.
+	ErrClinicInviteNotRedeemable = errors.New("store: clinic invite expired or already redeemed")
+
+	// ErrNoClinicEnrollment is returned when a patient isn't enrolled in a clinic.
+	ErrNoClinicEnrollment = errors.New("store: no clinic enrollment")
+
+	// ErrNoSuchOauthClient is returned when an oauth client isn't found.
+	ErrNoSuchOauthClient = errors.New("store: no such oauth client")
+
+	// ErrNoCodeChallenge is returned when an authorization code wasn't issued with a PKCE challenge.
+	ErrNoCodeChallenge = errors.New("store: no code challenge")
+
+	// ErrNoSuchOauthToken is returned when a user didn't authorize a token.
+	ErrNoSuchOauthToken = errors.New("store: no such oauth token")
+)
+
+// Repository is the storage abstraction for everything glukit persists for its users. The engine, the importers and
+// the http handlers should only ever talk to a Repository so that the backing storage (App Engine datastore,
+// an embedded SQL database, etc.) can be swapped without touching them.
+type Repository interface {
+	UserRepository
+	GlucoseReadRepository
+	CalibrationRepository
+	InjectionRepository
+	MealRepository
+	ExerciseRepository
+	ScoreRepository
+	FileImportRepository
+	ApiSecretRepository
+	ExportRepository
+	DeletionRepository
+	EpisodeRepository
+	InsulinRatioRepository
+	LabA1CRepository
+	CohortRepository
+	SharingRepository
+	ClinicRepository
+}
+
+// UserRepository persists GlukitUser profiles.
+type UserRepository interface {
+	// GetUserProfile returns the GlukitUser profile for the given email address or ErrNoSuchUser if
+	// it doesn't exist.
+	GetUserProfile(context context.Context, email string) (userProfile *model.GlukitUser, err error)
+
+	// StoreUserProfile stores a GlukitUser profile. If the entry already exists, it is overriden and it is created
+	// otherwise.
+	StoreUserProfile(context context.Context, updatedAt time.Time, userProfile model.GlukitUser) (err error)
+
+	// GetUserData returns a GlukitUser entry and the upper boundary of its most recent reads.
+	// If the user doesn't have any imported data yet, GetUserData returns ErrNoImportedDataFound.
+	GetUserData(context context.Context, email string) (userProfile *model.GlukitUser, upperBound time.Time, err error)
+
+	// FindSteadySailorCandidates returns the users of the given type of diabetes that could be shown as the steady sailor of
+	// another one: at most limit users who opted in to it and at most limit internal users, each by ascending order of most
+	// recent score value. Users who didn't opt in are never returned unless they're internal and internal users who opted in
+	// can be returned twice.
+	FindSteadySailorCandidates(context context.Context, diabetesType string, limit int) (candidates []model.GlukitUser, err error)
+}
+
+// GlucoseReadRepository persists days of GlucoseReads.
+type GlucoseReadRepository interface {
+	// GetGlucoseReads returns all GlucoseReads given a user's email address and the time boundaries. Note that the
+	// boundaries are both inclusive.
+	GetGlucoseReads(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (reads []apimodel.GlucoseRead, err error)
+
+	// StoreDaysOfReads stores a batch of DayOfGlucoseReads, merging them with any pre-existing reads for the
+	// same days. It also updates the user profile's most recent read, if applicable.
+	StoreDaysOfReads(context context.Context, email string, daysOfReads []apimodel.DayOfGlucoseReads) (err error)
+}
+
+// CalibrationRepository persists days of CalibrationReads.
+type CalibrationRepository interface {
+	// GetCalibrations returns all CalibrationReads given a user's email address and the time boundaries. Note that the
+	// boundaries are both inclusive.
+	GetCalibrations(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (calibrations []apimodel.CalibrationRead, err error)
+
+	// StoreDaysOfCalibrations stores a batch of DayOfCalibrationReads, merging them with any pre-existing
+	// calibrations for the same days.
+	StoreDaysOfCalibrations(context context.Context, email string, daysOfCalibrations []apimodel.DayOfCalibrationReads) (err error)
+}
+
+// InjectionRepository persists days of Injections.
+type InjectionRepository interface {
+	// GetInjections returns all Injections given a user's email address and the time boundaries. Note that the
+	// boundaries are both inclusive.
+	GetInjections(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (injections []apimodel.Injection, err error)
+
+	// StoreDaysOfInjections stores a batch of DayOfInjections, merging them with any pre-existing injections for the
+	// same days.
+	StoreDaysOfInjections(context context.Context, email string, daysOfInjections []apimodel.DayOfInjections) (err error)
+}
+
+// MealRepository persists days of Meals.
+type MealRepository interface {
+	// GetMeals returns all Meals given a user's email address and the time boundaries. Note that the
+	// boundaries are both inclusive.
+	GetMeals(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (meals []apimodel.Meal, err error)
+
+	// StoreDaysOfMeals stores a batch of DayOfMeals, merging them with any pre-existing meals for the
+	// same days.
+	StoreDaysOfMeals(context context.Context, email string, daysOfMeals []apimodel.DayOfMeals) (err error)
+}
+
+// ExerciseRepository persists days of Exercises.
+type ExerciseRepository interface {
+	// GetExercises returns all Exercises given a user's email address and the time boundaries. Note that the
+	// boundaries are both inclusive.
+	GetExercises(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (exercises []apimodel.Exercise, err error)
+
+	// StoreDaysOfExercises stores a batch of DayOfExercises, merging them with any pre-existing exercises for the
+	// same days.
+	StoreDaysOfExercises(context context.Context, email string, daysOfExercises []apimodel.DayOfExercises) (err error)
+}
+
+// ScoreRepository persists the GlukitScore and A1CEstimate series of a user.
+type ScoreRepository interface {
+	// StoreGlukitScoreBatch stores a batch of GlukitScores of any size.
+	StoreGlukitScoreBatch(context context.Context, email string, glukitScores []model.GlukitScore) (err error)
+
+	// GetGlukitScores returns all GlukitScores for the given email address and matching the query parameters,
+	// most recent first.
+	GetGlukitScores(context context.Context, email string, scanQuery ScoreScanQuery) (scores []model.GlukitScore, err error)
+
+	// StoreA1CBatch stores a batch of A1CEstimates of any size.
+	StoreA1CBatch(context context.Context, email string, a1cs []model.A1CEstimate) (err error)
+
+	// GetA1CEstimates returns all A1CEstimates for the given email address and matching the query parameters,
+	// most recent first.
+	GetA1CEstimates(context context.Context, email string, scanQuery ScoreScanQuery) (a1cs []model.A1CEstimate, err error)
+}
+
+// FileImportRepository persists the logs of file imports.
+type FileImportRepository interface {
+	// LogFileImport persists a log of a file import operation. A log entry is kept for each distinct file id.
+	LogFileImport(context context.Context, email string, fileImport model.FileImportLog) (err error)
+
+	// GetFileImportLog retrieves the FileImportLog entry for a given file id.
+	GetFileImportLog(context context.Context, email string, fileId string) (fileImport *model.FileImportLog, err error)
+}
+
+// ApiSecretRepository persists the secrets that clients like Nightscout uploaders authenticate with. Only a hash of
+// each secret is stored and a user has at most one secret.
+type ApiSecretRepository interface {
+	// StoreApiSecret sets the hash of the user's secret, replacing any previous one.
+	StoreApiSecret(context context.Context, email string, secretHash string) (err error)
+
+	// FindUserByApiSecret returns the email of the user with the given secret hash or ErrNoSuchUser if no user
+	// has it.
+	FindUserByApiSecret(context context.Context, secretHash string) (email string, err error)
+}
+
+// ExportRepository persists the data export of a user and its archive.
+type ExportRepository interface {
+	// GetFirstDayOfData returns the start time of the earliest day of data of any kind (reads, calibrations,
+	// injections, meals or exercises) or ErrNoImportedDataFound if the user doesn't have any.
+	GetFirstDayOfData(context context.Context, email string) (startTime time.Time, err error)
+
+	// StoreDataExport stores the state of the user's data export, replacing any previous one.
+	StoreDataExport(context context.Context, email string, dataExport model.DataExport) (err error)
+
+	// GetDataExport returns the state of the user's data export or ErrNoDataExport if the user never requested one.
+	GetDataExport(context context.Context, email string) (dataExport *model.DataExport, err error)
+
+	// StoreDataExportArchive stores the archive of the user's data export, replacing any previous one.
+	StoreDataExportArchive(context context.Context, email string, archive []byte) (err error)
+
+	// GetDataExportArchive returns the archive of the user's data export or ErrNoDataExport if there isn't one.
+	GetDataExportArchive(context context.Context, email string) (archive []byte, err error)
+}
+
+// DeletionRepository deletes the data of users and keeps track of the progress of deletions.
+type DeletionRepository interface {
+	// DeleteUserData deletes at most limit stored elements of the user's data (days of data, scores, file import logs,
+	// data exports, etc.) and returns how many were deleted. Unless keepAccount is set, the user profile and api secret are
+	// deleted once everything else is gone. A deletion is complete when nothing is left to delete.
+	DeleteUserData(context context.Context, email string, keepAccount bool, limit int) (deleted int, err error)
+
+	// StoreAccountDeletion stores the state of the user's account deletion, replacing any previous one.
+	StoreAccountDeletion(context context.Context, email string, deletion model.AccountDeletion) (err error)
+
+	// GetAccountDeletion returns the state of the user's account deletion or ErrNoAccountDeletion if the user never
+	// requested one.
+	GetAccountDeletion(context context.Context, email string) (deletion *model.AccountDeletion, err error)
+}
+
+// EpisodeRepository persists the GlycemicEpisodes detected from a user's reads.
+type EpisodeRepository interface {
+	// GetGlycemicEpisodes returns the GlycemicEpisodes of the user starting within the bounds of the scan query, most
+	// recent first.
+	GetGlycemicEpisodes(context context.Context, email string, scanQuery ScoreScanQuery) (episodes []model.GlycemicEpisode, err error)
+
+	// ReplaceGlycemicEpisodes replaces the GlycemicEpisodes starting between the lower and upper bounds by the given ones. Note
+	// that the boundaries are both inclusive.
+	ReplaceGlycemicEpisodes(context context.Context, email string, lowerBound time.Time, upperBound time.Time, episodes []model.GlycemicEpisode) (err error)
+}
+
+// InsulinRatioRepository persists the series of InsulinRatios estimated for a user.
+type InsulinRatioRepository interface {
+	// StoreInsulinRatios stores a batch of InsulinRatios, replacing any previous ones with the same upper bound.
+	StoreInsulinRatios(context context.Context, email string, ratios []model.InsulinRatios) (err error)
+
+	// GetInsulinRatios returns all InsulinRatios for the given email address and matching the query parameters,
+	// most recent first.
+	GetInsulinRatios(context context.Context, email string, scanQuery ScoreScanQuery) (ratios []model.InsulinRatios, err error)
+}
+
+// LabA1CRepository persists the lab a1c results recorded by a user.
+type LabA1CRepository interface {
+	// StoreLabA1C stores a lab result, replacing any previous one at the same time.
+	StoreLabA1C(context context.Context, email string, labA1C model.LabA1C) (err error)
+
+	// GetLabA1Cs returns all lab results of the user, most recent first.
+	GetLabA1Cs(context context.Context, email string) (labA1Cs []model.LabA1C, err error)
+}
+
+// CohortRepository persists the anonymized distributions of metrics users are ranked against.
+type CohortRepository interface {
+	// FindCohortMembers returns the profiles of all users who opted in to be part of the cohort distributions.
+	FindCohortMembers(context context.Context) (members []model.GlukitUser, err error)
+
+	// StoreCohortAggregation stores the aggregation of the cohorts, replacing the previous one along with all its distributions.
+	StoreCohortAggregation(context context.Context, aggregation model.CohortAggregation) (err error)
+
+	// GetCohortAggregation returns the most recent aggregation of the cohorts or ErrNoCohortAggregation if there's none.
+	GetCohortAggregation(context context.Context) (aggregation *model.CohortAggregation, err error)
+}
+
+// SharingRepository persists the grants users give viewers to their data and the audit log of the accesses of viewers.
+type SharingRepository interface {
+	// StoreSharingGrant stores a grant, replacing any previous one of the same owner to the same viewer.
+	StoreSharingGrant(context context.Context, grant model.SharingGrant) (err error)
+
+	// DeleteSharingGrant revokes the grant of the owner to the viewer or returns ErrNoSharingGrant if there's none.
+	DeleteSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (err error)
+
+	// GetSharingGrant returns the grant of the owner to the viewer or ErrNoSharingGrant if there's none.
+	GetSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (grant *model.SharingGrant, err error)
+
+	// GetSharingGrantsByOwner returns all grants given by the owner.
+	GetSharingGrantsByOwner(context context.Context, ownerEmail string) (grants []model.SharingGrant, err error)
+
+	// GetSharingGrantsByViewer returns all grants given to the viewer.
+	GetSharingGrantsByViewer(context context.Context, viewerEmail string) (grants []model.SharingGrant, err error)
+
+	// LogViewerAccess adds an access of a viewer to the audit log of the owner of the data.
+	LogViewerAccess(context context.Context, ownerEmail string, access model.ViewerAccess) (err error)
+
+	// GetViewerAccesses returns at most limit accesses of viewers to the data of the owner, most recent first.
+	GetViewerAccesses(context context.Context, ownerEmail string, limit int) (accesses []model.ViewerAccess, err error)
+}
+
+// TokenRevoker is implemented by the oauth storages that can revoke all tokens issued to a user.
+type TokenRevoker interface {
+	// RevokeUserTokens deletes the authorize codes, access tokens and refresh tokens issued to the user.
+	RevokeUserTokens(context context.Context, email string) (err error)
+}
+
+// TokenReindexer is implemented by the oauth storages that need to put back the tokens stored before their user was indexed so
+// the queries on the user of tokens find them.
+type TokenReindexer interface {
+	// ReindexUserTokens puts back all authorize codes, access tokens and refresh tokens and returns how many were put.
+	ReindexUserTokens(context context.Context) (count int, err error)
+}
+
+// OauthManager is implemented by the oauth storages that can register clients, keep the PKCE challenges of authorization codes and
+// list and revoke the tokens users authorized.
+type OauthManager interface {
+	// RegisterClient stores a new client with its secret, which is empty for public clients.
+	RegisterClient(context context.Context, client model.OauthClient, secret string) (err error)
+
+	// GetOauthClient returns the registration of a client or ErrNoSuchOauthClient if there's none. Clients registered before scopes
+	// existed have all scopes.
+	GetOauthClient(context context.Context, clientId string) (client *model.OauthClient, err error)
+
+	// GetOauthClientsByOwner returns the clients registered by the developer.
+	GetOauthClientsByOwner(context context.Context, ownerEmail string) (clients []model.OauthClient, err error)
+
+	// SaveCodeChallenge stores the PKCE challenge of an authorization code along with it.
+	SaveCodeChallenge(context context.Context, code string, challenge model.CodeChallenge) (err error)
+
+	// LoadCodeChallenge returns the PKCE challenge of an authorization code or ErrNoCodeChallenge if it was issued without one.
+	LoadCodeChallenge(context context.Context, code string) (challenge *model.CodeChallenge, err error)
+
+	// GetUserTokens returns the access tokens the user authorized, most recent first.
+	GetUserTokens(context context.Context, email string) (tokens []model.OauthToken, err error)
+
+	// RevokeUserToken deletes an access token of the user and its refresh token or returns ErrNoSuchOauthToken if there's none.
+	RevokeUserToken(context context.Context, email string, tokenId string) (err error)
+
+	// RevokeClientTokens deletes the authorization codes, access tokens and refresh tokens the user authorized the client to get.
+	RevokeClientTokens(context context.Context, email string, clientId string) (err error)
+}
+
+// ClinicRepository persists clinics, the invites of their practitioners and the enrollments of their patients.
+type ClinicRepository interface {
+	// StoreClinic stores a clinic, replacing any previous one with the same id.
+	StoreClinic(context context.Context, clinic model.Clinic) (err error)
+
+	// GetClinic returns the clinic with the given id or ErrNoSuchClinic if there's none.
+	GetClinic(context context.Context, clinicId string) (clinic *model.Clinic, err error)
+
+	// GetClinicsByPractitioner returns the clinics the user is a practitioner of.
+	GetClinicsByPractitioner(context context.Context, practitionerEmail string) (clinics []model.Clinic, err error)
+
+	// StoreClinicInvite stores an invite, replacing any previous one with the same code.
+	StoreClinicInvite(context context.Context, invite model.ClinicInvite) (err error)
+
+	// GetClinicInvite returns the invite with the given code or ErrNoSuchClinicInvite if there's none.
+	GetClinicInvite(context context.Context, code string) (invite *model.ClinicInvite, err error)
+
+	// RedeemClinicInvite atomically marks an invite as redeemed by the patient and returns it. It returns ErrNoSuchClinicInvite if
+	// there's none and ErrClinicInviteNotRedeemable if it expired or was already redeemed, even by a concurrent request.
+	RedeemClinicInvite(context context.Context, code string, patientEmail string, now time.Time) (invite *model.ClinicInvite, err error)
+
+	// StoreClinicEnrollment stores the enrollment of a patient, replacing any previous one in the same clinic.
+	StoreClinicEnrollment(context context.Context, enrollment model.ClinicEnrollment) (err error)
+
+	// DeleteClinicEnrollment deletes the enrollment of a patient in a clinic or returns ErrNoClinicEnrollment if there's none.
+	DeleteClinicEnrollment(context context.Context, patientEmail string, clinicId string) (err error)
+
+	// GetClinicEnrollmentsByPatient returns the enrollments of the patient.
+	GetClinicEnrollmentsByPatient(context context.Context, patientEmail string) (enrollments []model.ClinicEnrollment, err error)
+
+	// GetClinicEnrollmentsByClinic returns the enrollments of all patients of the clinic.
+	GetClinicEnrollmentsByClinic(context context.Context, clinicId string) (enrollments []model.ClinicEnrollment, err error)
+}
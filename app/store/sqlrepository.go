@@ -0,0 +1,1405 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Name of the postgres driver, the only supported driver that doesn't use ? as its placeholder
+	POSTGRES_DRIVER_NAME = "postgres"
+)
+
+// The schema only uses types and statements that are common to SQLite and Postgres. Like with the datastore,
+// days of data are stored as a short-and-wide row holding all elements of that day as json.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS glukit_users (
+		email VARCHAR(254) PRIMARY KEY,
+		diabetes_type VARCHAR(16) NOT NULL,
+		internal BOOLEAN NOT NULL,
+		most_recent_score BIGINT NOT NULL,
+		profile TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS days_of_data (
+		email VARCHAR(254) NOT NULL,
+		kind VARCHAR(64) NOT NULL,
+		start_time BIGINT NOT NULL,
+		end_time BIGINT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, kind, start_time))`,
+	`CREATE TABLE IF NOT EXISTS score_series (
+		email VARCHAR(254) NOT NULL,
+		kind VARCHAR(64) NOT NULL,
+		upper_bound BIGINT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, kind, upper_bound))`,
+	`CREATE TABLE IF NOT EXISTS file_import_logs (
+		email VARCHAR(254) NOT NULL,
+		id VARCHAR(255) NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, id))`,
+	`CREATE TABLE IF NOT EXISTS api_secrets (
+		secret_hash VARCHAR(128) PRIMARY KEY,
+		email VARCHAR(254) NOT NULL UNIQUE)`,
+	`CREATE TABLE IF NOT EXISTS data_exports (
+		email VARCHAR(254) PRIMARY KEY,
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS data_export_archives (
+		email VARCHAR(254) PRIMARY KEY,
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS account_deletions (
+		email VARCHAR(254) PRIMARY KEY,
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS glycemic_episodes (
+		email VARCHAR(254) NOT NULL,
+		type VARCHAR(16) NOT NULL,
+		start_time BIGINT NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, type, start_time))`,
+	`CREATE TABLE IF NOT EXISTS cohort_aggregations (
+		id VARCHAR(16) PRIMARY KEY,
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS sharing_grants (
+		email VARCHAR(254) NOT NULL,
+		viewer_email VARCHAR(254) NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, viewer_email))`,
+	`CREATE TABLE IF NOT EXISTS viewer_accesses (
+		email VARCHAR(254) NOT NULL,
+		access_time BIGINT NOT NULL,
+		viewer_email VARCHAR(254) NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, access_time, viewer_email))`,
+	`CREATE TABLE IF NOT EXISTS clinics (
+		id VARCHAR(64) PRIMARY KEY,
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS clinic_invites (
+		code VARCHAR(64) PRIMARY KEY,
+		redeemed_by VARCHAR(254),
+		content TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS clinic_enrollments (
+		email VARCHAR(254) NOT NULL,
+		clinic_id VARCHAR(64) NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (email, clinic_id))`,
+}
+
+// The tables holding a user's data with more than one row per user, along with the columns that identify a row for a user
+var sqlUserDataTables = []struct {
+	name       string
+	keyColumns string
+}{
+	{"days_of_data", "kind, start_time"},
+	{"score_series", "kind, upper_bound"},
+	{"file_import_logs", "id"},
+	{"glycemic_episodes", "type, start_time"},
+	{"sharing_grants", "viewer_email"},
+	{"viewer_accesses", "access_time, viewer_email"},
+	{"clinic_enrollments", "clinic_id"},
+}
+
+// The tables holding rows about a user as the viewer of the data of other users, along with the columns that identify a row for a
+// viewer. Viewer emails are normalized.
+var sqlViewerDataTables = []struct {
+	name       string
+	keyColumns string
+}{
+	{"sharing_grants", "email"},
+	{"viewer_accesses", "email, access_time"},
+}
+
+// SQLRepository is the Repository implementation backed by an embedded or external SQL database. It
+// works with SQLite and Postgres (or any database compatible with their common dialect).
+type SQLRepository struct {
+	db         *sql.DB
+	driverName string
+}
+
+// NewSQLRepository creates a new Repository that persists to the given database and creates the glukit schema
+// if it's not already present. The driverName is the one the database was opened with.
+// Note that in-memory SQLite databases should be limited to a single open connection as each connection
+// would otherwise get its own database.
+func NewSQLRepository(db *sql.DB, driverName string) (r *SQLRepository, err error) {
+	r = &SQLRepository{db, driverName}
+	for _, statement := range sqlSchema {
+		if _, err = db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// rebind rewrites the ? placeholders of a query into the positional form expected by postgres, when applicable
+func (r *SQLRepository) rebind(query string) string {
+	if r.driverName != POSTGRES_DRIVER_NAME {
+		return query
+	}
+
+	rebound := new(strings.Builder)
+	position := 1
+	for _, c := range query {
+		if c == '?' {
+			rebound.WriteString("$" + strconv.Itoa(position))
+			position = position + 1
+		} else {
+			rebound.WriteRune(c)
+		}
+	}
+
+	return rebound.String()
+}
+
+func (r *SQLRepository) GetUserProfile(context context.Context, email string) (userProfile *model.GlukitUser, err error) {
+	return getSQLUserProfile(context, r.db, r.rebind, email)
+}
+
+// sqlQueryer is what's common to sql.DB and sql.Tx for reads
+type sqlQueryer interface {
+	QueryRowContext(context context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqlExecer is what's common to sql.DB and sql.Tx for writes
+type sqlExecer interface {
+	ExecContext(context context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func getSQLUserProfile(context context.Context, q sqlQueryer, rebind func(string) string, email string) (userProfile *model.GlukitUser, err error) {
+	var content string
+	err = q.QueryRowContext(context, rebind("SELECT profile FROM glukit_users WHERE email = ?"), email).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchUser
+	} else if err != nil {
+		return nil, err
+	}
+
+	userProfile = new(model.GlukitUser)
+	if err = json.Unmarshal([]byte(content), userProfile); err != nil {
+		return nil, err
+	}
+
+	return userProfile, nil
+}
+
+func (r *SQLRepository) StoreUserProfile(context context.Context, updatedAt time.Time, userProfile model.GlukitUser) (err error) {
+	return storeSQLUserProfile(context, r.db, r.rebind, userProfile)
+}
+
+func storeSQLUserProfile(context context.Context, e sqlExecer, rebind func(string) string, userProfile model.GlukitUser) (err error) {
+	content, err := json.Marshal(userProfile)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.ExecContext(context, rebind(`INSERT INTO glukit_users (email, diabetes_type, internal, most_recent_score, profile) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (email) DO UPDATE SET diabetes_type = excluded.diabetes_type, internal = excluded.internal,
+		most_recent_score = excluded.most_recent_score, profile = excluded.profile`),
+		userProfile.Email, userProfile.DiabetesType, userProfile.Internal, userProfile.MostRecentScore.Value, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetUserData(context context.Context, email string) (userProfile *model.GlukitUser, upperBound time.Time, err error) {
+	userProfile, err = r.GetUserProfile(context, email)
+	if err != nil {
+		return nil, util.GLUKIT_EPOCH_TIME, err
+	}
+
+	// If the most recent read is still at the beginning on time, we know no data has been imported yet
+	if util.GLUKIT_EPOCH_TIME.Equal(userProfile.MostRecentRead.GetTime()) {
+		return userProfile, util.GLUKIT_EPOCH_TIME, ErrNoImportedDataFound
+	}
+
+	return userProfile, userProfile.MostRecentRead.GetTime(), nil
+}
+
+func (r *SQLRepository) FindSteadySailorCandidates(context context.Context, diabetesType string, limit int) (candidates []model.GlukitUser, err error) {
+	rows, err := r.db.QueryContext(context, r.rebind("SELECT profile FROM glukit_users WHERE diabetes_type = ? ORDER BY most_recent_score"),
+		diabetesType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// The opt-in is only part of the profile so users are filtered as they're read, until there are enough of each
+	optedIn := make([]model.GlukitUser, 0)
+	internal := make([]model.GlukitUser, 0)
+	for rows.Next() && (len(optedIn) < limit || len(internal) < limit) {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var candidate model.GlukitUser
+		if err = json.Unmarshal([]byte(content), &candidate); err != nil {
+			return nil, err
+		}
+
+		if candidate.Sailing.OptIn && len(optedIn) < limit {
+			optedIn = append(optedIn, candidate)
+		} else if candidate.Internal && len(internal) < limit {
+			internal = append(internal, candidate)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(optedIn, internal...), nil
+}
+
+// getDaysOfData returns the json content of all days of the given kind that could hold elements between the lower and upper bounds.
+func (r *SQLRepository) getDaysOfData(context context.Context, email string, kind string, lowerBound time.Time, upperBound time.Time) (contents [][]byte, err error) {
+	// Same as with the datastore, scan from one day prior to one day later so that we capture the days that start
+	// before the lower bound but could hold elements in range
+	scanStart := lowerBound.Add(time.Duration(-24 * time.Hour))
+	scanEnd := upperBound.Add(time.Duration(24 * time.Hour))
+
+	rows, err := r.db.QueryContext(context, r.rebind("SELECT content FROM days_of_data WHERE email = ? AND kind = ? AND start_time >= ? AND start_time <= ? ORDER BY start_time"),
+		email, kind, scanStart.Unix(), scanEnd.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contents = make([][]byte, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+		contents = append(contents, []byte(content))
+	}
+
+	return contents, rows.Err()
+}
+
+// sqlDayOfData adapts the different DayOf* types to the generic days_of_data table
+type sqlDayOfData interface {
+	// bounds returns the start and end time of the day of data
+	bounds() (startTime time.Time, endTime time.Time)
+	// reconcile merges the day of data with the json content of the existing day, if any and returns the merged content
+	reconcile(existing []byte) (content []byte, err error)
+}
+
+// storeDaysOfData stores days of data of the given kind, each one reconciled with any pre-existing data for the same day.
+func storeDaysOfData(context context.Context, tx *sql.Tx, rebind func(string) string, email string, kind string, days []sqlDayOfData) (err error) {
+	for _, day := range days {
+		startTime, endTime := day.bounds()
+
+		var existing []byte
+		var existingContent string
+		err = tx.QueryRowContext(context, rebind("SELECT content FROM days_of_data WHERE email = ? AND kind = ? AND start_time = ?"),
+			email, kind, startTime.Unix()).Scan(&existingContent)
+		if err == nil {
+			existing = []byte(existingContent)
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+
+		content, err := day.reconcile(existing)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(context, rebind(`INSERT INTO days_of_data (email, kind, start_time, end_time, content) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (email, kind, start_time) DO UPDATE SET end_time = excluded.end_time, content = excluded.content`),
+			email, kind, startTime.Unix(), endTime.Unix(), string(content))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inTransaction runs the given function within a transaction that is committed if the function succeeds and rolled back otherwise
+func (r *SQLRepository) inTransaction(context context.Context, f func(tx *sql.Tx) error) (err error) {
+	tx, err := r.db.BeginTx(context, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type sqlDayOfGlucoseReads apimodel.DayOfGlucoseReads
+
+func (day sqlDayOfGlucoseReads) bounds() (startTime time.Time, endTime time.Time) {
+	return day.StartTime, day.EndTime
+}
+
+func (day sqlDayOfGlucoseReads) reconcile(existing []byte) (content []byte, err error) {
+	var existingReads []apimodel.GlucoseRead
+	if existing != nil {
+		if err = json.Unmarshal(existing, &existingReads); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(reconcileReads(existingReads, day.Reads))
+}
+
+func (r *SQLRepository) GetGlucoseReads(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (reads []apimodel.GlucoseRead, err error) {
+	contents, err := r.getDaysOfData(context, email, "DayOfReads", lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	readsForPeriod := make([]apimodel.GlucoseRead, 0)
+	for _, content := range contents {
+		var dayOfReads []apimodel.GlucoseRead
+		if err = json.Unmarshal(content, &dayOfReads); err != nil {
+			return nil, err
+		}
+		readsForPeriod = mergeGlucoseReadArrays(readsForPeriod, dayOfReads)
+	}
+
+	startIndex, endIndex := apimodel.GetBoundariesOfElementsInRange(apimodel.GlucoseReadSlice(readsForPeriod), lowerBound, upperBound)
+	return readsForPeriod[startIndex : endIndex+1], nil
+}
+
+// StoreDaysOfReads stores days of reads and updates the GlukitUser entry with the most recent read, if applicable.
+func (r *SQLRepository) StoreDaysOfReads(context context.Context, email string, daysOfReads []apimodel.DayOfGlucoseReads) (err error) {
+	if len(daysOfReads) == 0 {
+		return nil
+	}
+
+	days := make([]sqlDayOfData, len(daysOfReads))
+	for i := range daysOfReads {
+		days[i] = sqlDayOfGlucoseReads(daysOfReads[i])
+	}
+
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		if err := storeDaysOfData(context, tx, r.rebind, email, "DayOfReads", days); err != nil {
+			return err
+		}
+
+		userProfile, err := getSQLUserProfile(context, tx, r.rebind, email)
+		if err != nil {
+			return err
+		}
+
+		lastDayOfRead := daysOfReads[len(daysOfReads)-1]
+		lastRead := lastDayOfRead.Reads[len(lastDayOfRead.Reads)-1]
+		if userProfile.MostRecentRead.GetTime().Before(lastRead.GetTime()) {
+			userProfile.MostRecentRead = lastRead
+			return storeSQLUserProfile(context, tx, r.rebind, *userProfile)
+		}
+
+		return nil
+	})
+}
+
+type sqlDayOfCalibrationReads apimodel.DayOfCalibrationReads
+
+func (day sqlDayOfCalibrationReads) bounds() (startTime time.Time, endTime time.Time) {
+	return day.StartTime, day.EndTime
+}
+
+func (day sqlDayOfCalibrationReads) reconcile(existing []byte) (content []byte, err error) {
+	var existingCalibrations []apimodel.CalibrationRead
+	if existing != nil {
+		if err = json.Unmarshal(existing, &existingCalibrations); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(reconcileCalibrations(existingCalibrations, day.Reads))
+}
+
+func (r *SQLRepository) GetCalibrations(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (calibrations []apimodel.CalibrationRead, err error) {
+	contents, err := r.getDaysOfData(context, email, "DayOfCalibrationReads", lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	calibrationsForPeriod := make([]apimodel.CalibrationRead, 0)
+	for _, content := range contents {
+		var dayOfCalibrations []apimodel.CalibrationRead
+		if err = json.Unmarshal(content, &dayOfCalibrations); err != nil {
+			return nil, err
+		}
+		calibrationsForPeriod = mergeCalibrationReadArrays(calibrationsForPeriod, dayOfCalibrations)
+	}
+
+	startIndex, endIndex := apimodel.GetBoundariesOfElementsInRange(apimodel.CalibrationReadSlice(calibrationsForPeriod), lowerBound, upperBound)
+	return calibrationsForPeriod[startIndex : endIndex+1], nil
+}
+
+func (r *SQLRepository) StoreDaysOfCalibrations(context context.Context, email string, daysOfCalibrations []apimodel.DayOfCalibrationReads) (err error) {
+	days := make([]sqlDayOfData, len(daysOfCalibrations))
+	for i := range daysOfCalibrations {
+		days[i] = sqlDayOfCalibrationReads(daysOfCalibrations[i])
+	}
+
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		return storeDaysOfData(context, tx, r.rebind, email, "DayOfCalibrationReads", days)
+	})
+}
+
+type sqlDayOfInjections apimodel.DayOfInjections
+
+func (day sqlDayOfInjections) bounds() (startTime time.Time, endTime time.Time) {
+	return day.StartTime, day.EndTime
+}
+
+func (day sqlDayOfInjections) reconcile(existing []byte) (content []byte, err error) {
+	var existingInjections []apimodel.Injection
+	if existing != nil {
+		if err = json.Unmarshal(existing, &existingInjections); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(reconcileInjections(existingInjections, day.Injections))
+}
+
+func (r *SQLRepository) GetInjections(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (injections []apimodel.Injection, err error) {
+	contents, err := r.getDaysOfData(context, email, "DayOfInjections", lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	injectionsForPeriod := make([]apimodel.Injection, 0)
+	for _, content := range contents {
+		var dayOfInjections []apimodel.Injection
+		if err = json.Unmarshal(content, &dayOfInjections); err != nil {
+			return nil, err
+		}
+		injectionsForPeriod = mergeInjectionArrays(injectionsForPeriod, dayOfInjections)
+	}
+
+	startIndex, endIndex := apimodel.GetBoundariesOfElementsInRange(apimodel.InjectionSlice(injectionsForPeriod), lowerBound, upperBound)
+	return injectionsForPeriod[startIndex : endIndex+1], nil
+}
+
+func (r *SQLRepository) StoreDaysOfInjections(context context.Context, email string, daysOfInjections []apimodel.DayOfInjections) (err error) {
+	days := make([]sqlDayOfData, len(daysOfInjections))
+	for i := range daysOfInjections {
+		days[i] = sqlDayOfInjections(daysOfInjections[i])
+	}
+
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		return storeDaysOfData(context, tx, r.rebind, email, "DayOfInjections", days)
+	})
+}
+
+type sqlDayOfMeals apimodel.DayOfMeals
+
+func (day sqlDayOfMeals) bounds() (startTime time.Time, endTime time.Time) {
+	return day.StartTime, day.EndTime
+}
+
+func (day sqlDayOfMeals) reconcile(existing []byte) (content []byte, err error) {
+	var existingMeals []apimodel.Meal
+	if existing != nil {
+		if err = json.Unmarshal(existing, &existingMeals); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(reconcileMeals(existingMeals, day.Meals))
+}
+
+func (r *SQLRepository) GetMeals(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (meals []apimodel.Meal, err error) {
+	contents, err := r.getDaysOfData(context, email, "DayOfMeals", lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	mealsForPeriod := make([]apimodel.Meal, 0)
+	for _, content := range contents {
+		var dayOfMeals []apimodel.Meal
+		if err = json.Unmarshal(content, &dayOfMeals); err != nil {
+			return nil, err
+		}
+		mealsForPeriod = mergeMealArrays(mealsForPeriod, dayOfMeals)
+	}
+
+	startIndex, endIndex := apimodel.GetBoundariesOfElementsInRange(apimodel.MealSlice(mealsForPeriod), lowerBound, upperBound)
+	return mealsForPeriod[startIndex : endIndex+1], nil
+}
+
+func (r *SQLRepository) StoreDaysOfMeals(context context.Context, email string, daysOfMeals []apimodel.DayOfMeals) (err error) {
+	days := make([]sqlDayOfData, len(daysOfMeals))
+	for i := range daysOfMeals {
+		days[i] = sqlDayOfMeals(daysOfMeals[i])
+	}
+
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		return storeDaysOfData(context, tx, r.rebind, email, "DayOfMeals", days)
+	})
+}
+
+type sqlDayOfExercises apimodel.DayOfExercises
+
+func (day sqlDayOfExercises) bounds() (startTime time.Time, endTime time.Time) {
+	return day.StartTime, day.EndTime
+}
+
+func (day sqlDayOfExercises) reconcile(existing []byte) (content []byte, err error) {
+	var existingExercises []apimodel.Exercise
+	if existing != nil {
+		if err = json.Unmarshal(existing, &existingExercises); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(reconcileExercises(existingExercises, day.Exercises))
+}
+
+func (r *SQLRepository) GetExercises(context context.Context, email string, lowerBound time.Time, upperBound time.Time) (exercises []apimodel.Exercise, err error) {
+	contents, err := r.getDaysOfData(context, email, "DayOfExercises", lowerBound, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	exercisesForPeriod := make([]apimodel.Exercise, 0)
+	for _, content := range contents {
+		var dayOfExercises []apimodel.Exercise
+		if err = json.Unmarshal(content, &dayOfExercises); err != nil {
+			return nil, err
+		}
+		exercisesForPeriod = mergeExerciseArrays(exercisesForPeriod, dayOfExercises)
+	}
+
+	startIndex, endIndex := apimodel.GetBoundariesOfElementsInRange(apimodel.ExerciseSlice(exercisesForPeriod), lowerBound, upperBound)
+	return exercisesForPeriod[startIndex : endIndex+1], nil
+}
+
+func (r *SQLRepository) StoreDaysOfExercises(context context.Context, email string, daysOfExercises []apimodel.DayOfExercises) (err error) {
+	days := make([]sqlDayOfData, len(daysOfExercises))
+	for i := range daysOfExercises {
+		days[i] = sqlDayOfExercises(daysOfExercises[i])
+	}
+
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		return storeDaysOfData(context, tx, r.rebind, email, "DayOfExercises", days)
+	})
+}
+
+// storeSeriesElement stores a single element of a time series (i.e. GlukitScore, A1CEstimate, LabA1C) keyed by its upper bound or time
+func storeSeriesElement(context context.Context, tx *sql.Tx, rebind func(string) string, email string, kind string, upperBound time.Time, element interface{}) (err error) {
+	content, err := json.Marshal(element)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(context, rebind(`INSERT INTO score_series (email, kind, upper_bound, content) VALUES (?, ?, ?, ?)
+		ON CONFLICT (email, kind, upper_bound) DO UPDATE SET content = excluded.content`),
+		email, kind, upperBound.Unix(), string(content))
+
+	return err
+}
+
+// scoreSeriesKind returns the kind the GlukitScores or A1CEstimates of a version are stored under. Versions up to the unversioned
+// one keep the original kind and later versions get their own.
+func scoreSeriesKind(kind string, unversionedVersion int, version int) string {
+	if version <= unversionedVersion {
+		return kind
+	}
+
+	return kind + "-v" + strconv.Itoa(version)
+}
+
+// getScoreSeries returns the json content of the GlukitScores or A1CEstimates matching the scan query, of all versions if it doesn't
+// have one, most recent first
+func (r *SQLRepository) getScoreSeries(context context.Context, email string, kind string, unversionedVersion int, scanQuery ScoreScanQuery) (contents [][]byte, err error) {
+	if scanQuery.Version != nil {
+		return r.getSeries(context, email, "kind = ?", []interface{}{scoreSeriesKind(kind, unversionedVersion, *scanQuery.Version)}, scanQuery)
+	}
+
+	return r.getSeries(context, email, "(kind = ? OR kind LIKE ?)", []interface{}{kind, kind + "-v%"}, scanQuery)
+}
+
+// getSeries returns the json content of the time series elements of the kinds matching the condition and the scan query, most recent first
+func (r *SQLRepository) getSeries(context context.Context, email string, kindCondition string, kindArgs []interface{}, scanQuery ScoreScanQuery) (contents [][]byte, err error) {
+	query := "SELECT content FROM score_series WHERE email = ? AND " + kindCondition
+	args := append([]interface{}{email}, kindArgs...)
+	if scanQuery.From != nil {
+		query = query + " AND upper_bound >= ?"
+		args = append(args, scanQuery.From.Unix())
+	}
+	if scanQuery.To != nil {
+		query = query + " AND upper_bound <= ?"
+		args = append(args, scanQuery.To.Unix())
+	}
+	query = query + " ORDER BY upper_bound DESC"
+	if scanQuery.Limit != nil {
+		query = query + " LIMIT ?"
+		args = append(args, *scanQuery.Limit)
+	}
+
+	rows, err := r.db.QueryContext(context, r.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contents = make([][]byte, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+		contents = append(contents, []byte(content))
+	}
+
+	return contents, rows.Err()
+}
+
+func (r *SQLRepository) StoreGlukitScoreBatch(context context.Context, email string, glukitScores []model.GlukitScore) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		for i := range glukitScores {
+			if err := storeSeriesElement(context, tx, r.rebind, email, scoreSeriesKind("GlukitScore", UNVERSIONED_GLUKIT_SCORE_VERSION,
+				glukitScores[i].ScoringVersion), glukitScores[i].UpperBound, glukitScores[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *SQLRepository) GetGlukitScores(context context.Context, email string, scanQuery ScoreScanQuery) (scores []model.GlukitScore, err error) {
+	contents, err := r.getScoreSeries(context, email, "GlukitScore", UNVERSIONED_GLUKIT_SCORE_VERSION, scanQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	scores = make([]model.GlukitScore, len(contents))
+	for i := range contents {
+		if err = json.Unmarshal(contents[i], &scores[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return scores, nil
+}
+
+func (r *SQLRepository) StoreA1CBatch(context context.Context, email string, a1cs []model.A1CEstimate) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		for i := range a1cs {
+			if err := storeSeriesElement(context, tx, r.rebind, email, scoreSeriesKind("A1CEstimate", UNVERSIONED_A1C_VERSION, a1cs[i].ScoringVersion),
+				a1cs[i].UpperBound, a1cs[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *SQLRepository) GetA1CEstimates(context context.Context, email string, scanQuery ScoreScanQuery) (a1cs []model.A1CEstimate, err error) {
+	contents, err := r.getScoreSeries(context, email, "A1CEstimate", UNVERSIONED_A1C_VERSION, scanQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	a1cs = make([]model.A1CEstimate, len(contents))
+	for i := range contents {
+		if err = json.Unmarshal(contents[i], &a1cs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return a1cs, nil
+}
+
+func (r *SQLRepository) StoreInsulinRatios(context context.Context, email string, ratios []model.InsulinRatios) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		for i := range ratios {
+			if err := storeSeriesElement(context, tx, r.rebind, email, "InsulinRatios", ratios[i].UpperBound, ratios[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *SQLRepository) GetInsulinRatios(context context.Context, email string, scanQuery ScoreScanQuery) (ratios []model.InsulinRatios, err error) {
+	contents, err := r.getSeries(context, email, "kind = ?", []interface{}{"InsulinRatios"}, scanQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	ratios = make([]model.InsulinRatios, len(contents))
+	for i := range contents {
+		if err = json.Unmarshal(contents[i], &ratios[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return ratios, nil
+}
+
+func (r *SQLRepository) StoreLabA1C(context context.Context, email string, labA1C model.LabA1C) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		return storeSeriesElement(context, tx, r.rebind, email, "LabA1C", labA1C.Time, labA1C)
+	})
+}
+
+func (r *SQLRepository) GetLabA1Cs(context context.Context, email string) (labA1Cs []model.LabA1C, err error) {
+	contents, err := r.getSeries(context, email, "kind = ?", []interface{}{"LabA1C"}, ScoreScanQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	labA1Cs = make([]model.LabA1C, len(contents))
+	for i := range contents {
+		if err = json.Unmarshal(contents[i], &labA1Cs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return labA1Cs, nil
+}
+
+func (r *SQLRepository) LogFileImport(context context.Context, email string, fileImport model.FileImportLog) (err error) {
+	content, err := json.Marshal(fileImport)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO file_import_logs (email, id, content) VALUES (?, ?, ?)
+		ON CONFLICT (email, id) DO UPDATE SET content = excluded.content`), email, fileImport.Id, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetFileImportLog(context context.Context, email string, fileId string) (fileImport *model.FileImportLog, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM file_import_logs WHERE email = ? AND id = ?"), email, fileId).Scan(&content)
+	if err != nil {
+		return nil, err
+	}
+
+	fileImport = new(model.FileImportLog)
+	if err = json.Unmarshal([]byte(content), fileImport); err != nil {
+		return nil, err
+	}
+
+	return fileImport, nil
+}
+
+func (r *SQLRepository) StoreApiSecret(context context.Context, email string, secretHash string) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(context, r.rebind("DELETE FROM api_secrets WHERE email = ?"), email); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(context, r.rebind("INSERT INTO api_secrets (secret_hash, email) VALUES (?, ?)"), secretHash, email)
+		return err
+	})
+}
+
+func (r *SQLRepository) FindUserByApiSecret(context context.Context, secretHash string) (email string, err error) {
+	err = r.db.QueryRowContext(context, r.rebind("SELECT email FROM api_secrets WHERE secret_hash = ?"), secretHash).Scan(&email)
+	if err == sql.ErrNoRows {
+		return "", ErrNoSuchUser
+	}
+
+	return email, err
+}
+
+func (r *SQLRepository) GetFirstDayOfData(context context.Context, email string) (startTime time.Time, err error) {
+	var firstStartTime sql.NullInt64
+	err = r.db.QueryRowContext(context, r.rebind("SELECT MIN(start_time) FROM days_of_data WHERE email = ?"), email).Scan(&firstStartTime)
+	if err != nil {
+		return util.GLUKIT_EPOCH_TIME, err
+	}
+
+	if !firstStartTime.Valid {
+		return util.GLUKIT_EPOCH_TIME, ErrNoImportedDataFound
+	}
+
+	return time.Unix(firstStartTime.Int64, 0), nil
+}
+
+func (r *SQLRepository) StoreDataExport(context context.Context, email string, dataExport model.DataExport) (err error) {
+	content, err := json.Marshal(dataExport)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO data_exports (email, content) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET content = excluded.content`), email, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetDataExport(context context.Context, email string) (dataExport *model.DataExport, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM data_exports WHERE email = ?"), email).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoDataExport
+	} else if err != nil {
+		return nil, err
+	}
+
+	dataExport = new(model.DataExport)
+	if err = json.Unmarshal([]byte(content), dataExport); err != nil {
+		return nil, err
+	}
+
+	return dataExport, nil
+}
+
+// StoreDataExportArchive stores the archive base64-encoded since binary columns aren't common to SQLite and Postgres
+func (r *SQLRepository) StoreDataExportArchive(context context.Context, email string, archive []byte) (err error) {
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO data_export_archives (email, content) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET content = excluded.content`), email, base64.StdEncoding.EncodeToString(archive))
+
+	return err
+}
+
+func (r *SQLRepository) GetDataExportArchive(context context.Context, email string) (archive []byte, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM data_export_archives WHERE email = ?"), email).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoDataExport
+	} else if err != nil {
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(content)
+}
+
+// DeleteUserData deletes the rows of the tables with many rows per user at most limit at a time and then the single rows
+// of the user's data export and, unless the account is kept, of the user's api secret and profile
+func (r *SQLRepository) DeleteUserData(context context.Context, email string, keepAccount bool, limit int) (deleted int, err error) {
+	err = r.inTransaction(context, func(tx *sql.Tx) error {
+		deleteRows := func(table string, emailColumn string, keyColumns string, email string) (err error) {
+			result, err := tx.ExecContext(context, r.rebind("DELETE FROM "+table+" WHERE "+emailColumn+" = ? AND ("+keyColumns+") IN (SELECT "+
+				keyColumns+" FROM "+table+" WHERE "+emailColumn+" = ? LIMIT ?)"), email, email, limit-deleted)
+			if err != nil {
+				return err
+			}
+
+			count, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			deleted = deleted + int(count)
+			return nil
+		}
+
+		for _, table := range sqlUserDataTables {
+			if err := deleteRows(table.name, "email", table.keyColumns, email); err != nil {
+				return err
+			}
+
+			if deleted >= limit {
+				return nil
+			}
+		}
+
+		// The grants other users gave to the user and the log of the user's accesses to their data
+		for _, table := range sqlViewerDataTables {
+			if err := deleteRows(table.name, "viewer_email", table.keyColumns, model.NormalizeEmail(email)); err != nil {
+				return err
+			}
+
+			if deleted >= limit {
+				return nil
+			}
+		}
+
+		singleRowTables := []string{"data_exports", "data_export_archives"}
+		if !keepAccount {
+			singleRowTables = append(singleRowTables, "api_secrets", "glukit_users")
+		}
+
+		for _, table := range singleRowTables {
+			result, err := tx.ExecContext(context, r.rebind("DELETE FROM "+table+" WHERE email = ?"), email)
+			if err != nil {
+				return err
+			}
+
+			count, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			deleted = deleted + int(count)
+		}
+
+		return nil
+	})
+
+	return deleted, err
+}
+
+func (r *SQLRepository) StoreAccountDeletion(context context.Context, email string, deletion model.AccountDeletion) (err error) {
+	content, err := json.Marshal(deletion)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO account_deletions (email, content) VALUES (?, ?)
+		ON CONFLICT (email) DO UPDATE SET content = excluded.content`), email, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetAccountDeletion(context context.Context, email string) (deletion *model.AccountDeletion, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM account_deletions WHERE email = ?"), email).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoAccountDeletion
+	} else if err != nil {
+		return nil, err
+	}
+
+	deletion = new(model.AccountDeletion)
+	if err = json.Unmarshal([]byte(content), deletion); err != nil {
+		return nil, err
+	}
+
+	return deletion, nil
+}
+
+func (r *SQLRepository) GetGlycemicEpisodes(context context.Context, email string, scanQuery ScoreScanQuery) (episodes []model.GlycemicEpisode, err error) {
+	query := "SELECT content FROM glycemic_episodes WHERE email = ?"
+	args := []interface{}{email}
+	if scanQuery.From != nil {
+		query = query + " AND start_time >= ?"
+		args = append(args, scanQuery.From.Unix())
+	}
+	if scanQuery.To != nil {
+		query = query + " AND start_time <= ?"
+		args = append(args, scanQuery.To.Unix())
+	}
+	query = query + " ORDER BY start_time DESC"
+	if scanQuery.Limit != nil {
+		query = query + " LIMIT ?"
+		args = append(args, *scanQuery.Limit)
+	}
+
+	rows, err := r.db.QueryContext(context, r.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	episodes = make([]model.GlycemicEpisode, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var episode model.GlycemicEpisode
+		if err = json.Unmarshal([]byte(content), &episode); err != nil {
+			return nil, err
+		}
+		episodes = append(episodes, episode)
+	}
+
+	return episodes, rows.Err()
+}
+
+func (r *SQLRepository) ReplaceGlycemicEpisodes(context context.Context, email string, lowerBound time.Time, upperBound time.Time, episodes []model.GlycemicEpisode) (err error) {
+	return r.inTransaction(context, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(context, r.rebind("DELETE FROM glycemic_episodes WHERE email = ? AND start_time >= ? AND start_time <= ?"),
+			email, lowerBound.Unix(), upperBound.Unix())
+		if err != nil {
+			return err
+		}
+
+		for _, episode := range episodes {
+			content, err := json.Marshal(episode)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(context, r.rebind(`INSERT INTO glycemic_episodes (email, type, start_time, content) VALUES (?, ?, ?, ?)
+				ON CONFLICT (email, type, start_time) DO UPDATE SET content = excluded.content`),
+				email, episode.Type, episode.Start.Unix(), string(content))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *SQLRepository) FindCohortMembers(context context.Context) (members []model.GlukitUser, err error) {
+	rows, err := r.db.QueryContext(context, "SELECT profile FROM glukit_users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// The opt-in is only part of the profile so users are filtered as they're read
+	members = make([]model.GlukitUser, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var user model.GlukitUser
+		if err = json.Unmarshal([]byte(content), &user); err != nil {
+			return nil, err
+		}
+
+		if user.CohortOptIn {
+			members = append(members, user)
+		}
+	}
+
+	return members, rows.Err()
+}
+
+func (r *SQLRepository) StoreCohortAggregation(context context.Context, aggregation model.CohortAggregation) (err error) {
+	content, err := json.Marshal(aggregation)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO cohort_aggregations (id, content) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET content = excluded.content`), COHORT_AGGREGATION_KEY, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetCohortAggregation(context context.Context) (aggregation *model.CohortAggregation, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM cohort_aggregations WHERE id = ?"), COHORT_AGGREGATION_KEY).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoCohortAggregation
+	} else if err != nil {
+		return nil, err
+	}
+
+	aggregation = new(model.CohortAggregation)
+	if err = json.Unmarshal([]byte(content), aggregation); err != nil {
+		return nil, err
+	}
+
+	return aggregation, nil
+}
+
+func (r *SQLRepository) StoreSharingGrant(context context.Context, grant model.SharingGrant) (err error) {
+	content, err := json.Marshal(grant)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO sharing_grants (email, viewer_email, content) VALUES (?, ?, ?)
+		ON CONFLICT (email, viewer_email) DO UPDATE SET content = excluded.content`), grant.OwnerEmail, grant.ViewerEmail, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) DeleteSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (err error) {
+	result, err := r.db.ExecContext(context, r.rebind("DELETE FROM sharing_grants WHERE email = ? AND viewer_email = ?"), ownerEmail, viewerEmail)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrNoSharingGrant
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) GetSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (grant *model.SharingGrant, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM sharing_grants WHERE email = ? AND viewer_email = ?"), ownerEmail,
+		viewerEmail).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSharingGrant
+	} else if err != nil {
+		return nil, err
+	}
+
+	grant = new(model.SharingGrant)
+	if err = json.Unmarshal([]byte(content), grant); err != nil {
+		return nil, err
+	}
+
+	return grant, nil
+}
+
+func (r *SQLRepository) GetSharingGrantsByOwner(context context.Context, ownerEmail string) (grants []model.SharingGrant, err error) {
+	return r.getSharingGrants(context, "SELECT content FROM sharing_grants WHERE email = ? ORDER BY viewer_email", ownerEmail)
+}
+
+func (r *SQLRepository) GetSharingGrantsByViewer(context context.Context, viewerEmail string) (grants []model.SharingGrant, err error) {
+	return r.getSharingGrants(context, "SELECT content FROM sharing_grants WHERE viewer_email = ? ORDER BY email", viewerEmail)
+}
+
+func (r *SQLRepository) getSharingGrants(context context.Context, query string, email string) (grants []model.SharingGrant, err error) {
+	rows, err := r.db.QueryContext(context, r.rebind(query), email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants = make([]model.SharingGrant, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var grant model.SharingGrant
+		if err = json.Unmarshal([]byte(content), &grant); err != nil {
+			return nil, err
+		}
+
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
+
+func (r *SQLRepository) LogViewerAccess(context context.Context, ownerEmail string, access model.ViewerAccess) (err error) {
+	content, err := json.Marshal(access)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO viewer_accesses (email, access_time, viewer_email, content) VALUES (?, ?, ?, ?)
+		ON CONFLICT (email, access_time, viewer_email) DO UPDATE SET content = excluded.content`), ownerEmail, access.Time.UnixNano(),
+		access.ViewerEmail, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetViewerAccesses(context context.Context, ownerEmail string, limit int) (accesses []model.ViewerAccess, err error) {
+	rows, err := r.db.QueryContext(context, r.rebind("SELECT content FROM viewer_accesses WHERE email = ? ORDER BY access_time DESC LIMIT ?"),
+		ownerEmail, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accesses = make([]model.ViewerAccess, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var access model.ViewerAccess
+		if err = json.Unmarshal([]byte(content), &access); err != nil {
+			return nil, err
+		}
+
+		accesses = append(accesses, access)
+	}
+
+	return accesses, rows.Err()
+}
+
+func (r *SQLRepository) StoreClinic(context context.Context, clinic model.Clinic) (err error) {
+	content, err := json.Marshal(clinic)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO clinics (id, content) VALUES (?, ?)
+		ON CONFLICT (id) DO UPDATE SET content = excluded.content`), clinic.Id, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetClinic(context context.Context, clinicId string) (clinic *model.Clinic, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM clinics WHERE id = ?"), clinicId).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchClinic
+	} else if err != nil {
+		return nil, err
+	}
+
+	clinic = new(model.Clinic)
+	if err = json.Unmarshal([]byte(content), clinic); err != nil {
+		return nil, err
+	}
+
+	return clinic, nil
+}
+
+// GetClinicsByPractitioner scans all clinics, the practitioners being only part of their content. There are few enough clinics for this
+// not to matter.
+func (r *SQLRepository) GetClinicsByPractitioner(context context.Context, practitionerEmail string) (clinics []model.Clinic, err error) {
+	rows, err := r.db.QueryContext(context, "SELECT content FROM clinics ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clinics = make([]model.Clinic, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var clinic model.Clinic
+		if err = json.Unmarshal([]byte(content), &clinic); err != nil {
+			return nil, err
+		}
+
+		if clinic.HasPractitioner(practitionerEmail) {
+			clinics = append(clinics, clinic)
+		}
+	}
+
+	return clinics, rows.Err()
+}
+
+func (r *SQLRepository) StoreClinicInvite(context context.Context, invite model.ClinicInvite) (err error) {
+	content, err := json.Marshal(invite)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO clinic_invites (code, redeemed_by, content) VALUES (?, ?, ?)
+		ON CONFLICT (code) DO UPDATE SET redeemed_by = excluded.redeemed_by, content = excluded.content`), invite.Code,
+		sql.NullString{String: invite.RedeemedBy, Valid: len(invite.RedeemedBy) > 0}, string(content))
+
+	return err
+}
+
+func (r *SQLRepository) GetClinicInvite(context context.Context, code string) (invite *model.ClinicInvite, err error) {
+	var content string
+	err = r.db.QueryRowContext(context, r.rebind("SELECT content FROM clinic_invites WHERE code = ?"), code).Scan(&content)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchClinicInvite
+	} else if err != nil {
+		return nil, err
+	}
+
+	invite = new(model.ClinicInvite)
+	if err = json.Unmarshal([]byte(content), invite); err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// RedeemClinicInvite marks the invite as redeemed with an update conditional on it not being redeemed yet, so that only one of
+// concurrent redemptions of the same code updates a row
+func (r *SQLRepository) RedeemClinicInvite(context context.Context, code string, patientEmail string, now time.Time) (invite *model.ClinicInvite, err error) {
+	invite, err = r.GetClinicInvite(context, code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !invite.IsRedeemable(now) {
+		return nil, ErrClinicInviteNotRedeemable
+	}
+
+	invite.RedeemedBy = patientEmail
+	invite.RedeemedOn = now
+	content, err := json.Marshal(invite)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.db.ExecContext(context, r.rebind("UPDATE clinic_invites SET redeemed_by = ?, content = ? WHERE code = ? AND redeemed_by IS NULL"),
+		patientEmail, string(content), code)
+	if err != nil {
+		return nil, err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if updated == 0 {
+		return nil, ErrClinicInviteNotRedeemable
+	}
+
+	return invite, nil
+}
+
+func (r *SQLRepository) StoreClinicEnrollment(context context.Context, enrollment model.ClinicEnrollment) (err error) {
+	content, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(context, r.rebind(`INSERT INTO clinic_enrollments (email, clinic_id, content) VALUES (?, ?, ?)
+		ON CONFLICT (email, clinic_id) DO UPDATE SET content = excluded.content`), enrollment.PatientEmail, enrollment.ClinicId,
+		string(content))
+
+	return err
+}
+
+func (r *SQLRepository) DeleteClinicEnrollment(context context.Context, patientEmail string, clinicId string) (err error) {
+	result, err := r.db.ExecContext(context, r.rebind("DELETE FROM clinic_enrollments WHERE email = ? AND clinic_id = ?"), patientEmail,
+		clinicId)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrNoClinicEnrollment
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) GetClinicEnrollmentsByPatient(context context.Context, patientEmail string) (enrollments []model.ClinicEnrollment, err error) {
+	return r.getClinicEnrollments(context, "SELECT content FROM clinic_enrollments WHERE email = ? ORDER BY clinic_id", patientEmail)
+}
+
+func (r *SQLRepository) GetClinicEnrollmentsByClinic(context context.Context, clinicId string) (enrollments []model.ClinicEnrollment, err error) {
+	return r.getClinicEnrollments(context, "SELECT content FROM clinic_enrollments WHERE clinic_id = ? ORDER BY email", clinicId)
+}
+
+func (r *SQLRepository) getClinicEnrollments(context context.Context, query string, key string) (enrollments []model.ClinicEnrollment, err error) {
+	rows, err := r.db.QueryContext(context, r.rebind(query), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	enrollments = make([]model.ClinicEnrollment, 0)
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+
+		var enrollment model.ClinicEnrollment
+		if err = json.Unmarshal([]byte(content), &enrollment); err != nil {
+			return nil, err
+		}
+
+		enrollments = append(enrollments, enrollment)
+	}
+
+	return enrollments, rows.Err()
+}
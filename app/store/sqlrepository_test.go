@@ -0,0 +1,582 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	. "github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+const SQL_TEST_USER = "sql@glukit.com"
+
+func setupSQLRepository(t *testing.T) (r *SQLRepository) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to an in-memory database gets its own database so we need to stick to a single one
+	db.SetMaxOpenConns(1)
+
+	r, err = NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := model.GlukitUser{Email: SQL_TEST_USER, DateOfBirth: time.Now(), DiabetesType: "T1", LastUpdated: util.GLUKIT_EPOCH_TIME,
+		MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, BestScore: model.UNDEFINED_SCORE, MostRecentScore: model.UNDEFINED_SCORE,
+		AccountCreated: time.Now(), MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE}
+	if err := r.StoreUserProfile(context.Background(), time.Now(), user); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func makeReads(start time.Time, count int) (reads []apimodel.GlucoseRead) {
+	reads = make([]apimodel.GlucoseRead, count)
+	for i := 0; i < count; i++ {
+		readTime := start.Add(time.Duration(i) * time.Hour)
+		reads[i] = apimodel.GlucoseRead{apimodel.Time{apimodel.GetTimeMillis(readTime), "America/Los_Angeles"}, apimodel.MG_PER_DL, float32(i + 80)}
+	}
+
+	return reads
+}
+
+func TestSQLGetMissingUserProfile(t *testing.T) {
+	r := setupSQLRepository(t)
+
+	if _, err := r.GetUserProfile(context.Background(), "missing@glukit.com"); err != ErrNoSuchUser {
+		t.Errorf("Expected error [%v] but got [%v]", ErrNoSuchUser, err)
+	}
+}
+
+func TestSQLUserDataWithoutReads(t *testing.T) {
+	r := setupSQLRepository(t)
+
+	if _, _, err := r.GetUserData(context.Background(), SQL_TEST_USER); err != ErrNoImportedDataFound {
+		t.Errorf("Expected error [%v] but got [%v]", ErrNoImportedDataFound, err)
+	}
+}
+
+func TestSQLStoreAndGetGlucoseReads(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	ct, _ := time.Parse("02/01/2006 15:04", "18/04/2014 00:00")
+	w := NewRepositoryGlucoseReadBatchWriter(c, r, SQL_TEST_USER)
+	if _, err := w.WriteGlucoseReadBatch(makeReads(ct, 24)); err != nil {
+		t.Fatal(err)
+	}
+	// Overlapping reads of the same day should be reconciled with the ones already stored
+	if _, err := w.WriteGlucoseReadBatch(makeReads(ct.Add(time.Duration(12)*time.Hour), 12)); err != nil {
+		t.Fatal(err)
+	}
+
+	reads, err := r.GetGlucoseReads(c, SQL_TEST_USER, ct, ct.Add(time.Duration(23)*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reads) != 24 {
+		t.Errorf("TestSQLStoreAndGetGlucoseReads failed: got a read count of [%d] but expected [%d]", len(reads), 24)
+	}
+
+	reads, err = r.GetGlucoseReads(c, SQL_TEST_USER, ct.Add(time.Duration(6)*time.Hour), ct.Add(time.Duration(9)*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reads) != 4 {
+		t.Errorf("TestSQLStoreAndGetGlucoseReads failed: got a read count of [%d] but expected [%d]", len(reads), 4)
+	}
+
+	_, upperBound, err := r.GetUserData(c, SQL_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedUpperBound := ct.Add(time.Duration(23) * time.Hour)
+	if !upperBound.Equal(expectedUpperBound) {
+		t.Errorf("TestSQLStoreAndGetGlucoseReads failed: got an upper bound of [%s] but expected [%s]", upperBound, expectedUpperBound)
+	}
+}
+
+func TestSQLStoreAndGetGlukitScores(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	ct, _ := time.Parse("02/01/2006 15:04", "18/04/2014 00:00")
+	scores := make([]model.GlukitScore, 10)
+	for i := range scores {
+		upperBound := ct.Add(time.Duration(i*24) * time.Hour)
+		scores[i] = model.GlukitScore{Value: int64(i), LowerBound: upperBound.Add(time.Duration(-24) * time.Hour), UpperBound: upperBound, CalculatedOn: time.Now(), ScoringVersion: 1}
+	}
+
+	if err := r.StoreGlukitScoreBatch(c, SQL_TEST_USER, scores); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := 3
+	stored, err := r.GetGlukitScores(c, SQL_TEST_USER, ScoreScanQuery{Limit: &limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != limit {
+		t.Fatalf("TestSQLStoreAndGetGlukitScores failed: got a score count of [%d] but expected [%d]", len(stored), limit)
+	}
+
+	if stored[0].Value != 9 {
+		t.Errorf("TestSQLStoreAndGetGlukitScores failed: got a most recent score of [%d] but expected [%d]", stored[0].Value, 9)
+	}
+}
+
+func TestSQLStoreGlukitScoresOfSeveralVersions(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	upperBound := time.Date(2014, time.April, 18, 0, 0, 0, 0, time.UTC)
+	scores := []model.GlukitScore{
+		model.GlukitScore{Value: 100, LowerBound: upperBound.AddDate(0, 0, -7), UpperBound: upperBound, ScoringVersion: 1},
+		model.GlukitScore{Value: 200, LowerBound: upperBound.AddDate(0, 0, -7), UpperBound: upperBound, ScoringVersion: 2},
+	}
+
+	if err := r.StoreGlukitScoreBatch(c, SQL_TEST_USER, scores); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range scores {
+		version := expected.ScoringVersion
+		stored, err := r.GetGlukitScores(c, SQL_TEST_USER, ScoreScanQuery{Version: &version})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(stored) != 1 || stored[0].Value != expected.Value {
+			t.Errorf("TestSQLStoreGlukitScoresOfSeveralVersions failed: got [%v] for version [%d] but expected a score of [%d]", stored,
+				version, expected.Value)
+		}
+	}
+
+	all, err := r.GetGlukitScores(c, SQL_TEST_USER, ScoreScanQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all) != len(scores) {
+		t.Errorf("TestSQLStoreGlukitScoresOfSeveralVersions failed: got [%d] scores of all versions but expected [%d]", len(all), len(scores))
+	}
+}
+
+func TestSQLStoreAndGetLabA1Cs(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	first := time.Date(2014, time.April, 18, 9, 0, 0, 0, time.UTC)
+	for _, labA1C := range []model.LabA1C{
+		model.LabA1C{Value: 6.8, Time: first},
+		model.LabA1C{Value: 6.4, Time: first.AddDate(0, 3, 0)},
+		// Corrects the first result
+		model.LabA1C{Value: 6.9, Time: first},
+	} {
+		if err := r.StoreLabA1C(c, SQL_TEST_USER, labA1C); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	labA1Cs, err := r.GetLabA1Cs(c, SQL_TEST_USER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(labA1Cs) != 2 || labA1Cs[0].Value != 6.4 || labA1Cs[1].Value != 6.9 {
+		t.Errorf("TestSQLStoreAndGetLabA1Cs failed: got [%v] but expected the results [6.4, 6.9]", labA1Cs)
+	}
+}
+
+func TestSQLSharingGrants(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	viewer := "parent@glukit.com"
+	for _, grant := range []model.SharingGrant{
+		model.SharingGrant{OwnerEmail: SQL_TEST_USER, ViewerEmail: viewer, Scopes: []string{model.SHARING_SCOPE_LIVE_DATA}},
+		model.SharingGrant{OwnerEmail: "sibling@glukit.com", ViewerEmail: viewer, Scopes: []string{model.SHARING_SCOPE_SCORES}},
+		// Replaces the first grant
+		model.SharingGrant{OwnerEmail: SQL_TEST_USER, ViewerEmail: viewer, Scopes: []string{model.SHARING_SCOPE_REPORTS}},
+	} {
+		if err := r.StoreSharingGrant(c, grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grant, err := r.GetSharingGrant(c, SQL_TEST_USER, viewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if grant.HasScope(model.SHARING_SCOPE_LIVE_DATA) || !grant.HasScope(model.SHARING_SCOPE_REPORTS) {
+		t.Errorf("TestSQLSharingGrants failed: got scopes [%v] but expected [%s]", grant.Scopes, model.SHARING_SCOPE_REPORTS)
+	}
+
+	if grants, err := r.GetSharingGrantsByOwner(c, SQL_TEST_USER); err != nil {
+		t.Fatal(err)
+	} else if len(grants) != 1 {
+		t.Errorf("TestSQLSharingGrants failed: got [%d] grants of the owner but expected [1]", len(grants))
+	}
+
+	if grants, err := r.GetSharingGrantsByViewer(c, viewer); err != nil {
+		t.Fatal(err)
+	} else if len(grants) != 2 {
+		t.Errorf("TestSQLSharingGrants failed: got [%d] grants to the viewer but expected [2]", len(grants))
+	}
+
+	if err := r.DeleteSharingGrant(c, SQL_TEST_USER, viewer); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.GetSharingGrant(c, SQL_TEST_USER, viewer); err != ErrNoSharingGrant {
+		t.Errorf("TestSQLSharingGrants failed: got [%v] but expected [%v] after revocation", err, ErrNoSharingGrant)
+	}
+
+	if err := r.DeleteSharingGrant(c, SQL_TEST_USER, viewer); err != ErrNoSharingGrant {
+		t.Errorf("TestSQLSharingGrants failed: got [%v] but expected [%v] revoking twice", err, ErrNoSharingGrant)
+	}
+}
+
+func TestSQLLogAndGetViewerAccesses(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	first := time.Date(2014, time.April, 18, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		access := model.ViewerAccess{ViewerEmail: "parent@glukit.com", Scope: model.SHARING_SCOPE_LIVE_DATA, Path: "/data",
+			Time: first.Add(time.Duration(i) * time.Minute)}
+		if err := r.LogViewerAccess(c, SQL_TEST_USER, access); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accesses, err := r.GetViewerAccesses(c, SQL_TEST_USER, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 2 || !accesses[0].Time.Equal(first.Add(2*time.Minute)) || !accesses[1].Time.Equal(first.Add(time.Minute)) {
+		t.Errorf("TestSQLLogAndGetViewerAccesses failed: got [%v] but expected the two most recent accesses, most recent first", accesses)
+	}
+}
+
+func TestSQLFindSteadySailorCandidates(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	for i, user := range []model.GlukitUser{
+		model.GlukitUser{Email: "private@glukit.com", DiabetesType: model.DIABETES_TYPE_1, MostRecentScore: model.GlukitScore{Value: 1}},
+		model.GlukitUser{Email: "internal@glukit.com", DiabetesType: model.DIABETES_TYPE_1, Internal: true},
+		model.GlukitUser{Email: "t2@glukit.com", DiabetesType: model.DIABETES_TYPE_2, Sailing: model.SailingProfile{OptIn: true}},
+		model.GlukitUser{Email: "worst@glukit.com", DiabetesType: model.DIABETES_TYPE_1, Sailing: model.SailingProfile{OptIn: true}},
+		model.GlukitUser{Email: "best@glukit.com", DiabetesType: model.DIABETES_TYPE_1, Sailing: model.SailingProfile{OptIn: true}},
+	} {
+		user.MostRecentScore.Value = user.MostRecentScore.Value + int64(10-i)
+		if err := r.StoreUserProfile(c, time.Now(), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	candidates, err := r.FindSteadySailorCandidates(c, model.DIABETES_TYPE_1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(candidates) != 2 || candidates[0].Email != "best@glukit.com" || candidates[1].Email != "internal@glukit.com" {
+		t.Errorf("TestSQLFindSteadySailorCandidates failed: got [%v] but expected [best@glukit.com, internal@glukit.com]", candidates)
+	}
+}
+
+func TestSQLApiSecrets(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	if _, err := r.FindUserByApiSecret(c, "unknown"); err != ErrNoSuchUser {
+		t.Errorf("TestSQLApiSecrets failed: got error [%v] but expected [%v]", err, ErrNoSuchUser)
+	}
+
+	if err := r.StoreApiSecret(c, SQL_TEST_USER, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreApiSecret(c, SQL_TEST_USER, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	if email, err := r.FindUserByApiSecret(c, "second"); err != nil || email != SQL_TEST_USER {
+		t.Errorf("TestSQLApiSecrets failed: got user [%s] and error [%v] but expected [%s]", email, err, SQL_TEST_USER)
+	}
+
+	if _, err := r.FindUserByApiSecret(c, "first"); err != ErrNoSuchUser {
+		t.Errorf("TestSQLApiSecrets failed: got error [%v] for a replaced secret but expected [%v]", err, ErrNoSuchUser)
+	}
+}
+
+func TestSQLDataExport(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	if _, err := r.GetFirstDayOfData(c, SQL_TEST_USER); err != ErrNoImportedDataFound {
+		t.Errorf("TestSQLDataExport failed: got error [%v] but expected [%v]", err, ErrNoImportedDataFound)
+	}
+
+	if _, err := r.GetDataExport(c, SQL_TEST_USER); err != ErrNoDataExport {
+		t.Errorf("TestSQLDataExport failed: got error [%v] but expected [%v]", err, ErrNoDataExport)
+	}
+
+	start := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+	if err := r.StoreDaysOfReads(c, SQL_TEST_USER, []apimodel.DayOfGlucoseReads{apimodel.NewDayOfGlucoseReads(makeReads(start, 4))}); err != nil {
+		t.Fatal(err)
+	}
+
+	if firstDay, err := r.GetFirstDayOfData(c, SQL_TEST_USER); err != nil || !firstDay.Equal(start) {
+		t.Errorf("TestSQLDataExport failed: got first day [%s] and error [%v] but expected [%s]", firstDay, err, start)
+	}
+
+	if err := r.StoreDataExport(c, SQL_TEST_USER, model.DataExport{Status: model.DATA_EXPORT_STATUS_DONE, Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if dataExport, err := r.GetDataExport(c, SQL_TEST_USER); err != nil || dataExport.Status != model.DATA_EXPORT_STATUS_DONE {
+		t.Errorf("TestSQLDataExport failed: got export [%v] and error [%v] but expected status [%s]", dataExport, err, model.DATA_EXPORT_STATUS_DONE)
+	}
+
+	archive := []byte{0x50, 0x4b, 0x00}
+	if err := r.StoreDataExportArchive(c, SQL_TEST_USER, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := r.GetDataExportArchive(c, SQL_TEST_USER); err != nil || string(stored) != string(archive) {
+		t.Errorf("TestSQLDataExport failed: got archive [%v] and error [%v] but expected [%v]", stored, err, archive)
+	}
+}
+
+func storeDeletionTestData(t *testing.T, r *SQLRepository) {
+	c := context.Background()
+	start := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+	days := make([]apimodel.DayOfGlucoseReads, 0)
+	for i := 0; i < 3; i++ {
+		days = append(days, apimodel.NewDayOfGlucoseReads(makeReads(start.Add(time.Duration(i*24)*time.Hour), 4)))
+	}
+
+	if err := r.StoreDaysOfReads(c, SQL_TEST_USER, days); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreGlukitScoreBatch(c, SQL_TEST_USER, []model.GlukitScore{model.GlukitScore{Value: 10, UpperBound: start}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.StoreApiSecret(c, SQL_TEST_USER, "secret"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLDeleteUserData(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+	storeDeletionTestData(t, r)
+
+	// The three days of reads and the score are deleted in two chunks
+	for i, expected := range []int{2, 2} {
+		if deleted, err := r.DeleteUserData(c, SQL_TEST_USER, true, 2); err != nil || deleted != expected {
+			t.Errorf("TestSQLDeleteUserData failed: got [%d] deleted and error [%v] for chunk [%d] but expected [%d]", deleted, err, i, expected)
+		}
+	}
+
+	if deleted, err := r.DeleteUserData(c, SQL_TEST_USER, true, 2); err != nil || deleted != 0 {
+		t.Errorf("TestSQLDeleteUserData failed: got [%d] deleted and error [%v] but expected nothing left to delete", deleted, err)
+	}
+
+	if _, err := r.GetFirstDayOfData(c, SQL_TEST_USER); err != ErrNoImportedDataFound {
+		t.Errorf("TestSQLDeleteUserData failed: got error [%v] but expected [%v]", err, ErrNoImportedDataFound)
+	}
+
+	if _, err := r.GetUserProfile(c, SQL_TEST_USER); err != nil {
+		t.Errorf("TestSQLDeleteUserData failed: got error [%v] but expected the profile to be kept", err)
+	}
+
+	if email, err := r.FindUserByApiSecret(c, "secret"); err != nil || email != SQL_TEST_USER {
+		t.Errorf("TestSQLDeleteUserData failed: got user [%s] and error [%v] but expected the api secret to be kept", email, err)
+	}
+}
+
+func TestSQLDeleteUserDataAsViewer(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+	owner := "owner@glukit.com"
+	now := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	if err := r.StoreSharingGrant(c, model.SharingGrant{OwnerEmail: owner, ViewerEmail: SQL_TEST_USER, Scopes: []string{model.SHARING_SCOPE_REPORTS},
+		GrantedOn: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, viewer := range []string{SQL_TEST_USER, "other@glukit.com"} {
+		if err := r.LogViewerAccess(c, owner, model.ViewerAccess{ViewerEmail: viewer, Scope: model.SHARING_SCOPE_REPORTS, Path: "/report",
+			Time: now.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if deleted, err := r.DeleteUserData(c, SQL_TEST_USER, true, 100); err != nil || deleted != 2 {
+		t.Errorf("TestSQLDeleteUserDataAsViewer failed: got [%d] deleted and error [%v] but expected [%d]", deleted, err, 2)
+	}
+
+	if grants, err := r.GetSharingGrantsByViewer(c, SQL_TEST_USER); err != nil || len(grants) != 0 {
+		t.Errorf("TestSQLDeleteUserDataAsViewer failed: got grants [%v] and error [%v] but expected none", grants, err)
+	}
+
+	if accesses, err := r.GetViewerAccesses(c, owner, 10); err != nil || len(accesses) != 1 || accesses[0].ViewerEmail != "other@glukit.com" {
+		t.Errorf("TestSQLDeleteUserDataAsViewer failed: got accesses [%v] and error [%v] but expected only the one of [other@glukit.com]",
+			accesses, err)
+	}
+}
+
+func TestSQLDeleteAccount(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+	storeDeletionTestData(t, r)
+
+	if deleted, err := r.DeleteUserData(c, SQL_TEST_USER, false, 100); err != nil || deleted != 6 {
+		t.Errorf("TestSQLDeleteAccount failed: got [%d] deleted and error [%v] but expected [%d]", deleted, err, 6)
+	}
+
+	if _, err := r.GetUserProfile(c, SQL_TEST_USER); err != ErrNoSuchUser {
+		t.Errorf("TestSQLDeleteAccount failed: got error [%v] but expected [%v]", err, ErrNoSuchUser)
+	}
+
+	if _, err := r.FindUserByApiSecret(c, "secret"); err != ErrNoSuchUser {
+		t.Errorf("TestSQLDeleteAccount failed: got error [%v] but expected [%v]", err, ErrNoSuchUser)
+	}
+
+	if err := r.StoreAccountDeletion(c, SQL_TEST_USER, model.AccountDeletion{Status: model.ACCOUNT_DELETION_STATUS_DONE, Deleted: 6}); err != nil {
+		t.Fatal(err)
+	}
+
+	if deletion, err := r.GetAccountDeletion(c, SQL_TEST_USER); err != nil || deletion.Deleted != 6 {
+		t.Errorf("TestSQLDeleteAccount failed: got deletion [%v] and error [%v] but expected [%d] deleted", deletion, err, 6)
+	}
+}
+
+func TestSQLReplaceGlycemicEpisodes(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	start := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+	episodes := make([]model.GlycemicEpisode, 4)
+	for i := range episodes {
+		episodes[i] = model.GlycemicEpisode{Type: model.EPISODE_TYPE_LOW, Level: model.EPISODE_LEVEL_1, Start: start.Add(time.Duration(i) * time.Hour),
+			End: start.Add(time.Duration(i)*time.Hour + 30*time.Minute), Recovered: true}
+	}
+
+	if err := r.ReplaceGlycemicEpisodes(c, SQL_TEST_USER, start, start.AddDate(0, 0, 1), episodes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the two last episodes by a single high
+	high := model.GlycemicEpisode{Type: model.EPISODE_TYPE_HIGH, Level: model.EPISODE_LEVEL_2, Start: start.Add(150 * time.Minute),
+		End: start.Add(5 * time.Hour)}
+	if err := r.ReplaceGlycemicEpisodes(c, SQL_TEST_USER, start.Add(2*time.Hour), start.AddDate(0, 0, 1), []model.GlycemicEpisode{high}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := r.GetGlycemicEpisodes(c, SQL_TEST_USER, ScoreScanQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 3 || stored[0].Type != model.EPISODE_TYPE_HIGH || !stored[0].Start.Equal(high.Start) || !stored[2].Start.Equal(start) {
+		t.Errorf("TestSQLReplaceGlycemicEpisodes failed: got [%v] but expected the high followed by the two first lows", stored)
+	}
+
+	limit := 1
+	to := start.Add(2 * time.Hour)
+	if latest, err := r.GetGlycemicEpisodes(c, SQL_TEST_USER, ScoreScanQuery{Limit: &limit, To: &to}); err != nil || len(latest) != 1 ||
+		!latest[0].Start.Equal(episodes[1].Start) {
+		t.Errorf("TestSQLReplaceGlycemicEpisodes failed: got [%v] and error [%v] but expected the episode starting at [%s]", latest, err, episodes[1].Start)
+	}
+}
+
+func TestSQLStoreAndGetInsulinRatios(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	upperBound := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+	ratios := []model.InsulinRatios{
+		model.InsulinRatios{LowerBound: upperBound.AddDate(0, 0, -37), UpperBound: upperBound.AddDate(0, 0, -7), CalculationVersion: 1},
+		model.InsulinRatios{LowerBound: upperBound.AddDate(0, 0, -30), UpperBound: upperBound, CalculationVersion: 1,
+			Estimates: []model.InsulinRatioEstimate{model.InsulinRatioEstimate{TimeOfDay: model.TIME_OF_DAY_ALL,
+				CarbRatio: model.RatioEstimate{Value: 10, ConfidenceLow: 8, ConfidenceHigh: 12, SampleCount: 5}}},
+			Samples: []model.InsulinRatioSample{model.InsulinRatioSample{Kind: model.INSULIN_RATIO_SAMPLE_MEAL, Carbohydrates: 50, Units: 5, Ratio: 10}}},
+	}
+
+	if err := r.StoreInsulinRatios(c, SQL_TEST_USER, ratios); err != nil {
+		t.Fatal(err)
+	}
+
+	limit := 1
+	stored, err := r.GetInsulinRatios(c, SQL_TEST_USER, ScoreScanQuery{Limit: &limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 || !stored[0].UpperBound.Equal(upperBound) || len(stored[0].Estimates) != 1 || stored[0].Estimates[0].CarbRatio.Value != 10 ||
+		len(stored[0].Samples) != 1 {
+		t.Errorf("TestSQLStoreAndGetInsulinRatios failed: got [%v] but expected the most recent ratios [%v]", stored, ratios[1])
+	}
+}
+
+func TestSQLRedeemClinicInviteOnce(t *testing.T) {
+	r := setupSQLRepository(t)
+	c := context.Background()
+
+	now := time.Date(2015, 3, 10, 0, 0, 0, 0, time.UTC)
+	invite := model.ClinicInvite{Code: "ABCDEFGH", ClinicId: "clinic", CreatedBy: "doctor@glukit.com", CreatedOn: now, ExpiresOn: now.AddDate(0, 0, 7)}
+	if err := r.StoreClinicInvite(c, invite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both redemptions read the invite before either is redeemed, as concurrent requests would
+	if read, err := r.GetClinicInvite(c, invite.Code); err != nil || !read.IsRedeemable(now) {
+		t.Fatalf("TestSQLRedeemClinicInviteOnce failed: got [%v] and error [%v] but expected a redeemable invite", read, err)
+	}
+
+	redeemed, err := r.RedeemClinicInvite(c, invite.Code, SQL_TEST_USER, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if redeemed.RedeemedBy != SQL_TEST_USER || !redeemed.RedeemedOn.Equal(now) {
+		t.Errorf("TestSQLRedeemClinicInviteOnce failed: got [%v] but expected it redeemed by [%s]", redeemed, SQL_TEST_USER)
+	}
+
+	if _, err = r.RedeemClinicInvite(c, invite.Code, "sibling@glukit.com", now); err != ErrClinicInviteNotRedeemable {
+		t.Errorf("TestSQLRedeemClinicInviteOnce failed: got [%v] redeeming twice but expected [%v]", err, ErrClinicInviteNotRedeemable)
+	}
+
+	// Storing a redeemed invite keeps its redemption
+	if err = r.StoreClinicInvite(c, *redeemed); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.RedeemClinicInvite(c, invite.Code, "sibling@glukit.com", now); err != ErrClinicInviteNotRedeemable {
+		t.Errorf("TestSQLRedeemClinicInviteOnce failed: got [%v] redeeming a stored redeemed invite but expected [%v]", err, ErrClinicInviteNotRedeemable)
+	}
+
+	if _, err = r.RedeemClinicInvite(c, "MISSING", SQL_TEST_USER, now); err != ErrNoSuchClinicInvite {
+		t.Errorf("TestSQLRedeemClinicInviteOnce failed: got [%v] for a missing invite but expected [%v]", err, ErrNoSuchClinicInvite)
+	}
+}
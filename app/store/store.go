@@ -4,22 +4,33 @@ package store
 import (
 	"github.com/alexandre-normand/glukit/app/apimodel"
 	"github.com/alexandre-normand/glukit/app/container"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
+	"fmt"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"math"
 	"sort"
+	"strconv"
 	"time"
 )
 
 const (
 	// Number of GlukitScores to batch in a single PutMulti
 	GLUKIT_SCORE_PUT_MULTI_SIZE = 10
+
+	// Size of the parts of data export archives, comfortably under the 1MB limit of datastore entities
+	DATA_EXPORT_ARCHIVE_CHUNK_SIZE = 900 * 1024
+
+	// Key of the cohort aggregation, there's only ever one
+	COHORT_AGGREGATION_KEY = "latest"
 )
 
+// The kinds of the days of data entities
+var DAY_OF_DATA_KINDS = []string{"DayOfReads", "DayOfCalibrationReads", "DayOfInjections", "DayOfMeals", "DayOfExercises"}
+
 // Error interface to distinguish between temporary errors from permanent ones
 type StoreError struct {
 	msg       string
@@ -34,8 +45,40 @@ type ScoreScanQuery struct {
 	Limit *int
 	From  *time.Time
 	To    *time.Time
+	// The scoring version of the GlukitScores and A1CEstimates to scan, all versions if not set. It's ignored for other series.
+	Version *int
+}
+
+// String describes the scan query for logging, with none for the parameters that aren't set
+func (scanQuery ScoreScanQuery) String() string {
+	limit, from, to, version := "none", "none", "none", "none"
+	if scanQuery.Limit != nil {
+		limit = strconv.Itoa(*scanQuery.Limit)
+	}
+	if scanQuery.From != nil {
+		from = scanQuery.From.String()
+	}
+	if scanQuery.To != nil {
+		to = scanQuery.To.String()
+	}
+	if scanQuery.Version != nil {
+		version = strconv.Itoa(*scanQuery.Version)
+	}
+
+	return fmt.Sprintf("limit [%s], from [%s], to [%s], version [%s]", limit, from, to, version)
 }
 
+const (
+	// The last scoring versions of GlukitScores and A1CEstimates stored before versions were part of their keys. They, and older
+	// versions, are still stored under their original keys so that existing scores don't need to be migrated. Later versions are
+	// stored side by side with them.
+	UNVERSIONED_GLUKIT_SCORE_VERSION = 1
+	UNVERSIONED_A1C_VERSION          = 3
+	// The datastore property of the scoring version. The tag of the ScoringVersion fields isn't well-formed so it's stored under
+	// the field name.
+	SCORING_VERSION_PROPERTY = "ScoringVersion"
+)
+
 var (
 	// ErrNoImportedDataFound is returned when the user doesn't have data imported yet.
 	ErrNoImportedDataFound = StoreError{"store: no imported data found", true}
@@ -148,7 +191,7 @@ func StoreDaysOfReads(context context.Context, userProfileKey *datastore.Key, da
 		userProfile.MostRecentRead = lastRead
 		_, err := StoreUserProfile(context, time.Now(), *userProfile)
 		if err != nil {
-			log.Criticalf(context, "Error storing updated user profile [%s] with most recent read value of %s: %v", userProfileKey, userProfile.MostRecentRead, err)
+			log.Criticalf(context, "Error storing updated user profile [%s] with most recent read value of %v: %v", userProfileKey, userProfile.MostRecentRead, err)
 			return nil, err
 		}
 	}
@@ -764,73 +807,37 @@ func GetUserData(context context.Context, email string) (userProfile *model.Gluk
 	}
 }
 
-// FindSteadySailor queries the datastore for others users of the same type of diabetes. It will then select the match that
-// has a top glukit score and return that user profile along with the upper boundary for its most recent day of reads.
-// The steps involved are:
-//    - Find the user profile of the recipient
-//    - Query the data store for profile data that matches (using the type of diabetes) in ascending order of score value
-//       * A first time for users that are NOT internal
-//       * A second time including internal users (if the first one returns no match)
-//    - Filter out the recipient profile that could be returned in the search
-//    - If match found, get the profile of the steady sailor
-func FindSteadySailor(context context.Context, recipientEmail string) (sailorProfile *model.GlukitUser, key *datastore.Key, upperBound time.Time, err error) {
-	key = GetUserKey(context, recipientEmail)
+// FindSteadySailorCandidates queries the datastore for the users of the given type of diabetes that opted in to be steady sailors
+// and, separately, for the internal users of that type. Each query returns at most limit users, in ascending order of score value,
+// so that the best candidates are found even when there are many users.
+func FindSteadySailorCandidates(context context.Context, diabetesType string, limit int) (candidates []model.GlukitUser, err error) {
+	log.Debugf(context, "Looking for steady sailor candidates with diabetes of type [%s]", diabetesType)
 
-	recipientProfile, err := GetUserProfile(context, key)
-	if err != nil {
-		return nil, nil, util.GLUKIT_EPOCH_TIME, err
+	queries := []*datastore.Query{
+		datastore.NewQuery("GlukitUser").Filter("diabetesType =", diabetesType).Filter("sailing.optIn =", true).
+			Order("mostRecentScore.value").Limit(limit),
+		datastore.NewQuery("GlukitUser").Filter("diabetesType =", diabetesType).Filter("internal =", true).
+			Order("mostRecentScore.value").Limit(limit),
 	}
 
-	log.Debugf(context, "Looking for other diabetes of type [%s]", recipientProfile.DiabetesType)
-
-	// Only get the top-sailor of the same type of diabetes. We might want to throw some randomization in there and pick one of the top 10
-	// using cursors or offsets. We need to check at least for two because the recipient user will always be returned by the query.
-	// It's more efficient to filter the recipient after the fact than before.
-	query := datastore.NewQuery("GlukitUser").
-		Filter("diabetesType =", recipientProfile.DiabetesType).
-		Order("mostRecentScore.value").Limit(5)
-
-	var steadySailors []model.GlukitUser
-	_, err = query.GetAll(context, &steadySailors)
-	if err != nil {
-		if unknownFields, ok := err.(*datastore.ErrFieldMismatch); ok {
-			log.Infof(context, "Ignoring unknown fields [%s]", unknownFields.Error())
-		} else {
-			return nil, nil, util.GLUKIT_EPOCH_TIME, err
+	candidates = make([]model.GlukitUser, 0)
+	for _, query := range queries {
+		var users []model.GlukitUser
+		_, err = query.GetAll(context, &users)
+		if err != nil {
+			if unknownFields, ok := err.(*datastore.ErrFieldMismatch); ok {
+				log.Infof(context, "Ignoring unknown fields [%s]", unknownFields.Error())
+			} else {
+				return nil, err
+			}
 		}
-	}
-
-	log.Debugf(context, "Found a few unfiltered matches [%v]", steadySailors)
-
-	// Stop when we find the first match.
 
-	// First, try for real users
-	for i := 0; sailorProfile == nil && i < len(steadySailors); i++ {
-		log.Debugf(context, "Loaded steady sailor with email [%s]...", steadySailors[i].Email)
-		if steadySailors[i].Email != recipientProfile.Email && !steadySailors[i].Internal {
-			sailorProfile = &steadySailors[i]
-		}
+		candidates = append(candidates, users...)
 	}
 
-	// Failing that, get an internal user
-	if sailorProfile == nil {
-		log.Debugf(context, "Could not find a real user match for recipient [%s], falling back to internal users...", recipientEmail)
-		for i := 0; sailorProfile == nil && i < len(steadySailors); i++ {
-			log.Debugf(context, "Loaded steady sailor with email [%s]...", steadySailors[i].Email)
-			if steadySailors[i].Email != recipientProfile.Email {
-				sailorProfile = &steadySailors[i]
-			}
-		}
-	}
+	log.Debugf(context, "Found [%d] steady sailor candidates", len(candidates))
 
-	if sailorProfile == nil {
-		log.Warningf(context, "No steady sailor match found for user [%s] with type of diabetes [%s]", recipientEmail, recipientProfile.DiabetesType)
-		return nil, nil, util.GLUKIT_EPOCH_TIME, ErrNoSteadySailorMatchFound
-	} else {
-		log.Infof(context, "Found a steady sailor match for user [%s]: healthy [%s]", recipientEmail, sailorProfile.Email)
-		upperBound = util.GetEndOfDayBoundaryBefore(sailorProfile.MostRecentRead.GetTime())
-		return sailorProfile, GetUserKey(context, sailorProfile.Email), upperBound, nil
-	}
+	return candidates, nil
 }
 
 // StoreGlukitScoreBatch stores a batch of GlukitScores. The array could be of any size. A large batch of GlukitScores
@@ -853,7 +860,8 @@ func storeGlukitScoreChunk(context context.Context, parentKey *datastore.Key, gl
 
 	elementKeys := make([]*datastore.Key, len(glukitScoreChunk))
 	for i := range glukitScoreChunk {
-		elementKeys[i] = datastore.NewKey(context, "GlukitScore", "", glukitScoreChunk[i].UpperBound.Unix(), parentKey)
+		elementKeys[i] = newScoreKey(context, "GlukitScore", UNVERSIONED_GLUKIT_SCORE_VERSION, glukitScoreChunk[i].ScoringVersion,
+			glukitScoreChunk[i].UpperBound, parentKey)
 	}
 
 	log.Infof(context, "Emitting a PutMulti with [%d] keys for all [%d] glukit scores of chunk", len(elementKeys), len(glukitScoreChunk))
@@ -866,13 +874,26 @@ func storeGlukitScoreChunk(context context.Context, parentKey *datastore.Key, gl
 	return elementKeys, nil
 }
 
+// newScoreKey returns the key of a GlukitScore or A1CEstimate. Scores of versions up to the unversioned one are keyed by their upper
+// bound, like they've always been, and scores of later versions by their version and upper bound.
+func newScoreKey(context context.Context, kind string, unversionedVersion int, version int, upperBound time.Time, parentKey *datastore.Key) *datastore.Key {
+	if version <= unversionedVersion {
+		return datastore.NewKey(context, kind, "", upperBound.Unix(), parentKey)
+	}
+
+	return datastore.NewKey(context, kind, fmt.Sprintf("v%d-%d", version, upperBound.Unix()), 0, parentKey)
+}
+
 // GetGlukitScores returns all GlukitScores for the given email address and matching the query parameters
 func GetGlukitScores(context context.Context, email string, scanQuery ScoreScanQuery) (scores []model.GlukitScore, err error) {
 	key := GetUserKey(context, email)
 
-	log.Infof(context, "Scanning for glukit scores with limit [%d], from [%s], to [%s]", *scanQuery.Limit, scanQuery.From, scanQuery.To)
+	log.Infof(context, "Scanning for glukit scores with %s", scanQuery)
 
 	query := datastore.NewQuery("GlukitScore").Ancestor(key)
+	if scanQuery.Version != nil {
+		query = query.Filter(SCORING_VERSION_PROPERTY+" =", *scanQuery.Version)
+	}
 	if scanQuery.From != nil {
 		query = query.Filter("upperBound >=", *scanQuery.From)
 	}
@@ -914,7 +935,7 @@ func storeA1CChunk(context context.Context, parentKey *datastore.Key, a1cChunk [
 
 	elementKeys := make([]*datastore.Key, len(a1cChunk))
 	for i := range a1cChunk {
-		elementKeys[i] = datastore.NewKey(context, "A1CEstimate", "", a1cChunk[i].UpperBound.Unix(), parentKey)
+		elementKeys[i] = newScoreKey(context, "A1CEstimate", UNVERSIONED_A1C_VERSION, a1cChunk[i].ScoringVersion, a1cChunk[i].UpperBound, parentKey)
 	}
 
 	log.Infof(context, "Emitting a PutMulti with [%d] keys for all [%d] a1cs of chunk", len(elementKeys), len(a1cChunk))
@@ -931,9 +952,12 @@ func storeA1CChunk(context context.Context, parentKey *datastore.Key, a1cChunk [
 func GetA1CEstimates(context context.Context, email string, scanQuery ScoreScanQuery) (scores []model.A1CEstimate, err error) {
 	key := GetUserKey(context, email)
 
-	log.Infof(context, "Scanning for a1c estimates scores with limit [%d], from [%s], to [%s]", *scanQuery.Limit, scanQuery.From, scanQuery.To)
+	log.Infof(context, "Scanning for a1c estimates scores with %s", scanQuery)
 
 	query := datastore.NewQuery("A1CEstimate").Ancestor(key)
+	if scanQuery.Version != nil {
+		query = query.Filter(SCORING_VERSION_PROPERTY+" =", *scanQuery.Version)
+	}
 	if scanQuery.From != nil {
 		query = query.Filter("upperBound >=", *scanQuery.From)
 	}
@@ -954,3 +978,582 @@ func GetA1CEstimates(context context.Context, email string, scanQuery ScoreScanQ
 	log.Infof(context, "Found [%d] a1c estimates.", len(scores))
 	return scores, nil
 }
+
+// StoreLabA1C stores a lab a1c result as a child of the GlukitUser, keyed by its time
+func StoreLabA1C(context context.Context, userEmail string, labA1C model.LabA1C) (err error) {
+	key := datastore.NewKey(context, "LabA1C", "", labA1C.Time.Unix(), GetUserKey(context, userEmail))
+
+	log.Infof(context, "Emitting a Put for lab a1c of user [%s] at [%s]", userEmail, labA1C.Time)
+	_, err = datastore.Put(context, key, &labA1C)
+
+	return err
+}
+
+// GetLabA1Cs returns all lab a1c results of a user, most recent first
+func GetLabA1Cs(context context.Context, email string) (labA1Cs []model.LabA1C, err error) {
+	query := datastore.NewQuery("LabA1C").Ancestor(GetUserKey(context, email)).Order("-time")
+	if _, err = query.GetAll(context, &labA1Cs); err != nil {
+		return nil, err
+	}
+
+	return labA1Cs, nil
+}
+
+// StoreInsulinRatios stores a batch of InsulinRatios as children of the GlukitUser, keyed by their upper bound
+func StoreInsulinRatios(context context.Context, userEmail string, ratios []model.InsulinRatios) (err error) {
+	parentKey := GetUserKey(context, userEmail)
+
+	elementKeys := make([]*datastore.Key, len(ratios))
+	for i := range ratios {
+		elementKeys[i] = datastore.NewKey(context, "InsulinRatios", "", ratios[i].UpperBound.Unix(), parentKey)
+	}
+
+	log.Infof(context, "Emitting a PutMulti with [%d] keys for insulin ratios of user [%s]", len(elementKeys), userEmail)
+	_, err = datastore.PutMulti(context, elementKeys, ratios)
+
+	return err
+}
+
+// GetInsulinRatios returns all InsulinRatios for the given email address and matching the query parameters
+func GetInsulinRatios(context context.Context, email string, scanQuery ScoreScanQuery) (ratios []model.InsulinRatios, err error) {
+	log.Infof(context, "Scanning for insulin ratios with %s", scanQuery)
+
+	query := datastore.NewQuery("InsulinRatios").Ancestor(GetUserKey(context, email))
+	if scanQuery.From != nil {
+		query = query.Filter("upperBound >=", *scanQuery.From)
+	}
+	if scanQuery.To != nil {
+		query = query.Filter("upperBound <=", *scanQuery.To)
+	}
+	if scanQuery.Limit != nil {
+		query = query.Limit(*scanQuery.Limit)
+	}
+	query = query.Order("-upperBound")
+
+	ratios = make([]model.InsulinRatios, 0)
+	if _, err = query.GetAll(context, &ratios); err != nil {
+		return nil, err
+	}
+
+	return ratios, nil
+}
+
+// StoreApiSecret stores the hash of a user's api secret. Since the secret is looked up by its hash, it's stored as a root entity keyed
+// by the hash and the user's previous secrets are deleted
+func StoreApiSecret(context context.Context, email string, secretHash string) (err error) {
+	previousKeys, err := datastore.NewQuery("ApiSecret").Filter("email =", email).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = datastore.DeleteMulti(context, previousKeys); err != nil {
+		return err
+	}
+
+	key := datastore.NewKey(context, "ApiSecret", secretHash, 0, nil)
+	log.Infof(context, "Emitting a Put for api secret of user [%s]", email)
+	_, err = datastore.Put(context, key, &model.ApiSecret{Email: email})
+
+	return err
+}
+
+// FindUserByApiSecret returns the email of the user with the given api secret hash
+func FindUserByApiSecret(context context.Context, secretHash string) (email string, err error) {
+	key := datastore.NewKey(context, "ApiSecret", secretHash, 0, nil)
+
+	apiSecret := new(model.ApiSecret)
+	if err = datastore.Get(context, key, apiSecret); err != nil {
+		return "", err
+	}
+
+	return apiSecret.Email, nil
+}
+
+// dayOfDataStart is the projection of the start time of any day of data
+type dayOfDataStart struct {
+	StartTime time.Time `datastore:"startTime"`
+}
+
+// dataExportArchiveChunk is a part of a data export archive. Archives are split in chunks to stay under the maximum
+// size of a datastore entity.
+type dataExportArchiveChunk struct {
+	Content []byte `datastore:"content,noindex"`
+}
+
+// GetFirstDayOfData returns the start time of the earliest day of data of any kind for a user
+func GetFirstDayOfData(context context.Context, email string) (startTime time.Time, err error) {
+	key := GetUserKey(context, email)
+
+	found := false
+	for _, kind := range DAY_OF_DATA_KINDS {
+		var starts []dayOfDataStart
+		query := datastore.NewQuery(kind).Ancestor(key).Project("startTime").Order("startTime").Limit(1)
+		if _, err = query.GetAll(context, &starts); err != nil {
+			return util.GLUKIT_EPOCH_TIME, err
+		}
+
+		if len(starts) > 0 && (!found || starts[0].StartTime.Before(startTime)) {
+			startTime = starts[0].StartTime
+			found = true
+		}
+	}
+
+	if !found {
+		return util.GLUKIT_EPOCH_TIME, ErrNoImportedDataFound
+	}
+
+	return startTime, nil
+}
+
+// getDataExportKey returns the key of the single DataExport of a user
+func getDataExportKey(context context.Context, email string) (key *datastore.Key) {
+	return datastore.NewKey(context, "DataExport", email, 0, GetUserKey(context, email))
+}
+
+// StoreDataExport stores the state of a user's data export
+func StoreDataExport(context context.Context, email string, dataExport model.DataExport) (err error) {
+	log.Infof(context, "Emitting a Put for data export of user [%s] with status [%s]", email, dataExport.Status)
+	_, err = datastore.Put(context, getDataExportKey(context, email), &dataExport)
+
+	return err
+}
+
+// GetDataExport returns the state of a user's data export
+func GetDataExport(context context.Context, email string) (dataExport *model.DataExport, err error) {
+	dataExport = new(model.DataExport)
+	if err = datastore.Get(context, getDataExportKey(context, email), dataExport); err != nil {
+		return nil, err
+	}
+
+	return dataExport, nil
+}
+
+// StoreDataExportArchive stores the archive of a user's data export as chunks of DATA_EXPORT_ARCHIVE_CHUNK_SIZE bytes, all children of
+// the DataExport key. The chunks of any previous archive are deleted first.
+func StoreDataExportArchive(context context.Context, email string, archive []byte) (err error) {
+	exportKey := getDataExportKey(context, email)
+	previousKeys, err := datastore.NewQuery("DataExportArchiveChunk").Ancestor(exportKey).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = datastore.DeleteMulti(context, previousKeys); err != nil {
+		return err
+	}
+
+	for i := 0; i*DATA_EXPORT_ARCHIVE_CHUNK_SIZE < len(archive); i++ {
+		end := (i + 1) * DATA_EXPORT_ARCHIVE_CHUNK_SIZE
+		if end > len(archive) {
+			end = len(archive)
+		}
+
+		key := datastore.NewKey(context, "DataExportArchiveChunk", "", int64(i+1), exportKey)
+		if _, err = datastore.Put(context, key, &dataExportArchiveChunk{Content: archive[i*DATA_EXPORT_ARCHIVE_CHUNK_SIZE : end]}); err != nil {
+			log.Criticalf(context, "Error storing chunk [%d] of data export archive for user [%s]: %v", i+1, email, err)
+			return err
+		}
+	}
+
+	log.Infof(context, "Stored data export archive of [%d] bytes for user [%s]", len(archive), email)
+	return nil
+}
+
+// GetDataExportArchive reassembles the chunks of a user's data export archive
+func GetDataExportArchive(context context.Context, email string) (archive []byte, err error) {
+	var chunks []dataExportArchiveChunk
+	query := datastore.NewQuery("DataExportArchiveChunk").Ancestor(getDataExportKey(context, email)).Order("__key__")
+	if _, err = query.GetAll(context, &chunks); err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 {
+		return nil, ErrNoDataExport
+	}
+
+	archive = make([]byte, 0, len(chunks)*DATA_EXPORT_ARCHIVE_CHUNK_SIZE)
+	for _, chunk := range chunks {
+		archive = append(archive, chunk.Content...)
+	}
+
+	return archive, nil
+}
+
+// DeleteUserData deletes at most limit descendants of the GlukitUser entity. Once there are none left and unless the account is
+// kept, the api secret of the user and the GlukitUser entity itself are deleted.
+func DeleteUserData(context context.Context, email string, keepAccount bool, limit int) (deleted int, err error) {
+	userKey := GetUserKey(context, email)
+	keys, err := datastore.NewQuery("").Ancestor(userKey).KeysOnly().Limit(limit + 1).GetAll(context, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	hasProfile := false
+	descendants := make([]*datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if key.Equal(userKey) {
+			hasProfile = true
+		} else if len(descendants) < limit {
+			descendants = append(descendants, key)
+		}
+	}
+
+	if len(descendants) > 0 {
+		log.Infof(context, "Deleting [%d] entities of user [%s]", len(descendants), email)
+		if err = datastore.DeleteMulti(context, descendants); err != nil {
+			return 0, err
+		}
+
+		return len(descendants), nil
+	}
+
+	// The grants other users gave to the user. The log of the user's accesses to their data isn't indexed on the viewer.
+	grantKeys, err := datastore.NewQuery("SharingGrant").Filter("viewerEmail =", model.NormalizeEmail(email)).KeysOnly().Limit(limit).GetAll(context, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(grantKeys) > 0 {
+		log.Infof(context, "Deleting [%d] grants to user [%s]", len(grantKeys), email)
+		if err = datastore.DeleteMulti(context, grantKeys); err != nil {
+			return 0, err
+		}
+
+		return len(grantKeys), nil
+	}
+
+	if keepAccount {
+		return 0, nil
+	}
+
+	secretKeys, err := datastore.NewQuery("ApiSecret").Filter("email =", email).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if hasProfile {
+		secretKeys = append(secretKeys, userKey)
+	}
+
+	log.Infof(context, "Deleting profile and api secret of user [%s]", email)
+	if err = datastore.DeleteMulti(context, secretKeys); err != nil {
+		return 0, err
+	}
+
+	return len(secretKeys), nil
+}
+
+// getAccountDeletionKey returns the key of the AccountDeletion of a user. It's a root entity so that it isn't deleted along
+// with the user's data.
+func getAccountDeletionKey(context context.Context, email string) (key *datastore.Key) {
+	return datastore.NewKey(context, "AccountDeletion", email, 0, nil)
+}
+
+// StoreAccountDeletion stores the state of a user's account deletion
+func StoreAccountDeletion(context context.Context, email string, deletion model.AccountDeletion) (err error) {
+	log.Infof(context, "Emitting a Put for account deletion of user [%s] with status [%s]", email, deletion.Status)
+	_, err = datastore.Put(context, getAccountDeletionKey(context, email), &deletion)
+
+	return err
+}
+
+// GetAccountDeletion returns the state of a user's account deletion
+func GetAccountDeletion(context context.Context, email string) (deletion *model.AccountDeletion, err error) {
+	deletion = new(model.AccountDeletion)
+	if err = datastore.Get(context, getAccountDeletionKey(context, email), deletion); err != nil {
+		return nil, err
+	}
+
+	return deletion, nil
+}
+
+// GetGlycemicEpisodes returns the GlycemicEpisodes of a user starting within the bounds of the scan query, most recent first
+func GetGlycemicEpisodes(context context.Context, email string, scanQuery ScoreScanQuery) (episodes []model.GlycemicEpisode, err error) {
+	query := datastore.NewQuery("GlycemicEpisode").Ancestor(GetUserKey(context, email))
+	if scanQuery.From != nil {
+		query = query.Filter("start >=", *scanQuery.From)
+	}
+	if scanQuery.To != nil {
+		query = query.Filter("start <=", *scanQuery.To)
+	}
+	if scanQuery.Limit != nil {
+		query = query.Limit(*scanQuery.Limit)
+	}
+	query = query.Order("-start")
+
+	episodes = make([]model.GlycemicEpisode, 0)
+	if _, err = query.GetAll(context, &episodes); err != nil {
+		return nil, err
+	}
+
+	log.Infof(context, "Found [%d] glycemic episodes.", len(episodes))
+	return episodes, nil
+}
+
+// ReplaceGlycemicEpisodes deletes the GlycemicEpisodes of a user starting between the lower and upper bounds and stores the given ones.
+// Episodes are children of the GlukitUser keyed by their type and start time.
+func ReplaceGlycemicEpisodes(context context.Context, email string, lowerBound time.Time, upperBound time.Time, episodes []model.GlycemicEpisode) (err error) {
+	parentKey := GetUserKey(context, email)
+	previousKeys, err := datastore.NewQuery("GlycemicEpisode").Ancestor(parentKey).Filter("start >=", lowerBound).Filter("start <=", upperBound).
+		KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = datastore.DeleteMulti(context, previousKeys); err != nil {
+		return err
+	}
+
+	elementKeys := make([]*datastore.Key, len(episodes))
+	for i := range episodes {
+		elementKeys[i] = datastore.NewKey(context, "GlycemicEpisode", episodes[i].Type+"-"+strconv.FormatInt(episodes[i].Start.Unix(), 10), 0, parentKey)
+	}
+
+	log.Infof(context, "Emitting a PutMulti with [%d] keys for glycemic episodes of user [%s], replacing [%d]", len(elementKeys), email, len(previousKeys))
+	_, err = datastore.PutMulti(context, elementKeys, episodes)
+
+	return err
+}
+
+// FindCohortMembers returns the profiles of all users who opted in to be part of the cohort distributions
+func FindCohortMembers(context context.Context) (members []model.GlukitUser, err error) {
+	_, err = datastore.NewQuery("GlukitUser").Filter("cohortOptIn =", true).GetAll(context, &members)
+	if err != nil {
+		if unknownFields, ok := err.(*datastore.ErrFieldMismatch); ok {
+			log.Infof(context, "Ignoring unknown fields [%s]", unknownFields.Error())
+		} else {
+			return nil, err
+		}
+	}
+
+	log.Debugf(context, "Found [%d] cohort members", len(members))
+	return members, nil
+}
+
+func getCohortAggregationKey(context context.Context) (key *datastore.Key) {
+	return datastore.NewKey(context, "CohortAggregation", COHORT_AGGREGATION_KEY, 0, nil)
+}
+
+// StoreCohortAggregation replaces the cohort aggregation. Its distributions are stored as children of the CohortAggregation entity,
+// keyed by their type of diabetes, age band and metric, and the distributions of the previous aggregation are deleted first.
+func StoreCohortAggregation(context context.Context, aggregation model.CohortAggregation) (err error) {
+	aggregationKey := getCohortAggregationKey(context)
+	previousKeys, err := datastore.NewQuery("CohortDistribution").Ancestor(aggregationKey).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = datastore.DeleteMulti(context, previousKeys); err != nil {
+		return err
+	}
+
+	if _, err = datastore.Put(context, aggregationKey, &aggregation); err != nil {
+		return err
+	}
+
+	elementKeys := make([]*datastore.Key, len(aggregation.Distributions))
+	for i, distribution := range aggregation.Distributions {
+		elementKeys[i] = datastore.NewKey(context, "CohortDistribution", fmt.Sprintf("%s-%d-%s", distribution.DiabetesType, distribution.AgeBand,
+			distribution.Metric), 0, aggregationKey)
+	}
+
+	log.Infof(context, "Emitting a PutMulti with [%d] keys for cohort distributions, replacing [%d]", len(elementKeys), len(previousKeys))
+	_, err = datastore.PutMulti(context, elementKeys, aggregation.Distributions)
+
+	return err
+}
+
+// GetCohortAggregation returns the most recent cohort aggregation along with its distributions
+func GetCohortAggregation(context context.Context) (aggregation *model.CohortAggregation, err error) {
+	aggregationKey := getCohortAggregationKey(context)
+	aggregation = new(model.CohortAggregation)
+	if err = datastore.Get(context, aggregationKey, aggregation); err != nil {
+		return nil, err
+	}
+
+	aggregation.Distributions = make([]model.CohortDistribution, 0)
+	if _, err = datastore.NewQuery("CohortDistribution").Ancestor(aggregationKey).GetAll(context, &aggregation.Distributions); err != nil {
+		return nil, err
+	}
+
+	return aggregation, nil
+}
+
+// getSharingGrantKey returns the key of the grant of the owner to a viewer, a child of the owner's GlukitUser keyed by the viewer's email
+func getSharingGrantKey(context context.Context, ownerEmail string, viewerEmail string) (key *datastore.Key) {
+	return datastore.NewKey(context, "SharingGrant", viewerEmail, 0, GetUserKey(context, ownerEmail))
+}
+
+// StoreSharingGrant stores a grant, replacing any previous one of the same owner to the same viewer
+func StoreSharingGrant(context context.Context, grant model.SharingGrant) (err error) {
+	_, err = datastore.Put(context, getSharingGrantKey(context, grant.OwnerEmail, grant.ViewerEmail), &grant)
+	return err
+}
+
+// DeleteSharingGrant deletes the grant of the owner to the viewer. It returns datastore.ErrNoSuchEntity if there's none.
+func DeleteSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (err error) {
+	key := getSharingGrantKey(context, ownerEmail, viewerEmail)
+	if err = datastore.Get(context, key, new(model.SharingGrant)); err != nil {
+		return err
+	}
+
+	log.Infof(context, "Deleting grant of user [%s] to viewer [%s]", ownerEmail, viewerEmail)
+	return datastore.Delete(context, key)
+}
+
+// GetSharingGrant returns the grant of the owner to the viewer
+func GetSharingGrant(context context.Context, ownerEmail string, viewerEmail string) (grant *model.SharingGrant, err error) {
+	grant = new(model.SharingGrant)
+	if err = datastore.Get(context, getSharingGrantKey(context, ownerEmail, viewerEmail), grant); err != nil {
+		return nil, err
+	}
+
+	return grant, nil
+}
+
+// GetSharingGrantsByOwner returns all grants given by the owner
+func GetSharingGrantsByOwner(context context.Context, ownerEmail string) (grants []model.SharingGrant, err error) {
+	grants = make([]model.SharingGrant, 0)
+	if _, err = datastore.NewQuery("SharingGrant").Ancestor(GetUserKey(context, ownerEmail)).GetAll(context, &grants); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+// GetSharingGrantsByViewer returns all grants given to the viewer
+func GetSharingGrantsByViewer(context context.Context, viewerEmail string) (grants []model.SharingGrant, err error) {
+	grants = make([]model.SharingGrant, 0)
+	if _, err = datastore.NewQuery("SharingGrant").Filter("viewerEmail =", viewerEmail).GetAll(context, &grants); err != nil {
+		return nil, err
+	}
+
+	return grants, nil
+}
+
+// LogViewerAccess stores an access of a viewer as a child of the GlukitUser owning the data
+func LogViewerAccess(context context.Context, ownerEmail string, access model.ViewerAccess) (err error) {
+	_, err = datastore.Put(context, datastore.NewIncompleteKey(context, "ViewerAccess", GetUserKey(context, ownerEmail)), &access)
+	return err
+}
+
+// GetViewerAccesses returns at most limit accesses of viewers to the data of the owner, most recent first
+func GetViewerAccesses(context context.Context, ownerEmail string, limit int) (accesses []model.ViewerAccess, err error) {
+	accesses = make([]model.ViewerAccess, 0)
+	query := datastore.NewQuery("ViewerAccess").Ancestor(GetUserKey(context, ownerEmail)).Order("-time").Limit(limit)
+	if _, err = query.GetAll(context, &accesses); err != nil {
+		return nil, err
+	}
+
+	return accesses, nil
+}
+
+// StoreClinic stores a clinic as a root entity keyed by its id
+func StoreClinic(context context.Context, clinic model.Clinic) (err error) {
+	_, err = datastore.Put(context, datastore.NewKey(context, "Clinic", clinic.Id, 0, nil), &clinic)
+	return err
+}
+
+// GetClinic returns the clinic with the given id
+func GetClinic(context context.Context, clinicId string) (clinic *model.Clinic, err error) {
+	clinic = new(model.Clinic)
+	if err = datastore.Get(context, datastore.NewKey(context, "Clinic", clinicId, 0, nil), clinic); err != nil {
+		return nil, err
+	}
+
+	return clinic, nil
+}
+
+// GetClinicsByPractitioner returns the clinics the user is a practitioner of
+func GetClinicsByPractitioner(context context.Context, practitionerEmail string) (clinics []model.Clinic, err error) {
+	clinics = make([]model.Clinic, 0)
+	if _, err = datastore.NewQuery("Clinic").Filter("practitionerEmails =", practitionerEmail).GetAll(context, &clinics); err != nil {
+		return nil, err
+	}
+
+	return clinics, nil
+}
+
+// StoreClinicInvite stores an invite as a root entity keyed by its code
+func StoreClinicInvite(context context.Context, invite model.ClinicInvite) (err error) {
+	_, err = datastore.Put(context, datastore.NewKey(context, "ClinicInvite", invite.Code, 0, nil), &invite)
+	return err
+}
+
+// GetClinicInvite returns the invite with the given code
+func GetClinicInvite(context context.Context, code string) (invite *model.ClinicInvite, err error) {
+	invite = new(model.ClinicInvite)
+	if err = datastore.Get(context, datastore.NewKey(context, "ClinicInvite", code, 0, nil), invite); err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// RedeemClinicInvite marks the invite as redeemed by the patient in a transaction so that it can only be redeemed once. It returns
+// datastore.ErrNoSuchEntity if there's no invite with the code.
+func RedeemClinicInvite(c context.Context, code string, patientEmail string, now time.Time) (invite *model.ClinicInvite, err error) {
+	err = datastore.RunInTransaction(c, func(context context.Context) error {
+		key := datastore.NewKey(context, "ClinicInvite", code, 0, nil)
+		invite = new(model.ClinicInvite)
+		if err := datastore.Get(context, key, invite); err != nil {
+			return err
+		}
+
+		if !invite.IsRedeemable(now) {
+			return ErrClinicInviteNotRedeemable
+		}
+
+		invite.RedeemedBy = patientEmail
+		invite.RedeemedOn = now
+		_, err := datastore.Put(context, key, invite)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// getClinicEnrollmentKey returns the key of the enrollment of a patient in a clinic, a child of the patient's GlukitUser keyed by the
+// clinic id
+func getClinicEnrollmentKey(context context.Context, patientEmail string, clinicId string) (key *datastore.Key) {
+	return datastore.NewKey(context, "ClinicEnrollment", clinicId, 0, GetUserKey(context, patientEmail))
+}
+
+// StoreClinicEnrollment stores the enrollment of a patient in a clinic
+func StoreClinicEnrollment(context context.Context, enrollment model.ClinicEnrollment) (err error) {
+	_, err = datastore.Put(context, getClinicEnrollmentKey(context, enrollment.PatientEmail, enrollment.ClinicId), &enrollment)
+	return err
+}
+
+// DeleteClinicEnrollment deletes the enrollment of a patient in a clinic. It returns datastore.ErrNoSuchEntity if there's none.
+func DeleteClinicEnrollment(context context.Context, patientEmail string, clinicId string) (err error) {
+	key := getClinicEnrollmentKey(context, patientEmail, clinicId)
+	if err = datastore.Get(context, key, new(model.ClinicEnrollment)); err != nil {
+		return err
+	}
+
+	log.Infof(context, "Deleting enrollment of user [%s] in clinic [%s]", patientEmail, clinicId)
+	return datastore.Delete(context, key)
+}
+
+// GetClinicEnrollmentsByPatient returns the enrollments of the patient
+func GetClinicEnrollmentsByPatient(context context.Context, patientEmail string) (enrollments []model.ClinicEnrollment, err error) {
+	enrollments = make([]model.ClinicEnrollment, 0)
+	if _, err = datastore.NewQuery("ClinicEnrollment").Ancestor(GetUserKey(context, patientEmail)).GetAll(context, &enrollments); err != nil {
+		return nil, err
+	}
+
+	return enrollments, nil
+}
+
+// GetClinicEnrollmentsByClinic returns the enrollments of all patients of the clinic
+func GetClinicEnrollmentsByClinic(context context.Context, clinicId string) (enrollments []model.ClinicEnrollment, err error) {
+	enrollments = make([]model.ClinicEnrollment, 0)
+	if _, err = datastore.NewQuery("ClinicEnrollment").Filter("clinicId =", clinicId).GetAll(context, &enrollments); err != nil {
+		return nil, err
+	}
+
+	return enrollments, nil
+}
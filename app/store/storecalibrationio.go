@@ -37,3 +37,36 @@ func (w *DataStoreCalibrationBatchWriter) WriteCalibrationBatch(p []apimodel.Cal
 func (w *DataStoreCalibrationBatchWriter) Flush() (glukitio.CalibrationBatchWriter, error) {
 	return w, nil
 }
+
+type RepositoryCalibrationBatchWriter struct {
+	c     context.Context
+	r     CalibrationRepository
+	email string
+}
+
+// NewRepositoryCalibrationBatchWriter creates a new CalibrationBatchWriter that persists to a CalibrationRepository
+func NewRepositoryCalibrationBatchWriter(context context.Context, repository CalibrationRepository, email string) *RepositoryCalibrationBatchWriter {
+	w := new(RepositoryCalibrationBatchWriter)
+	w.c = context
+	w.r = repository
+	w.email = email
+	return w
+}
+
+func (w *RepositoryCalibrationBatchWriter) WriteCalibrationBatches(p []apimodel.DayOfCalibrationReads) (glukitio.CalibrationBatchWriter, error) {
+	if err := w.r.StoreDaysOfCalibrations(w.c, w.email, p); err != nil {
+		return w, err
+	} else {
+		return w, nil
+	}
+}
+
+func (w *RepositoryCalibrationBatchWriter) WriteCalibrationBatch(p []apimodel.CalibrationRead) (glukitio.CalibrationBatchWriter, error) {
+	dayOfCalibrationReads := make([]apimodel.DayOfCalibrationReads, 1)
+	dayOfCalibrationReads[0] = apimodel.NewDayOfCalibrationReads(p)
+	return w.WriteCalibrationBatches(dayOfCalibrationReads)
+}
+
+func (w *RepositoryCalibrationBatchWriter) Flush() (glukitio.CalibrationBatchWriter, error) {
+	return w, nil
+}
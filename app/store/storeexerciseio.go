@@ -37,3 +37,36 @@ func (w *DataStoreExerciseBatchWriter) WriteExerciseBatch(p []apimodel.Exercise)
 func (w *DataStoreExerciseBatchWriter) Flush() (glukitio.ExerciseBatchWriter, error) {
 	return w, nil
 }
+
+type RepositoryExerciseBatchWriter struct {
+	c     context.Context
+	r     ExerciseRepository
+	email string
+}
+
+// NewRepositoryExerciseBatchWriter creates a new ExerciseBatchWriter that persists to a ExerciseRepository
+func NewRepositoryExerciseBatchWriter(context context.Context, repository ExerciseRepository, email string) *RepositoryExerciseBatchWriter {
+	w := new(RepositoryExerciseBatchWriter)
+	w.c = context
+	w.r = repository
+	w.email = email
+	return w
+}
+
+func (w *RepositoryExerciseBatchWriter) WriteExerciseBatches(p []apimodel.DayOfExercises) (glukitio.ExerciseBatchWriter, error) {
+	if err := w.r.StoreDaysOfExercises(w.c, w.email, p); err != nil {
+		return w, err
+	} else {
+		return w, nil
+	}
+}
+
+func (w *RepositoryExerciseBatchWriter) WriteExerciseBatch(p []apimodel.Exercise) (glukitio.ExerciseBatchWriter, error) {
+	dayOfExercises := make([]apimodel.DayOfExercises, 1)
+	dayOfExercises[0] = apimodel.NewDayOfExercises(p)
+	return w.WriteExerciseBatches(dayOfExercises)
+}
+
+func (w *RepositoryExerciseBatchWriter) Flush() (glukitio.ExerciseBatchWriter, error) {
+	return w, nil
+}
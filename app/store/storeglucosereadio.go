@@ -37,3 +37,36 @@ func (w *DataStoreGlucoseReadBatchWriter) WriteGlucoseReadBatch(p []apimodel.Glu
 func (w *DataStoreGlucoseReadBatchWriter) Flush() (glukitio.GlucoseReadBatchWriter, error) {
 	return w, nil
 }
+
+type RepositoryGlucoseReadBatchWriter struct {
+	c     context.Context
+	r     GlucoseReadRepository
+	email string
+}
+
+// NewRepositoryGlucoseReadBatchWriter creates a new GlucoseReadBatchWriter that persists to a GlucoseReadRepository
+func NewRepositoryGlucoseReadBatchWriter(context context.Context, repository GlucoseReadRepository, email string) *RepositoryGlucoseReadBatchWriter {
+	w := new(RepositoryGlucoseReadBatchWriter)
+	w.c = context
+	w.r = repository
+	w.email = email
+	return w
+}
+
+func (w *RepositoryGlucoseReadBatchWriter) WriteGlucoseReadBatches(p []apimodel.DayOfGlucoseReads) (glukitio.GlucoseReadBatchWriter, error) {
+	if err := w.r.StoreDaysOfReads(w.c, w.email, p); err != nil {
+		return w, err
+	} else {
+		return w, nil
+	}
+}
+
+func (w *RepositoryGlucoseReadBatchWriter) WriteGlucoseReadBatch(p []apimodel.GlucoseRead) (glukitio.GlucoseReadBatchWriter, error) {
+	dayOfGlucoseReads := make([]apimodel.DayOfGlucoseReads, 1)
+	dayOfGlucoseReads[0] = apimodel.NewDayOfGlucoseReads(p)
+	return w.WriteGlucoseReadBatches(dayOfGlucoseReads)
+}
+
+func (w *RepositoryGlucoseReadBatchWriter) Flush() (glukitio.GlucoseReadBatchWriter, error) {
+	return w, nil
+}
@@ -37,3 +37,36 @@ func (w *DataStoreInjectionBatchWriter) WriteInjectionBatch(p []apimodel.Injecti
 func (w *DataStoreInjectionBatchWriter) Flush() (glukitio.InjectionBatchWriter, error) {
 	return w, nil
 }
+
+type RepositoryInjectionBatchWriter struct {
+	c     context.Context
+	r     InjectionRepository
+	email string
+}
+
+// NewRepositoryInjectionBatchWriter creates a new InjectionBatchWriter that persists to a InjectionRepository
+func NewRepositoryInjectionBatchWriter(context context.Context, repository InjectionRepository, email string) *RepositoryInjectionBatchWriter {
+	w := new(RepositoryInjectionBatchWriter)
+	w.c = context
+	w.r = repository
+	w.email = email
+	return w
+}
+
+func (w *RepositoryInjectionBatchWriter) WriteInjectionBatches(p []apimodel.DayOfInjections) (glukitio.InjectionBatchWriter, error) {
+	if err := w.r.StoreDaysOfInjections(w.c, w.email, p); err != nil {
+		return w, err
+	} else {
+		return w, nil
+	}
+}
+
+func (w *RepositoryInjectionBatchWriter) WriteInjectionBatch(p []apimodel.Injection) (glukitio.InjectionBatchWriter, error) {
+	dayOfInjections := make([]apimodel.DayOfInjections, 1)
+	dayOfInjections[0] = apimodel.NewDayOfInjections(p)
+	return w.WriteInjectionBatches(dayOfInjections)
+}
+
+func (w *RepositoryInjectionBatchWriter) Flush() (glukitio.InjectionBatchWriter, error) {
+	return w, nil
+}
@@ -37,3 +37,36 @@ func (w *DataStoreMealBatchWriter) WriteMealBatch(p []apimodel.Meal) (glukitio.M
 func (w *DataStoreMealBatchWriter) Flush() (glukitio.MealBatchWriter, error) {
 	return w, nil
 }
+
+type RepositoryMealBatchWriter struct {
+	c     context.Context
+	r     MealRepository
+	email string
+}
+
+// NewRepositoryMealBatchWriter creates a new MealBatchWriter that persists to a MealRepository
+func NewRepositoryMealBatchWriter(context context.Context, repository MealRepository, email string) *RepositoryMealBatchWriter {
+	w := new(RepositoryMealBatchWriter)
+	w.c = context
+	w.r = repository
+	w.email = email
+	return w
+}
+
+func (w *RepositoryMealBatchWriter) WriteMealBatches(p []apimodel.DayOfMeals) (glukitio.MealBatchWriter, error) {
+	if err := w.r.StoreDaysOfMeals(w.c, w.email, p); err != nil {
+		return w, err
+	} else {
+		return w, nil
+	}
+}
+
+func (w *RepositoryMealBatchWriter) WriteMealBatch(p []apimodel.Meal) (glukitio.MealBatchWriter, error) {
+	dayOfMeals := make([]apimodel.DayOfMeals, 1)
+	dayOfMeals[0] = apimodel.NewDayOfMeals(p)
+	return w.WriteMealBatches(dayOfMeals)
+}
+
+func (w *RepositoryMealBatchWriter) Flush() (glukitio.MealBatchWriter, error) {
+	return w, nil
+}
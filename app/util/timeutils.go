@@ -136,11 +136,13 @@ func GetOrLoadLocationForName(locationName string) (location *time.Location, err
 			if !zoneNameRegexp.MatchString(locationName) {
 				return nil, errors.New(fmt.Sprintf("Invalid location name, not a valid timezone location [%s]", locationName))
 			} else {
-				var hours, minutes int64
-				fmt.Sscanf(locationName, "%+03d%02d", &hours, &minutes)
-				offsetInMinutes := hours*int64(time.Duration(60)*time.Minute) + minutes
-				offsetInSeconds := offsetInMinutes + minutes*int64(time.Duration(60)*time.Second)
-				location = time.FixedZone(locationName, int(offsetInSeconds))
+				var hours, minutes int
+				fmt.Sscanf(locationName[1:], "%02d%02d", &hours, &minutes)
+				offsetInSeconds := hours*3600 + minutes*60
+				if locationName[0] == '-' {
+					offsetInSeconds = -offsetInSeconds
+				}
+				location = time.FixedZone(locationName, offsetInSeconds)
 				locationCache[locationName] = location
 			}
 		}
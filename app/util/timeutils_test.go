@@ -36,6 +36,19 @@ func TestGetTimezoneNegativeOffset(t *testing.T) {
 	}
 }
 
+func TestFixedLocationOffset(t *testing.T) {
+	for name, expectedOffset := range map[string]int{"+0130": 5400, "-0700": -25200, "-0030": -1800} {
+		location, err := GetOrLoadLocationForName(name)
+		if err != nil {
+			t.Fatalf("Invalid location [%s]: [%v]", name, err)
+		}
+
+		if _, offset := time.Date(2014, time.April, 18, 0, 0, 0, 0, location).Zone(); offset != expectedOffset {
+			t.Errorf("Expected offset [%d] for location [%s] but got [%d]", expectedOffset, name, offset)
+		}
+	}
+}
+
 func TestKnownLocationLoading(t *testing.T) {
 	location := "America/Montreal"
 	if _, err := GetOrLoadLocationForName(location); err != nil {
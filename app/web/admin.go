@@ -0,0 +1,151 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+)
+
+const (
+	JOB_STATUS_PARAMETER = "status"
+
+	RECALCULATION_EMAIL_PARAMETER   = "email"
+	RECALCULATION_SERIES_PARAMETER  = "series"
+	RECALCULATION_VERSION_PARAMETER = "version"
+	// The series that can be recalculated
+	GLUKIT_SCORES_SERIES = "glukitScores"
+	A1CS_SERIES          = "a1cs"
+)
+
+// listJobs writes the background jobs as json, optionally filtered by the status parameter (pending, running, failed
+// or dead). It's restricted to administrators and only available with queues that support inspection.
+func listJobs(writer http.ResponseWriter, request *http.Request) {
+	if !authProvider.IsAdmin(request) {
+		http.Error(writer, "Administrator access required", http.StatusForbidden)
+		return
+	}
+
+	inspector, ok := jobQueue.(queue.Inspector)
+	if !ok {
+		http.Error(writer, "Job inspection isn't supported by this queue", http.StatusNotImplemented)
+		return
+	}
+
+	status := request.FormValue(JOB_STATUS_PARAMETER)
+	switch status {
+	case "", queue.JOB_STATUS_PENDING, queue.JOB_STATUS_RUNNING, queue.JOB_STATUS_FAILED, queue.JOB_STATUS_DEAD:
+	default:
+		http.Error(writer, "Invalid job status ["+status+"]", http.StatusBadRequest)
+		return
+	}
+
+	context := appengine.NewContext(request)
+	records, err := inspector.Jobs(context, status)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(records)
+}
+
+// recalculateScores queues the recalculation of the glukit scores or a1c estimates of a user with a registered scoring version, from
+// their oldest score onwards. Scores of other versions are kept so the versions can be compared. It's restricted to administrators.
+func recalculateScores(writer http.ResponseWriter, request *http.Request) {
+	if !authProvider.IsAdmin(request) {
+		http.Error(writer, "Administrator access required", http.StatusForbidden)
+		return
+	}
+
+	email := request.FormValue(RECALCULATION_EMAIL_PARAMETER)
+	if len(email) == 0 {
+		http.Error(writer, "Missing "+RECALCULATION_EMAIL_PARAMETER, http.StatusBadRequest)
+		return
+	}
+
+	version, err := strconv.Atoi(request.FormValue(RECALCULATION_VERSION_PARAMETER))
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid %s: [%v]", RECALCULATION_VERSION_PARAMETER, err), http.StatusBadRequest)
+		return
+	}
+
+	context := appengine.NewContext(request)
+	series := request.FormValue(RECALCULATION_SERIES_PARAMETER)
+	switch series {
+	case GLUKIT_SCORES_SERIES:
+		if _, ok := engine.GetGlukitScorer(version); !ok {
+			http.Error(writer, fmt.Sprintf("No glukit scorer registered for version [%d]", version), http.StatusBadRequest)
+			return
+		}
+		err = engine.StartGlukitScoreRecalculation(context, repository, jobQueue, email, version)
+	case A1CS_SERIES:
+		if _, ok := engine.GetA1CEstimator(version); !ok {
+			http.Error(writer, fmt.Sprintf("No a1c estimator registered for version [%d]", version), http.StatusBadRequest)
+			return
+		}
+		err = engine.StartA1CRecalculation(context, repository, jobQueue, email, version)
+	default:
+		http.Error(writer, fmt.Sprintf("Invalid %s [%s], expected one of [%s, %s]", RECALCULATION_SERIES_PARAMETER, series,
+			GLUKIT_SCORES_SERIES, A1CS_SERIES), http.StatusBadRequest)
+		return
+	}
+
+	if err == engine.ErrNothingToRecalculate {
+		http.Error(writer, err.Error(), http.StatusNoContent)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Started the recalculation of the %s of user [%s] with version [%d]", series, email, version)
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// aggregateCohorts queues the aggregation of the cohorts without waiting for the current one to be stale. It's restricted to
+// administrators.
+func aggregateCohorts(writer http.ResponseWriter, request *http.Request) {
+	if !authProvider.IsAdmin(request) {
+		http.Error(writer, "Administrator access required", http.StatusForbidden)
+		return
+	}
+
+	context := appengine.NewContext(request)
+	if err := engine.StartCohortAggregation(context, jobQueue); err != nil {
+		util.Propagate(err)
+	}
+
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// reindexOauthTokens puts back the oauth tokens stored before their user was indexed so they can be listed and revoked. It's a
+// one-off migration of storages that need it, restricted to administrators.
+func reindexOauthTokens(writer http.ResponseWriter, request *http.Request) {
+	if !authProvider.IsAdmin(request) {
+		http.Error(writer, "Administrator access required", http.StatusForbidden)
+		return
+	}
+
+	reindexer, ok := newOsinStorage(request).(store.TokenReindexer)
+	if !ok {
+		http.Error(writer, "Reindexing isn't needed by this oauth storage", http.StatusNotImplemented)
+		return
+	}
+
+	context := appengine.NewContext(request)
+	count, err := reindexer.ReindexUserTokens(context)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Reindexed [%d] oauth entities", count)
+	writer.WriteHeader(http.StatusNoContent)
+}
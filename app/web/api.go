@@ -1,4 +1,4 @@
-package main
+package web
 
 import (
 	"encoding/json"
@@ -6,13 +6,16 @@ import (
 	"github.com/alexandre-normand/glukit/app/apimodel"
 	"github.com/alexandre-normand/glukit/app/bufio"
 	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/streaming"
+	"github.com/alexandre-normand/osin"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
@@ -21,6 +24,13 @@ const (
 	EXERCISES_V1_ROUTE    = "v1_exercises"
 	MEALS_V1_ROUTE        = "v1_meals"
 	INJECTIONS_V1_ROUTE   = "v1_injections"
+
+	GLUCOSEREADS_V1_GET_ROUTE = "v1_glucosereads_get"
+	CALIBRATIONS_V1_GET_ROUTE = "v1_calibrations_get"
+	EXERCISES_V1_GET_ROUTE    = "v1_exercises_get"
+	MEALS_V1_GET_ROUTE        = "v1_meals_get"
+	INJECTIONS_V1_GET_ROUTE   = "v1_injections_get"
+	PROFILE_V1_GET_ROUTE      = "v1_profile_get"
 )
 
 // Represents the logging of a file import
@@ -28,33 +38,72 @@ type ApiUser struct {
 	Email string
 }
 
+// Represents the profile of a user as returned to applications with the profile:read scope
+type ApiProfile struct {
+	Email        string    `json:"email"`
+	FirstName    string    `json:"firstName"`
+	LastName     string    `json:"lastName"`
+	DiabetesType string    `json:"diabetesType"`
+	Timezone     string    `json:"timezone"`
+	JoinedOn     time.Time `json:"joinedOn"`
+}
+
 func CurrentApiUser(request *http.Request) (user *ApiUser) {
 	request.ParseForm()
 
-	authorizationValue := request.Header.Get("Authorization")
-	if authorizationValue == "" {
-		return nil
+	if accessData := loadBearerAccess(request); accessData != nil {
+		return &ApiUser{accessData.UserData.(string)}
 	}
 
-	accessCode := strings.TrimPrefix(authorizationValue, "Bearer ")
+	return nil
+}
+
+// loadBearerAccess returns the access data of the bearer token of the request or nil if it doesn't have a known one. It doesn't
+// check that the token is still valid.
+func loadBearerAccess(request *http.Request) (accessData *osin.AccessData) {
+	accessCode := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
 	if accessCode == "" {
 		return nil
 	}
 
-	// load access data
-	if accessData, err := server.Storage.LoadAccess(accessCode, request); err == nil {
-		return &ApiUser{accessData.UserData.(string)}
+	accessData, err := server.Storage.LoadAccess(accessCode, request)
+	if err != nil {
+		return nil
 	}
 
-	return nil
+	return accessData
 }
 
 func initApiEndpoints(writer http.ResponseWriter, request *http.Request) {
-	muxRouter.Get(CALIBRATIONS_V1_ROUTE).Handler(newOauthAuthenticationHandler(http.HandlerFunc(processNewCalibrationData)))
-	muxRouter.Get(INJECTIONS_V1_ROUTE).Handler(newOauthAuthenticationHandler(http.HandlerFunc(processNewInjectionData)))
-	muxRouter.Get(MEALS_V1_ROUTE).Handler(newOauthAuthenticationHandler(http.HandlerFunc(processNewMealData)))
-	muxRouter.Get(GLUCOSEREADS_V1_ROUTE).Handler(newOauthAuthenticationHandler(http.HandlerFunc(processNewGlucoseReadData)))
-	muxRouter.Get(EXERCISES_V1_ROUTE).Handler(newOauthAuthenticationHandler(http.HandlerFunc(processNewExerciseData)))
+	muxRouter.Get(CALIBRATIONS_V1_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_WRITE, http.HandlerFunc(processNewCalibrationData)))
+	muxRouter.Get(INJECTIONS_V1_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_WRITE, http.HandlerFunc(processNewInjectionData)))
+	muxRouter.Get(MEALS_V1_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_WRITE, http.HandlerFunc(processNewMealData)))
+	muxRouter.Get(GLUCOSEREADS_V1_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_WRITE, http.HandlerFunc(processNewGlucoseReadData)))
+	muxRouter.Get(EXERCISES_V1_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_WRITE, http.HandlerFunc(processNewExerciseData)))
+	muxRouter.Get(CALIBRATIONS_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_READ, http.HandlerFunc(calibrationsPage)))
+	muxRouter.Get(INJECTIONS_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_READ, http.HandlerFunc(injectionsPage)))
+	muxRouter.Get(MEALS_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_READ, http.HandlerFunc(mealsPage)))
+	muxRouter.Get(GLUCOSEREADS_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_READ, http.HandlerFunc(glucoseReadsPage)))
+	muxRouter.Get(EXERCISES_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_READ, http.HandlerFunc(exercisesPage)))
+	muxRouter.Get(PROFILE_V1_GET_ROUTE).Handler(newOauthAuthenticationHandler(model.OAUTH_SCOPE_PROFILE_READ, http.HandlerFunc(apiProfile)))
+}
+
+// apiProfile is the endpoint that returns the profile of the api user
+func apiProfile(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := CurrentApiUser(request)
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		log.Warningf(context, "Error getting profile of user [%s]: %v", user.Email, err)
+		http.Error(writer, "Error getting user profile", 500)
+		return
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(ApiProfile{Email: glukitUser.Email, FirstName: glukitUser.FirstName, LastName: glukitUser.LastName,
+		DiabetesType: glukitUser.DiabetesType, Timezone: glukitUser.Timezone, JoinedOn: glukitUser.AccountCreated})
 }
 
 // processNewCalibrationData Handles a Post to the calibration endpoint and
@@ -63,15 +112,15 @@ func processNewCalibrationData(writer http.ResponseWriter, request *http.Request
 	context := appengine.NewContext(request)
 	user := CurrentApiUser(request)
 
-	userProfileKey, _, err := store.GetGlukitUser(context, user.Email)
+	_, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Error getting user to process calibration data, user email is [%s]: %v", user.Email, err)
 		http.Error(writer, "Error getting user to process calibration data", 500)
 		return
 	}
 
-	dataStoreWriter := store.NewDataStoreCalibrationBatchWriter(context, userProfileKey)
-	batchingWriter := bufio.NewCalibrationWriterSize(dataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	repositoryWriter := store.NewRepositoryCalibrationBatchWriter(context, repository, user.Email)
+	batchingWriter := bufio.NewCalibrationWriterSize(repositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
 	calibrationStreamer := streaming.NewCalibrationReadStreamerDuration(batchingWriter, apimodel.DAY_OF_DATA_DURATION)
 
 	decoder := json.NewDecoder(request.Body)
@@ -118,18 +167,19 @@ func processNewGlucoseReadData(writer http.ResponseWriter, request *http.Request
 	context := appengine.NewContext(request)
 	user := CurrentApiUser(request)
 
-	userProfileKey, _, err := store.GetGlukitUser(context, user.Email)
+	_, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Error getting user to process glucose read data, user email is [%s]: %v", user.Email, err)
 		http.Error(writer, "Error getting user to process glucose read data", 500)
 		return
 	}
 
-	dataStoreWriter := store.NewDataStoreGlucoseReadBatchWriter(context, userProfileKey)
-	batchingWriter := bufio.NewGlucoseReadWriterSize(dataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	repositoryWriter := store.NewRepositoryGlucoseReadBatchWriter(context, repository, user.Email)
+	batchingWriter := bufio.NewGlucoseReadWriterSize(repositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
 	glucoseReadStreamer := streaming.NewGlucoseStreamerDuration(batchingWriter, apimodel.DAY_OF_DATA_DURATION)
 
 	decoder := json.NewDecoder(request.Body)
+	var earliestRead *apimodel.GlucoseRead
 
 	for {
 		var c []apimodel.GlucoseRead
@@ -141,6 +191,12 @@ func processNewGlucoseReadData(writer http.ResponseWriter, request *http.Request
 			break
 		}
 
+		for i := range c {
+			if earliestRead == nil || c[i].Time.Timestamp < earliestRead.Time.Timestamp {
+				earliestRead = &c[i]
+			}
+		}
+
 		log.Debugf(context, "Writing [%d] new glucose reads: %v", len(c), c)
 		glucoseReadStreamer, err = glucoseReadStreamer.WriteGlucoseReads(c)
 		if err != nil {
@@ -163,21 +219,33 @@ func processNewGlucoseReadData(writer http.ResponseWriter, request *http.Request
 		return
 	}
 
-	_, glukitUser, err := store.GetGlukitUser(context, user.Email)
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Couldn't get glukit user profile [%s] to recalculate score: %v", user.Email, err)
 	}
 
-	err = engine.StartGlukitScoreBatch(context, glukitUser)
+	err = engine.StartGlukitScoreBatch(context, jobQueue, glukitUser)
 	if err != nil {
 		log.Warningf(context, "Error starting glukit score calculation batch for user [%s]: %v", user.Email, err)
 	}
 
-	err = engine.StartA1CCalculationBatch(context, glukitUser)
+	err = engine.StartA1CCalculationBatch(context, jobQueue, glukitUser)
 	if err != nil {
 		log.Warningf(context, "Error starting a1c calculation batch for user [%s]: %v", user.Email, err)
 	}
 
+	err = engine.StartInsulinRatioBatch(context, repository, jobQueue, user.Email)
+	if err != nil {
+		log.Warningf(context, "Error starting insulin ratio estimation batch for user [%s]: %v", user.Email, err)
+	}
+
+	if earliestRead != nil {
+		err = engine.StartGlycemicEpisodeDetection(context, jobQueue, user.Email, earliestRead.GetTime())
+		if err != nil {
+			log.Warningf(context, "Error starting episode detection for user [%s]: %v", user.Email, err)
+		}
+	}
+
 	log.Infof(context, "Wrote glucose reads to the datastore for user [%s]", user.Email)
 	writer.WriteHeader(200)
 }
@@ -188,15 +256,15 @@ func processNewInjectionData(writer http.ResponseWriter, request *http.Request)
 	context := appengine.NewContext(request)
 	user := CurrentApiUser(request)
 
-	userProfileKey, _, err := store.GetGlukitUser(context, user.Email)
+	_, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Error getting user to process injection data, user email is [%s]: %v", user.Email, err)
 		http.Error(writer, "Error getting user to process injection data", 500)
 		return
 	}
 
-	dataStoreWriter := store.NewDataStoreInjectionBatchWriter(context, userProfileKey)
-	batchingWriter := bufio.NewInjectionWriterSize(dataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	repositoryWriter := store.NewRepositoryInjectionBatchWriter(context, repository, user.Email)
+	batchingWriter := bufio.NewInjectionWriterSize(repositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
 	injectionStreamer := streaming.NewInjectionStreamerDuration(batchingWriter, apimodel.DAY_OF_DATA_DURATION)
 
 	decoder := json.NewDecoder(request.Body)
@@ -243,15 +311,15 @@ func processNewMealData(writer http.ResponseWriter, request *http.Request) {
 	context := appengine.NewContext(request)
 	user := CurrentApiUser(request)
 
-	userProfileKey, _, err := store.GetGlukitUser(context, user.Email)
+	_, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Error getting user to process meal data, user email is [%s]: %v", user.Email, err)
 		http.Error(writer, "Error getting user to process meal data", 500)
 		return
 	}
 
-	dataStoreWriter := store.NewDataStoreMealBatchWriter(context, userProfileKey)
-	batchingWriter := bufio.NewMealWriterSize(dataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	repositoryWriter := store.NewRepositoryMealBatchWriter(context, repository, user.Email)
+	batchingWriter := bufio.NewMealWriterSize(repositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
 	mealStreamer := streaming.NewMealStreamerDuration(batchingWriter, apimodel.DAY_OF_DATA_DURATION)
 
 	decoder := json.NewDecoder(request.Body)
@@ -298,15 +366,15 @@ func processNewExerciseData(writer http.ResponseWriter, request *http.Request) {
 	context := appengine.NewContext(request)
 	user := CurrentApiUser(request)
 
-	userProfileKey, _, err := store.GetGlukitUser(context, user.Email)
+	_, err := repository.GetUserProfile(context, user.Email)
 	if err != nil {
 		log.Warningf(context, "Error getting user to process exercise data, user email is [%s]: %v", user.Email, err)
 		http.Error(writer, "Error getting user to process exercise data", 500)
 		return
 	}
 
-	dataStoreWriter := store.NewDataStoreExerciseBatchWriter(context, userProfileKey)
-	batchingWriter := bufio.NewExerciseWriterSize(dataStoreWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
+	repositoryWriter := store.NewRepositoryExerciseBatchWriter(context, repository, user.Email)
+	batchingWriter := bufio.NewExerciseWriterSize(repositoryWriter, store.GLUKIT_SCORE_PUT_MULTI_SIZE)
 	exerciseStreamer := streaming.NewExerciseStreamerDuration(batchingWriter, apimodel.DAY_OF_DATA_DURATION)
 
 	decoder := json.NewDecoder(request.Body)
@@ -0,0 +1,316 @@
+package web
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	QUERY_PARAM_CURSOR = "cursor"
+
+	// The number of elements returned when the request doesn't have a limit and the maximum it can ask for
+	API_DEFAULT_LIMIT = 1000
+	API_MAX_LIMIT     = 10000
+	// The size of the windows elements are loaded in from the store, so that a page doesn't load the whole range
+	API_FETCH_PERIOD = time.Duration(7*24) * time.Hour
+	// The longest range a request can ask for, so that a page never loads more than a bounded number of windows
+	API_MAX_QUERY_PERIOD = time.Duration(90*24) * time.Hour
+)
+
+// Represents a page of elements of the api, in chronological order. The NextCursor is set when there are more elements
+// in the range and is passed back as the cursor parameter to get the next page.
+type ApiPage struct {
+	Data       []interface{} `json:"data"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// apiElement is an element of any type returned by the api along with its timestamp
+type apiElement struct {
+	timestamp int64
+	value     interface{}
+}
+
+// apiElementLoader loads the elements of a user between two bounds, sorted by time. Glucose values are converted to
+// the unit if it's not nil.
+type apiElementLoader func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+	unit *apimodel.GlucoseUnit) (elements []apiElement, err error)
+
+// apiQuery holds the parameters of an api query
+type apiQuery struct {
+	lowerBound time.Time
+	upperBound time.Time
+	limit      int
+	unit       *apimodel.GlucoseUnit
+	// The timestamp of the last element of the previous page and the number of elements with that timestamp
+	// that were already returned
+	cursorTimestamp int64
+	cursorSkip      int
+}
+
+func glucoseReadsPage(writer http.ResponseWriter, request *http.Request) {
+	writeApiPage(writer, request, func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+		unit *apimodel.GlucoseUnit) (elements []apiElement, err error) {
+		reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = make([]apiElement, len(reads))
+		for i, read := range reads {
+			if unit != nil {
+				if read.Value, err = read.GetNormalizedValue(*unit); err != nil {
+					return nil, err
+				}
+				read.Unit = *unit
+			}
+			elements[i] = apiElement{read.Time.Timestamp, read}
+		}
+
+		return elements, nil
+	})
+}
+
+func calibrationsPage(writer http.ResponseWriter, request *http.Request) {
+	writeApiPage(writer, request, func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+		unit *apimodel.GlucoseUnit) (elements []apiElement, err error) {
+		calibrations, err := repository.GetCalibrations(context, email, lowerBound, upperBound)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = make([]apiElement, len(calibrations))
+		for i, calibration := range calibrations {
+			if unit != nil {
+				if calibration.Value, err = calibration.GetNormalizedValue(*unit); err != nil {
+					return nil, err
+				}
+				calibration.Unit = *unit
+			}
+			elements[i] = apiElement{calibration.Time.Timestamp, calibration}
+		}
+
+		return elements, nil
+	})
+}
+
+func injectionsPage(writer http.ResponseWriter, request *http.Request) {
+	writeApiPage(writer, request, func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+		unit *apimodel.GlucoseUnit) (elements []apiElement, err error) {
+		injections, err := repository.GetInjections(context, email, lowerBound, upperBound)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = make([]apiElement, len(injections))
+		for i, injection := range injections {
+			elements[i] = apiElement{injection.Time.Timestamp, injection}
+		}
+
+		return elements, nil
+	})
+}
+
+func mealsPage(writer http.ResponseWriter, request *http.Request) {
+	writeApiPage(writer, request, func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+		unit *apimodel.GlucoseUnit) (elements []apiElement, err error) {
+		meals, err := repository.GetMeals(context, email, lowerBound, upperBound)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = make([]apiElement, len(meals))
+		for i, meal := range meals {
+			elements[i] = apiElement{meal.Time.Timestamp, meal}
+		}
+
+		return elements, nil
+	})
+}
+
+func exercisesPage(writer http.ResponseWriter, request *http.Request) {
+	writeApiPage(writer, request, func(context context.Context, email string, lowerBound time.Time, upperBound time.Time,
+		unit *apimodel.GlucoseUnit) (elements []apiElement, err error) {
+		exercises, err := repository.GetExercises(context, email, lowerBound, upperBound)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = make([]apiElement, len(exercises))
+		for i, exercise := range exercises {
+			elements[i] = apiElement{exercise.Time.Timestamp, exercise}
+		}
+
+		return elements, nil
+	})
+}
+
+// writeApiPage writes a page of the elements of the api user as json. The range is defined by the from/to parameters, in
+// seconds since the epoch, defaults to the DEFAULT_LOOKBACK_PERIOD before now and spans at most the API_MAX_QUERY_PERIOD. Elements are loaded from the store one
+// API_FETCH_PERIOD at a time until the page is full.
+func writeApiPage(writer http.ResponseWriter, request *http.Request, loader apiElementLoader) {
+	context := appengine.NewContext(request)
+	user := CurrentApiUser(request)
+
+	query, err := newApiQuery(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	elements := make([]apiElement, 0)
+	skipped := 0
+	for chunkStart := query.lowerBound; !chunkStart.After(query.upperBound) && len(elements) <= query.limit; {
+		chunkEnd := chunkStart.Add(API_FETCH_PERIOD - time.Second)
+		if chunkEnd.After(query.upperBound) {
+			chunkEnd = query.upperBound
+		}
+
+		chunk, err := loader(context, user.Email, chunkStart, chunkEnd, query.unit)
+		if err != nil {
+			log.Warningf(context, "Error loading elements for api user [%s] from [%s] to [%s]: %v", user.Email, chunkStart, chunkEnd, err)
+			http.Error(writer, fmt.Sprintf("Error loading data: %v", err), 500)
+			return
+		}
+
+		for _, element := range chunk {
+			// Leave out what the previous chunk or page already has
+			if element.timestamp < chunkStart.Unix()*1000 || element.timestamp > chunkEnd.Unix()*1000+999 || element.timestamp < query.cursorTimestamp {
+				continue
+			}
+
+			if element.timestamp == query.cursorTimestamp && skipped < query.cursorSkip {
+				skipped = skipped + 1
+				continue
+			}
+
+			elements = append(elements, element)
+		}
+
+		chunkStart = chunkEnd.Add(time.Second)
+	}
+
+	page := ApiPage{Data: make([]interface{}, 0, query.limit)}
+	if len(elements) > query.limit {
+		elements = elements[:query.limit]
+		page.NextCursor = newApiCursor(query, elements)
+	}
+
+	for _, element := range elements {
+		page.Data = append(page.Data, element.value)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(page)
+}
+
+// newApiQuery parses the from/to/limit/cursor/unit parameters of an api request
+func newApiQuery(request *http.Request) (query *apiQuery, err error) {
+	query = new(apiQuery)
+	query.upperBound = time.Now()
+	query.limit = API_DEFAULT_LIMIT
+
+	if to := request.FormValue(QUERY_PARAM_TO); len(to) > 0 {
+		toValue, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_TO, err))
+		}
+		query.upperBound = time.Unix(toValue, 0)
+	}
+
+	query.lowerBound = query.upperBound.Add(model.DEFAULT_LOOKBACK_PERIOD)
+	if from := request.FormValue(QUERY_PARAM_FROM); len(from) > 0 {
+		fromValue, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_FROM, err))
+		}
+		query.lowerBound = time.Unix(fromValue, 0)
+	}
+
+	if query.lowerBound.After(query.upperBound) {
+		return nil, errors.New(fmt.Sprintf("Invalid range, %s is after %s.", QUERY_PARAM_FROM, QUERY_PARAM_TO))
+	}
+
+	if query.upperBound.Sub(query.lowerBound) > API_MAX_QUERY_PERIOD {
+		return nil, errors.New(fmt.Sprintf("Invalid range, %s and %s can't be more than %d days apart.", QUERY_PARAM_FROM, QUERY_PARAM_TO,
+			API_MAX_QUERY_PERIOD/(24*time.Hour)))
+	}
+
+	if limit := request.FormValue(QUERY_PARAM_LIMIT); len(limit) > 0 {
+		if query.limit, err = strconv.Atoi(limit); err != nil || query.limit < 1 || query.limit > API_MAX_LIMIT {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: must be between 1 and %d.", QUERY_PARAM_LIMIT, API_MAX_LIMIT))
+		}
+	}
+
+	if unit := request.FormValue(GLUCOSE_UNIT_PARAMETER); len(unit) > 0 {
+		if unit != apimodel.MG_PER_DL && unit != apimodel.MMOL_PER_L {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%s] is not one of [%s, %s].", GLUCOSE_UNIT_PARAMETER, unit,
+				apimodel.MG_PER_DL, apimodel.MMOL_PER_L))
+		}
+		unitValue := apimodel.GlucoseUnit(unit)
+		query.unit = &unitValue
+	}
+
+	if cursor := request.FormValue(QUERY_PARAM_CURSOR); len(cursor) > 0 {
+		if query.cursorTimestamp, query.cursorSkip, err = parseApiCursor(cursor); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%s].", QUERY_PARAM_CURSOR, cursor))
+		}
+
+		// Start from the last element of the previous page rather than the beginning of the range
+		if cursorTime := time.Unix(query.cursorTimestamp/1000, 0); cursorTime.After(query.lowerBound) {
+			query.lowerBound = cursorTime
+		}
+	}
+
+	return query, nil
+}
+
+// newApiCursor returns the cursor of the page that follows the elements. It's made of the timestamp of the last element and the
+// number of elements of the page and of previous pages with that same timestamp.
+func newApiCursor(query *apiQuery, elements []apiElement) string {
+	lastTimestamp := elements[len(elements)-1].timestamp
+	skip := 0
+	if lastTimestamp == query.cursorTimestamp {
+		skip = query.cursorSkip
+	}
+
+	for i := len(elements) - 1; i >= 0 && elements[i].timestamp == lastTimestamp; i-- {
+		skip = skip + 1
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", lastTimestamp, skip)))
+}
+
+func parseApiCursor(cursor string) (timestamp int64, skip int, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	parts := strings.Split(string(decoded), ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("Invalid cursor")
+	}
+
+	if timestamp, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+
+	if skip, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, err
+	}
+
+	return timestamp, skip, nil
+}
@@ -0,0 +1,29 @@
+package web
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewApiQueryBoundsTheRange(t *testing.T) {
+	to := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []struct {
+		from  time.Time
+		valid bool
+	}{
+		{to.Add(-API_MAX_QUERY_PERIOD), true},
+		{to.Add(-API_MAX_QUERY_PERIOD - time.Second), false},
+		{time.Unix(0, 0), false},
+	}
+
+	for _, r := range ranges {
+		request := httptest.NewRequest("GET", "/v1/glucosereads?"+QUERY_PARAM_FROM+"="+strconv.FormatInt(r.from.Unix(), 10)+"&"+
+			QUERY_PARAM_TO+"="+strconv.FormatInt(to.Unix(), 10), nil)
+		if _, err := newApiQuery(request); (err == nil) != r.valid {
+			t.Errorf("TestNewApiQueryBoundsTheRange failed: got error [%v] from [%s] to [%s] but expected valid [%t]", err, r.from, to,
+				r.valid)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package web
 
 import (
 	"bytes"
@@ -6,13 +6,12 @@ import (
 	"github.com/alexandre-normand/glukit/app/apimodel"
 	"github.com/alexandre-normand/glukit/app/engine"
 	"github.com/alexandre-normand/glukit/app/importer"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"io"
 	"net/http"
 	"strings"
@@ -34,38 +33,37 @@ var BERNSTEIN_BIRTH_DATE, _ = time.Parse(util.TIMEFORMAT_NO_TZ, "1934-06-17 00:0
 func initializeGlukitBernstein(writer http.ResponseWriter, reader *http.Request) {
 	context := appengine.NewContext(reader)
 
-	_, _, _, err := store.GetUserData(context, GLUKIT_BERNSTEIN_EMAIL)
-	if err == datastore.ErrNoSuchEntity {
+	_, _, err := repository.GetUserData(context, GLUKIT_BERNSTEIN_EMAIL)
+	if err == store.ErrNoSuchUser {
 		log.Infof(context, "No data found for glukit bernstein user [%s], creating it", GLUKIT_BERNSTEIN_EMAIL)
-		userProfileKey, err := store.StoreUserProfile(context, time.Now(),
+		err := repository.StoreUserProfile(context, time.Now(),
 			model.GlukitUser{GLUKIT_BERNSTEIN_EMAIL, "Glukit", "Bernstein", BERNSTEIN_BIRTH_DATE, model.DIABETES_TYPE_1, "America/New_York", time.Now(),
-				BERNSTEIN_MOST_RECENT_READ, model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, true, "", time.Now(), model.UNDEFINED_A1C_ESTIMATE})
+				BERNSTEIN_MOST_RECENT_READ, model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, true, "", time.Now(), model.UNDEFINED_A1C_ESTIMATE, model.DEFAULT_GLUCOSE_TARGETS, model.SailingProfile{}, false})
 		if err != nil {
 			util.Propagate(err)
 		}
 
 		fileReader := generateBernsteinData(context)
-		lastReadTime, err := importer.ParseContent(context, fileReader, userProfileKey, util.GLUKIT_EPOCH_TIME,
-			store.StoreDaysOfReads, store.StoreDaysOfMeals, store.StoreDaysOfInjections, store.StoreDaysOfExercises)
+		lastReadTime, err := importer.ParseContent(context, fileReader, repository, GLUKIT_BERNSTEIN_EMAIL, util.GLUKIT_EPOCH_TIME)
 
 		if err != nil {
 			util.Propagate(err)
 		}
 
-		store.LogFileImport(context, userProfileKey, model.FileImportLog{Id: "bernstein", Md5Checksum: "dummychecksum",
+		repository.LogFileImport(context, GLUKIT_BERNSTEIN_EMAIL, model.FileImportLog{Id: "bernstein", Md5Checksum: "dummychecksum",
 			LastDataProcessed: lastReadTime, ImportResult: "Success"})
 
-		if glukitUser, err := store.GetUserProfile(context, userProfileKey); err != nil {
+		if glukitUser, err := repository.GetUserProfile(context, GLUKIT_BERNSTEIN_EMAIL); err != nil {
 			log.Warningf(context, "Error getting retrieving GlukitUser [%s], this needs attention: [%v]", GLUKIT_BERNSTEIN_EMAIL, err)
 		} else {
 			// Start batch calculation of the glukit scores
-			err := engine.StartGlukitScoreBatch(context, glukitUser)
+			err := engine.StartGlukitScoreBatch(context, jobQueue, glukitUser)
 
 			if err != nil {
 				log.Warningf(context, "Error starting batch calculation of GlukitScores for [%s], this needs attention: [%v]", GLUKIT_BERNSTEIN_EMAIL, err)
 			}
 
-			err = engine.StartA1CCalculationBatch(context, glukitUser)
+			err = engine.StartA1CCalculationBatch(context, jobQueue, glukitUser)
 			if err != nil {
 				log.Warningf(context, "Error starting batch calculation of a1cs for [%s], this needs attention: [%v]", GLUKIT_BERNSTEIN_EMAIL, err)
 			}
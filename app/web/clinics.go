@@ -0,0 +1,275 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The id of the clinic of practitioner and enrollment requests
+	QUERY_PARAM_CLINIC = "clinic"
+	// The value patients are sorted on, one of the engine's PATIENT_SORT values
+	QUERY_PARAM_SORT = "sort"
+	// The order patients are sorted in, ascending or descending
+	QUERY_PARAM_ORDER = "order"
+	// The type of diabetes of the patients to list
+	QUERY_PARAM_DIABETES_TYPE = "type"
+	// Text matched against the name and email of the patients to list
+	QUERY_PARAM_SEARCH = "search"
+	// Only list patients who didn't sync since this unix timestamp
+	QUERY_PARAM_NOT_SYNCED_SINCE = "notSyncedSince"
+
+	SORT_ORDER_ASCENDING  = "asc"
+	SORT_ORDER_DESCENDING = "desc"
+)
+
+// clinicEnrollmentRequest is the document a patient sends to enroll in a clinic
+type clinicEnrollmentRequest struct {
+	Code string `json:"code"`
+}
+
+// storeClinic is the endpoint that creates a clinic from a json Clinic document or, if it has the id of an existing one, changes its
+// name and practitioners. It's restricted to administrators.
+func storeClinic(writer http.ResponseWriter, request *http.Request) {
+	if !authProvider.IsAdmin(request) {
+		http.Error(writer, "Administrator access required", http.StatusForbidden)
+		return
+	}
+
+	context := appengine.NewContext(request)
+
+	var document model.Clinic
+	if err := json.NewDecoder(request.Body).Decode(&document); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid clinic: [%v].", err), 400)
+		return
+	}
+
+	if err := document.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	var clinic *model.Clinic
+	var err error
+	if len(document.Id) > 0 {
+		if clinic, err = repository.GetClinic(context, document.Id); err == store.ErrNoSuchClinic {
+			http.Error(writer, err.Error(), 404)
+			return
+		} else if err != nil {
+			util.Propagate(err)
+		}
+
+		clinic.Name = document.Name
+		clinic.PractitionerEmails = document.PractitionerEmails
+		*clinic = clinic.NormalizePractitionerEmails()
+	} else if clinic, err = engine.NewClinic(document.Name, document.PractitionerEmails, time.Now()); err != nil {
+		util.Propagate(err)
+	}
+
+	if err := repository.StoreClinic(context, *clinic); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Stored clinic [%s] with id [%s] and practitioners %v", clinic.Name, clinic.Id, clinic.PractitionerEmails)
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(clinic)
+}
+
+// practitionerClinics is the endpoint to retrieve the clinics the active user is a practitioner of
+func practitionerClinics(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	clinics, err := repository.GetClinicsByPractitioner(context, model.NormalizeEmail(user.Email))
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeClinicDocuments(writer, clinics)
+}
+
+// resolvePractitionerClinic returns the clinic of the request if the active user is one of its practitioners. Requests for other
+// clinics get a 403 and ok is false.
+func resolvePractitionerClinic(writer http.ResponseWriter, request *http.Request) (clinic *model.Clinic, ok bool) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	clinicId := request.FormValue(QUERY_PARAM_CLINIC)
+	if len(clinicId) == 0 {
+		http.Error(writer, fmt.Sprintf("Missing %s.", QUERY_PARAM_CLINIC), 400)
+		return nil, false
+	}
+
+	clinic, err := repository.GetClinic(context, clinicId)
+	if err != nil && err != store.ErrNoSuchClinic {
+		util.Propagate(err)
+	}
+
+	if clinic == nil || !clinic.HasPractitioner(user.Email) {
+		log.Warningf(context, "Denied access of user [%s] to clinic [%s]", user.Email, clinicId)
+		http.Error(writer, fmt.Sprintf("Not a practitioner of clinic [%s].", clinicId), http.StatusForbidden)
+		return nil, false
+	}
+
+	return clinic, true
+}
+
+// createClinicInvite is the endpoint that creates an invite code for a patient to enroll in a clinic of the active practitioner
+func createClinicInvite(writer http.ResponseWriter, request *http.Request) {
+	clinic, ok := resolvePractitionerClinic(writer, request)
+	if !ok {
+		return
+	}
+
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	invite, err := engine.NewClinicInvite(*clinic, user.Email, time.Now())
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if err := repository.StoreClinicInvite(context, *invite); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Practitioner [%s] created an invite to clinic [%s]", user.Email, clinic.Id)
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(invite)
+}
+
+// clinicPatients is the endpoint that lists the summaries of the patients of a clinic of the active practitioner, optionally filtered
+// and sorted by name by default. The reports of each patient are available to practitioners through the subject parameter of the
+// report endpoints.
+func clinicPatients(writer http.ResponseWriter, request *http.Request) {
+	clinic, ok := resolvePractitionerClinic(writer, request)
+	if !ok {
+		return
+	}
+
+	context := appengine.NewContext(request)
+
+	filter := engine.PatientFilter{DiabetesType: request.FormValue(QUERY_PARAM_DIABETES_TYPE), Search: request.FormValue(QUERY_PARAM_SEARCH)}
+	if value := request.FormValue(QUERY_PARAM_NOT_SYNCED_SINCE); len(value) > 0 {
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_NOT_SYNCED_SINCE, err), 400)
+			return
+		}
+
+		notSyncedSince := time.Unix(timestamp, 0)
+		filter.NotSyncedSince = &notSyncedSince
+	}
+
+	sortBy := engine.PATIENT_SORT_NAME
+	if value := request.FormValue(QUERY_PARAM_SORT); len(value) > 0 {
+		sortBy = value
+	}
+
+	order := request.FormValue(QUERY_PARAM_ORDER)
+	if order != "" && order != SORT_ORDER_ASCENDING && order != SORT_ORDER_DESCENDING {
+		http.Error(writer, fmt.Sprintf("Invalid %s [%s], expected %s or %s.", QUERY_PARAM_ORDER, order, SORT_ORDER_ASCENDING,
+			SORT_ORDER_DESCENDING), 400)
+		return
+	}
+
+	summaries, err := engine.SummarizeClinicPatients(context, repository, clinic.Id)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	summaries = engine.FilterPatientSummaries(summaries, filter)
+	if err := engine.SortPatientSummaries(summaries, sortBy, order == SORT_ORDER_DESCENDING); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	writeClinicDocuments(writer, summaries)
+}
+
+// clinicEnrollments is the endpoint to retrieve the clinics the active user is enrolled in
+func clinicEnrollments(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	enrollments, err := repository.GetClinicEnrollmentsByPatient(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeClinicDocuments(writer, enrollments)
+}
+
+// enrollInClinic is the endpoint that enrolls the active user in a clinic with an invite code from one of its practitioners. Enrolling
+// gives the practitioners of the clinic read-only access to all the data of the user.
+func enrollInClinic(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var enrollmentRequest clinicEnrollmentRequest
+	if err := json.NewDecoder(request.Body).Decode(&enrollmentRequest); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid clinic enrollment: [%v].", err), 400)
+		return
+	}
+
+	enrollment, err := engine.EnrollInClinic(context, repository, user.Email, enrollmentRequest.Code, time.Now())
+	if err == store.ErrNoSuchClinicInvite {
+		http.Error(writer, err.Error(), 404)
+		return
+	} else if err == engine.ErrClinicInviteNotRedeemable {
+		http.Error(writer, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(enrollment)
+}
+
+// withdrawFromClinic is the endpoint that withdraws the active user from a clinic, revoking the access of its practitioners
+func withdrawFromClinic(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	clinicId := request.FormValue(QUERY_PARAM_CLINIC)
+	if len(clinicId) == 0 {
+		http.Error(writer, fmt.Sprintf("Missing %s.", QUERY_PARAM_CLINIC), 400)
+		return
+	}
+
+	err := repository.DeleteClinicEnrollment(context, user.Email, clinicId)
+	if err == store.ErrNoClinicEnrollment {
+		http.Error(writer, err.Error(), 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] withdrew from clinic [%s]", user.Email, clinicId)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeClinicDocuments(writer http.ResponseWriter, documents interface{}) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(documents)
+}
@@ -0,0 +1,171 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClinicEnrollmentGivesPractitionersAccess(t *testing.T) {
+	setupTestEnvironment(t)
+
+	c := context.Background()
+	clinic, err := engine.NewClinic("Endocrinology", []string{"Doctor@Glukit.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repository.StoreClinic(c, *clinic); err != nil {
+		t.Fatal(err)
+	}
+
+	patient := model.GlukitUser{Email: "patient@glukit.com", FirstName: "Patient", DiabetesType: model.DIABETES_TYPE_1,
+		MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, MostRecentScore: model.UNDEFINED_SCORE, MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE,
+		Targets: model.DEFAULT_GLUCOSE_TARGETS}
+	if err := repository.StoreUserProfile(c, time.Now(), patient); err != nil {
+		t.Fatal(err)
+	}
+
+	clinicQuery := "?" + QUERY_PARAM_CLINIC + "=" + url.QueryEscape(clinic.Id)
+	if response := serveTestRequest(httptest.NewRequest("POST", "/clinics/invites"+clinicQuery, nil), "stranger@glukit.com"); response.Code !=
+		http.StatusForbidden {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] creating an invite to another clinic but expected [%d]",
+			response.Code, http.StatusForbidden)
+	}
+
+	response := serveTestRequest(httptest.NewRequest("POST", "/clinics/invites"+clinicQuery, nil), "doctor@glukit.com")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] creating an invite but expected [%d]", response.Code,
+			http.StatusCreated)
+	}
+
+	var invite model.ClinicInvite
+	if err := json.NewDecoder(response.Body).Decode(&invite); err != nil {
+		t.Fatal(err)
+	}
+
+	subjectQuery := "?" + QUERY_PARAM_SUBJECT + "=" + url.QueryEscape(patient.Email)
+	if response := serveTestRequest(httptest.NewRequest("GET", "/labA1Cs"+subjectQuery, nil), "doctor@glukit.com"); response.Code !=
+		http.StatusForbidden {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] reading the data of a patient before enrollment but expected [%d]",
+			response.Code, http.StatusForbidden)
+	}
+
+	enrollment := strings.NewReader(`{"code": "` + strings.ToLower(invite.Code) + `"}`)
+	if response := serveTestRequest(httptest.NewRequest("POST", "/clinics/enrollments", enrollment), patient.Email); response.Code !=
+		http.StatusCreated {
+		t.Fatalf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] enrolling but expected [%d]", response.Code, http.StatusCreated)
+	}
+
+	enrollment = strings.NewReader(`{"code": "` + invite.Code + `"}`)
+	if response := serveTestRequest(httptest.NewRequest("POST", "/clinics/enrollments", enrollment), "sibling@glukit.com"); response.Code !=
+		http.StatusGone {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] redeeming an invite twice but expected [%d]", response.Code,
+			http.StatusGone)
+	}
+
+	response = serveTestRequest(httptest.NewRequest("GET", "/clinics/patients"+clinicQuery, nil), "doctor@glukit.com")
+	var summaries []model.PatientSummary
+	if err := json.NewDecoder(response.Body).Decode(&summaries); err != nil {
+		t.Fatalf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] listing patients: %v", response.Code, err)
+	}
+
+	if len(summaries) != 1 || summaries[0].Email != patient.Email {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got patients [%v] but expected [%s]", summaries, patient.Email)
+	}
+
+	if response := serveTestRequest(httptest.NewRequest("GET", "/clinics/patients"+clinicQuery, nil), "stranger@glukit.com"); response.Code !=
+		http.StatusForbidden {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] listing the patients of another clinic but expected [%d]",
+			response.Code, http.StatusForbidden)
+	}
+
+	// The patient doesn't have reads yet so there are no metrics
+	for path, code := range map[string]int{"/labA1Cs": http.StatusOK, "/metrics": http.StatusNoContent} {
+		if response := serveTestRequest(httptest.NewRequest("GET", path+subjectQuery, nil), "doctor@glukit.com"); response.Code != code {
+			t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] reading [%s] of a patient but expected [%d]", response.Code,
+				path, code)
+		}
+	}
+
+	accesses, err := repository.GetViewerAccesses(c, patient.Email, DEFAULT_VIEWER_ACCESSES_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 2 || accesses[0].ViewerEmail != "doctor@glukit.com" {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got accesses [%v] but expected the two of [doctor@glukit.com]", accesses)
+	}
+
+	if response := serveTestRequest(httptest.NewRequest("DELETE", "/clinics/enrollments"+clinicQuery, nil), patient.Email); response.Code !=
+		http.StatusNoContent {
+		t.Fatalf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] withdrawing but expected [%d]", response.Code,
+			http.StatusNoContent)
+	}
+
+	if response := serveTestRequest(httptest.NewRequest("GET", "/labA1Cs"+subjectQuery, nil), "doctor@glukit.com"); response.Code !=
+		http.StatusForbidden {
+		t.Errorf("TestClinicEnrollmentGivesPractitionersAccess failed: got [%d] reading the data of a patient after withdrawal but expected [%d]",
+			response.Code, http.StatusForbidden)
+	}
+}
+
+func TestClinicAccessToPatientsEnrolledWithMixedCaseEmails(t *testing.T) {
+	setupTestEnvironment(t)
+
+	c := context.Background()
+	clinic, err := engine.NewClinic("Endocrinology", []string{"doctor@glukit.com"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repository.StoreClinic(c, *clinic); err != nil {
+		t.Fatal(err)
+	}
+
+	invite, err := engine.NewClinicInvite(*clinic, "doctor@glukit.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repository.StoreClinicInvite(c, *invite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Patients signed in with an email that isn't normalized have their data and enrollments stored under it
+	patient := model.GlukitUser{Email: "Patient@Glukit.com", FirstName: "Patient", DiabetesType: model.DIABETES_TYPE_1,
+		MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, MostRecentScore: model.UNDEFINED_SCORE, MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE,
+		Targets: model.DEFAULT_GLUCOSE_TARGETS}
+	if err := repository.StoreUserProfile(c, time.Now(), patient); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.EnrollInClinic(c, repository, patient.Email, invite.Code, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	subjectQuery := "?" + QUERY_PARAM_SUBJECT + "=" + url.QueryEscape("patient@glukit.com")
+	if response := serveTestRequest(httptest.NewRequest("GET", "/labA1Cs"+subjectQuery, nil), "doctor@glukit.com"); response.Code !=
+		http.StatusOK {
+		t.Errorf("TestClinicAccessToPatientsEnrolledWithMixedCaseEmails failed: got [%d] reading the data of a patient but expected [%d]",
+			response.Code, http.StatusOK)
+	}
+
+	accesses, err := repository.GetViewerAccesses(c, patient.Email, DEFAULT_VIEWER_ACCESSES_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 1 || accesses[0].ViewerEmail != "doctor@glukit.com" {
+		t.Errorf("TestClinicAccessToPatientsEnrolledWithMixedCaseEmails failed: got accesses [%v] under [%s] but expected the one of [doctor@glukit.com]",
+			accesses, patient.Email)
+	}
+}
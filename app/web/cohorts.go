@@ -0,0 +1,116 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"time"
+)
+
+// cohortMembership is the document of the endpoints to see and change whether a user is part of the cohort distributions
+type cohortMembership struct {
+	OptIn bool `json:"optIn"`
+}
+
+func cohortRankings(writer http.ResponseWriter, request *http.Request) {
+	user := authProvider.CurrentUser(request)
+
+	cohortRankingsForEmail(writer, request, user.Email)
+}
+
+func cohortRankingsForDemo(writer http.ResponseWriter, request *http.Request) {
+	cohortRankingsForEmail(writer, request, DEMO_EMAIL)
+}
+
+// cohortRankingsForEmail is the endpoint to retrieve how the glukit score, time in range and a1c estimate of a user rank within the
+// cohorts of users with the same type of diabetes, of all ages and of their age band. Rankings come from the most recent aggregation
+// of the cohorts and a new one is started if it's stale.
+func cohortRankingsForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	aggregation, err := repository.GetCohortAggregation(context)
+	if err != nil && err != store.ErrNoCohortAggregation {
+		util.Propagate(err)
+	}
+
+	if aggregation == nil || engine.IsCohortAggregationStale(*aggregation, time.Now()) {
+		if err := engine.StartCohortAggregation(context, jobQueue); err != nil {
+			log.Warningf(context, "Error starting cohort aggregation: %v", err)
+		}
+	}
+
+	if aggregation == nil {
+		http.Error(writer, "Cohorts not aggregated yet.", 204)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	rankings, err := engine.RankInCohorts(context, repository, *glukitUser, *aggregation, time.Now())
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(rankings) == 0 {
+		http.Error(writer, "No cohort large enough to rank in.", 204)
+		return
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(rankings)
+}
+
+// cohortMembershipReport is the endpoint to retrieve whether the active user is part of the cohort distributions
+func cohortMembershipReport(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeCohortMembership(writer, cohortMembership{OptIn: glukitUser.CohortOptIn})
+}
+
+// updateCohortMembership is the endpoint to opt in or out of the cohort distributions. The change shows in the distributions of the
+// next aggregation.
+func updateCohortMembership(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var membership cohortMembership
+	if err := json.NewDecoder(request.Body).Decode(&membership); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid cohort membership: [%v].", err), 400)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	glukitUser.CohortOptIn = membership.OptIn
+	if err := repository.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Updated the cohort membership of user [%s] to [%t]", user.Email, membership.OptIn)
+
+	writeCohortMembership(writer, membership)
+}
+
+func writeCohortMembership(writer http.ResponseWriter, membership cohortMembership) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(membership)
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"time"
+)
+
+const (
+	ACCOUNT_DELETION_JOB_NAME = "deleteAccount"
+
+	DELETION_MODE_PARAMETER = "mode"
+	// Deletes the user's data and profile and revokes the user's tokens and api secret
+	DELETION_MODE_ACCOUNT = "account"
+	// Deletes the user's data but keeps the profile and access to the account
+	DELETION_MODE_DATA = "data"
+
+	// The number of elements deleted by each run of the deletion job
+	ACCOUNT_DELETION_CHUNK_SIZE = 500
+)
+
+// requestAccountDeletion is the endpoint that starts the deletion of the active user's data in the background. The mode
+// parameter is either account (the default) to delete the whole account or data to delete the data but keep the account. When
+// deleting the account, the user's oauth tokens are revoked right away. The state of the deletion is returned. Requesting another
+// mode while a deletion is in progress is a conflict.
+func requestAccountDeletion(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	mode := request.FormValue(DELETION_MODE_PARAMETER)
+	if mode == "" {
+		mode = DELETION_MODE_ACCOUNT
+	}
+
+	if mode != DELETION_MODE_ACCOUNT && mode != DELETION_MODE_DATA {
+		http.Error(writer, fmt.Sprintf("Invalid value for %s: [%s] is not one of [%s, %s].", DELETION_MODE_PARAMETER, mode,
+			DELETION_MODE_ACCOUNT, DELETION_MODE_DATA), 400)
+		return
+	}
+
+	deletion, err := repository.GetAccountDeletion(context, user.Email)
+	if err != nil && err != store.ErrNoAccountDeletion {
+		util.Propagate(err)
+	}
+
+	if err == store.ErrNoAccountDeletion || deletion.Status == model.ACCOUNT_DELETION_STATUS_DONE {
+		deletion = &model.AccountDeletion{KeepAccount: mode == DELETION_MODE_DATA, Status: model.ACCOUNT_DELETION_STATUS_PENDING, RequestedOn: time.Now()}
+		if err := repository.StoreAccountDeletion(context, user.Email, *deletion); err != nil {
+			util.Propagate(err)
+		}
+
+		if err := jobQueue.Enqueue(context, DATASTORE_WRITES_QUEUE_NAME, queue.Job{Name: ACCOUNT_DELETION_JOB_NAME, UserEmail: user.Email}); err != nil {
+			util.Propagate(err)
+		}
+
+		log.Infof(context, "Queued deletion of user [%s] with mode [%s]", user.Email, mode)
+	} else if deletion.KeepAccount != (mode == DELETION_MODE_DATA) {
+		http.Error(writer, fmt.Sprintf("A deletion of user [%s] with another mode is already in progress.", user.Email), http.StatusConflict)
+		return
+	}
+
+	if !deletion.KeepAccount {
+		if revoker, ok := newOsinStorage(request).(store.TokenRevoker); ok {
+			if err := revoker.RevokeUserTokens(context, user.Email); err != nil {
+				util.Propagate(err)
+			}
+		} else {
+			log.Warningf(context, "Oauth storage can't revoke tokens, tokens of user [%s] will expire on their own", user.Email)
+		}
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(writer)
+	enc.Encode(deletion)
+}
+
+// accountDeletionStatus is the endpoint that returns the state of the active user's account deletion
+func accountDeletionStatus(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	deletion, err := repository.GetAccountDeletion(context, user.Email)
+	if err == store.ErrNoAccountDeletion {
+		http.Error(writer, "No account deletion requested", 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(deletion)
+}
+
+// runAccountDeletion deletes a chunk of ACCOUNT_DELETION_CHUNK_SIZE elements of the user's data and queues itself until
+// there's nothing left to delete. This keeps each run short and lets the deletion resume where it left off after a failure.
+// When keeping the account, the profile is reset to what it was before any data was imported.
+func runAccountDeletion(context context.Context, email string) (err error) {
+	deletion, err := repository.GetAccountDeletion(context, email)
+	if err != nil {
+		return err
+	}
+
+	if deletion.Status == model.ACCOUNT_DELETION_STATUS_DONE {
+		log.Infof(context, "Deletion of user [%s] already done, skipping", email)
+		return nil
+	}
+
+	deleted, err := repository.DeleteUserData(context, email, deletion.KeepAccount, ACCOUNT_DELETION_CHUNK_SIZE)
+	if err != nil {
+		return err
+	}
+
+	deletion.Deleted = deletion.Deleted + deleted
+	if deleted > 0 {
+		deletion.Status = model.ACCOUNT_DELETION_STATUS_RUNNING
+		if err = repository.StoreAccountDeletion(context, email, *deletion); err != nil {
+			return err
+		}
+
+		log.Infof(context, "Deleted [%d] elements for user [%s], queuing next chunk", deleted, email)
+		return jobQueue.Enqueue(context, DATASTORE_WRITES_QUEUE_NAME, queue.Job{Name: ACCOUNT_DELETION_JOB_NAME, UserEmail: email})
+	}
+
+	if deletion.KeepAccount {
+		userProfile, err := repository.GetUserProfile(context, email)
+		if err != nil {
+			return err
+		}
+
+		userProfile.MostRecentRead = apimodel.UNDEFINED_GLUCOSE_READ
+		userProfile.BestScore = model.UNDEFINED_SCORE
+		userProfile.MostRecentScore = model.UNDEFINED_SCORE
+		userProfile.MostRecentA1C = model.UNDEFINED_A1C_ESTIMATE
+		if err = repository.StoreUserProfile(context, time.Now(), *userProfile); err != nil {
+			return err
+		}
+	}
+
+	deletion.Status = model.ACCOUNT_DELETION_STATUS_DONE
+	deletion.CompletedOn = time.Now()
+	log.Infof(context, "Deletion of user [%s] done, deleted [%d] elements", email, deletion.Deleted)
+
+	return repository.StoreAccountDeletion(context, email, *deletion)
+}
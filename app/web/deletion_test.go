@@ -0,0 +1,27 @@
+package web
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAccountDeletionRejectsAnotherModeWhileInProgress(t *testing.T) {
+	setupTestEnvironment(t)
+
+	deletion := model.AccountDeletion{KeepAccount: true, Status: model.ACCOUNT_DELETION_STATUS_RUNNING, RequestedOn: time.Now()}
+	if err := repository.StoreAccountDeletion(context.Background(), "patient@glukit.com", deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	for mode, code := range map[string]int{DELETION_MODE_ACCOUNT: http.StatusConflict, DELETION_MODE_DATA: http.StatusAccepted} {
+		request := httptest.NewRequest("POST", "/account/deletion?"+DELETION_MODE_PARAMETER+"="+mode, nil)
+		if response := serveTestRequest(request, "patient@glukit.com"); response.Code != code {
+			t.Errorf("TestAccountDeletionRejectsAnotherModeWhileInProgress failed: got [%d] requesting the [%s] mode but expected [%d]",
+				response.Code, mode, code)
+		}
+	}
+}
@@ -0,0 +1,915 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/payment"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"github.com/grd/stat"
+	"google.golang.org/appengine"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Represents a DataResponse with an array of DataSeries and some metadata
+type DataResponse struct {
+	FirstName    string            `json:"firstName"`
+	LastName     string            `json:"lastName"`
+	Picture      string            `json:"picture"`
+	LastSync     time.Time         `json:"lastSync"`
+	Score        *int64            `json:"score"`
+	ScoreDetails model.GlukitScore `json:"scoreDetails"`
+	JoinedOn     time.Time         `json:"joinedOn"`
+	Data         []DataSeries      `json:"data"`
+	Trend        string            `json:"trend"`
+}
+
+// Represents a generic DataSeries structure with a series of DataPoints
+type DataSeries struct {
+	Name string               `json:"name"`
+	Data []apimodel.DataPoint `json:"data"`
+	Type string               `json:"type"`
+}
+
+const (
+	QUERY_PARAM_LIMIT = "limit"
+	QUERY_PARAM_FROM  = "from"
+	QUERY_PARAM_TO    = "to"
+	QUERY_PARAM_LOW   = "low"
+	QUERY_PARAM_HIGH  = "high"
+	// The scoring version of glukit scores and a1c estimates, the current version by default
+	QUERY_PARAM_VERSION = "version"
+	// The email of the user whose data is read, the active user by default. Other users must have granted access to their data.
+	QUERY_PARAM_SUBJECT = "subject"
+
+	// The window of reads metrics are calculated over when the request doesn't have a lower bound
+	DEFAULT_METRICS_PERIOD_IN_DAYS = 14
+	// The window of episodes returned when the request doesn't have a lower bound
+	DEFAULT_EPISODES_PERIOD_IN_DAYS = 28
+	// The window of meals analyzed when the request doesn't have a lower bound
+	DEFAULT_MEAL_ANALYSIS_PERIOD_IN_DAYS = 28
+)
+
+// glycemicEpisodes is the response of the episodes endpoint
+type glycemicEpisodes struct {
+	// The episodes of the window, most recent first
+	Episodes     []model.GlycemicEpisode     `json:"episodes"`
+	WeeklyCounts []model.WeeklyEpisodeCounts `json:"weeklyCounts"`
+}
+
+// personalData renders the most recent week of data as json for the active user or a user who granted them access to their live data
+func personalData(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_LIVE_DATA); ok {
+		mostRecentWeekAsJson(writer, request, email)
+	}
+}
+
+// demoContent renders the most recent day's worth of data as json for the demo user
+func demoContent(writer http.ResponseWriter, request *http.Request) {
+	mostRecentWeekAsJson(writer, request, DEMO_EMAIL)
+}
+
+// mostRecentWeekAsJson retrieves the most recent day's week worth of data for the user identified by
+// the given email address and writes to the response writer as json
+func mostRecentWeekAsJson(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+	glukitUser, upperBound, err := repository.GetUserData(context, email)
+	lowerBound := util.GetEndOfDayBoundaryBefore(upperBound).Add(model.DEFAULT_LOOKBACK_PERIOD)
+
+	if err != nil && err == store.ErrNoImportedDataFound {
+		log.Debugf(context, "No imported data found for user [%s]", email)
+		http.Error(writer, err.Error(), 204)
+	} else if err != nil {
+		util.Propagate(err)
+	} else {
+		unitValue, err := resolveGlucoseUnit(email, request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+		injections, err := repository.GetInjections(context, email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+		carbs, err := repository.GetMeals(context, email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+		exercises, err := repository.GetExercises(context, email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		onBoardSeries, err := generateOnBoardDataSeries(context, email, lowerBound, upperBound, glukitUser.MostRecentRead.Time.TimeZoneId)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		forecastSeries, err := generateForecastDataSeries(context, email, upperBound, glukitUser.MostRecentRead.Time.TimeZoneId, *unitValue)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		trend, rateOfChangeSeries, err := generateTrendDataSeries(reads, *unitValue)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		value := writer.Header()
+		value.Add("Content-type", "application/json")
+
+		data := append(append(generateDataSeriesFromData(reads, injections, carbs, exercises, *unitValue), onBoardSeries...), forecastSeries...)
+		data = append(data, rateOfChangeSeries)
+		response := DataResponse{FirstName: glukitUser.FirstName, LastName: glukitUser.LastName, Picture: glukitUser.PictureUrl, LastSync: glukitUser.MostRecentRead.GetTime(), Score: engine.CalculateUserFacingScore(glukitUser.MostRecentScore), ScoreDetails: glukitUser.MostRecentScore, JoinedOn: glukitUser.AccountCreated, Data: data, Trend: trend}
+		writeAsJson(writer, response)
+	}
+}
+
+// find the steady sailor and retrieve his most recent day's worth of data.
+func steadySailorData(writer http.ResponseWriter, request *http.Request) {
+	user := authProvider.CurrentUser(request)
+
+	steadySailorDataForEmail(writer, request, user.Email)
+}
+
+// find the steady sailor for the demo user and retrieve his most recent day's worth of data.
+func demoSteadySailorData(writer http.ResponseWriter, request *http.Request) {
+	steadySailorDataForEmail(writer, request, DEMO_EMAIL)
+}
+
+// find the steady sailor and retrieve their most recent day's worth of data.
+func steadySailorDataForEmail(writer http.ResponseWriter, request *http.Request, recipientEmail string) {
+	context := appengine.NewContext(request)
+	steadySailor, upperBound, err := engine.FindSteadySailor(context, repository, recipientEmail, rand.New(rand.NewSource(time.Now().UnixNano())))
+
+	// Overscan by a day so that we have enough data to cover for a partial day of the user's data
+	lowerBound := upperBound.Add(model.DEFAULT_LOOKBACK_PERIOD + time.Duration(-24)*time.Hour)
+	if err != nil && err == store.ErrNoSteadySailorMatchFound {
+		log.Debugf(context, "No steady sailor match found for user [%s]", recipientEmail)
+		http.Error(writer, err.Error(), 204)
+	} else if err != nil {
+		util.Propagate(err)
+	} else {
+		unitValue, err := resolveGlucoseUnit(recipientEmail, request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reads, err := repository.GetGlucoseReads(context, steadySailor.Email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		trend, rateOfChangeSeries, err := generateTrendDataSeries(reads, *unitValue)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		value := writer.Header()
+		value.Add("Content-type", "application/json")
+
+		data := append(generateDataSeriesFromData(reads, nil, nil, nil, *unitValue), rateOfChangeSeries)
+		// Only the anonymized profile of the sailor is shown
+		response := DataResponse{FirstName: steadySailor.DisplayName, Picture: steadySailor.PictureUrl, LastSync: steadySailor.MostRecentRead, Score: engine.CalculateUserFacingScore(steadySailor.MostRecentScore), ScoreDetails: steadySailor.MostRecentScore, Data: data, Trend: trend}
+		writeAsJson(writer, response)
+	}
+}
+
+// writeAsJson writes a DataResponse with its set of GlucoseReads, Injections, Meals and Exercises as json. This is what is called from the javascript
+// front-end to get the data.
+func writeAsJson(writer http.ResponseWriter, response DataResponse) {
+	enc := json.NewEncoder(writer)
+	enc.Encode(response)
+}
+
+func generateDataSeriesFromData(reads []apimodel.GlucoseRead, injections []apimodel.Injection, carbs []apimodel.Meal, exercises []apimodel.Exercise, glucoseUnit apimodel.GlucoseUnit) (dataSeries []DataSeries) {
+	data := make([]DataSeries, 1)
+
+	data[0] = DataSeries{"GlucoseReads", apimodel.GlucoseReadSlice(reads).ToDataPointSlice(glucoseUnit), "GlucoseReads"}
+	var userEvents []apimodel.DataPoint
+	if injections != nil {
+		userEvents = apimodel.MergeDataPointArrays(userEvents, apimodel.InjectionSlice(injections).ToDataPointSlice(reads, glucoseUnit))
+	}
+
+	if carbs != nil {
+		userEvents = apimodel.MergeDataPointArrays(userEvents, apimodel.MealSlice(carbs).ToDataPointSlice(reads, glucoseUnit))
+	}
+
+	// TODO: clean up exercise from all the app or restore it. We won't be using it at the moment as we don't think the exercise data
+	// from the dexcom is good enough
+	// if exercises != nil {
+	// 	userEvents = apimodel.MergeDataPointArrays(userEvents, apimodel.ExerciseSlice(exercises).ToDataPointSlice(reads))
+	// }
+
+	sort.Sort(apimodel.DataPointSlice(userEvents))
+
+	data = append(data, DataSeries{"UserEvents", userEvents, "UserEvents"})
+
+	return data
+}
+
+// generateOnBoardDataSeries calculates the insulin on board and carbs on board series of a user between the lower and upper bounds.
+// Injections and meals are loaded from before the lower bound so that the ones still on board at the lower bound are accounted for.
+func generateOnBoardDataSeries(context context.Context, email string, lowerBound time.Time, upperBound time.Time, timeZoneId string) (dataSeries []DataSeries, err error) {
+	settings := onBoardSettings()
+	scanStart := lowerBound.Add(-settings.MaxActionDuration())
+	injections, err := repository.GetInjections(context, email, scanStart, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	meals, err := repository.GetMeals(context, email, scanStart, upperBound)
+	if err != nil {
+		return nil, err
+	}
+
+	insulinOnBoard, err := engine.CalculateInsulinOnBoard(injections, settings, lowerBound, upperBound, timeZoneId)
+	if err != nil {
+		return nil, err
+	}
+
+	carbsOnBoard, err := engine.CalculateCarbsOnBoard(meals, settings, lowerBound, upperBound, timeZoneId)
+	if err != nil {
+		return nil, err
+	}
+
+	return []DataSeries{DataSeries{"InsulinOnBoard", insulinOnBoard, engine.INSULIN_ON_BOARD_TAG},
+		DataSeries{"CarbsOnBoard", carbsOnBoard, engine.CARBS_ON_BOARD_TAG}}, nil
+}
+
+// generateTrendDataSeries returns the trend at the most recent of the reads (one of the TREND_* values) along with the rate of change
+// series of the reads in the given unit
+func generateTrendDataSeries(reads []apimodel.GlucoseRead, glucoseUnit apimodel.GlucoseUnit) (trend string, dataSeries DataSeries, err error) {
+	trend, err = engine.CalculateTrend(reads)
+	if err != nil {
+		return "", dataSeries, err
+	}
+
+	ratesOfChange, err := engine.CalculateRateOfChange(reads, glucoseUnit)
+	if err != nil {
+		return "", dataSeries, err
+	}
+
+	return trend, DataSeries{"RateOfChange", ratesOfChange, engine.RATE_OF_CHANGE_TAG}, nil
+}
+
+// onBoardSettings returns the insulin action curves and carb absorption model from the configuration or the defaults if they
+// aren't configured
+func onBoardSettings() model.OnBoardSettings {
+	if appConfig.OnBoard != nil {
+		return *appConfig.OnBoard
+	}
+
+	return model.DEFAULT_ONBOARD_SETTINGS
+}
+
+// generateForecastDataSeries forecasts the glucose of a user with the autoregressive model from the data leading to the given time,
+// normally the time of the most recent read. It returns the forecast values along with the low and high bounds of their prediction
+// intervals. The series are empty when there aren't enough recent reads to forecast.
+func generateForecastDataSeries(context context.Context, email string, forecastTime time.Time, timeZoneId string,
+	glucoseUnit apimodel.GlucoseUnit) (dataSeries []DataSeries, err error) {
+	forecastModel, _ := engine.GetForecastModel(engine.AUTOREGRESSIVE_MODEL_NAME)
+	forecast, err := forecastFor(context, email, forecastModel, forecastTime)
+	if err == engine.ErrNotEnoughReadsToForecast {
+		forecast = &model.Forecast{Model: forecastModel.Name(), MadeAt: forecastTime, Points: make([]model.ForecastPoint, 0)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	values, lows, highs, err := engine.ForecastToDataPoints(forecast, timeZoneId, glucoseUnit)
+	if err != nil {
+		return nil, err
+	}
+
+	return []DataSeries{DataSeries{"Forecast", values, engine.FORECAST_TAG}, DataSeries{"ForecastLow", lows, engine.FORECAST_LOW_TAG},
+		DataSeries{"ForecastHigh", highs, engine.FORECAST_HIGH_TAG}}, nil
+}
+
+// forecastFor loads the reads, injections and meals a forecast made at the given time needs and makes it with the given model
+func forecastFor(context context.Context, email string, forecastModel engine.ForecastModel, forecastTime time.Time) (forecast *model.Forecast, err error) {
+	reads, err := repository.GetGlucoseReads(context, email, forecastTime.Add(-engine.FORECAST_HISTORY-engine.MEAL_MAX_READ_GAP), forecastTime)
+	if err != nil {
+		return nil, err
+	}
+
+	scanStart := forecastTime.Add(-engine.FORECAST_HISTORY - onBoardSettings().MaxActionDuration())
+	injections, err := repository.GetInjections(context, email, scanStart, forecastTime)
+	if err != nil {
+		return nil, err
+	}
+
+	meals, err := repository.GetMeals(context, email, scanStart, forecastTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return forecastModel.Forecast(engine.NewForecastInput(forecastTime, reads, injections, meals), engine.FORECAST_HORIZONS)
+}
+
+// dashboard renders the dashboard statistics as json
+func dashboard(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		dashboardDataForUser(writer, request, email)
+	}
+}
+
+// demodashboard renders the dashboard statistics as json for the demo user
+func demoDashboard(writer http.ResponseWriter, request *http.Request) {
+	dashboardDataForUser(writer, request, DEMO_EMAIL)
+}
+
+// dashboardDataForUser retrieves reads and generates dashboard statistics from them
+func dashboardDataForUser(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	_, upperBound, err := repository.GetUserData(context, email)
+	lowerBound := util.GetEndOfDayBoundaryBefore(upperBound).Add(time.Duration(-1*24) * time.Hour)
+
+	if err != nil && err == store.ErrNoImportedDataFound {
+		log.Debugf(context, "No imported data found for user [%s]", email)
+		http.Error(writer, err.Error(), 204)
+	} else if err != nil {
+		util.Propagate(err)
+	} else {
+		reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		writeDashboardDataAsJson(writer, request, reads)
+	}
+}
+
+// writedashboardDataAsJson calculates dashboard statistics from an array of GlucoseReads and writes it
+// as json
+func writeDashboardDataAsJson(writer http.ResponseWriter, request *http.Request, reads []apimodel.GlucoseRead) {
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	var dashboardData model.DashboardData
+	if len(reads) > 0 {
+		sort.Sort(model.ReadStatsSlice(reads))
+		dashboardData.Average = stat.Mean(model.ReadStatsSlice(reads))
+		dashboardData.High, _ = stat.Max(model.ReadStatsSlice(reads))
+		dashboardData.Low, _ = stat.Min(model.ReadStatsSlice(reads))
+		dashboardData.Median = stat.MedianFromSortedData(model.ReadStatsSlice(reads))
+	}
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(dashboardData)
+}
+
+func glukitScores(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_SCORES); ok {
+		glukitScoresForEmail(writer, request, email)
+	}
+}
+
+func glukitScoresForDemo(writer http.ResponseWriter, request *http.Request) {
+	glukitScoresForEmail(writer, request, DEMO_EMAIL)
+}
+
+// glukitScoresForEmail is the endpoint to retrieve a list of glukitscores.
+func glukitScoresForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	scanQuery, err := newScanQuery(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	version, err := parseScoringVersion(request, engine.SCORING_VERSION, func(version int) bool {
+		_, ok := engine.GetGlukitScorer(version)
+		return ok
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	scanQuery.Version = &version
+
+	glukitScores, err := repository.GetGlukitScores(context, email, *scanQuery)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(glukitScores) < 1 {
+		http.Error(writer, "No glukit scores calculated yet.", 204)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(glukitScores)
+}
+
+func a1cEstimates(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_SCORES); ok {
+		a1csForEmail(writer, request, email)
+	}
+}
+
+func a1cEstimatesForDemo(writer http.ResponseWriter, request *http.Request) {
+	a1csForEmail(writer, request, DEMO_EMAIL)
+}
+
+// a1cs is the endpoint to retrieve a list of a1cs.
+func a1csForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	scanQuery, err := newScanQuery(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	version, err := parseScoringVersion(request, engine.A1C_SCORING_VERSION, func(version int) bool {
+		_, ok := engine.GetA1CEstimator(version)
+		return ok
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	scanQuery.Version = &version
+
+	a1cs, err := repository.GetA1CEstimates(context, email, *scanQuery)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(a1cs) < 1 {
+		http.Error(writer, "No a1c estimated yet.", 204)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(a1cs)
+}
+
+func insulinRatios(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		insulinRatiosForEmail(writer, request, email)
+	}
+}
+
+func insulinRatiosForDemo(writer http.ResponseWriter, request *http.Request) {
+	insulinRatiosForEmail(writer, request, DEMO_EMAIL)
+}
+
+// insulinRatiosForEmail is the endpoint to retrieve a list of insulin ratio estimates along with the samples they were
+// estimated from
+func insulinRatiosForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	scanQuery, err := newScanQuery(request)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	ratios, err := repository.GetInsulinRatios(context, email, *scanQuery)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(ratios) < 1 {
+		http.Error(writer, "No insulin ratios estimated yet.", 204)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(ratios)
+}
+
+func glycemicMetrics(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		glycemicMetricsForEmail(writer, request, email)
+	}
+}
+
+func glycemicMetricsForDemo(writer http.ResponseWriter, request *http.Request) {
+	glycemicMetricsForEmail(writer, request, DEMO_EMAIL)
+}
+
+// glycemicMetricsForEmail is the endpoint to retrieve the time in range and glycemic variability metrics over a window of reads. The
+// window is defined by the from/to parameters and defaults to the DEFAULT_METRICS_PERIOD_IN_DAYS leading to the most recent read. The
+// range thresholds are the ones of the user's targets and can be overridden with the low/high parameters, in mg/dL.
+func glycemicMetricsForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	lowerBound, upperBound, err := newReadWindow(context, request, email, DEFAULT_METRICS_PERIOD_IN_DAYS)
+	if err == store.ErrNoImportedDataFound {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	thresholds, err := newGlucoseThresholds(request, glukitUser.GetTargets().Thresholds)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	metrics, err := engine.CalculateGlycemicMetrics(context, reads, *thresholds)
+	if err == engine.ErrNoReadsForMetrics {
+		http.Error(writer, "No reads in the requested window.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(metrics)
+}
+
+func glycemicEpisodesReport(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		glycemicEpisodesForEmail(writer, request, email)
+	}
+}
+
+func glycemicEpisodesForDemo(writer http.ResponseWriter, request *http.Request) {
+	glycemicEpisodesForEmail(writer, request, DEMO_EMAIL)
+}
+
+// glycemicEpisodesForEmail is the endpoint to retrieve the low and high episodes starting within a window along with their counts
+// for each week of the window. The window is defined by the from/to parameters and defaults to the DEFAULT_EPISODES_PERIOD_IN_DAYS
+// leading to the most recent read.
+func glycemicEpisodesForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	lowerBound, upperBound, err := newReadWindow(context, request, email, DEFAULT_EPISODES_PERIOD_IN_DAYS)
+	if err == store.ErrNoImportedDataFound {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	episodes, err := repository.GetGlycemicEpisodes(context, email, store.ScoreScanQuery{From: &lowerBound, To: &upperBound})
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(glycemicEpisodes{Episodes: episodes, WeeklyCounts: engine.CountEpisodesPerWeek(episodes, lowerBound, upperBound)})
+}
+
+func mealAnalysis(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		mealAnalysisForEmail(writer, request, email)
+	}
+}
+
+func mealAnalysisForDemo(writer http.ResponseWriter, request *http.Request) {
+	mealAnalysisForEmail(writer, request, DEMO_EMAIL)
+}
+
+// mealAnalysisForEmail is the endpoint to retrieve the glucose response to each meal of a window along with the averages of the
+// responses by time of day and carb size. The window is defined by the from/to parameters and defaults to the
+// DEFAULT_MEAL_ANALYSIS_PERIOD_IN_DAYS leading to the most recent read.
+func mealAnalysisForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	lowerBound, upperBound, err := newReadWindow(context, request, email, DEFAULT_MEAL_ANALYSIS_PERIOD_IN_DAYS)
+	if err == store.ErrNoImportedDataFound {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	// The responses to the last meals of the window end after it
+	responseUpperBound := upperBound.Add(engine.MEAL_RESPONSE_DURATION)
+	meals, err := repository.GetMeals(context, email, lowerBound, responseUpperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound, responseUpperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	analysis, err := engine.AnalyzeMeals(meals, reads, lowerBound, upperBound)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(analysis)
+}
+
+func forecastBacktests(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		forecastBacktestsForEmail(writer, request, email)
+	}
+}
+
+func forecastBacktestsForDemo(writer http.ResponseWriter, request *http.Request) {
+	forecastBacktestsForEmail(writer, request, DEMO_EMAIL)
+}
+
+// forecastBacktestsForEmail is the endpoint to retrieve the errors of each forecast model backtested against the history of a window.
+// The window is defined by the from/to parameters and defaults to the FORECAST_BACKTEST_PERIOD_IN_DAYS leading to the most recent read.
+func forecastBacktestsForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	lowerBound, upperBound, err := newReadWindow(context, request, email, engine.FORECAST_BACKTEST_PERIOD_IN_DAYS)
+	if err == store.ErrNoImportedDataFound {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	// The first forecasts need the history before the window and the last ones are checked against the reads after it
+	lastHorizon := engine.FORECAST_HORIZONS[len(engine.FORECAST_HORIZONS)-1]
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound.Add(-engine.FORECAST_HISTORY-engine.MEAL_MAX_READ_GAP),
+		upperBound.Add(lastHorizon))
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	scanStart := lowerBound.Add(-engine.FORECAST_HISTORY - onBoardSettings().MaxActionDuration())
+	injections, err := repository.GetInjections(context, email, scanStart, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	meals, err := repository.GetMeals(context, email, scanStart, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	backtests := make([]model.ForecastBacktest, 0)
+	for _, forecastModel := range engine.GetForecastModels() {
+		backtest, err := engine.BacktestForecastModel(forecastModel, reads, injections, meals, lowerBound, upperBound, engine.FORECAST_HORIZONS)
+		if err != nil {
+			http.Error(writer, err.Error(), 500)
+			return
+		}
+
+		backtests = append(backtests, *backtest)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(backtests)
+}
+
+func ambulatoryGlucoseProfile(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_REPORTS); ok {
+		ambulatoryGlucoseProfileForEmail(writer, request, email)
+	}
+}
+
+func ambulatoryGlucoseProfileForDemo(writer http.ResponseWriter, request *http.Request) {
+	ambulatoryGlucoseProfileForEmail(writer, request, DEMO_EMAIL)
+}
+
+// ambulatoryGlucoseProfileForEmail is the endpoint to retrieve the ambulatory glucose profile, along with its glycemic metrics, over
+// a window of reads. The window is defined by the from/to parameters and defaults to the AGP_PERIOD_IN_DAYS leading to the most
+// recent read. Values are in the unit requested with the unit parameter or in the user's unit. The metrics use the thresholds of the
+// user's targets.
+func ambulatoryGlucoseProfileForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	lowerBound, upperBound, err := newReadWindow(context, request, email, engine.AGP_PERIOD_IN_DAYS)
+	if err == store.ErrNoImportedDataFound {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	unitValue, err := resolveGlucoseUnit(email, request)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if *unitValue != apimodel.MMOL_PER_L {
+		*unitValue = apimodel.MG_PER_DL
+	}
+
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	agp, err := engine.CalculateAGP(context, reads, engine.AGP_BUCKET_MINUTES, *unitValue)
+	if err == engine.ErrNoReadsForAGP {
+		http.Error(writer, "No reads in the requested window.", 204)
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if agp.Metrics, err = engine.CalculateGlycemicMetrics(context, reads, glukitUser.GetTargets().Thresholds); err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+
+	enc := json.NewEncoder(writer)
+	enc.Encode(agp)
+}
+
+// newReadWindow returns the window of reads requested with the from/to parameters. Unlike for scores, the parameters are optional:
+// the upper bound defaults to the user's most recent read and the lower bound to the given number of days before the upper bound.
+// Other than store.ErrNoImportedDataFound, errors are about invalid parameters.
+func newReadWindow(context context.Context, request *http.Request, email string, defaultDays int) (lowerBound time.Time, upperBound time.Time, err error) {
+	_, upperBound, err = repository.GetUserData(context, email)
+	if err == store.ErrNoImportedDataFound {
+		return lowerBound, upperBound, err
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	var from *time.Time
+	if len(request.FormValue(QUERY_PARAM_FROM)) > 0 || len(request.FormValue(QUERY_PARAM_TO)) > 0 {
+		scanQuery, err := newScanQuery(request)
+		if err != nil {
+			return lowerBound, upperBound, err
+		}
+
+		if scanQuery.To != nil {
+			upperBound = *scanQuery.To
+		}
+		from = scanQuery.From
+	}
+
+	lowerBound = upperBound.AddDate(0, 0, -1*defaultDays)
+	if from != nil {
+		lowerBound = *from
+	}
+
+	return lowerBound, upperBound, nil
+}
+
+// newGlucoseThresholds returns the defaults thresholds with the low/high overrides of the request, if any
+func newGlucoseThresholds(request *http.Request, defaults model.GlucoseThresholds) (thresholds *model.GlucoseThresholds, err error) {
+	thresholds = &defaults
+	if low := request.FormValue(QUERY_PARAM_LOW); len(low) > 0 {
+		if thresholds.Low, err = strconv.ParseFloat(low, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_LOW, err))
+		}
+	}
+
+	if high := request.FormValue(QUERY_PARAM_HIGH); len(high) > 0 {
+		if thresholds.High, err = strconv.ParseFloat(high, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_HIGH, err))
+		}
+	}
+
+	if thresholds.Low >= thresholds.High {
+		return nil, errors.New(fmt.Sprintf("Invalid range, %s [%.0f] must be lower than %s [%.0f].", QUERY_PARAM_LOW, thresholds.Low,
+			QUERY_PARAM_HIGH, thresholds.High))
+	}
+
+	return thresholds, nil
+}
+
+func newScanQuery(request *http.Request) (scanQuery *store.ScoreScanQuery, err error) {
+	limit := request.FormValue(QUERY_PARAM_LIMIT)
+	fromTimestamp := request.FormValue(QUERY_PARAM_FROM)
+	toTimestamp := request.FormValue(QUERY_PARAM_TO)
+
+	scanQuery = new(store.ScoreScanQuery)
+	// The request must include at least one of from/to/limit to be considered valid
+	// as leaving it too open would could open the door for costly queries
+	if len(limit) == 0 && len(fromTimestamp) == 0 && len(toTimestamp) == 0 {
+		return nil, errors.New(fmt.Sprintf("Query must specify at least one of: %s, %s or %s.",
+			QUERY_PARAM_LIMIT, QUERY_PARAM_FROM, QUERY_PARAM_TO))
+	}
+
+	if len(limit) > 0 {
+		if limitValue, err := strconv.ParseInt(limit, 10, 32); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_LIMIT, err))
+		} else {
+			limitVal := int(limitValue)
+			scanQuery.Limit = &limitVal
+		}
+	}
+
+	if len(fromTimestamp) > 0 {
+		if fromValue, err := strconv.ParseInt(fromTimestamp, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_FROM, err))
+		} else {
+			fromTime := time.Unix(fromValue, 0)
+			scanQuery.From = &fromTime
+		}
+	}
+
+	if len(toTimestamp) > 0 {
+		if toValue, err := strconv.ParseInt(toTimestamp, 10, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_TO, err))
+		} else {
+			toTime := time.Unix(toValue, 0)
+			scanQuery.To = &toTime
+		}
+	}
+
+	return scanQuery, nil
+}
+
+// parseScoringVersion returns the scoring version of the request or the current version if it doesn't have one. The version
+// must be one of the registered ones.
+func parseScoringVersion(request *http.Request, currentVersion int, isRegistered func(version int) bool) (version int, err error) {
+	value := request.FormValue(QUERY_PARAM_VERSION)
+	if len(value) == 0 {
+		return currentVersion, nil
+	}
+
+	version, err = strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid value for %s: [%v].", QUERY_PARAM_VERSION, err))
+	}
+
+	if !isRegistered(version) {
+		return 0, errors.New(fmt.Sprintf("Unknown %s [%d].", QUERY_PARAM_VERSION, version))
+	}
+
+	return version, nil
+}
+
+func handleDonation(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	request.ParseForm()
+	token := request.FormValue(payment.STRIPE_TOKEN)
+	amountInCentsVal := request.FormValue(payment.DONATION_AMOUNT)
+
+	stripeClient := payment.NewStripeClient(appConfig)
+	err := stripeClient.SubmitDonation(context, token, amountInCentsVal)
+	if err != nil {
+		log.Warningf(context, "Error processing donation from [%v] of [%s] cents with token [%s]: [%v]", user, amountInCentsVal, token, err)
+		writer.WriteHeader(502)
+	} else {
+		writer.WriteHeader(200)
+	}
+}
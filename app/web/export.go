@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/export"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	EXPORT_ARCHIVE_CONTENT_TYPE = "application/zip"
+)
+
+// requestDataExport is the endpoint that starts the export of all of the active user's data in the background. A new
+// export isn't started if one is already pending or running. The state of the export is returned.
+func requestDataExport(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	dataExport, err := repository.GetDataExport(context, user.Email)
+	if err != nil && err != store.ErrNoDataExport {
+		util.Propagate(err)
+	}
+
+	if err == store.ErrNoDataExport || (dataExport.Status != model.DATA_EXPORT_STATUS_PENDING && dataExport.Status != model.DATA_EXPORT_STATUS_RUNNING) {
+		dataExport = &model.DataExport{Status: model.DATA_EXPORT_STATUS_PENDING, RequestedOn: time.Now()}
+		if err := repository.StoreDataExport(context, user.Email, *dataExport); err != nil {
+			util.Propagate(err)
+		}
+
+		if err := jobQueue.Enqueue(context, export.EXPORT_QUEUE_NAME, queue.Job{Name: export.EXPORT_DATA_JOB_NAME, UserEmail: user.Email}); err != nil {
+			util.Propagate(err)
+		}
+
+		log.Infof(context, "Queued data export for user [%s]", user.Email)
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(writer)
+	enc.Encode(dataExport)
+}
+
+// dataExportStatus is the endpoint that returns the state of the active user's data export
+func dataExportStatus(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	dataExport, err := repository.GetDataExport(context, user.Email)
+	if err == store.ErrNoDataExport {
+		http.Error(writer, "No data export requested", 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(dataExport)
+}
+
+// downloadDataExport is the endpoint to download the archive of the active user's data export once it's done
+func downloadDataExport(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	dataExport, err := repository.GetDataExport(context, user.Email)
+	if err == store.ErrNoDataExport {
+		http.Error(writer, "No data export requested", 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	if dataExport.Status != model.DATA_EXPORT_STATUS_DONE {
+		http.Error(writer, fmt.Sprintf("Data export is not ready, its status is [%s]", dataExport.Status), 409)
+		return
+	}
+
+	archive, err := repository.GetDataExportArchive(context, user.Email)
+	if err == store.ErrNoDataExport {
+		http.Error(writer, "Data export archive not found", 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	value := writer.Header()
+	value.Add("Content-type", EXPORT_ARCHIVE_CONTENT_TYPE)
+	value.Add("Content-Length", strconv.Itoa(len(archive)))
+	value.Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"glukit-export-%s.zip\"", dataExport.CompletedOn.Format("20060102")))
+	writer.Write(archive)
+}
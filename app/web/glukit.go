@@ -1,12 +1,15 @@
-// The glukit package is the main package for the application. This is where it all starts.
-package main
+// The web package holds the glukit http handlers. It is shared by the App Engine application and the standalone
+// server, each providing its own Environment.
+package web
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"github.com/alexandre-normand/glukit/app/apimodel"
 	"github.com/alexandre-normand/glukit/app/config"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
 	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
@@ -14,8 +17,6 @@ import (
 	"golang.org/x/oauth2/google"
 	googleuser "google.golang.org/api/oauth2/v2"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"net/http"
 	"time"
 )
@@ -40,9 +41,20 @@ func configuration() *oauth2.Config {
 	return &configuration
 }
 
-// handleUserLogin starts the login flow with google
+// handleUserLogin starts the login flow with google. Servers without a google client configured skip it and only
+// make sure the GlukitUser exists
 func handleUserLogin(writer http.ResponseWriter, request *http.Request) {
 	context := appengine.NewContext(request)
+	if appConfig.GoogleClientId == "" {
+		user := authProvider.CurrentUser(request)
+		if err := initializeUserProfile(context, user.Email); err != nil {
+			util.Propagate(err)
+		}
+
+		renderRealUser(writer, request)
+		return
+	}
+
 	conf := configuration()
 
 	// Refresh and store the profile
@@ -57,6 +69,20 @@ func handleUserLogin(writer http.ResponseWriter, request *http.Request) {
 	http.Redirect(writer, request, url, http.StatusTemporaryRedirect)
 }
 
+// initializeUserProfile stores a new GlukitUser for the email if it doesn't exist already
+func initializeUserProfile(context context.Context, email string) (err error) {
+	_, err = repository.GetUserProfile(context, email)
+	if err == store.ErrNoSuchUser {
+		log.Infof(context, "No data found for user [%s], creating it", email)
+		glukitUser := model.GlukitUser{Email: email, DateOfBirth: time.Now(), DiabetesType: model.DIABETES_TYPE_1, LastUpdated: util.GLUKIT_EPOCH_TIME,
+			MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, BestScore: model.UNDEFINED_SCORE, MostRecentScore: model.UNDEFINED_SCORE,
+			AccountCreated: time.Now(), MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE}
+		return repository.StoreUserProfile(context, time.Now(), glukitUser)
+	}
+
+	return err
+}
+
 // randomHex generates a random state string
 func randomHex(n int) (string, error) {
 	bytes := make([]byte, n)
@@ -92,10 +118,10 @@ func handleLoggedInUser(writer http.ResponseWriter, request *http.Request) {
 		} else {
 			log.Infof(context, "User profile refreshed to %v", userInfo)
 
-			log.Infof(context, "Got user info for logged in google account [%s]", userInfo)
-			glukitUser, _, _, err := store.GetUserData(context, userInfo.Email)
+			log.Infof(context, "Got user info for logged in google account [%v]", userInfo)
+			glukitUser, _, err := repository.GetUserData(context, userInfo.Email)
 
-			if err == datastore.ErrNoSuchEntity {
+			if err == store.ErrNoSuchUser {
 				log.Infof(context, "No data found for user [%s], creating it", userInfo.Email)
 
 				// TODO: Populate GlukitUser correctly, this will likely require getting rid of all data from the store when
@@ -104,8 +130,8 @@ func handleLoggedInUser(writer http.ResponseWriter, request *http.Request) {
 				// we have a glukit user with no refresh token, we need to force getting a new one (which is to be avoided)
 				glukitUser = &model.GlukitUser{userInfo.Email, userInfo.GivenName, userInfo.FamilyName, time.Now(),
 					model.DIABETES_TYPE_1, "", util.GLUKIT_EPOCH_TIME, apimodel.UNDEFINED_GLUCOSE_READ,
-					model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, false, userInfo.Picture, time.Now(), model.UNDEFINED_A1C_ESTIMATE}
-				_, err = store.StoreUserProfile(context, time.Now(), *glukitUser)
+					model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, false, userInfo.Picture, time.Now(), model.UNDEFINED_A1C_ESTIMATE, model.DEFAULT_GLUCOSE_TARGETS, model.SailingProfile{}, false}
+				err = repository.StoreUserProfile(context, time.Now(), *glukitUser)
 				if err != nil {
 					util.Propagate(err)
 				}
@@ -116,7 +142,7 @@ func handleLoggedInUser(writer http.ResponseWriter, request *http.Request) {
 				glukitUser.FirstName = userInfo.GivenName
 				glukitUser.LastName = userInfo.FamilyName
 
-				_, err = store.StoreUserProfile(context, time.Now(), *glukitUser)
+				err = repository.StoreUserProfile(context, time.Now(), *glukitUser)
 				if err != nil {
 					util.Propagate(err)
 				}
@@ -0,0 +1,172 @@
+package web
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/importer"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	IMPORT_FILE_PARAMETER     = "file"
+	IMPORT_FORMAT_PARAMETER   = "format"
+	IMPORT_TIMEZONE_PARAMETER = "timezone"
+	IMPORT_MAPPING_PARAMETER  = "mapping"
+
+	// The maximum size of an uploaded file kept in memory, the rest is written to temporary files
+	MAX_IMPORT_MEMORY = 32 << 20
+)
+
+// readTrackingRepository is a repository that keeps the earliest glucose read stored through it so the detection of episodes can
+// start from it
+type readTrackingRepository struct {
+	store.Repository
+	earliestRead *apimodel.GlucoseRead
+}
+
+func (r *readTrackingRepository) StoreDaysOfReads(context context.Context, email string, daysOfReads []apimodel.DayOfGlucoseReads) (err error) {
+	for _, dayOfReads := range daysOfReads {
+		for i := range dayOfReads.Reads {
+			if r.earliestRead == nil || dayOfReads.Reads[i].Time.Timestamp < r.earliestRead.Time.Timestamp {
+				r.earliestRead = &dayOfReads.Reads[i]
+			}
+		}
+	}
+
+	return r.Repository.StoreDaysOfReads(context, email, daysOfReads)
+}
+
+// Represents the result of a file import
+type ImportResponse struct {
+	Format       string    `json:"format"`
+	LastReadTime time.Time `json:"lastReadTime"`
+}
+
+// importFile is the endpoint to upload a CGM export for the active user. The format is detected unless the format
+// parameter is set. Generic csv files need the format set to csv and a json column mapping in the mapping parameter. Local
+// times are in the timezone parameter which defaults to the timezone of the user.
+func importFile(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		log.Warningf(context, "Error getting user to import file, user email is [%s]: %v", user.Email, err)
+		http.Error(writer, "Error getting user to import file", 500)
+		return
+	}
+
+	if err := request.ParseMultipartForm(MAX_IMPORT_MEMORY); err != nil {
+		http.Error(writer, fmt.Sprintf("Error reading upload: %v", err), 400)
+		return
+	}
+
+	file, header, err := request.FormFile(IMPORT_FILE_PARAMETER)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Missing [%s] file: %v", IMPORT_FILE_PARAMETER, err), 400)
+		return
+	}
+	defer file.Close()
+
+	locationName := request.FormValue(IMPORT_TIMEZONE_PARAMETER)
+	if locationName == "" {
+		locationName = glukitUser.Timezone
+	}
+
+	location := time.UTC
+	if locationName != "" {
+		if location, err = util.GetOrLoadLocationForName(locationName); err != nil {
+			http.Error(writer, err.Error(), 400)
+			return
+		}
+	}
+
+	fileImporter, content, err := newImporter(request, file)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	checksum := md5.New()
+	trackingRepository := &readTrackingRepository{Repository: repository}
+	lastReadTime, err := fileImporter.Import(context, io.TeeReader(content, checksum), trackingRepository, user.Email, util.GLUKIT_EPOCH_TIME,
+		location)
+	if err != nil {
+		log.Warningf(context, "Error importing [%s] file [%s] for user [%s]: %v", fileImporter.Name(), header.Filename, user.Email, err)
+		http.Error(writer, fmt.Sprintf("Error importing file: %v", err), 400)
+		return
+	}
+
+	repository.LogFileImport(context, user.Email, model.FileImportLog{Id: header.Filename, Md5Checksum: hex.EncodeToString(checksum.Sum(nil)),
+		LastDataProcessed: lastReadTime, ImportResult: "Success"})
+
+	if glukitUser, err = repository.GetUserProfile(context, user.Email); err != nil {
+		log.Warningf(context, "Couldn't get glukit user profile [%s] to recalculate score: %v", user.Email, err)
+	} else {
+		if err := engine.StartGlukitScoreBatch(context, jobQueue, glukitUser); err != nil {
+			log.Warningf(context, "Error starting glukit score calculation batch for user [%s]: %v", user.Email, err)
+		}
+
+		if err := engine.StartA1CCalculationBatch(context, jobQueue, glukitUser); err != nil {
+			log.Warningf(context, "Error starting a1c calculation batch for user [%s]: %v", user.Email, err)
+		}
+	}
+
+	if err := engine.StartInsulinRatioBatch(context, repository, jobQueue, user.Email); err != nil {
+		log.Warningf(context, "Error starting insulin ratio estimation batch for user [%s]: %v", user.Email, err)
+	}
+
+	if earliestRead := trackingRepository.earliestRead; earliestRead != nil {
+		if err := engine.StartGlycemicEpisodeDetection(context, jobQueue, user.Email, earliestRead.GetTime()); err != nil {
+			log.Warningf(context, "Error starting episode detection for user [%s]: %v", user.Email, err)
+		}
+	}
+
+	log.Infof(context, "Imported [%s] file [%s] for user [%s]", fileImporter.Name(), header.Filename, user.Email)
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(ImportResponse{fileImporter.Name(), lastReadTime})
+}
+
+// newImporter returns the importer for the format parameter of the request or detects the format of the file when
+// the parameter isn't set. The returned reader must be used in place of the file.
+func newImporter(request *http.Request, file io.Reader) (fileImporter importer.Importer, content io.Reader, err error) {
+	format := request.FormValue(IMPORT_FORMAT_PARAMETER)
+	switch format {
+	case "":
+		return importer.Detect(file)
+	case importer.GENERIC_CSV_FORMAT:
+		var mapping importer.CSVColumnMapping
+		if err := json.Unmarshal([]byte(request.FormValue(IMPORT_MAPPING_PARAMETER)), &mapping); err != nil {
+			return nil, file, errors.New(fmt.Sprintf("Invalid csv column mapping: %v", err))
+		}
+
+		fileImporter, err := importer.NewGenericCSVImporter(mapping)
+		if err != nil {
+			return nil, file, err
+		}
+
+		return fileImporter, file, nil
+	}
+
+	if fileImporter = importer.ForName(format); fileImporter == nil {
+		return nil, file, errors.New(fmt.Sprintf("Unsupported format [%s]", format))
+	}
+
+	return fileImporter, file, nil
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+)
+
+func labA1Cs(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_SCORES); ok {
+		labA1CsForEmail(writer, request, email)
+	}
+}
+
+func labA1CsForDemo(writer http.ResponseWriter, request *http.Request) {
+	labA1CsForEmail(writer, request, DEMO_EMAIL)
+}
+
+// labA1CsForEmail is the endpoint to retrieve the lab a1c results recorded by a user, most recent first
+func labA1CsForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	results, err := repository.GetLabA1Cs(context, email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(results)
+}
+
+// recordLabA1C is the endpoint that stores a lab a1c result of the active user from a json LabA1C document. A result at the same
+// time as a previous one replaces it.
+func recordLabA1C(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var labA1C model.LabA1C
+	if err := json.NewDecoder(request.Body).Decode(&labA1C); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid lab a1c: [%v].", err), 400)
+		return
+	}
+
+	if err := labA1C.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	if err := repository.StoreLabA1C(context, user.Email, labA1C); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Recorded lab a1c of [%.1f] at [%s] for user [%s]", labA1C.Value, labA1C.Time, user.Email)
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(labA1C)
+}
+
+func a1cReport(writer http.ResponseWriter, request *http.Request) {
+	if email, ok := resolveSubject(writer, request, model.SHARING_SCOPE_SCORES); ok {
+		a1cReportForEmail(writer, request, email)
+	}
+}
+
+func a1cReportForDemo(writer http.ResponseWriter, request *http.Request) {
+	a1cReportForEmail(writer, request, DEMO_EMAIL)
+}
+
+// a1cReportForEmail is the endpoint to retrieve the most recent a1c estimate of a user, both raw and calibrated to their lab results,
+// along with the GMI of the same reads
+func a1cReportForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	version := engine.A1C_SCORING_VERSION
+	estimates, err := repository.GetA1CEstimates(context, email, store.ScoreScanQuery{Version: &version})
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(estimates) < 1 {
+		http.Error(writer, "No a1c estimated yet.", 204)
+		return
+	}
+
+	estimate := estimates[0]
+	reads, err := repository.GetGlucoseReads(context, email, estimate.LowerBound, estimate.UpperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	results, err := repository.GetLabA1Cs(context, email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	report, err := engine.CalculateA1CReport(context, estimate, reads, estimates, results)
+	if err == engine.ErrNoReadsForMetrics {
+		http.Error(writer, "No data imported yet.", 204)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(report)
+}
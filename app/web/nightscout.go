@@ -0,0 +1,505 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/bufio"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/nightscout"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/streaming"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The header Nightscout uploaders send the sha1 hash of the api secret in
+	NIGHTSCOUT_API_SECRET_HEADER = "api-secret"
+	NIGHTSCOUT_SECRET_PARAMETER  = "secret"
+	NIGHTSCOUT_COUNT_PARAMETER   = "count"
+	NIGHTSCOUT_DEFAULT_COUNT     = 10
+	// How far back entries are looked up, at least, from the upper bound of a query
+	NIGHTSCOUT_ENTRIES_PERIOD = 48 * time.Hour
+	// How far back treatments are looked up from the upper bound of a query
+	NIGHTSCOUT_TREATMENTS_PERIOD = 7 * 24 * time.Hour
+	// The interval of sensor reads, used to extend the entries lookup to the requested count
+	NIGHTSCOUT_READ_INTERVAL = 5 * time.Minute
+	API_SECRET_SIZE          = 16
+)
+
+// Represents the status of the Nightscout api, uploaders check it before sending data
+type NightscoutStatus struct {
+	Status     string            `json:"status"`
+	Name       string            `json:"name"`
+	Version    string            `json:"version"`
+	ApiEnabled bool              `json:"apiEnabled"`
+	Settings   map[string]string `json:"settings"`
+}
+
+// Represents a new api secret, only returned when it's generated
+type ApiSecretResponse struct {
+	Secret string `json:"secret"`
+}
+
+// nightscoutAuthenticatedHandler only lets requests authenticated with an api secret or an oauth access token granted the scope through
+type nightscoutAuthenticatedHandler struct {
+	scope                string
+	authenticatedHandler http.Handler
+}
+
+func (handler *nightscoutAuthenticatedHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// The oauth server is needed to authenticate access tokens
+	warmUp(writer, request)
+
+	if email := currentNightscoutUser(request, handler.scope); email == "" {
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	handler.authenticatedHandler.ServeHTTP(writer, request)
+}
+
+func newNightscoutAuthenticationHandler(scope string, next http.Handler) *nightscoutAuthenticatedHandler {
+	return &nightscoutAuthenticatedHandler{scope, next}
+}
+
+// currentNightscoutUser returns the email of the user the request is authenticated as or an empty string if it's not
+// authenticated. Requests are authenticated with the api-secret header, the secret parameter or a valid oauth bearer token
+// granted the scope. Api secrets give access to all scopes.
+func currentNightscoutUser(request *http.Request, scope string) (email string) {
+	secret := request.Header.Get(NIGHTSCOUT_API_SECRET_HEADER)
+	if secret == "" {
+		secret = request.URL.Query().Get(NIGHTSCOUT_SECRET_PARAMETER)
+	}
+
+	if secret != "" {
+		context := appengine.NewContext(request)
+		email, err := repository.FindUserByApiSecret(context, hashApiSecret(secret))
+		if err != nil && err != store.ErrNoSuchUser {
+			log.Warningf(context, "Error looking up api secret: %v", err)
+		}
+
+		return email
+	}
+
+	if accessData, _, _ := authorizeBearerAccess(request, scope); accessData != nil {
+		return accessData.UserData.(string)
+	}
+
+	return ""
+}
+
+// hashApiSecret returns the sha1 hash of the secret, as sent by Nightscout uploaders. Secrets that are already hashed are
+// returned as is.
+func hashApiSecret(secret string) string {
+	if decoded, err := hex.DecodeString(secret); err == nil && len(decoded) == sha1.Size {
+		return hex.EncodeToString(decoded)
+	}
+
+	hash := sha1.Sum([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// generateApiSecret is the endpoint that generates a new api secret for the active user, replacing any previous one. The
+// secret is returned only once since only its hash is stored.
+func generateApiSecret(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	secret := make([]byte, API_SECRET_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		util.Propagate(err)
+	}
+
+	encodedSecret := hex.EncodeToString(secret)
+	if err := repository.StoreApiSecret(context, user.Email, hashApiSecret(encodedSecret)); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Generated new api secret for user [%s]", user.Email)
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(ApiSecretResponse{encodedSecret})
+}
+
+// nightscoutStatus is the endpoint that reports the api as enabled to Nightscout uploaders
+func nightscoutStatus(writer http.ResponseWriter, request *http.Request) {
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(NightscoutStatus{Status: "ok", Name: "glukit", Version: "0.0.0", ApiEnabled: true, Settings: map[string]string{"units": "mg/dl"}})
+}
+
+// processNightscoutEntries handles a post of Nightscout entries, either as an array or a single document
+func processNightscoutEntries(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	email := currentNightscoutUser(request, model.OAUTH_SCOPE_GLUCOSE_WRITE)
+
+	var entries []nightscout.Entry
+	if err := decodeNightscoutDocuments(request, &entries); err != nil {
+		http.Error(writer, fmt.Sprintf("Error decoding entries: %v", err), 400)
+		return
+	}
+
+	location, err := nightscoutLocation(context, email)
+	if err != nil {
+		http.Error(writer, "Error getting user to process entries", 500)
+		return
+	}
+
+	data, err := nightscout.ConvertEntries(entries, location)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error converting entries: %v", err), 400)
+		return
+	}
+
+	if err := storeNightscoutData(context, email, data); err != nil {
+		log.Warningf(context, "Error storing nightscout entries for user [%s]: %v", email, err)
+		http.Error(writer, fmt.Sprintf("Error storing data: %v", err), 502)
+		return
+	}
+
+	log.Infof(context, "Wrote [%d] nightscout entries for user [%s]", len(entries), email)
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(entries)
+}
+
+// processNightscoutTreatments handles a post of Nightscout treatments, either as an array or a single document
+func processNightscoutTreatments(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	email := currentNightscoutUser(request, model.OAUTH_SCOPE_EVENTS_WRITE)
+
+	var treatments []nightscout.Treatment
+	if err := decodeNightscoutDocuments(request, &treatments); err != nil {
+		http.Error(writer, fmt.Sprintf("Error decoding treatments: %v", err), 400)
+		return
+	}
+
+	location, err := nightscoutLocation(context, email)
+	if err != nil {
+		http.Error(writer, "Error getting user to process treatments", 500)
+		return
+	}
+
+	data, err := nightscout.ConvertTreatments(treatments, location)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error converting treatments: %v", err), 400)
+		return
+	}
+
+	if err := storeNightscoutData(context, email, data); err != nil {
+		log.Warningf(context, "Error storing nightscout treatments for user [%s]: %v", email, err)
+		http.Error(writer, fmt.Sprintf("Error storing data: %v", err), 502)
+		return
+	}
+
+	log.Infof(context, "Wrote [%d] nightscout treatments for user [%s]", len(treatments), email)
+
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(treatments)
+}
+
+// nightscoutEntries is the endpoint that returns the most recent entries, sensor glucose values and meter checks, as
+// Nightscout documents
+func nightscoutEntries(writer http.ResponseWriter, request *http.Request) {
+	writeNightscoutEntries(writer, request, true)
+}
+
+// nightscoutSgvEntries is the endpoint that returns the most recent sensor glucose values as Nightscout documents
+func nightscoutSgvEntries(writer http.ResponseWriter, request *http.Request) {
+	writeNightscoutEntries(writer, request, false)
+}
+
+func writeNightscoutEntries(writer http.ResponseWriter, request *http.Request, includeCalibrations bool) {
+	context := appengine.NewContext(request)
+	email := currentNightscoutUser(request, model.OAUTH_SCOPE_GLUCOSE_READ)
+
+	count, lowerBound, upperBound, err := newNightscoutQuery(context, request, email, NIGHTSCOUT_ENTRIES_PERIOD)
+	if err == store.ErrNoImportedDataFound {
+		writeNightscoutDocuments(writer, []nightscout.Entry{})
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	// Make sure the window is large enough to have the requested number of reads
+	if countPeriod := time.Duration(count) * NIGHTSCOUT_READ_INTERVAL; upperBound.Sub(lowerBound) < countPeriod && !hasNightscoutBound(request, "$gte") {
+		lowerBound = upperBound.Add(-countPeriod)
+	}
+
+	reads, err := repository.GetGlucoseReads(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	calibrations := []apimodel.CalibrationRead{}
+	if includeCalibrations {
+		if calibrations, err = repository.GetCalibrations(context, email, lowerBound, upperBound); err != nil {
+			util.Propagate(err)
+		}
+	}
+
+	entries, err := nightscout.NewEntries(reads, calibrations)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	if len(entries) > count {
+		entries = entries[:count]
+	}
+
+	writeNightscoutDocuments(writer, entries)
+}
+
+// nightscoutTreatments is the endpoint that returns the most recent injections, meals, exercises and calibrations as
+// Nightscout treatments
+func nightscoutTreatments(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	email := currentNightscoutUser(request, model.OAUTH_SCOPE_EVENTS_READ)
+
+	count, lowerBound, upperBound, err := newNightscoutQuery(context, request, email, NIGHTSCOUT_TREATMENTS_PERIOD)
+	if err == store.ErrNoImportedDataFound {
+		writeNightscoutDocuments(writer, []nightscout.Treatment{})
+		return
+	} else if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	injections, err := repository.GetInjections(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	meals, err := repository.GetMeals(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	exercises, err := repository.GetExercises(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	calibrations, err := repository.GetCalibrations(context, email, lowerBound, upperBound)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	treatments := nightscout.NewTreatments(injections, meals, exercises, calibrations)
+	if len(treatments) > count {
+		treatments = treatments[:count]
+	}
+
+	writeNightscoutDocuments(writer, treatments)
+}
+
+func writeNightscoutDocuments(writer http.ResponseWriter, documents interface{}) {
+	value := writer.Header()
+	value.Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(documents)
+}
+
+// decodeNightscoutDocuments decodes the body of the request into the documents slice. Uploaders send either an array of
+// documents or a single one.
+func decodeNightscoutDocuments(request *http.Request, documents interface{}) (err error) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		return err
+	}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] != '[' {
+		body = append(append([]byte("["), body...), ']')
+	}
+
+	return json.Unmarshal(body, documents)
+}
+
+// nightscoutLocation returns the timezone of the user, used for documents that don't have a utc offset
+func nightscoutLocation(context context.Context, email string) (location *time.Location, err error) {
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		log.Warningf(context, "Error getting user to process nightscout documents, user email is [%s]: %v", email, err)
+		return nil, err
+	}
+
+	if glukitUser.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	return util.GetOrLoadLocationForName(glukitUser.Timezone)
+}
+
+// newNightscoutQuery returns the count and the time bounds of a Nightscout query. The upper bound defaults to the
+// user's most recent data and the lower bound to the period before the upper bound.
+func newNightscoutQuery(context context.Context, request *http.Request, email string, period time.Duration) (count int,
+	lowerBound time.Time, upperBound time.Time, err error) {
+	count = NIGHTSCOUT_DEFAULT_COUNT
+	if value := request.FormValue(NIGHTSCOUT_COUNT_PARAMETER); value != "" {
+		if count, err = strconv.Atoi(value); err != nil || count < 0 {
+			return count, lowerBound, upperBound, errors.New(fmt.Sprintf("Invalid count [%s]", value))
+		}
+	}
+
+	upper, err := nightscoutBound(request, "$lte")
+	if err != nil {
+		return count, lowerBound, upperBound, err
+	}
+
+	if upper != nil {
+		upperBound = *upper
+	} else if _, upperBound, err = repository.GetUserData(context, email); err != nil {
+		return count, lowerBound, upperBound, err
+	}
+
+	lower, err := nightscoutBound(request, "$gte")
+	if err != nil {
+		return count, lowerBound, upperBound, err
+	}
+
+	lowerBound = upperBound.Add(-period)
+	if lower != nil {
+		lowerBound = *lower
+	}
+
+	return count, lowerBound, upperBound, nil
+}
+
+// The fields Nightscout clients filter documents by time on
+var nightscoutTimeFields = []string{"date", "created_at", "dateString"}
+
+func hasNightscoutBound(request *http.Request, operator string) bool {
+	bound, err := nightscoutBound(request, operator)
+	return err == nil && bound != nil
+}
+
+// nightscoutBound returns the time of a find[field][operator] parameter, given either as epoch milliseconds or as an
+// RFC 3339 date, or nil if the request doesn't have one
+func nightscoutBound(request *http.Request, operator string) (bound *time.Time, err error) {
+	for _, field := range nightscoutTimeFields {
+		value := request.FormValue(fmt.Sprintf("find[%s][%s]", field, operator))
+		if value == "" {
+			continue
+		}
+
+		if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+			boundTime := time.Unix(millis/1000, 0)
+			return &boundTime, nil
+		}
+
+		boundTime, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid time [%s] for [%s]", value, field))
+		}
+
+		return &boundTime, nil
+	}
+
+	return nil, nil
+}
+
+// storeNightscoutData streams the data to the repository and starts the score calculations if there are new reads
+func storeNightscoutData(context context.Context, email string, data *nightscout.Data) (err error) {
+	glucoseReadStreamer := streaming.NewGlucoseStreamerDuration(bufio.NewGlucoseReadWriterSize(store.NewRepositoryGlucoseReadBatchWriter(context,
+		repository, email), store.GLUKIT_SCORE_PUT_MULTI_SIZE), apimodel.DAY_OF_DATA_DURATION)
+	if glucoseReadStreamer, err = glucoseReadStreamer.WriteGlucoseReads(data.Reads); err != nil {
+		return err
+	}
+	if glucoseReadStreamer, err = glucoseReadStreamer.Close(); err != nil {
+		return err
+	}
+
+	calibrationStreamer := streaming.NewCalibrationReadStreamerDuration(bufio.NewCalibrationWriterSize(store.NewRepositoryCalibrationBatchWriter(context,
+		repository, email), store.GLUKIT_SCORE_PUT_MULTI_SIZE), apimodel.DAY_OF_DATA_DURATION)
+	if calibrationStreamer, err = calibrationStreamer.WriteCalibrations(data.Calibrations); err != nil {
+		return err
+	}
+	if calibrationStreamer, err = calibrationStreamer.Close(); err != nil {
+		return err
+	}
+
+	injectionStreamer := streaming.NewInjectionStreamerDuration(bufio.NewInjectionWriterSize(store.NewRepositoryInjectionBatchWriter(context,
+		repository, email), store.GLUKIT_SCORE_PUT_MULTI_SIZE), apimodel.DAY_OF_DATA_DURATION)
+	if injectionStreamer, err = injectionStreamer.WriteInjections(data.Injections); err != nil {
+		return err
+	}
+	if injectionStreamer, err = injectionStreamer.Close(); err != nil {
+		return err
+	}
+
+	mealStreamer := streaming.NewMealStreamerDuration(bufio.NewMealWriterSize(store.NewRepositoryMealBatchWriter(context,
+		repository, email), store.GLUKIT_SCORE_PUT_MULTI_SIZE), apimodel.DAY_OF_DATA_DURATION)
+	if mealStreamer, err = mealStreamer.WriteMeals(data.Meals); err != nil {
+		return err
+	}
+	if mealStreamer, err = mealStreamer.Close(); err != nil {
+		return err
+	}
+
+	exerciseStreamer := streaming.NewExerciseStreamerDuration(bufio.NewExerciseWriterSize(store.NewRepositoryExerciseBatchWriter(context,
+		repository, email), store.GLUKIT_SCORE_PUT_MULTI_SIZE), apimodel.DAY_OF_DATA_DURATION)
+	if exerciseStreamer, err = exerciseStreamer.WriteExercises(data.Exercises); err != nil {
+		return err
+	}
+	if exerciseStreamer, err = exerciseStreamer.Close(); err != nil {
+		return err
+	}
+
+	if len(data.Reads) == 0 {
+		return nil
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err != nil {
+		log.Warningf(context, "Couldn't get glukit user profile [%s] to recalculate score: %v", email, err)
+		return nil
+	}
+
+	if err := engine.StartGlukitScoreBatch(context, jobQueue, glukitUser); err != nil {
+		log.Warningf(context, "Error starting glukit score calculation batch for user [%s]: %v", email, err)
+	}
+
+	if err := engine.StartA1CCalculationBatch(context, jobQueue, glukitUser); err != nil {
+		log.Warningf(context, "Error starting a1c calculation batch for user [%s]: %v", email, err)
+	}
+
+	if err := engine.StartInsulinRatioBatch(context, repository, jobQueue, email); err != nil {
+		log.Warningf(context, "Error starting insulin ratio estimation batch for user [%s]: %v", email, err)
+	}
+
+	earliestRead := &data.Reads[0]
+	for i := range data.Reads {
+		if data.Reads[i].Time.Timestamp < earliestRead.Time.Timestamp {
+			earliestRead = &data.Reads[i]
+		}
+	}
+
+	if err := engine.StartGlycemicEpisodeDetection(context, jobQueue, email, earliestRead.GetTime()); err != nil {
+		log.Warningf(context, "Error starting episode detection for user [%s]: %v", email, err)
+	}
+
+	return nil
+}
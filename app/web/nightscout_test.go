@@ -0,0 +1,72 @@
+package web
+
+import (
+	"github.com/alexandre-normand/glukit/app/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveNightscoutRequest routes a request authenticated with the bearer token
+func serveNightscoutRequest(method string, path string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader("[]"))
+	request.Header.Set("Authorization", "Bearer "+token)
+	response := httptest.NewRecorder()
+	muxRouter.ServeHTTP(response, request)
+
+	return response
+}
+
+func TestNightscoutRejectsExpiredTokens(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+	storeTestProfile(t, "patient@glukit.com")
+
+	scope := model.OAUTH_SCOPE_GLUCOSE_READ + " " + model.OAUTH_SCOPE_GLUCOSE_WRITE
+	saveTestAccess(t, "valid", scope, time.Now(), "patient@glukit.com")
+	saveTestAccess(t, "expired", scope, time.Now().Add(-2*time.Hour), "patient@glukit.com")
+
+	if response := serveNightscoutRequest("GET", "/api/v1/entries.json", "valid"); response.Code != http.StatusOK {
+		t.Errorf("TestNightscoutRejectsExpiredTokens failed: got [%d] with a valid token but expected [%d]", response.Code, http.StatusOK)
+	}
+
+	for _, method := range []string{"GET", "POST"} {
+		if response := serveNightscoutRequest(method, "/api/v1/entries.json", "expired"); response.Code != http.StatusUnauthorized {
+			t.Errorf("TestNightscoutRejectsExpiredTokens failed: got [%d] for a %s with an expired token but expected [%d]", response.Code,
+				method, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestNightscoutRequiresScope(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+	storeTestProfile(t, "patient@glukit.com")
+
+	saveTestAccess(t, "glucose", model.OAUTH_SCOPE_GLUCOSE_READ, time.Now(), "patient@glukit.com")
+	saveTestAccess(t, "profile", model.OAUTH_SCOPE_PROFILE_READ, time.Now(), "patient@glukit.com")
+
+	requests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{"GET", "/api/v1/entries.json", "glucose", http.StatusOK},
+		{"GET", "/api/v1/entries/sgv.json", "glucose", http.StatusOK},
+		{"POST", "/api/v1/entries.json", "glucose", http.StatusUnauthorized},
+		{"GET", "/api/v1/treatments.json", "glucose", http.StatusUnauthorized},
+		{"POST", "/api/v1/treatments.json", "glucose", http.StatusUnauthorized},
+		{"GET", "/api/v1/entries.json", "profile", http.StatusUnauthorized},
+		{"POST", "/api/v1/entries.json", "profile", http.StatusUnauthorized},
+	}
+
+	for _, r := range requests {
+		if response := serveNightscoutRequest(r.method, r.path, r.token); response.Code != r.code {
+			t.Errorf("TestNightscoutRequiresScope failed: got [%d] for a %s of [%s] with the [%s] token but expected [%d]", response.Code,
+				r.method, r.path, r.token, r.code)
+		}
+	}
+}
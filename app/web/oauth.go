@@ -0,0 +1,407 @@
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"github.com/alexandre-normand/osin"
+	"google.golang.org/appengine"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var server *osin.Server
+
+const (
+	TOKEN_ROUTE             = "token"
+	AUTHORIZE_ROUTE         = "authorize"
+	AUTHORIZE_CONSENT_ROUTE = "authorize_consent"
+
+	// PKCE parameters of the authorize and token requests
+	PARAM_CODE_CHALLENGE        = "code_challenge"
+	PARAM_CODE_CHALLENGE_METHOD = "code_challenge_method"
+	PARAM_CODE_VERIFIER         = "code_verifier"
+
+	// The decision of the user on the consent page
+	PARAM_CONSENT   = "consent"
+	CONSENT_APPROVE = "approve"
+
+	// The consent page is protected from cross-site requests by a token signed with a random nonce kept in a cookie. The token
+	// ties the decision to the user and the parameters of the authorize request.
+	PARAM_CONSENT_TOKEN    = "consent_token"
+	CONSENT_COOKIE         = "glukit_consent"
+	CONSENT_NONCE_SIZE     = 32
+	CONSENT_COOKIE_PATH    = "/authorize"
+	CONSENT_COOKIE_MAX_AGE = 10 * 60
+
+	// The error of requests with a token that doesn't grant the scope of the endpoint
+	E_INSUFFICIENT_SCOPE = "insufficient_scope"
+)
+
+type oauthAuthenticatedHandler struct {
+	scope                string
+	authenticatedHandler http.Handler
+}
+
+// Some variables that are used during rendering of oauth templates
+type OauthRenderVariables struct {
+	Code  string
+	State string
+}
+
+// Some variables that are used during rendering of the consent page. The parameters of the authorize request are posted back
+// along with the decision of the user.
+type OauthConsentVariables struct {
+	ClientName   string
+	Scopes       []string
+	Parameters   url.Values
+	ConsentToken string
+}
+
+var authorizeLocalAppTemplate *template.Template
+var oauthConsentTemplate *template.Template
+
+// oauthManager returns the management of clients and tokens of the oauth storage, which both the App Engine and SQL storages implement
+func oauthManager() store.OauthManager {
+	return server.Storage.(store.OauthManager)
+}
+
+// resolveAuthorizeScopes returns the scopes of an authorize request, the ones the client registered if it didn't request any. Clients
+// can't request scopes they didn't register.
+func resolveAuthorizeScopes(client *model.OauthClient, scope string) (scopes []string, err error) {
+	scopes = model.ParseOauthScopes(scope)
+	if len(scopes) == 0 {
+		return client.Scopes, nil
+	}
+
+	return scopes, model.ValidateOauthScopes(scopes, client.Scopes)
+}
+
+// resolveCodeChallenge returns the PKCE challenge of an authorize request or nil if it doesn't have one. Public clients can't keep
+// a secret and must make a challenge.
+func resolveCodeChallenge(client *model.OauthClient, request *http.Request) (challenge *model.CodeChallenge, err error) {
+	value := request.Form.Get(PARAM_CODE_CHALLENGE)
+	if len(value) == 0 {
+		if client.Public {
+			return nil, errors.New(fmt.Sprintf("Missing %s, public clients must use PKCE", PARAM_CODE_CHALLENGE))
+		}
+
+		return nil, nil
+	}
+
+	challenge = &model.CodeChallenge{Challenge: value, Method: request.Form.Get(PARAM_CODE_CHALLENGE_METHOD)}
+	if len(challenge.Method) == 0 {
+		challenge.Method = model.CODE_CHALLENGE_METHOD_PLAIN
+	}
+
+	return challenge, challenge.Validate()
+}
+
+// validateAccessRequest returns an error if the code verifier doesn't match the PKCE challenge of the authorization code or if a
+// refresh asks for scopes the original token wasn't granted
+func validateAccessRequest(c context.Context, ar *osin.AccessRequest, request *http.Request) (err error) {
+	switch ar.Type {
+	case osin.AUTHORIZATION_CODE:
+		challenge, err := oauthManager().LoadCodeChallenge(c, ar.Code)
+		if err == store.ErrNoCodeChallenge {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !challenge.Verify(request.Form.Get(PARAM_CODE_VERIFIER)) {
+			return errors.New(fmt.Sprintf("Invalid %s", PARAM_CODE_VERIFIER))
+		}
+	case osin.REFRESH_TOKEN:
+		return model.ValidateOauthScopes(model.ParseOauthScopes(ar.Scope), model.GrantedOauthScopes(ar.AccessData.Scope))
+	}
+
+	return nil
+}
+
+// authorizeParameters returns the parameters of the authorize request without the ones of the consent page
+func authorizeParameters(form url.Values) (parameters url.Values) {
+	parameters = url.Values{}
+	for name, values := range form {
+		if name != PARAM_CONSENT && name != PARAM_CONSENT_TOKEN {
+			parameters[name] = values
+		}
+	}
+
+	return parameters
+}
+
+// signConsent returns the consent token of the user for the authorize parameters, signed with the nonce
+func signConsent(nonce []byte, email string, parameters url.Values) string {
+	mac := hmac.New(sha256.New, nonce)
+	mac.Write([]byte(email))
+	mac.Write([]byte{0})
+	mac.Write([]byte(parameters.Encode()))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newConsentToken sets a new nonce cookie on the response and returns the consent token of the user for the authorize parameters
+func newConsentToken(writer http.ResponseWriter, email string, parameters url.Values) (token string, err error) {
+	nonce := make([]byte, CONSENT_NONCE_SIZE)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	http.SetCookie(writer, &http.Cookie{Name: CONSENT_COOKIE, Value: base64.RawURLEncoding.EncodeToString(nonce), Path: CONSENT_COOKIE_PATH,
+		MaxAge: CONSENT_COOKIE_MAX_AGE, HttpOnly: true, Secure: strings.HasPrefix(appConfig.SSLHost, "https"), SameSite: http.SameSiteStrictMode})
+
+	return signConsent(nonce, email, parameters), nil
+}
+
+// verifyConsentToken returns an error if the consent token of the request is missing or wasn't signed with the nonce of the cookie
+// for the user and the authorize parameters
+func verifyConsentToken(request *http.Request, email string) (err error) {
+	token := request.PostForm.Get(PARAM_CONSENT_TOKEN)
+	if len(token) == 0 {
+		return errors.New(fmt.Sprintf("Missing %s", PARAM_CONSENT_TOKEN))
+	}
+
+	cookie, err := request.Cookie(CONSENT_COOKIE)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Missing %s cookie", CONSENT_COOKIE))
+	}
+
+	nonce, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(nonce) != CONSENT_NONCE_SIZE {
+		return errors.New(fmt.Sprintf("Invalid %s cookie", CONSENT_COOKIE))
+	}
+
+	if !hmac.Equal([]byte(token), []byte(signConsent(nonce, email, authorizeParameters(request.Form)))) {
+		return errors.New(fmt.Sprintf("Invalid %s", PARAM_CONSENT_TOKEN))
+	}
+
+	return nil
+}
+
+func initOauthProvider(writer http.ResponseWriter, request *http.Request) {
+	sconfig := osin.NewServerConfig()
+	sconfig.AllowedAuthorizeTypes = osin.AllowedAuthorizeType{osin.CODE, osin.TOKEN}
+	sconfig.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE,
+		osin.REFRESH_TOKEN}
+	// 30 days
+	sconfig.AccessExpiration = 60 * 60 * 24 * 30
+	sconfig.AllowGetAccessRequest = true
+	server = osin.NewServer(sconfig, newOsinStorage(request))
+	authorizeHandler := authProvider.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := appengine.NewContext(req)
+		user := authProvider.CurrentUser(req)
+		resp := server.NewResponse()
+		req.ParseForm()
+		req.SetBasicAuth(req.Form.Get("client_id"), req.Form.Get("client_secret"))
+		log.Debugf(c, "Processing authorization request: %v and form [%v]", req, req.PostForm)
+		if ar := server.HandleAuthorizeRequest(resp, req); ar != nil {
+			client, err := oauthManager().GetOauthClient(c, ar.Client.Id)
+			if err != nil {
+				util.Propagate(err)
+			}
+
+			scopes, err := resolveAuthorizeScopes(client, ar.Scope)
+			if err != nil {
+				resp.SetErrorState(osin.E_INVALID_SCOPE, err.Error(), ar.State)
+				osin.OutputJSON(resp, w, req)
+				return
+			}
+			ar.Scope = strings.Join(scopes, " ")
+
+			// The implicit grant hands out tokens without a code exchange so public clients would get around PKCE with it
+			if ar.Type == osin.TOKEN && client.Public {
+				resp.SetErrorState(osin.E_UNSUPPORTED_RESPONSE_TYPE, "Public clients must use the authorization code flow with PKCE", ar.State)
+				osin.OutputJSON(resp, w, req)
+				return
+			}
+
+			var challenge *model.CodeChallenge
+			if ar.Type == osin.CODE {
+				if challenge, err = resolveCodeChallenge(client, req); err != nil {
+					resp.SetErrorState(osin.E_INVALID_REQUEST, err.Error(), ar.State)
+					osin.OutputJSON(resp, w, req)
+					return
+				}
+			}
+
+			// Ask the user for consent before giving any access to the client, the decision is posted back with the request parameters
+			if req.Method != "POST" {
+				parameters := authorizeParameters(req.Form)
+				token, err := newConsentToken(w, user.Email, parameters)
+				if err != nil {
+					util.Propagate(err)
+				}
+
+				renderVariables := &OauthConsentVariables{ClientName: client.Name, Scopes: scopes, Parameters: parameters, ConsentToken: token}
+				if err := oauthConsentTemplate.Execute(w, renderVariables); err != nil {
+					log.Criticalf(c, "Error executing template [%s]", oauthConsentTemplate.Name())
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			if err := verifyConsentToken(req, user.Email); err != nil {
+				log.Warningf(c, "Rejecting consent of user [%s] to client [%s]: %v", user.Email, ar.Client.Id, err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			// The nonce is only good for one decision
+			http.SetCookie(w, &http.Cookie{Name: CONSENT_COOKIE, Path: CONSENT_COOKIE_PATH, MaxAge: -1})
+
+			ar.Authorized = req.Form.Get(PARAM_CONSENT) == CONSENT_APPROVE
+			ar.UserData = user.Email
+
+			_, _, err = repository.GetUserData(c, user.Email)
+			if err == store.ErrNoSuchUser {
+				log.Debugf(c, "Creating GlukitUser on first oauth access for [%s]: ", user.Email)
+				// If the user doesn't exist already, create it
+				glukitUser := model.GlukitUser{user.Email, "", "", time.Now(),
+					model.DIABETES_TYPE_1, "", util.GLUKIT_EPOCH_TIME, apimodel.UNDEFINED_GLUCOSE_READ,
+					model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, false, "", time.Now(), model.UNDEFINED_A1C_ESTIMATE, model.DEFAULT_GLUCOSE_TARGETS, model.SailingProfile{}, false}
+				err = repository.StoreUserProfile(c, time.Now(), glukitUser)
+				if err != nil {
+					resp.SetError(osin.E_SERVER_ERROR, fmt.Sprintf("Fail to initialize user for email [%s]: [%v]", user.Email, err))
+					resp.StatusCode = 500
+					osin.OutputJSON(resp, w, req)
+					return
+				}
+			} else if err != nil {
+				resp.SetError(osin.E_SERVER_ERROR, fmt.Sprintf("Unable to find user for email [%s]: [%v]", user.Email, err))
+				resp.StatusCode = 500
+				osin.OutputJSON(resp, w, req)
+				return
+			}
+
+			if err != nil {
+				util.Propagate(err)
+			}
+
+			server.FinishAuthorizeRequest(resp, req, ar)
+
+			data := resp.Output
+			if resp.IsError {
+				log.Infof(c, "User [%s] denied access to client [%s]", user.Email, ar.Client.Id)
+			} else if code, isCode := data["code"].(string); isCode {
+				if challenge != nil {
+					if err := oauthManager().SaveCodeChallenge(c, code, *challenge); err != nil {
+						util.Propagate(err)
+					}
+				}
+
+				if resp.URL == model.OOB_REDIRECT_URI {
+					// Render a page with the title including the code
+					renderVariables := &OauthRenderVariables{Code: code, State: data["state"].(string)}
+
+					if err := authorizeLocalAppTemplate.Execute(w, renderVariables); err != nil {
+						log.Criticalf(c, "Error executing template [%s]", authorizeLocalAppTemplate.Name())
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+					}
+				} else {
+					redirectUrl := fmt.Sprintf("%s?code=%s&state=%s", resp.URL, code, data["state"].(string))
+					log.Infof(c, "Redirecting to [%s] with valid code.", redirectUrl)
+					http.Redirect(w, req, redirectUrl, http.StatusTemporaryRedirect)
+				}
+				return
+			}
+		}
+		if resp.IsError && resp.InternalError != nil {
+			log.Debugf(c, "ERROR: %s\n", resp.InternalError)
+		}
+		log.Debugf(c, "Writing response: %v", resp.Output)
+		osin.OutputJSON(resp, w, req)
+	}))
+	muxRouter.Get(AUTHORIZE_ROUTE).Handler(authorizeHandler)
+	muxRouter.Get(AUTHORIZE_CONSENT_ROUTE).Handler(authorizeHandler)
+
+	// Access token endpoint
+	muxRouter.Get(TOKEN_ROUTE).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := appengine.NewContext(req)
+		resp := server.NewResponse()
+		req.ParseForm()
+		if _, _, ok := req.BasicAuth(); !ok {
+			req.SetBasicAuth(req.Form.Get("client_id"), req.Form.Get("client_secret"))
+		}
+		log.Debugf(c, "Processing token request: %v with form [%v]", req, req.PostForm)
+		if ar := server.HandleAccessRequest(resp, req); ar != nil {
+			log.Debugf(c, "Retrieved authorize data [%v]", ar)
+			if err := validateAccessRequest(c, ar, req); err != nil {
+				log.Infof(c, "Rejecting token request of client [%s]: %v", ar.Client.Id, err)
+				resp.SetError(osin.E_INVALID_GRANT, err.Error())
+			} else {
+				ar.Authorized = true
+				server.FinishAccessRequest(resp, req, ar)
+			}
+		}
+		log.Debugf(c, "Writing response: %v", resp.Output)
+		osin.OutputJSON(resp, w, req)
+	})
+	context := appengine.NewContext(request)
+	log.Debugf(context, "Oauth server loaded: [%v]", server)
+}
+
+// authorizeBearerAccess returns the access data of the bearer token of the request if it's a valid token granted the scope. Requests
+// without one get the id and description of the oauth error to respond with.
+func authorizeBearerAccess(request *http.Request, scope string) (accessData *osin.AccessData, errorId string, description string) {
+	authorizationValue := request.Header.Get("Authorization")
+	if authorizationValue == "" {
+		return nil, osin.E_INVALID_REQUEST, "Empty authorization"
+	}
+
+	accessCode := strings.TrimPrefix(authorizationValue, "Bearer ")
+	if accessCode == "" {
+		return nil, osin.E_INVALID_REQUEST, "Empty authorization value"
+	}
+
+	// load access data
+	accessData, err := server.Storage.LoadAccess(accessCode, request)
+	if err != nil {
+		return nil, osin.E_INVALID_REQUEST, fmt.Sprintf("Error loading access data for code [%s]: [%v]", accessCode, err)
+	}
+	if accessData.Client == nil || accessData.Client.RedirectUri == "" {
+		return nil, osin.E_UNAUTHORIZED_CLIENT, ""
+	}
+	if accessData.IsExpired() {
+		return nil, osin.E_INVALID_GRANT, ""
+	}
+
+	if !model.HasOauthScope(accessData.Scope, scope) {
+		return nil, E_INSUFFICIENT_SCOPE, fmt.Sprintf("The token wasn't granted the [%s] scope", scope)
+	}
+
+	return accessData, "", ""
+}
+
+func (handler *oauthAuthenticatedHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	c := appengine.NewContext(request)
+	request.ParseForm()
+	log.Debugf(c, "Checking authentication for request [%s]...", request.RequestURI)
+
+	if _, errorId, description := authorizeBearerAccess(request, handler.scope); errorId != "" {
+		ret := server.NewResponse()
+		ret.SetError(errorId, description)
+		ret.StatusCode = 403
+		osin.OutputJSON(ret, writer, request)
+		return
+	}
+
+	handler.authenticatedHandler.ServeHTTP(writer, request)
+}
+
+// newOauthAuthenticationHandler returns a handler that only lets through requests with a valid token granted the scope
+func newOauthAuthenticationHandler(scope string, next http.Handler) *oauthAuthenticatedHandler {
+	return &oauthAuthenticatedHandler{scope, next}
+}
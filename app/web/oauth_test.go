@@ -0,0 +1,272 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/osin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_CLIENT_ID           = "public.localhost"
+	TEST_CLIENT_REDIRECT_URI = "http://localhost/callback"
+
+	// The example of RFC 7636
+	TEST_CODE_VERIFIER  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	TEST_CODE_CHALLENGE = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+var consentTokenPattern = regexp.MustCompile(`name="` + PARAM_CONSENT_TOKEN + `" value="([^"]*)"`)
+
+// registerTestClient registers a public client with all scopes
+func registerTestClient(t *testing.T) {
+	client := model.OauthClient{Id: TEST_CLIENT_ID, Name: "Test", OwnerEmail: "developer@glukit.com", RedirectUri: TEST_CLIENT_REDIRECT_URI,
+		Scopes: model.OAUTH_SCOPES, Public: true, CreatedOn: time.Now()}
+	if err := oauthManager().RegisterClient(context.Background(), client, ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthorizeRejectsImplicitGrantOfPublicClients(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+
+	parameters := url.Values{}
+	parameters.Set("response_type", string(osin.TOKEN))
+	parameters.Set("client_id", TEST_CLIENT_ID)
+	parameters.Set("redirect_uri", TEST_CLIENT_REDIRECT_URI)
+	parameters.Set("state", "xyz")
+	parameters.Set(PARAM_CONSENT, CONSENT_APPROVE)
+
+	for _, method := range []string{"GET", "POST"} {
+		var request *http.Request
+		if method == "GET" {
+			request = httptest.NewRequest(method, "/authorize?"+parameters.Encode(), nil)
+		} else {
+			request = httptest.NewRequest(method, "/authorize", strings.NewReader(parameters.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		response := serveTestRequest(request, "patient@glukit.com")
+		location := response.Header().Get("Location")
+		if !strings.Contains(location, "error="+osin.E_UNSUPPORTED_RESPONSE_TYPE) || strings.Contains(location, "access_token") {
+			t.Errorf("TestAuthorizeRejectsImplicitGrantOfPublicClients failed: got [%d] redirecting to [%s] for a %s but expected an [%s] error",
+				response.Code, location, method, osin.E_UNSUPPORTED_RESPONSE_TYPE)
+		}
+	}
+}
+
+// codeAuthorizeParameters returns the parameters of an authorization code request of the test client with a PKCE challenge
+func codeAuthorizeParameters() url.Values {
+	parameters := url.Values{}
+	parameters.Set("response_type", string(osin.CODE))
+	parameters.Set("client_id", TEST_CLIENT_ID)
+	parameters.Set("redirect_uri", TEST_CLIENT_REDIRECT_URI)
+	parameters.Set("state", "xyz")
+	parameters.Set(PARAM_CODE_CHALLENGE, TEST_CODE_CHALLENGE)
+	parameters.Set(PARAM_CODE_CHALLENGE_METHOD, model.CODE_CHALLENGE_METHOD_S256)
+
+	return parameters
+}
+
+// renderTestConsent gets the consent page of the authorize request and returns its consent token and nonce cookie
+func renderTestConsent(t *testing.T, parameters url.Values, email string) (token string, cookie *http.Cookie) {
+	response := serveTestRequest(httptest.NewRequest("GET", "/authorize?"+parameters.Encode(), nil), email)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Error rendering consent page: got [%d] with [%s]", response.Code, response.Body.String())
+	}
+
+	match := consentTokenPattern.FindStringSubmatch(response.Body.String())
+	if match == nil {
+		t.Fatalf("Missing %s in consent page [%s]", PARAM_CONSENT_TOKEN, response.Body.String())
+	}
+
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == CONSENT_COOKIE {
+			return match[1], cookie
+		}
+	}
+
+	t.Fatalf("Missing %s cookie in consent page response", CONSENT_COOKIE)
+	return "", nil
+}
+
+// postTestConsent posts the decision of the user on the consent page
+func postTestConsent(parameters url.Values, decision string, token string, cookie *http.Cookie, email string) *httptest.ResponseRecorder {
+	form := url.Values{}
+	for name, values := range parameters {
+		form[name] = values
+	}
+	form.Set(PARAM_CONSENT, decision)
+	if len(token) > 0 {
+		form.Set(PARAM_CONSENT_TOKEN, token)
+	}
+
+	request := httptest.NewRequest("POST", "/authorize", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+
+	return serveTestRequest(request, email)
+}
+
+func TestAuthorizeConsentRequiresToken(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+
+	parameters := codeAuthorizeParameters()
+	token, cookie := renderTestConsent(t, parameters, "patient@glukit.com")
+
+	tampered := codeAuthorizeParameters()
+	tampered.Set("scope", model.OAUTH_SCOPE_GLUCOSE_WRITE)
+
+	forgeries := []struct {
+		description string
+		parameters  url.Values
+		token       string
+		cookie      *http.Cookie
+		email       string
+	}{
+		{"a missing token", parameters, "", cookie, "patient@glukit.com"},
+		{"a missing cookie", parameters, token, nil, "patient@glukit.com"},
+		{"another cookie", parameters, token, &http.Cookie{Name: CONSENT_COOKIE, Value: strings.Repeat("A", 43)}, "patient@glukit.com"},
+		{"tampered parameters", tampered, token, cookie, "patient@glukit.com"},
+		{"another user", parameters, token, cookie, "other@glukit.com"},
+	}
+
+	for _, forgery := range forgeries {
+		response := postTestConsent(forgery.parameters, CONSENT_APPROVE, forgery.token, forgery.cookie, forgery.email)
+		if response.Code != http.StatusForbidden {
+			t.Errorf("TestAuthorizeConsentRequiresToken failed: got [%d] for %s but expected [%d]", response.Code, forgery.description,
+				http.StatusForbidden)
+		}
+	}
+
+	response := postTestConsent(parameters, CONSENT_APPROVE, token, cookie, "patient@glukit.com")
+	if location := response.Header().Get("Location"); !strings.HasPrefix(location, TEST_CLIENT_REDIRECT_URI+"?code=") {
+		t.Errorf("TestAuthorizeConsentRequiresToken failed: got [%d] redirecting to [%s] but expected a redirect with a code", response.Code,
+			location)
+	}
+}
+
+// authorizeTestCode goes through the consent of the user and returns the authorization code given to the test client
+func authorizeTestCode(t *testing.T, email string) (code string) {
+	parameters := codeAuthorizeParameters()
+	token, cookie := renderTestConsent(t, parameters, email)
+
+	response := postTestConsent(parameters, CONSENT_APPROVE, token, cookie, email)
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil || len(location.Query().Get("code")) == 0 {
+		t.Fatalf("Error authorizing test client: got [%d] redirecting to [%s]", response.Code, response.Header().Get("Location"))
+	}
+
+	return location.Query().Get("code")
+}
+
+// exchangeTestCode posts a token request of the test client for the code and returns the decoded response
+func exchangeTestCode(t *testing.T, code string, verifier string) (output map[string]interface{}) {
+	form := url.Values{}
+	form.Set("grant_type", string(osin.AUTHORIZATION_CODE))
+	form.Set("client_id", TEST_CLIENT_ID)
+	form.Set("redirect_uri", TEST_CLIENT_REDIRECT_URI)
+	form.Set("code", code)
+	if len(verifier) > 0 {
+		form.Set(PARAM_CODE_VERIFIER, verifier)
+	}
+
+	request := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	muxRouter.ServeHTTP(response, request)
+
+	if err := json.NewDecoder(response.Body).Decode(&output); err != nil {
+		t.Fatalf("Error decoding token response: got [%d]: %v", response.Code, err)
+	}
+
+	return output
+}
+
+func TestTokenRequiresCodeVerifier(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+
+	code := authorizeTestCode(t, "patient@glukit.com")
+	for _, verifier := range []string{"", strings.Repeat("a", len(TEST_CODE_VERIFIER)), TEST_CODE_CHALLENGE} {
+		if output := exchangeTestCode(t, code, verifier); output["error"] != osin.E_INVALID_GRANT || output["access_token"] != nil {
+			t.Errorf("TestTokenRequiresCodeVerifier failed: got [%v] for verifier [%s] but expected an [%s] error", output, verifier,
+				osin.E_INVALID_GRANT)
+		}
+	}
+
+	if output := exchangeTestCode(t, code, TEST_CODE_VERIFIER); output["error"] != nil || output["access_token"] == nil {
+		t.Errorf("TestTokenRequiresCodeVerifier failed: got [%v] for the verifier of the challenge but expected an access token", output)
+	}
+}
+
+// storeTestProfile stores the profile of a user without any data
+func storeTestProfile(t *testing.T, email string) {
+	user := model.GlukitUser{Email: email, MostRecentRead: apimodel.UNDEFINED_GLUCOSE_READ, MostRecentScore: model.UNDEFINED_SCORE,
+		MostRecentA1C: model.UNDEFINED_A1C_ESTIMATE, Targets: model.DEFAULT_GLUCOSE_TARGETS}
+	if err := repository.StoreUserProfile(context.Background(), time.Now(), user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saveTestAccess stores an access token of the test client, valid for an hour from its creation, granted the scope by the user
+func saveTestAccess(t *testing.T, token string, scope string, createdAt time.Time, email string) (accessData *osin.AccessData) {
+	client, err := server.Storage.GetClient(TEST_CLIENT_ID, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessData = &osin.AccessData{Client: client, AccessToken: token, ExpiresIn: 3600, Scope: scope, RedirectUri: TEST_CLIENT_REDIRECT_URI,
+		CreatedAt: createdAt, UserData: email}
+	if err := server.Storage.SaveAccess(accessData, httptest.NewRequest("POST", "/token", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	return accessData
+}
+
+func TestOauthRoutesRequireScope(t *testing.T) {
+	setupTestEnvironment(t)
+	registerTestClient(t)
+
+	storeTestProfile(t, "patient@glukit.com")
+	accessData := saveTestAccess(t, "glucose-reader", model.OAUTH_SCOPE_GLUCOSE_READ, time.Now(), "patient@glukit.com")
+
+	routes := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/v1/glucosereads", http.StatusOK},
+		{"POST", "/v1/glucosereads", http.StatusForbidden},
+		{"GET", "/v1/injections", http.StatusForbidden},
+		{"GET", "/v1/profile", http.StatusForbidden},
+	}
+
+	for _, route := range routes {
+		request := httptest.NewRequest(route.method, route.path, strings.NewReader("[]"))
+		request.Header.Set("Authorization", "Bearer "+accessData.AccessToken)
+		response := httptest.NewRecorder()
+		muxRouter.ServeHTTP(response, request)
+
+		if response.Code != route.code {
+			t.Errorf("TestOauthRoutesRequireScope failed: got [%d] for [%s %s] with a [%s] token but expected [%d]", response.Code, route.method,
+				route.path, accessData.Scope, route.code)
+		} else if route.code == http.StatusForbidden && !strings.Contains(response.Body.String(), E_INSUFFICIENT_SCOPE) {
+			t.Errorf("TestOauthRoutesRequireScope failed: got [%s] for [%s %s] but expected an [%s] error", response.Body.String(), route.method,
+				route.path, E_INSUFFICIENT_SCOPE)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"time"
+)
+
+const (
+	// The client whose tokens are revoked
+	QUERY_PARAM_CLIENT = "client"
+	// The id of the token that is revoked
+	QUERY_PARAM_TOKEN = "token"
+
+	// The size in bytes of generated client ids and secrets
+	OAUTH_CLIENT_ID_SIZE     = 14
+	OAUTH_CLIENT_SECRET_SIZE = 24
+)
+
+// Represents the response to a client registration, the secret is only ever returned once and is empty for public clients
+type OauthClientRegistration struct {
+	model.OauthClient
+	Secret string `json:"secret,omitempty"`
+}
+
+// generateOauthValue returns a random hex value of size bytes
+func generateOauthValue(size int) string {
+	value := make([]byte, size)
+	if _, err := rand.Read(value); err != nil {
+		util.Propagate(err)
+	}
+
+	return hex.EncodeToString(value)
+}
+
+// oauthClients is the endpoint to retrieve the clients registered by the active user
+func oauthClients(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	clients, err := oauthManager().GetOauthClientsByOwner(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeOauthDocuments(writer, clients)
+}
+
+// registerOauthClient is the endpoint that registers a new client owned by the active user from a json OauthClient document. The
+// client id and secret are generated and returned in the response, public clients don't get a secret.
+func registerOauthClient(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var client model.OauthClient
+	if err := json.NewDecoder(request.Body).Decode(&client); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid oauth client: [%v].", err), 400)
+		return
+	}
+
+	if err := client.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	client.Id = fmt.Sprintf("%s.%s", generateOauthValue(OAUTH_CLIENT_ID_SIZE), appConfig.Host)
+	client.OwnerEmail = user.Email
+	client.CreatedOn = time.Now()
+
+	secret := ""
+	if !client.Public {
+		secret = generateOauthValue(OAUTH_CLIENT_SECRET_SIZE)
+	}
+
+	if err := oauthManager().RegisterClient(context, client, secret); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] registered oauth client [%s] with scopes %v", user.Email, client.Id, client.Scopes)
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(OauthClientRegistration{client, secret})
+}
+
+// oauthAuthorizations is the endpoint to retrieve the applications the active user authorized along with their tokens
+func oauthAuthorizations(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	tokens, err := oauthManager().GetUserTokens(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	authorizations := make([]model.OauthAuthorization, 0)
+	authorizationIndexes := make(map[string]int)
+	for _, token := range tokens {
+		index, found := authorizationIndexes[token.ClientId]
+		if !found {
+			clientName := token.ClientId
+			client, err := oauthManager().GetOauthClient(context, token.ClientId)
+			if err == nil {
+				clientName = client.Name
+			} else if err != store.ErrNoSuchOauthClient {
+				util.Propagate(err)
+			}
+
+			index = len(authorizations)
+			authorizationIndexes[token.ClientId] = index
+			authorizations = append(authorizations, model.OauthAuthorization{ClientId: token.ClientId, ClientName: clientName,
+				Tokens: make([]model.OauthToken, 0)})
+		}
+
+		authorizations[index].Tokens = append(authorizations[index].Tokens, token)
+	}
+
+	writeOauthDocuments(writer, authorizations)
+}
+
+// revokeOauthAuthorization is the endpoint that revokes all codes and tokens the active user authorized a client to get
+func revokeOauthAuthorization(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	clientId := request.FormValue(QUERY_PARAM_CLIENT)
+	if len(clientId) == 0 {
+		http.Error(writer, fmt.Sprintf("Missing %s.", QUERY_PARAM_CLIENT), 400)
+		return
+	}
+
+	if err := oauthManager().RevokeClientTokens(context, user.Email, clientId); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] revoked the authorization of client [%s]", user.Email, clientId)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// revokeOauthToken is the endpoint that revokes a single token of the active user
+func revokeOauthToken(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	tokenId := request.FormValue(QUERY_PARAM_TOKEN)
+	if len(tokenId) == 0 {
+		http.Error(writer, fmt.Sprintf("Missing %s.", QUERY_PARAM_TOKEN), 400)
+		return
+	}
+
+	err := oauthManager().RevokeUserToken(context, user.Email, tokenId)
+	if err == store.ErrNoSuchOauthToken {
+		http.Error(writer, err.Error(), 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] revoked token [%s]", user.Email, tokenId)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func writeOauthDocuments(writer http.ResponseWriter, documents interface{}) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(documents)
+}
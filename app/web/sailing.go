@@ -0,0 +1,80 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"time"
+)
+
+// sailingPreferences are the preferences of a user about being shown as the steady sailor of others along with the date of birth
+// users are matched on
+type sailingPreferences struct {
+	Sailing     model.SailingProfile `json:"sailing"`
+	DateOfBirth *time.Time           `json:"dateOfBirth"`
+}
+
+// sailingPreferencesReport is the endpoint to retrieve the sailing preferences of the active user
+func sailingPreferencesReport(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeSailingPreferences(writer, *glukitUser)
+}
+
+// updateSailingPreferences is the endpoint that sets the sailing preferences of the active user from a json document. Users are only
+// ever shown as the steady sailor of others once they opted in and only under their display name. The date of birth is left
+// unchanged if it isn't part of the document.
+func updateSailingPreferences(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var preferences sailingPreferences
+	if err := json.NewDecoder(request.Body).Decode(&preferences); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid sailing preferences: [%v].", err), 400)
+		return
+	}
+
+	if err := preferences.Sailing.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	if preferences.DateOfBirth != nil && preferences.DateOfBirth.After(time.Now()) {
+		http.Error(writer, fmt.Sprintf("Invalid date of birth [%s], it can't be in the future", preferences.DateOfBirth), 400)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	glukitUser.Sailing = preferences.Sailing
+	if preferences.DateOfBirth != nil {
+		glukitUser.DateOfBirth = *preferences.DateOfBirth
+	}
+
+	if err := repository.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Updated the sailing preferences of user [%s] to [%v]", user.Email, preferences.Sailing)
+
+	writeSailingPreferences(writer, *glukitUser)
+}
+
+func writeSailingPreferences(writer http.ResponseWriter, glukitUser model.GlukitUser) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(sailingPreferences{Sailing: glukitUser.Sailing, DateOfBirth: &glukitUser.DateOfBirth})
+}
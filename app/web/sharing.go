@@ -0,0 +1,182 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// The email of the viewer whose grant is revoked
+	QUERY_PARAM_VIEWER = "viewer"
+	// The number of viewer accesses returned when the request doesn't have a limit
+	DEFAULT_VIEWER_ACCESSES_LIMIT = 100
+)
+
+// resolveSubject returns the email of the user whose data is read by the active user, the subject of the request or the active user
+// if it doesn't have one. Reading the data of another user requires a grant of the scope from that user, or that user to be enrolled
+// in a clinic the active user is a practitioner of, and every such access is logged for them to see. Requests without access get a
+// 403 and ok is false. Subjects and viewers are matched on their normalized email but the returned email is the one the data of the
+// subject is stored under.
+func resolveSubject(writer http.ResponseWriter, request *http.Request, scope string) (email string, ok bool) {
+	user := authProvider.CurrentUser(request)
+	subject := model.NormalizeEmail(request.FormValue(QUERY_PARAM_SUBJECT))
+	viewerEmail := model.NormalizeEmail(user.Email)
+	if len(subject) == 0 || subject == viewerEmail {
+		return user.Email, true
+	}
+
+	context := appengine.NewContext(request)
+	grants, err := repository.GetSharingGrantsByViewer(context, viewerEmail)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	// Owners can sign in with an email that isn't normalized so the data is read under the one of their grant or enrollment
+	owner := ""
+	for _, grant := range grants {
+		if model.NormalizeEmail(grant.OwnerEmail) == subject && grant.HasScope(scope) {
+			owner = grant.OwnerEmail
+			break
+		}
+	}
+
+	if owner == "" {
+		if owner, err = engine.FindClinicPatient(context, repository, viewerEmail, subject); err != nil {
+			util.Propagate(err)
+		}
+	}
+
+	if owner == "" {
+		log.Warningf(context, "Denied [%s] access of user [%s] to the data of [%s]", scope, user.Email, subject)
+		http.Error(writer, fmt.Sprintf("No [%s] access granted to the data of [%s].", scope, subject), http.StatusForbidden)
+		return "", false
+	}
+
+	access := model.ViewerAccess{ViewerEmail: viewerEmail, Scope: scope, Path: request.URL.Path, Time: time.Now()}
+	if err := repository.LogViewerAccess(context, owner, access); err != nil {
+		util.Propagate(err)
+	}
+
+	return owner, true
+}
+
+// sharingGrants is the endpoint to retrieve the grants the active user gave to viewers of their data
+func sharingGrants(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	grants, err := repository.GetSharingGrantsByOwner(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeSharingDocuments(writer, grants)
+}
+
+// grantSharing is the endpoint that gives a viewer read-only access to scopes of the data of the active user from a json SharingGrant
+// document. A grant to the same viewer replaces the previous one.
+func grantSharing(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var grant model.SharingGrant
+	if err := json.NewDecoder(request.Body).Decode(&grant); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid sharing grant: [%v].", err), 400)
+		return
+	}
+
+	grant.OwnerEmail = user.Email
+	grant.ViewerEmail = model.NormalizeEmail(grant.ViewerEmail)
+	grant.GrantedOn = time.Now()
+	if err := grant.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	if err := repository.StoreSharingGrant(context, grant); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] granted [%v] access to viewer [%s]", user.Email, grant.Scopes, grant.ViewerEmail)
+
+	writer.Header().Add("Content-type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	enc := json.NewEncoder(writer)
+	enc.Encode(grant)
+}
+
+// revokeSharing is the endpoint that revokes the grant of the active user to a viewer
+func revokeSharing(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	viewer := model.NormalizeEmail(request.FormValue(QUERY_PARAM_VIEWER))
+	if len(viewer) == 0 {
+		http.Error(writer, fmt.Sprintf("Missing %s.", QUERY_PARAM_VIEWER), 400)
+		return
+	}
+
+	err := repository.DeleteSharingGrant(context, user.Email, viewer)
+	if err == store.ErrNoSharingGrant {
+		http.Error(writer, err.Error(), 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "User [%s] revoked the access of viewer [%s]", user.Email, viewer)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// sharedWithViewer is the endpoint to retrieve the grants other users gave to the active user
+func sharedWithViewer(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	grants, err := repository.GetSharingGrantsByViewer(context, model.NormalizeEmail(user.Email))
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeSharingDocuments(writer, grants)
+}
+
+// viewerAccesses is the endpoint to retrieve the audit log of the accesses of viewers to the data of the active user, most recent first
+func viewerAccesses(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	limit := DEFAULT_VIEWER_ACCESSES_LIMIT
+	if value := request.FormValue(QUERY_PARAM_LIMIT); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(writer, fmt.Sprintf("Invalid value for %s: [%s].", QUERY_PARAM_LIMIT, value), 400)
+			return
+		}
+
+		limit = parsed
+	}
+
+	accesses, err := repository.GetViewerAccesses(context, user.Email, limit)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	writeSharingDocuments(writer, accesses)
+}
+
+func writeSharingDocuments(writer http.ResponseWriter, documents interface{}) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(documents)
+}
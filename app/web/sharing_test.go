@@ -0,0 +1,69 @@
+package web
+
+import (
+	"context"
+	"github.com/alexandre-normand/glukit/app/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// resolveTestSubject resolves the subject of a report request of the user
+func resolveTestSubject(subject string, email string, scope string) (resolved string, ok bool, response *httptest.ResponseRecorder) {
+	request := httptest.NewRequest("GET", "/report?"+QUERY_PARAM_SUBJECT+"="+url.QueryEscape(subject), nil)
+	request.Header.Set(TEST_USER_HEADER, email)
+	response = httptest.NewRecorder()
+
+	resolved, ok = resolveSubject(response, request, scope)
+	return resolved, ok, response
+}
+
+func TestResolveSubjectWithSharingGrant(t *testing.T) {
+	setupTestEnvironment(t)
+
+	c := context.Background()
+	// The owner signed in with an email that isn't normalized so their data is stored under it
+	grant := model.SharingGrant{OwnerEmail: "Patient@Glukit.com", ViewerEmail: "parent@glukit.com", Scopes: []string{model.SHARING_SCOPE_REPORTS},
+		GrantedOn: time.Now()}
+	if err := repository.StoreSharingGrant(c, grant); err != nil {
+		t.Fatal(err)
+	}
+
+	if resolved, ok, _ := resolveTestSubject("", "parent@glukit.com", model.SHARING_SCOPE_REPORTS); !ok || resolved != "parent@glukit.com" {
+		t.Errorf("TestResolveSubjectWithSharingGrant failed: got [%s] without a subject but expected [parent@glukit.com]", resolved)
+	}
+
+	if resolved, ok, _ := resolveTestSubject(" patient@glukit.COM ", "parent@glukit.com", model.SHARING_SCOPE_REPORTS); !ok ||
+		resolved != "Patient@Glukit.com" {
+		t.Errorf("TestResolveSubjectWithSharingGrant failed: got [%s] with a granted scope but expected [Patient@Glukit.com]", resolved)
+	}
+
+	denials := []struct {
+		description string
+		email       string
+		scope       string
+	}{
+		{"a scope that wasn't granted", "parent@glukit.com", model.SHARING_SCOPE_SCORES},
+		{"a user without a grant", "stranger@glukit.com", model.SHARING_SCOPE_REPORTS},
+	}
+
+	for _, denial := range denials {
+		if _, ok, response := resolveTestSubject("patient@glukit.com", denial.email, denial.scope); ok || response.Code != http.StatusForbidden {
+			t.Errorf("TestResolveSubjectWithSharingGrant failed: got [%d] for %s but expected [%d]", response.Code, denial.description,
+				http.StatusForbidden)
+		}
+	}
+
+	accesses, err := repository.GetViewerAccesses(c, "Patient@Glukit.com", DEFAULT_VIEWER_ACCESSES_LIMIT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accesses) != 1 || accesses[0].ViewerEmail != "parent@glukit.com" || accesses[0].Scope != model.SHARING_SCOPE_REPORTS ||
+		accesses[0].Path != "/report" {
+		t.Errorf("TestResolveSubjectWithSharingGrant failed: got accesses [%v] but expected the one [%s] access of [parent@glukit.com]",
+			accesses, model.SHARING_SCOPE_REPORTS)
+	}
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"google.golang.org/appengine"
+	"net/http"
+	"time"
+)
+
+// glucoseTargets is the response of the targets endpoints
+type glucoseTargets struct {
+	Targets model.GlucoseTargets            `json:"targets"`
+	Presets map[string]model.GlucoseTargets `json:"presets"`
+}
+
+func glucoseTargetsReport(writer http.ResponseWriter, request *http.Request) {
+	user := authProvider.CurrentUser(request)
+
+	glucoseTargetsForEmail(writer, request, user.Email)
+}
+
+func glucoseTargetsForDemo(writer http.ResponseWriter, request *http.Request) {
+	glucoseTargetsForEmail(writer, request, DEMO_EMAIL)
+}
+
+// glucoseTargetsForEmail is the endpoint to retrieve the glucose targets of a user along with the available presets
+func glucoseTargetsForEmail(writer http.ResponseWriter, request *http.Request, email string) {
+	context := appengine.NewContext(request)
+
+	glukitUser, err := repository.GetUserProfile(context, email)
+	if err == store.ErrNoSuchUser {
+		http.Error(writer, err.Error(), 404)
+		return
+	} else if err != nil {
+		util.Propagate(err)
+	}
+
+	writeGlucoseTargets(writer, glukitUser.GetTargets())
+}
+
+// updateGlucoseTargets is the endpoint that sets the glucose targets of the active user from a json GlucoseTargets document. Preset
+// profiles get the values of the preset, only custom targets use the values of the document. Scores keep the target they were calculated
+// against but episodes of the last MAX_CALCULATION_DAYS_TO_LOOK_BACK days are detected again with the new thresholds.
+func updateGlucoseTargets(writer http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+
+	var targets model.GlucoseTargets
+	if err := json.NewDecoder(request.Body).Decode(&targets); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid targets: [%v].", err), 400)
+		return
+	}
+
+	if preset, ok := model.GLUCOSE_TARGETS_PRESETS[targets.Profile]; ok {
+		targets = preset
+	}
+
+	if err := targets.Validate(); err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+
+	glukitUser, err := repository.GetUserProfile(context, user.Email)
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	glukitUser.Targets = targets
+	if err := repository.StoreUserProfile(context, time.Now(), *glukitUser); err != nil {
+		util.Propagate(err)
+	}
+
+	log.Infof(context, "Updated the glucose targets of user [%s] to [%v]", user.Email, targets)
+
+	lowerBound := time.Now().AddDate(0, 0, -1*engine.MAX_CALCULATION_DAYS_TO_LOOK_BACK)
+	if err := engine.StartGlycemicEpisodeDetection(context, jobQueue, user.Email, lowerBound); err != nil {
+		log.Warningf(context, "Error starting episode detection for user [%s]: %v", user.Email, err)
+	}
+
+	writeGlucoseTargets(writer, targets)
+}
+
+func writeGlucoseTargets(writer http.ResponseWriter, targets model.GlucoseTargets) {
+	writer.Header().Add("Content-type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.Encode(glucoseTargets{Targets: targets, Presets: model.GLUCOSE_TARGETS_PRESETS})
+}
@@ -1,24 +1,21 @@
-package main
+package web
 
 import (
 	"bufio"
 	"github.com/alexandre-normand/glukit/app/engine"
 	"github.com/alexandre-normand/glukit/app/importer"
+	"github.com/alexandre-normand/glukit/app/log"
 	"github.com/alexandre-normand/glukit/app/model"
-	"github.com/alexandre-normand/glukit/app/store"
 	"github.com/alexandre-normand/glukit/app/util"
 	"context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/channel"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/delay"
-	"google.golang.org/appengine/log"
 	"os"
 )
 
-var processDemoFile = delay.Func("processDemoFile", processStaticDemoFile)
-
 const (
 	DATASTORE_WRITES_QUEUE_NAME = "datastore-writes"
+	PROCESS_DEMO_FILE_JOB_NAME  = "processDemoFile"
 )
 
 func disabledUpdateUserData(context context.Context, userEmail string, autoScheduleNextRun bool) {
@@ -26,7 +23,7 @@ func disabledUpdateUserData(context context.Context, userEmail string, autoSched
 }
 
 // processStaticDemoFile imports the static resource included with the app for the demo user
-func processStaticDemoFile(context context.Context, userProfileKey *datastore.Key) {
+func processStaticDemoFile(context context.Context, userEmail string) {
 
 	// open input file
 	fi, err := os.Open("data.xml")
@@ -42,28 +39,30 @@ func processStaticDemoFile(context context.Context, userProfileKey *datastore.Ke
 	// make a read buffer
 	reader := bufio.NewReader(fi)
 
-	lastReadTime, err := importer.ParseContent(context, reader, userProfileKey, util.GLUKIT_EPOCH_TIME,
-		store.StoreDaysOfReads, store.StoreDaysOfMeals, store.StoreDaysOfInjections, store.StoreDaysOfExercises)
+	lastReadTime, err := importer.ParseContent(context, reader, repository, userEmail, util.GLUKIT_EPOCH_TIME)
 
 	if err != nil {
 		util.Propagate(err)
 	}
 
-	store.LogFileImport(context, userProfileKey, model.FileImportLog{Id: "demo", Md5Checksum: "dummychecksum",
+	repository.LogFileImport(context, userEmail, model.FileImportLog{Id: "demo", Md5Checksum: "dummychecksum",
 		LastDataProcessed: lastReadTime, ImportResult: "Success"})
 
-	if userProfile, err := store.GetUserProfile(context, userProfileKey); err != nil {
+	if userProfile, err := repository.GetUserProfile(context, userEmail); err != nil {
 		log.Warningf(context, "Error while persisting score for %s: %v", DEMO_EMAIL, err)
 	} else {
-		if err := engine.StartGlukitScoreBatch(context, userProfile); err != nil {
+		if err := engine.StartGlukitScoreBatch(context, jobQueue, userProfile); err != nil {
 			log.Warningf(context, "Error while starting batch calculation of glukit scores for %s: %v", DEMO_EMAIL, err)
 		}
 
-		err = engine.StartA1CCalculationBatch(context, userProfile)
+		err = engine.StartA1CCalculationBatch(context, jobQueue, userProfile)
 		if err != nil {
 			log.Warningf(context, "Error starting a1c calculation batch for user [%s]: %v", DEMO_EMAIL, err)
 		}
 	}
 
-	channel.Send(context, DEMO_EMAIL, "Refresh")
+	// The channel API only exists on App Engine, standalone clients pick up the new data on their next refresh
+	if appengine.IsAppEngine() {
+		channel.Send(context, DEMO_EMAIL, "Refresh")
+	}
 }
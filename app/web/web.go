@@ -0,0 +1,428 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"github.com/alexandre-normand/glukit/app/apimodel"
+	"github.com/alexandre-normand/glukit/app/auth"
+	"github.com/alexandre-normand/glukit/app/config"
+	"github.com/alexandre-normand/glukit/app/engine"
+	"github.com/alexandre-normand/glukit/app/export"
+	"github.com/alexandre-normand/glukit/app/log"
+	"github.com/alexandre-normand/glukit/app/model"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/util"
+	"github.com/alexandre-normand/osin"
+	"github.com/gorilla/mux"
+	"google.golang.org/appengine"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var dataBrowserTemplate *template.Template
+var reportTemplate *template.Template
+var landingTemplate *template.Template
+var muxRouter = mux.NewRouter()
+var initOnce sync.Once
+
+// The storage of all user data
+var repository store.Repository
+
+// The authentication of users
+var authProvider auth.Provider
+
+// The queue of background jobs
+var jobQueue queue.Queue
+
+// The factory of the oauth server's storage
+var newOsinStorage func(request *http.Request) osin.Storage
+
+const (
+	DEMO_PATH_PREFIX        = "demo."
+	DEMO_PICTURE_URL        = "https://farm8.staticflickr.com/7389/10813078553_ab4e1397f4_b_d.jpg"
+	GLUCOSE_UNIT_PARAMETER  = "unit"
+	CONTENT_SECURITY_POLICY = "default-src 'self'; img-src *; style-src 'unsafe-inline' 'self'; font-src 'self' https://fonts.gstatic.com; connect-src 'self' https://api.stripe.com; frame-src 'self' https://js.stripe.com; script-src 'self' 'unsafe-inline' js.stripe.com *.googleapis.com *.google-analytics.com"
+)
+
+// Some variables that are used during rendering of templates
+type RenderVariables struct {
+	PathPrefix           string
+	StripePublishableKey string
+	SSLHost              string
+	GlucoseUnit          apimodel.GlucoseUnit
+}
+
+// Environment holds the services that differ between the App Engine and the standalone deployments of glukit
+type Environment struct {
+	Config     *config.AppConfig
+	Repository store.Repository
+	Auth       auth.Provider
+	Queue      queue.Queue
+	// OsinStorage returns the storage of the oauth server for a request
+	OsinStorage func(request *http.Request) osin.Storage
+	// The directory holding the view resources (templates, javascript, css, etc.)
+	ViewDir string
+}
+
+// Initialize sets up the environment, the routes and the background jobs. It returns the router that
+// serves all glukit requests.
+func Initialize(environment Environment) (router *mux.Router) {
+	appConfig = environment.Config
+	repository = environment.Repository
+	authProvider = environment.Auth
+	jobQueue = environment.Queue
+	newOsinStorage = environment.OsinStorage
+
+	loadTemplates(environment.ViewDir)
+	engine.RegisterForecastModel(engine.NewAutoregressiveModel(onBoardSettings()))
+
+	// Create user Glukit Bernstein as a fallback for comparisons
+	muxRouter.HandleFunc("/_ah/warmup", warmUp)
+	muxRouter.HandleFunc("/initpower", warmUp)
+
+	// GAE Json endpoints
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"data", demoContent)
+	muxRouter.Handle("/data", authProvider.RequireLogin(http.HandlerFunc(personalData)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"steadySailor", demoSteadySailorData)
+	muxRouter.Handle("/steadySailor", authProvider.RequireLogin(http.HandlerFunc(steadySailorData)))
+	muxRouter.Handle("/sailing", authProvider.RequireLogin(http.HandlerFunc(sailingPreferencesReport))).Methods("GET")
+	muxRouter.Handle("/sailing", authProvider.RequireLogin(http.HandlerFunc(updateSailingPreferences))).Methods("POST")
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"dashboard", demoDashboard)
+	muxRouter.Handle("/dashboard", authProvider.RequireLogin(http.HandlerFunc(dashboard)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"glukitScores", glukitScoresForDemo)
+	muxRouter.Handle("/glukitScores", authProvider.RequireLogin(http.HandlerFunc(glukitScores)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"a1cs", a1cEstimatesForDemo)
+	muxRouter.Handle("/a1cs", authProvider.RequireLogin(http.HandlerFunc(a1cEstimates)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"a1cReport", a1cReportForDemo)
+	muxRouter.Handle("/a1cReport", authProvider.RequireLogin(http.HandlerFunc(a1cReport)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"labA1Cs", labA1CsForDemo).Methods("GET")
+	muxRouter.Handle("/labA1Cs", authProvider.RequireLogin(http.HandlerFunc(labA1Cs))).Methods("GET")
+	muxRouter.Handle("/labA1Cs", authProvider.RequireLogin(http.HandlerFunc(recordLabA1C))).Methods("POST")
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"insulinRatios", insulinRatiosForDemo)
+	muxRouter.Handle("/insulinRatios", authProvider.RequireLogin(http.HandlerFunc(insulinRatios)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"metrics", glycemicMetricsForDemo)
+	muxRouter.Handle("/metrics", authProvider.RequireLogin(http.HandlerFunc(glycemicMetrics)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"agp", ambulatoryGlucoseProfileForDemo)
+	muxRouter.Handle("/agp", authProvider.RequireLogin(http.HandlerFunc(ambulatoryGlucoseProfile)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"episodes", glycemicEpisodesForDemo)
+	muxRouter.Handle("/episodes", authProvider.RequireLogin(http.HandlerFunc(glycemicEpisodesReport)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"meals/analysis", mealAnalysisForDemo)
+	muxRouter.Handle("/meals/analysis", authProvider.RequireLogin(http.HandlerFunc(mealAnalysis)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"forecast/backtests", forecastBacktestsForDemo)
+	muxRouter.Handle("/forecast/backtests", authProvider.RequireLogin(http.HandlerFunc(forecastBacktests)))
+	muxRouter.Handle("/import", authProvider.RequireLogin(http.HandlerFunc(importFile))).Methods("POST")
+	muxRouter.Handle("/export", authProvider.RequireLogin(http.HandlerFunc(requestDataExport))).Methods("POST")
+	muxRouter.Handle("/export", authProvider.RequireLogin(http.HandlerFunc(dataExportStatus))).Methods("GET")
+	muxRouter.Handle("/export/download", authProvider.RequireLogin(http.HandlerFunc(downloadDataExport))).Methods("GET")
+	muxRouter.Handle("/account/deletion", authProvider.RequireLogin(http.HandlerFunc(requestAccountDeletion))).Methods("POST")
+	muxRouter.Handle("/account/deletion", authProvider.RequireLogin(http.HandlerFunc(accountDeletionStatus))).Methods("GET")
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"targets", glucoseTargetsForDemo).Methods("GET")
+	muxRouter.Handle("/targets", authProvider.RequireLogin(http.HandlerFunc(glucoseTargetsReport))).Methods("GET")
+	muxRouter.Handle("/targets", authProvider.RequireLogin(http.HandlerFunc(updateGlucoseTargets))).Methods("POST")
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"cohorts", cohortRankingsForDemo).Methods("GET")
+	muxRouter.Handle("/cohorts", authProvider.RequireLogin(http.HandlerFunc(cohortRankings))).Methods("GET")
+	muxRouter.Handle("/cohorts/membership", authProvider.RequireLogin(http.HandlerFunc(cohortMembershipReport))).Methods("GET")
+	muxRouter.Handle("/cohorts/membership", authProvider.RequireLogin(http.HandlerFunc(updateCohortMembership))).Methods("POST")
+	muxRouter.Handle("/sharing/grants", authProvider.RequireLogin(http.HandlerFunc(sharingGrants))).Methods("GET")
+	muxRouter.Handle("/sharing/grants", authProvider.RequireLogin(http.HandlerFunc(grantSharing))).Methods("POST")
+	muxRouter.Handle("/sharing/grants", authProvider.RequireLogin(http.HandlerFunc(revokeSharing))).Methods("DELETE")
+	muxRouter.Handle("/sharing/shared", authProvider.RequireLogin(http.HandlerFunc(sharedWithViewer))).Methods("GET")
+	muxRouter.Handle("/sharing/accesses", authProvider.RequireLogin(http.HandlerFunc(viewerAccesses))).Methods("GET")
+	muxRouter.Handle("/clinics", authProvider.RequireLogin(http.HandlerFunc(practitionerClinics))).Methods("GET")
+	muxRouter.Handle("/clinics/invites", authProvider.RequireLogin(http.HandlerFunc(createClinicInvite))).Methods("POST")
+	muxRouter.Handle("/clinics/patients", authProvider.RequireLogin(http.HandlerFunc(clinicPatients))).Methods("GET")
+	muxRouter.Handle("/clinics/enrollments", authProvider.RequireLogin(http.HandlerFunc(clinicEnrollments))).Methods("GET")
+	muxRouter.Handle("/clinics/enrollments", authProvider.RequireLogin(http.HandlerFunc(enrollInClinic))).Methods("POST")
+	muxRouter.Handle("/clinics/enrollments", authProvider.RequireLogin(http.HandlerFunc(withdrawFromClinic))).Methods("DELETE")
+	muxRouter.HandleFunc("/donation", handleDonation)
+
+	// "main"-page for both demo and real users
+	muxRouter.HandleFunc("/demo", renderDemo)
+	muxRouter.Handle("/browse", authProvider.RequireLogin(http.HandlerFunc(renderRealUser)))
+	muxRouter.HandleFunc("/"+DEMO_PATH_PREFIX+"report", demoReport)
+	muxRouter.Handle("/report", authProvider.RequireLogin(http.HandlerFunc(report)))
+
+	// Static pages
+	muxRouter.HandleFunc("/", landing)
+
+	muxRouter.Handle("/googleauth", authProvider.RequireLogin(http.HandlerFunc(googleauth)))
+	muxRouter.Handle("/userlogin", authProvider.RequireLogin(http.HandlerFunc(loginUser)))
+	muxRouter.Handle("/oauth2callback", authProvider.RequireLogin(http.HandlerFunc(oauthCallback)))
+
+	// Administration endpoints
+	muxRouter.Handle("/admin/jobs", authProvider.RequireLogin(http.HandlerFunc(listJobs))).Methods("GET")
+	muxRouter.Handle("/admin/recalculations", authProvider.RequireLogin(http.HandlerFunc(recalculateScores))).Methods("POST")
+	muxRouter.Handle("/admin/cohorts/aggregation", authProvider.RequireLogin(http.HandlerFunc(aggregateCohorts))).Methods("POST")
+	muxRouter.Handle("/admin/clinics", authProvider.RequireLogin(http.HandlerFunc(storeClinic))).Methods("POST")
+	muxRouter.Handle("/admin/oauth/reindex", authProvider.RequireLogin(http.HandlerFunc(reindexOauthTokens))).Methods("POST")
+
+	// Client API endpoints
+	muxRouter.HandleFunc("/v1/calibrations", initializeAndHandleRequest).Methods("POST").Name(CALIBRATIONS_V1_ROUTE)
+	muxRouter.HandleFunc("/v1/injections", initializeAndHandleRequest).Methods("POST").Name(INJECTIONS_V1_ROUTE)
+	muxRouter.HandleFunc("/v1/meals", initializeAndHandleRequest).Methods("POST").Name(MEALS_V1_ROUTE)
+	muxRouter.HandleFunc("/v1/glucosereads", initializeAndHandleRequest).Methods("POST").Name(GLUCOSEREADS_V1_ROUTE)
+	muxRouter.HandleFunc("/v1/exercises", initializeAndHandleRequest).Methods("POST").Name(EXERCISES_V1_ROUTE)
+	muxRouter.HandleFunc("/v1/calibrations", initializeAndHandleRequest).Methods("GET").Name(CALIBRATIONS_V1_GET_ROUTE)
+	muxRouter.HandleFunc("/v1/injections", initializeAndHandleRequest).Methods("GET").Name(INJECTIONS_V1_GET_ROUTE)
+	muxRouter.HandleFunc("/v1/meals", initializeAndHandleRequest).Methods("GET").Name(MEALS_V1_GET_ROUTE)
+	muxRouter.HandleFunc("/v1/glucosereads", initializeAndHandleRequest).Methods("GET").Name(GLUCOSEREADS_V1_GET_ROUTE)
+	muxRouter.HandleFunc("/v1/exercises", initializeAndHandleRequest).Methods("GET").Name(EXERCISES_V1_GET_ROUTE)
+	muxRouter.HandleFunc("/v1/profile", initializeAndHandleRequest).Methods("GET").Name(PROFILE_V1_GET_ROUTE)
+
+	// Nightscout compatible endpoints
+	muxRouter.HandleFunc("/api/v1/status.json", nightscoutStatus).Methods("GET")
+	for _, path := range []string{"/api/v1/entries", "/api/v1/entries.json"} {
+		muxRouter.Handle(path, newNightscoutAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_WRITE, http.HandlerFunc(processNightscoutEntries))).Methods("POST")
+		muxRouter.Handle(path, newNightscoutAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_READ, http.HandlerFunc(nightscoutEntries))).Methods("GET")
+	}
+	muxRouter.Handle("/api/v1/entries/sgv.json", newNightscoutAuthenticationHandler(model.OAUTH_SCOPE_GLUCOSE_READ, http.HandlerFunc(nightscoutSgvEntries))).Methods("GET")
+	for _, path := range []string{"/api/v1/treatments", "/api/v1/treatments.json"} {
+		muxRouter.Handle(path, newNightscoutAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_WRITE, http.HandlerFunc(processNightscoutTreatments))).Methods("POST")
+		muxRouter.Handle(path, newNightscoutAuthenticationHandler(model.OAUTH_SCOPE_EVENTS_READ, http.HandlerFunc(nightscoutTreatments))).Methods("GET")
+	}
+	muxRouter.Handle("/nightscout/secret", authProvider.RequireLogin(http.HandlerFunc(generateApiSecret))).Methods("POST")
+
+	// Oauth client registration and management of the applications users authorized
+	muxRouter.Handle("/oauth/clients", authProvider.RequireLogin(http.HandlerFunc(oauthClients))).Methods("GET")
+	muxRouter.Handle("/oauth/clients", authProvider.RequireLogin(http.HandlerFunc(registerOauthClient))).Methods("POST")
+	muxRouter.Handle("/oauth/authorizations", authProvider.RequireLogin(http.HandlerFunc(oauthAuthorizations))).Methods("GET")
+	muxRouter.Handle("/oauth/authorizations", authProvider.RequireLogin(http.HandlerFunc(revokeOauthAuthorization))).Methods("DELETE")
+	muxRouter.Handle("/oauth/tokens", authProvider.RequireLogin(http.HandlerFunc(revokeOauthToken))).Methods("DELETE")
+
+	// Register oauth endpoints to warmup which will initilize the oauth server and replace the routes with the actual oauth handlers
+	muxRouter.HandleFunc("/token", initializeAndHandleRequest).Methods("POST").Name(TOKEN_ROUTE)
+	muxRouter.HandleFunc("/authorize", initializeAndHandleRequest).Methods("GET").Name(AUTHORIZE_ROUTE)
+	muxRouter.HandleFunc("/authorize", initializeAndHandleRequest).Methods("POST").Name(AUTHORIZE_CONSENT_ROUTE)
+
+	// Register the background jobs
+	jobQueue.Register(engine.GLUKIT_SCORE_BATCH_CALCULATION_FUNCTION_NAME, func(context context.Context, job queue.Job) error {
+		return engine.RunGlukitScoreBatchCalculation(context, repository, jobQueue, job.UserEmail, job.LowerBound)
+	})
+	jobQueue.Register(engine.A1C_BATCH_CALCULATION_FUNCTION_NAME, func(context context.Context, job queue.Job) error {
+		return engine.RunA1CBatchCalculation(context, repository, jobQueue, job.UserEmail, job.LowerBound)
+	})
+	for _, scorer := range engine.GetGlukitScorers() {
+		version := scorer.Version()
+		jobQueue.Register(engine.GlukitScoreRecalculationJobName(version), func(context context.Context, job queue.Job) error {
+			return engine.RunGlukitScoreRecalculation(context, repository, jobQueue, version, job.UserEmail, job.LowerBound)
+		})
+	}
+	for _, estimator := range engine.GetA1CEstimators() {
+		version := estimator.Version()
+		jobQueue.Register(engine.A1CRecalculationJobName(version), func(context context.Context, job queue.Job) error {
+			return engine.RunA1CRecalculation(context, repository, jobQueue, version, job.UserEmail, job.LowerBound)
+		})
+	}
+	jobQueue.Register(engine.EPISODE_DETECTION_FUNCTION_NAME, func(context context.Context, job queue.Job) error {
+		return engine.RunGlycemicEpisodeDetection(context, repository, jobQueue, job.UserEmail, job.LowerBound)
+	})
+	jobQueue.Register(engine.INSULIN_RATIO_BATCH_CALCULATION_FUNCTION_NAME, func(context context.Context, job queue.Job) error {
+		return engine.RunInsulinRatioBatchCalculation(context, repository, jobQueue, job.UserEmail, job.LowerBound)
+	})
+	jobQueue.Register(engine.COHORT_AGGREGATION_FUNCTION_NAME, func(context context.Context, job queue.Job) error {
+		_, err := engine.RunCohortAggregation(context, repository, time.Now())
+		return err
+	})
+	jobQueue.Register(export.EXPORT_DATA_JOB_NAME, func(context context.Context, job queue.Job) error {
+		return export.RunExport(context, repository, job.UserEmail)
+	})
+	jobQueue.Register(ACCOUNT_DELETION_JOB_NAME, func(context context.Context, job queue.Job) error {
+		return runAccountDeletion(context, job.UserEmail)
+	})
+	jobQueue.Register(PROCESS_DEMO_FILE_JOB_NAME, func(context context.Context, job queue.Job) error {
+		processStaticDemoFile(context, job.UserEmail)
+		return nil
+	})
+
+	return muxRouter
+}
+
+// loadTemplates parses all page templates from the view directory
+func loadTemplates(viewDir string) {
+	dataBrowserTemplate = template.Must(template.ParseFiles(filepath.Join(viewDir, "templates", "databrowser.html")))
+	reportTemplate = template.Must(template.ParseFiles(filepath.Join(viewDir, "templates", "report.html")))
+	landingTemplate = template.Must(template.ParseFiles(filepath.Join(viewDir, "templates", "landing.html")))
+	authorizeLocalAppTemplate = template.Must(template.ParseFiles(filepath.Join(viewDir, "templates", "oauthorize.html")))
+	oauthConsentTemplate = template.Must(template.ParseFiles(filepath.Join(viewDir, "templates", "oauthconsent.html")))
+}
+
+// landing executes the landing page template
+func landing(w http.ResponseWriter, request *http.Request) {
+	if err := landingTemplate.Execute(w, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// oauthCallback is invoked on return of the google oauth flow after being
+// the user comes back from being redirected to google oauth for authorization
+func oauthCallback(writer http.ResponseWriter, request *http.Request) {
+	handleLoggedInUser(writer, request)
+}
+
+// renderDemo executes the graph template for the demo user
+func renderDemo(w http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+
+	_, _, err := repository.GetUserData(context, DEMO_EMAIL)
+	if err == store.ErrNoSuchUser {
+		log.Infof(context, "No data found for demo user [%s], creating it", DEMO_EMAIL)
+
+		// TODO: Populate GlukitUser correctly, this will likely require
+		// getting rid of all data from the store when this is ready
+		err = repository.StoreUserProfile(context, time.Now(),
+			model.GlukitUser{DEMO_EMAIL, "Demo", "OfMe", time.Now(), model.DIABETES_TYPE_1, "", time.Now(),
+				apimodel.UNDEFINED_GLUCOSE_READ, model.UNDEFINED_SCORE, model.UNDEFINED_SCORE, true, DEMO_PICTURE_URL, time.Now(),
+				model.UNDEFINED_A1C_ESTIMATE, model.DEFAULT_GLUCOSE_TARGETS, model.SailingProfile{}, false})
+		if err != nil {
+			util.Propagate(err)
+		}
+
+		err = jobQueue.Enqueue(context, DATASTORE_WRITES_QUEUE_NAME, queue.Job{Name: PROCESS_DEMO_FILE_JOB_NAME, UserEmail: DEMO_EMAIL})
+		if err != nil {
+			util.Propagate(err)
+		}
+
+	} else if err != nil {
+		util.Propagate(err)
+	} else {
+		log.Infof(context, "Data already stored for demo user [%s], continuing...", DEMO_EMAIL)
+	}
+
+	render(DEMO_EMAIL, DEMO_PATH_PREFIX, w, request)
+}
+
+// renderRealUser executes the graph page template for a real user
+func renderRealUser(w http.ResponseWriter, request *http.Request) {
+	user := authProvider.CurrentUser(request)
+	render(user.Email, "", w, request)
+}
+
+// report executes the report page template
+func demoReport(w http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+	unitValue, err := resolveGlucoseUnit(user.Email, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderVariables := &RenderVariables{PathPrefix: DEMO_PATH_PREFIX, StripePublishableKey: appConfig.StripePublishableKey, SSLHost: appConfig.SSLHost, GlucoseUnit: *unitValue}
+
+	if err := reportTemplate.Execute(w, renderVariables); err != nil {
+		log.Criticalf(context, "Error executing template [%s]", dataBrowserTemplate.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// report executes the report page template
+func report(w http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+	user := authProvider.CurrentUser(request)
+	unitValue, err := resolveGlucoseUnit(user.Email, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderVariables := &RenderVariables{PathPrefix: "", StripePublishableKey: appConfig.StripePublishableKey, SSLHost: appConfig.SSLHost, GlucoseUnit: *unitValue}
+	w.Header().Set("Content-Security-Policy", CONTENT_SECURITY_POLICY)
+
+	if err := reportTemplate.Execute(w, renderVariables); err != nil {
+		log.Criticalf(context, "Error executing template [%s]", dataBrowserTemplate.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// render executed the graph page template
+func render(email string, datapath string, w http.ResponseWriter, request *http.Request) {
+	context := appengine.NewContext(request)
+
+	unitValue, err := resolveGlucoseUnit(email, request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderVariables := &RenderVariables{PathPrefix: datapath, StripePublishableKey: appConfig.StripePublishableKey, SSLHost: appConfig.SSLHost, GlucoseUnit: *unitValue}
+
+	w.Header().Set("Content-Security-Policy", CONTENT_SECURITY_POLICY)
+	if err := dataBrowserTemplate.Execute(w, renderVariables); err != nil {
+		log.Criticalf(context, "Error executing template [%s]", dataBrowserTemplate.Name())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func resolveGlucoseUnit(email string, request *http.Request) (unit *apimodel.GlucoseUnit, err error) {
+	rawUnitValue := request.FormValue(GLUCOSE_UNIT_PARAMETER)
+	if rawUnitValue != apimodel.MMOL_PER_L && rawUnitValue != apimodel.MG_PER_DL {
+		context := appengine.NewContext(request)
+		glukitUser, _, err := repository.GetUserData(context, email)
+		if err != nil {
+			return nil, err
+		}
+
+		unitValue := glukitUser.MostRecentRead.Unit
+		return &unitValue, nil
+	} else {
+		unitValue := apimodel.GlucoseUnit(rawUnitValue)
+		return &unitValue, nil
+	}
+}
+
+func googleauth(writer http.ResponseWriter, request *http.Request) {
+	loginurl, err := authProvider.LoginURL(request, fmt.Sprintf("https://%s/userlogin", appConfig.Host))
+	if err != nil {
+		util.Propagate(err)
+	}
+
+	http.Redirect(writer, request, loginurl, http.StatusTemporaryRedirect)
+}
+
+// loginUser handles the flow for a real non-demo user. It will redirect to authorization if required
+func loginUser(writer http.ResponseWriter, request *http.Request) {
+	/**
+	glukitUser, _, _, err := store.GetUserData(context, user.Email)
+	if _, ok := err.(store.StoreError); err != nil && !ok || len(glukitUser.RefreshToken) == 0 {
+		log.Infof(context, "Redirecting [%s], glukitUser [%v] for authorization. Error: [%v]", user.Email, glukitUser, err)
+
+		configuration := configuration()
+		log.Debugf(context, "We don't current have a refresh token (either lost or it's "+
+			"the first access). Let's set the ApprovalPrompt to force to get a new one...")
+
+		configuration.ApprovalPrompt = "force"
+
+		url := configuration.AuthCodeURL(request.URL.RawQuery)
+		http.Redirect(writer, request, url, http.StatusFound)
+	} else {
+		log.Infof(context, "User [%s] already exists with a valid refresh token [%s], skipping authorization step...",
+			glukitUser.RefreshToken, user.Email)
+		oauthCallback(writer, request)
+	}*/
+
+	handleUserLogin(writer, request)
+}
+
+func warmUp(writer http.ResponseWriter, request *http.Request) {
+	initOnce.Do(func() {
+		c := appengine.NewContext(request)
+		log.Infof(c, "Initializing application...")
+		initializeApp(writer, request)
+	})
+}
+
+func initializeAndHandleRequest(writer http.ResponseWriter, request *http.Request) {
+	warmUp(writer, request)
+
+	muxRouter.ServeHTTP(writer, request)
+}
+
+func initializeApp(writer http.ResponseWriter, request *http.Request) {
+	initOauthProvider(writer, request)
+	initApiEndpoints(writer, request)
+	initializeGlukitBernstein(writer, request)
+}
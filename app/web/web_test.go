@@ -0,0 +1,70 @@
+package web
+
+import (
+	"database/sql"
+	"github.com/alexandre-normand/glukit/app/auth"
+	"github.com/alexandre-normand/glukit/app/config"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/osin"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const TEST_USER_HEADER = "X-Glukit-User"
+
+var testInitOnce sync.Once
+
+// setupTestEnvironment registers the routes once for all tests and gives each test its own in-memory repository and oauth storage
+func setupTestEnvironment(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	r, err := store.NewSQLRepository(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	osinStore, err := store.NewOsinSQLStore(db, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testInitOnce.Do(func() {
+		Initialize(Environment{
+			Config:     &config.AppConfig{Host: "localhost"},
+			Repository: r,
+			Auth:       auth.NewHeaderProvider(TEST_USER_HEADER, nil),
+			Queue:      queue.NewLocalQueue(queue.NewMemoryJobStore(), 1, queue.DEFAULT_RETRY_POLICY),
+			ViewDir:    filepath.Join("..", "..", "view"),
+		})
+
+		// The oauth server and api endpoints are set up for every test so the lazy initialization of the demo user is skipped
+		initOnce.Do(func() {})
+	})
+
+	repository = r
+	newOsinStorage = func(request *http.Request) osin.Storage {
+		return osinStore
+	}
+
+	initOauthProvider(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	initApiEndpoints(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+// serveTestRequest routes the request on behalf of the user
+func serveTestRequest(request *http.Request, email string) *httptest.ResponseRecorder {
+	request.Header.Set(TEST_USER_HEADER, email)
+
+	recorder := httptest.NewRecorder()
+	muxRouter.ServeHTTP(recorder, request)
+
+	return recorder
+}
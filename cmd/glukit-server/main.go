@@ -0,0 +1,119 @@
+// The glukit-server command runs glukit as a standalone server, without App Engine. Data is stored in a SQL
+// database (sqlite3 or postgres), users are authenticated with http basic authentication or by an
+// authenticating reverse proxy and background jobs run in-process. It's configured with a json file:
+//
+//	{
+//	  "listen": ":8080",
+//	  "host": "glukit.example.com",
+//	  "sslHost": "https://glukit.example.com",
+//	  "database": {"driver": "sqlite3", "dataSource": "/var/lib/glukit/glukit.db"},
+//	  "auth": {"mode": "basic", "users": {"me@example.com": "a-long-password"}, "admins": ["me@example.com"]},
+//	  "oauthClients": [{"id": "glukloader", "secret": "a-secret", "redirectUri": "x-glukloader://oauth/callback"}]
+//	}
+//
+// The server must be started from the directory holding the view resources or be given their location
+// with "viewDir".
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"github.com/alexandre-normand/glukit/app/auth"
+	"github.com/alexandre-normand/glukit/app/config"
+	"github.com/alexandre-normand/glukit/app/queue"
+	"github.com/alexandre-normand/glukit/app/store"
+	"github.com/alexandre-normand/glukit/app/web"
+	"github.com/alexandre-normand/osin"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+)
+
+var configPath = flag.String("config", "glukit.json", "path to the json configuration file")
+
+// Directories served as is from the view directory, matching the static handlers of app.yaml
+var staticDirs = []string{"js", "css", "bower_components", "images", "fonts"}
+
+func main() {
+	flag.Parse()
+
+	serverConfig, err := config.LoadServerConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+
+	db, err := sql.Open(serverConfig.Database.Driver, serverConfig.Database.DataSource)
+	if err != nil {
+		log.Fatalf("Error opening database [%s]: %v", serverConfig.Database.Driver, err)
+	}
+
+	// SQLite doesn't do concurrent writes and in-memory databases are per connection
+	if serverConfig.Database.Driver != store.POSTGRES_DRIVER_NAME {
+		db.SetMaxOpenConns(1)
+	}
+
+	repository, err := store.NewSQLRepository(db, serverConfig.Database.Driver)
+	if err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	osinStorage, err := store.NewOsinSQLStore(db, serverConfig.Database.Driver)
+	if err != nil {
+		log.Fatalf("Error initializing oauth storage: %v", err)
+	}
+
+	for _, client := range serverConfig.OauthClients {
+		if err := osinStorage.AddClient(&osin.Client{Id: client.Id, Secret: client.Secret, RedirectUri: client.RedirectUri, UserData: ""}); err != nil {
+			log.Fatalf("Error registering oauth client [%s]: %v", client.Id, err)
+		}
+	}
+
+	jobStore, err := store.NewQueueSQLStore(db, serverConfig.Database.Driver)
+	if err != nil {
+		log.Fatalf("Error initializing job storage: %v", err)
+	}
+
+	var authProvider auth.Provider
+	if serverConfig.Auth.Mode == config.AUTH_MODE_HEADER {
+		authProvider = auth.NewHeaderProvider(serverConfig.Auth.Header, serverConfig.Auth.Admins)
+	} else {
+		authProvider = auth.NewBasicAuthProvider(serverConfig.Auth.Users, serverConfig.Auth.Admins)
+	}
+
+	jobQueue := queue.NewLocalQueue(jobStore, serverConfig.Workers, queue.DEFAULT_RETRY_POLICY)
+	defer jobQueue.Close()
+
+	router := web.Initialize(web.Environment{
+		Config:     serverConfig.AppConfig(),
+		Repository: repository,
+		Auth:       authProvider,
+		Queue:      jobQueue,
+		OsinStorage: func(request *http.Request) osin.Storage {
+			return osinStorage
+		},
+		ViewDir: serverConfig.ViewDir,
+	})
+
+	fileServer := http.FileServer(http.Dir(serverConfig.ViewDir))
+	for _, dir := range staticDirs {
+		router.PathPrefix("/" + dir + "/").Handler(fileServer)
+	}
+	router.HandleFunc("/favicon.ico", func(writer http.ResponseWriter, request *http.Request) {
+		http.ServeFile(writer, request, filepath.Join(serverConfig.ViewDir, "images", "Glukit.ico"))
+	})
+
+	// Jobs only start once all handlers are registered, including the ones left over by a previous run
+	if err = jobQueue.Start(); err != nil {
+		log.Fatalf("Error starting job queue: %v", err)
+	}
+
+	// Run the same initialization App Engine does on its warmup requests
+	warmUpRequest, _ := http.NewRequest("GET", "/_ah/warmup", nil)
+	router.ServeHTTP(httptest.NewRecorder(), warmUpRequest)
+
+	log.Printf("Glukit server listening on [%s]", serverConfig.Listen)
+	log.Fatal(http.ListenAndServe(serverConfig.Listen, router))
+}
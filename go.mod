@@ -7,6 +7,8 @@ require (
 	github.com/cosn/stripe v0.0.0-20140828021728-89929ab307fe
 	github.com/gorilla/mux v1.7.2
 	github.com/grd/stat v0.0.0-20130623202159-138af3fd5012
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/pborman/uuid v1.2.0 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	google.golang.org/api v0.7.0